@@ -0,0 +1,104 @@
+use std::fmt::{Display, Formatter};
+use std::str::FromStr;
+
+use chrono::NaiveTime;
+use eyre::{eyre, Context, Result};
+use serde::{Serialize, Serializer};
+
+/// The time ranges of a day when the pods are drained. e.g. `09:00-18:00`, `22:00-02:00,12:00-13:00`
+///
+/// A range includes its start and excludes its end. It wraps around the midnight if it ends before it starts.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct ActiveHours {
+    raw: String,
+    ranges: Vec<(NaiveTime, NaiveTime)>,
+}
+
+impl ActiveHours {
+    pub fn contains(&self, time: NaiveTime) -> bool {
+        self.ranges.iter().any(|(start, end)| {
+            if start < end {
+                *start <= time && time < *end
+            } else {
+                *start <= time || time < *end
+            }
+        })
+    }
+}
+
+impl FromStr for ActiveHours {
+    type Err = eyre::Report;
+
+    fn from_str(input: &str) -> Result<Self> {
+        let mut ranges = Vec::new();
+        for range in input.split(',').map(str::trim) {
+            let (start, end) = range
+                .split_once('-')
+                .ok_or(eyre!("range '{range}' should be like 09:00-18:00"))?;
+            let start = parse_time(start)?;
+            let end = parse_time(end)?;
+            if start == end {
+                return Err(eyre!("range '{range}' is empty"));
+            }
+            ranges.push((start, end));
+        }
+
+        Ok(Self {
+            raw: String::from(input),
+            ranges,
+        })
+    }
+}
+
+fn parse_time(input: &str) -> Result<NaiveTime> {
+    let input = input.trim();
+    NaiveTime::parse_from_str(input, "%H:%M").with_context(|| format!("invalid time '{input}'"))
+}
+
+impl Display for ActiveHours {
+    fn fmt(&self, f: &mut Formatter<'_>) -> std::fmt::Result {
+        f.write_str(&self.raw)
+    }
+}
+
+impl Serialize for ActiveHours {
+    fn serialize<S: Serializer>(&self, serializer: S) -> Result<S::Ok, S::Error> {
+        serializer.collect_str(self)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn time(input: &str) -> NaiveTime {
+        parse_time(input).unwrap()
+    }
+
+    #[test]
+    fn active_hours_should_contain_times_within_ranges() {
+        let hours: ActiveHours = "09:00-18:00".parse().unwrap();
+        assert!(hours.contains(time("09:00")));
+        assert!(hours.contains(time("17:59")));
+        assert!(!hours.contains(time("18:00")));
+        assert!(!hours.contains(time("03:00")));
+    }
+
+    #[test]
+    fn active_hours_should_wrap_around_midnight() {
+        let hours: ActiveHours = "22:00-02:00, 12:00-13:00".parse().unwrap();
+        assert!(hours.contains(time("23:00")));
+        assert!(hours.contains(time("01:00")));
+        assert!(hours.contains(time("12:30")));
+        assert!(!hours.contains(time("02:00")));
+        assert!(!hours.contains(time("18:00")));
+    }
+
+    #[test]
+    fn active_hours_should_reject_invalid_ranges() {
+        assert!("09:00".parse::<ActiveHours>().is_err());
+        assert!("09:00-25:00".parse::<ActiveHours>().is_err());
+        assert!("09:00-09:00".parse::<ActiveHours>().is_err());
+        assert!("09:00-18:00,".parse::<ActiveHours>().is_err());
+    }
+}
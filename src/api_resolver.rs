@@ -70,6 +70,14 @@ impl ApiResolver {
         }
     }
 
+    pub fn namespaced<K>(&self, ns: &str) -> Api<K>
+    where
+        K: Resource<Scope = NamespaceResourceScope>,
+        K::DynamicType: Default,
+    {
+        Api::namespaced(self.client.clone(), ns)
+    }
+
     pub fn api_for<K>(&self, res: &K) -> Api<K>
     where
         K: Resource<Scope = NamespaceResourceScope>,
@@ -4,30 +4,47 @@ use eyre::Result;
 use std::process::ExitCode;
 use std::time::Duration;
 use tokio::select;
-use tracing::{debug, error, info, Level};
+use tracing::{debug, error, info, warn, Level};
 use tracing_error::ErrorLayer;
 use tracing_subscriber::prelude::*;
 use tracing_subscriber::{filter::Directive, EnvFilter};
 use uuid::Uuid;
 
 use pod_graceful_drain::{
-    start_controller, start_reflectors, start_webhook, ApiResolver, Config, LoadBalancingConfig,
-    ServiceRegistry, Shutdown, WebhookConfig,
+    fmt_layer, log_drain_summary, otlp_layer, run_self_test, shutdown_otlp, start_controller,
+    start_pre_isolator, start_reflectors, start_webhook, verify_webhook_reachable, ApiResolver,
+    Clock, Config, DrainReservations, LoadBalancingConfig, ServiceRegistry, Shutdown,
+    WebhookConfig,
 };
 
 #[tokio::main(flavor = "current_thread")]
 async fn main() -> Result<ExitCode> {
     let config = Config::parse();
+    config.validate()?;
 
-    init_tracing_subscriber()?;
+    init_tracing_subscriber(&config)?;
     install_color_eyre()?;
 
     print_build_info();
+    info!(config = %serde_json::to_string(&config)?, "Effective configuration");
+    for warning in config.warnings() {
+        warn!("{warning}");
+    }
 
     let shutdown = Shutdown::new();
-    if let Err(err) = try_main(config, &shutdown).await {
-        error!(?err, "Failed to start server");
-        shutdown.trigger_shutdown();
+    let verify_only = config.verify_webhook;
+    let mut exit_code = ExitCode::from(1);
+    match try_main(config, &shutdown).await {
+        Ok(()) if verify_only => {
+            info!("Webhook is verified");
+            exit_code = ExitCode::SUCCESS;
+            shutdown.trigger_shutdown();
+        }
+        Ok(()) => {}
+        Err(err) => {
+            error!(?err, "Failed to start server");
+            shutdown.trigger_shutdown();
+        }
     }
 
     shutdown.wait_shutdown_triggered().await;
@@ -40,8 +57,10 @@ async fn main() -> Result<ExitCode> {
         }
     }
 
+    log_drain_summary();
+    shutdown_otlp();
     info!("Bye!");
-    Ok(ExitCode::from(1))
+    Ok(exit_code)
 }
 
 async fn try_main(config: Config, shutdown: &Shutdown) -> Result<()> {
@@ -50,18 +69,52 @@ async fn try_main(config: Config, shutdown: &Shutdown) -> Result<()> {
     let api_resolver = ApiResolver::try_new(kube::Config::infer().await?)?;
     let service_registry = ServiceRegistry::default();
     let loadbalancing = LoadBalancingConfig::new(instance_id);
-    start_controller(&api_resolver, &service_registry, &loadbalancing, shutdown)?;
+    let clock = Clock::default();
+    let drain_reservations = DrainReservations::default();
+    let verify_only = config.verify_webhook;
+    if let Some(namespace) = config.self_test_namespace.as_ref().filter(|_| !verify_only) {
+        run_self_test(&api_resolver, &config, &loadbalancing, &clock, namespace).await?;
+    }
+    if !verify_only {
+        start_controller(
+            &api_resolver,
+            &config,
+            &service_registry,
+            &loadbalancing,
+            &clock,
+            shutdown,
+        )?;
+    }
     let reflectors = start_reflectors(&api_resolver, &config, &service_registry, shutdown)?;
-    start_webhook(
+    // Nothing is isolated in the observe-only mode, and the evictions report what they would've drained.
+    if config.pre_isolate_on_cordon && !config.observe_only && !verify_only {
+        start_pre_isolator(
+            &api_resolver,
+            &config,
+            &reflectors,
+            &service_registry,
+            &loadbalancing,
+            &drain_reservations,
+            &clock,
+            shutdown,
+        )?;
+    }
+    let webhook_addr = start_webhook(
         &api_resolver,
-        config,
-        WebhookConfig::controller_runtime_default(),
+        config.clone(),
+        WebhookConfig::controller_runtime_default()
+            .with_clock(clock)
+            .with_drain_reservations(drain_reservations),
         reflectors,
         &service_registry,
         &loadbalancing,
         shutdown,
     )
     .await?;
+    verify_webhook_reachable(&api_resolver, &config, webhook_addr).await?;
+    if verify_only {
+        return Ok(());
+    }
 
     info!("Services started");
     loop {
@@ -90,16 +143,22 @@ fn selfish_frame_filter(frames: &mut Vec<&Frame>) {
     });
 }
 
-fn init_tracing_subscriber() -> Result<()> {
+fn init_tracing_subscriber(config: &Config) -> Result<()> {
     let filter = EnvFilter::builder()
         .with_default_directive(Directive::from(Level::INFO))
         .from_env()?;
 
-    let fmt = tracing_subscriber::fmt::layer().with_filter(filter);
+    let fmt = fmt_layer(config).with_filter(filter);
+    let otlp = config
+        .otlp_endpoint
+        .as_deref()
+        .map(otlp_layer)
+        .transpose()?;
 
     tracing_subscriber::registry()
         .with(fmt)
         .with(ErrorLayer::default())
+        .with(otlp)
         .try_init()?;
 
     Ok(())
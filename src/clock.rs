@@ -0,0 +1,65 @@
+use std::fmt::{Debug, Formatter};
+use std::sync::{Arc, Mutex};
+
+use chrono::{DateTime, Duration, Utc};
+
+/// The source of the current time of the drains.
+///
+/// It is the wall clock by default, and the tests can replace it with a fake one to travel in time.
+#[derive(Clone, Default)]
+pub struct Clock {
+    fake: Option<Arc<Mutex<DateTime<Utc>>>>,
+}
+
+impl Clock {
+    /// A clock that stays at `now` until it is advanced.
+    pub fn fake(now: DateTime<Utc>) -> Self {
+        Self {
+            fake: Some(Arc::new(Mutex::new(now))),
+        }
+    }
+
+    pub fn now(&self) -> DateTime<Utc> {
+        match &self.fake {
+            Some(fake) => *fake.lock().unwrap(),
+            None => Utc::now(),
+        }
+    }
+
+    /// Moves the fake clock forward. The wall clock can't be advanced.
+    pub fn advance(&self, duration: Duration) {
+        let fake = self
+            .fake
+            .as_ref()
+            .expect("only the fake clock can be advanced");
+        let mut now = fake.lock().unwrap();
+        *now += duration;
+    }
+}
+
+impl Debug for Clock {
+    fn fmt(&self, f: &mut Formatter<'_>) -> std::fmt::Result {
+        match &self.fake {
+            Some(_) => write!(f, "Clock::Fake({})", self.now()),
+            None => write!(f, "Clock::System"),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn fake_clock_should_advance_for_its_clones() {
+        let start = DateTime::parse_from_rfc3339("2024-01-01T00:00:00Z")
+            .unwrap()
+            .with_timezone(&Utc);
+        let clock = Clock::fake(start);
+        let cloned = clock.clone();
+
+        clock.advance(Duration::seconds(10));
+        assert_eq!(clock.now(), start + Duration::seconds(10));
+        assert_eq!(cloned.now(), start + Duration::seconds(10));
+    }
+}
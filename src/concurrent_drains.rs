@@ -0,0 +1,359 @@
+use std::collections::{BTreeMap, HashMap};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+use k8s_openapi::api::core::v1::{Pod, Service};
+use kube::runtime::reflector::ObjectRef;
+use kube::ResourceExt;
+
+use crate::pod_draining_info::{get_pod_draining_info, PodDrainingInfo};
+use crate::pod_state::get_original_labels;
+use crate::reflector::Stores;
+use crate::{try_some, Config};
+
+/// The reflector is expected to have caught up with the isolation by then.
+const RESERVATION_TIMEOUT: Duration = Duration::from_secs(30);
+
+type Reserved = Arc<Mutex<HashMap<ObjectRef<Pod>, Instant>>>;
+
+/// The drains that are admitted, but not seen as draining in the stores yet.
+///
+/// The stores are eventually consistent, so the admissions of a simultaneous rollout would all see no draining pods.
+/// An admitted drain is counted by its reservation until its isolation shows up in the stores.
+#[derive(Clone, Default)]
+pub struct DrainReservations {
+    reserved: Reserved,
+}
+
+/// Cancels the reservation when dropped, unless it is kept.
+pub struct DrainReservation {
+    reserved: Reserved,
+    entry: Option<(ObjectRef<Pod>, Instant)>,
+}
+
+impl DrainReservations {
+    /// Returns `None` if isolating the pod would drain more than the allowed fraction of the pods of any of its services.
+    ///
+    /// When every replica of a deployment is rolled at once, its load balancer would have no healthy targets.
+    /// In that case, we'd better let the deletion go through without delay so that the others keep serving.
+    pub fn try_reserve(
+        &self,
+        config: &Config,
+        stores: &Stores,
+        pod: &Pod,
+    ) -> Option<DrainReservation> {
+        if config.max_concurrent_drains_fraction.is_none() {
+            return Some(DrainReservation {
+                reserved: self.reserved.clone(),
+                entry: None,
+            });
+        }
+
+        let mut reserved = self.reserved.lock().unwrap();
+        let now = Instant::now();
+        reserved.retain(|key, reserved_at| {
+            now.duration_since(*reserved_at) < RESERVATION_TIMEOUT
+                && is_isolation_pending(stores, key)
+        });
+
+        let key = ObjectRef::from_obj(pod);
+        if would_exceed_max_concurrent_drains(config, stores, pod, |other| {
+            let other = ObjectRef::from_obj(other);
+            other != key && reserved.contains_key(&other)
+        }) {
+            return None;
+        }
+
+        reserved.insert(key.clone(), now);
+        Some(DrainReservation {
+            reserved: self.reserved.clone(),
+            entry: Some((key, now)),
+        })
+    }
+}
+
+impl DrainReservation {
+    /// Keep it after the isolation, until the isolation shows up in the stores.
+    pub fn keep(mut self) {
+        self.entry = None;
+    }
+}
+
+impl Drop for DrainReservation {
+    fn drop(&mut self) {
+        let Some((key, reserved_at)) = self.entry.take() else {
+            return;
+        };
+
+        let mut reserved = self.reserved.lock().unwrap();
+        // It might have been reserved again by a later admission of the same pod.
+        if reserved.get(&key) == Some(&reserved_at) {
+            reserved.remove(&key);
+        }
+    }
+}
+
+fn is_isolation_pending(stores: &Stores, key: &ObjectRef<Pod>) -> bool {
+    stores
+        .get_pod(key)
+        .is_some_and(|pod| matches!(get_pod_draining_info(&pod), PodDrainingInfo::None))
+}
+
+/// Isolated pods lose their labels, so they are matched by their original labels.
+fn would_exceed_max_concurrent_drains(
+    config: &Config,
+    stores: &Stores,
+    pod: &Pod,
+    is_reserved: impl Fn(&Pod) -> bool,
+) -> bool {
+    let Some(max_fraction) = config.max_concurrent_drains_fraction else {
+        return false;
+    };
+
+    let pod_namespace = pod.namespace();
+    let services: Vec<_> = stores
+        .services()
+        .into_iter()
+        .filter(|service| {
+            service.namespace() == pod_namespace && is_selected_by(service, pod.labels())
+        })
+        .collect();
+    if services.is_empty() {
+        return false;
+    }
+
+    let pods = stores.pods();
+    for service in services {
+        let mut total = 0;
+        let mut draining = 0;
+        for other in pods.iter() {
+            if other.namespace() != pod_namespace {
+                continue;
+            }
+
+            let is_isolated =
+                matches!(get_pod_draining_info(other), PodDrainingInfo::DrainUntil(_));
+            let labels = if is_isolated {
+                get_original_labels(other)
+            } else {
+                other.labels().clone()
+            };
+            if !is_selected_by(&service, &labels) {
+                continue;
+            }
+
+            total += 1;
+            if is_isolated || is_reserved(other) {
+                draining += 1;
+            }
+        }
+
+        // At least one pod can be drained at a time, so that a single replica is drained as well.
+        let max_draining = ((total as f64 * max_fraction).floor() as usize).max(1);
+        if draining + 1 > max_draining {
+            return true;
+        }
+    }
+
+    false
+}
+
+fn is_selected_by(service: &Service, labels: &BTreeMap<String, String>) -> bool {
+    let Some(selector) = try_some!(service.spec?.selector?) else {
+        return false;
+    };
+
+    selector
+        .iter()
+        .all(|(key, value)| labels.get(key) == Some(value))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    use crate::from_json;
+    use crate::test_utils::store_from;
+
+    fn pod(name: &str) -> Pod {
+        from_json!({
+            "metadata": {
+                "name": name,
+                "namespace": "ns",
+                "labels": {
+                    "app": "test"
+                }
+            }
+        })
+    }
+
+    fn draining_pod(name: &str) -> Pod {
+        from_json!({
+            "metadata": {
+                "name": name,
+                "namespace": "ns",
+                "labels": {
+                    "pod-graceful-drain/draining": "true"
+                },
+                "annotations": {
+                    "pod-graceful-drain/drain-until": "2099-01-01T00:00:00Z",
+                    "pod-graceful-drain/original-labels": "{\"app\":\"test\"}"
+                }
+            }
+        })
+    }
+
+    fn stores_with(pods: Vec<Pod>) -> Stores {
+        let service: Service = from_json!({
+            "metadata": {
+                "name": "svc",
+                "namespace": "ns",
+            },
+            "spec": {
+                "selector": {
+                    "app": "test",
+                },
+            },
+        });
+
+        Stores::new(
+            store_from(pods),
+            store_from([service]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+        )
+    }
+
+    #[test]
+    fn should_limit_concurrent_drains_of_service() {
+        let config = Config {
+            max_concurrent_drains_fraction: Some(0.5),
+            ..Config::default()
+        };
+
+        let stores = stores_with(vec![
+            draining_pod("pod1"),
+            pod("pod2"),
+            pod("pod3"),
+            pod("pod4"),
+        ]);
+        assert!(DrainReservations::default()
+            .try_reserve(&config, &stores, &pod("pod2"))
+            .is_some());
+
+        let stores = stores_with(vec![
+            draining_pod("pod1"),
+            draining_pod("pod2"),
+            pod("pod3"),
+            pod("pod4"),
+        ]);
+        assert!(DrainReservations::default()
+            .try_reserve(&config, &stores, &pod("pod3"))
+            .is_none());
+
+        assert!(DrainReservations::default()
+            .try_reserve(&Config::default(), &stores, &pod("pod3"))
+            .is_some());
+    }
+
+    #[test]
+    fn single_replica_should_be_drained() {
+        let config = Config {
+            max_concurrent_drains_fraction: Some(0.5),
+            ..Config::default()
+        };
+
+        let stores = stores_with(vec![pod("pod1")]);
+        assert!(DrainReservations::default()
+            .try_reserve(&config, &stores, &pod("pod1"))
+            .is_some());
+    }
+
+    #[test]
+    fn concurrent_admissions_should_be_limited_before_the_stores_catch_up() {
+        let config = Config {
+            max_concurrent_drains_fraction: Some(0.5),
+            ..Config::default()
+        };
+        let names = ["pod1", "pod2", "pod3", "pod4"];
+        let stores = stores_with(names.iter().map(|name| pod(name)).collect());
+        let reservations = DrainReservations::default();
+
+        // Every admission sees no draining pods in the stores.
+        let reserved: Vec<_> = std::thread::scope(|scope| {
+            let handles: Vec<_> = names
+                .iter()
+                .map(|name| {
+                    let (config, stores, reservations) = (&config, &stores, &reservations);
+                    scope.spawn(move || reservations.try_reserve(config, stores, &pod(name)))
+                })
+                .collect();
+            handles
+                .into_iter()
+                .filter_map(|handle| handle.join().unwrap())
+                .collect()
+        });
+        assert_eq!(reserved.len(), 2);
+
+        for reservation in reserved {
+            reservation.keep();
+        }
+        assert!(reservations
+            .try_reserve(&config, &stores, &pod("pod3"))
+            .is_none());
+    }
+
+    #[test]
+    fn reservation_should_be_cancelled_unless_kept() {
+        let config = Config {
+            max_concurrent_drains_fraction: Some(0.5),
+            ..Config::default()
+        };
+        let stores = stores_with(vec![pod("pod1"), pod("pod2")]);
+        let reservations = DrainReservations::default();
+
+        let reservation = reservations.try_reserve(&config, &stores, &pod("pod1"));
+        assert!(reservation.is_some());
+        assert!(reservations
+            .try_reserve(&config, &stores, &pod("pod2"))
+            .is_none());
+
+        // e.g. the isolation has failed.
+        drop(reservation);
+        assert!(reservations
+            .try_reserve(&config, &stores, &pod("pod2"))
+            .is_some());
+    }
+
+    #[test]
+    fn kept_reservation_should_be_released_once_stores_show_the_isolation() {
+        let config = Config {
+            max_concurrent_drains_fraction: Some(0.5),
+            ..Config::default()
+        };
+        let reservations = DrainReservations::default();
+
+        let stores = stores_with(vec![pod("pod1"), pod("pod2"), pod("pod3"), pod("pod4")]);
+        reservations
+            .try_reserve(&config, &stores, &pod("pod1"))
+            .unwrap()
+            .keep();
+        assert_eq!(reservations.reserved.lock().unwrap().len(), 1);
+
+        // The isolation is counted by the stores instead.
+        let stores = stores_with(vec![
+            draining_pod("pod1"),
+            pod("pod2"),
+            pod("pod3"),
+            pod("pod4"),
+        ]);
+        reservations
+            .try_reserve(&config, &stores, &pod("pod2"))
+            .unwrap()
+            .keep();
+        let reserved = reservations.reserved.lock().unwrap();
+        assert_eq!(reserved.len(), 1);
+        assert!(reserved.contains_key(&ObjectRef::new("pod2").within("ns")));
+    }
+}
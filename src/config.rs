@@ -1,24 +1,672 @@
+use std::path::PathBuf;
 use std::time::Duration;
 
-use clap::Parser;
+use chrono::format::{Item, StrftimeItems};
+use chrono::FixedOffset;
+use clap::{Parser, ValueEnum};
 use eyre::{eyre, Result};
-use humantime::parse_duration;
+use humantime::{format_duration, parse_duration};
+use serde::{Serialize, Serializer};
 
-#[derive(Clone, Debug, Parser)]
+use crate::active_hours::ActiveHours;
+use crate::consts::CONTROLLER_NAME;
+use crate::pod_selector::PodSelector;
+use crate::webhooks::{ADMISSION_TIMEOUT_OVERHEAD, RESERVED_PATHS};
+
+#[derive(Clone, Debug, Parser, Serialize)]
 #[command(version, about)]
 pub struct Config {
+    /// How long pods are drained before they are deleted.
+    /// Admissions are delayed no longer than the webhook timeout, or `--fallback-admission-delay-timeout`.
+    /// Past that, evicted pods are drained for the rest by the controller, but deleted pods are deleted
+    /// while they are still draining, since their deletions are allowed as they are.
+    /// `0` drains them as long as the webhook timeout allows.
     #[arg(long, default_value = "25s", value_parser = parse_delete_after)]
+    #[serde(serialize_with = "serialize_duration")]
     pub delete_after: Duration,
 
     #[arg(long, default_value = "false")]
     pub experimental_general_ingress: bool,
+
+    /// Pods that have been ready for less than this are deleted without delay,
+    /// since they are unlikely to have served any traffic yet.
+    #[arg(long, default_value = "0s", value_parser = parse_duration)]
+    #[serde(serialize_with = "serialize_duration")]
+    pub min_ready_age: Duration,
+
+    /// Delay the deletion of not-ready pods if they have `target-health.elbv2.k8s.aws` readiness gates,
+    /// since their targets might still be deregistering.
+    #[arg(long, default_value = "false")]
+    pub delay_not_ready_with_target_gate: bool,
+
+    /// Pod condition types that should also be `True` for the pods to be ready, in addition to `Ready` and the readiness gates.
+    /// e.g. `example.com/warmed-up`
+    #[arg(long, value_delimiter = ',')]
+    pub required_ready_conditions: Vec<String>,
+
+    /// Don't delay the deletion of pods exposed by TargetGroupBindings unless they are, or were, registered targets.
+    /// i.e. one of their `target-health.elbv2.k8s.aws` conditions is `True`. Pods without the readiness gates are assumed to be.
+    #[arg(long, default_value = "false")]
+    pub verify_target_membership: bool,
+
+    /// Decide whether the pods are serving by whether they are ready endpoints in the EndpointSlices of
+    /// the services that select them, instead of their Ready conditions.
+    #[arg(long, default_value = "false")]
+    pub use_endpointslice_readiness: bool,
+
+    /// Only the services annotated with `pod-graceful-drain/enabled: "true"` are considered exposing their pods
+    /// through IP-target TargetGroupBindings, or through the fallbacks when the bindings aren't found.
+    #[arg(long, default_value = "false")]
+    pub require_service_optin: bool,
+
+    /// Also drain `hostNetwork` pods exposed by instance-target TargetGroupBindings, e.g. ingress controllers behind NLBs.
+    /// They share the node's IP, so the NLB drains the connections to them when they are deregistered.
+    #[arg(long, default_value = "false")]
+    pub drain_host_network_instance_targets: bool,
+
+    /// Deny the pod updates that remove the pods from the load balancers by their labels, so they are deleted
+    /// or evicted with the drain instead. The validating webhook should also receive the `UPDATE` operations.
+    #[arg(long, default_value = "false")]
+    pub intercept_label_removal: bool,
+
+    /// Admissions past this limit are allowed without delay to shed the load.
+    #[arg(long)]
+    pub max_concurrent_admissions: Option<usize>,
+
+    /// Allow the admissions without the drain for `--circuit-breaker-cooldown` once more than this fraction of them
+    /// fail within a minute, so that an outage of the dependencies doesn't block the deletions cluster-wide.
+    #[arg(long, value_parser = parse_fraction)]
+    pub circuit_breaker_error_rate: Option<f64>,
+
+    /// How long the circuit breaker stays open before it intercepts the admissions again.
+    #[arg(long, default_value = "30s", value_parser = parse_positive_duration)]
+    #[serde(serialize_with = "serialize_duration")]
+    pub circuit_breaker_cooldown: Duration,
+
+    /// Pods are deleted without delay if more than this fraction of the pods of the same service would be draining,
+    /// so that the load balancer keeps the capacity. At least one pod of a service can be drained at a time.
+    /// The drains admitted by this replica count at once, and the others' count once their isolations are observed.
+    #[arg(long, value_parser = parse_fraction)]
+    pub max_concurrent_drains_fraction: Option<f64>,
+
+    /// Tell the clients why the deletions and the evictions are allowed without delay, with the admission warnings.
+    /// e.g. `kubectl delete` prints them.
+    #[arg(long, default_value = "false")]
+    pub emit_admission_warnings: bool,
+
+    /// The status code of the denials on the transient errors. Clients back off and retry on `429`.
+    #[arg(long, default_value = "429", value_parser = parse_deny_status_code)]
+    pub deny_status_code: u16,
+
+    /// The reason of the denials on the transient errors. e.g. `TooManyRequests`, `ServiceUnavailable`
+    #[arg(long, default_value = "TooManyRequests")]
+    pub deny_reason: String,
+
+    /// Also drain pods selected by `externalTrafficPolicy: Local` services for at least this long.
+    /// It should cover the load balancer's health check interval * unhealthy threshold.
+    #[arg(long, value_parser = parse_delete_after)]
+    #[serde(serialize_with = "serialize_optional_duration")]
+    pub local_traffic_policy_delete_after: Option<Duration>,
+
+    /// Also drain pods exposed by the TargetGroupBindings of Gateway Load Balancers for at least this long.
+    /// The TargetGroupBindings should be annotated with `pod-graceful-drain/gateway-load-balancer: "true"`.
+    #[arg(long, value_parser = parse_delete_after)]
+    #[serde(serialize_with = "serialize_optional_duration")]
+    pub gateway_load_balancer_delete_after: Option<Duration>,
+
+    /// Drain pods for the `deregistration_delay.timeout_seconds` target group attribute of their services,
+    /// up to this, instead of `--delete-after`. It can be as long as `--max-isolation-time`, e.g. the default `300s`
+    /// of the target groups. Deletions are allowed before that with the pods still draining, like `--delete-after`.
+    #[arg(long, value_parser = parse_positive_duration)]
+    #[serde(serialize_with = "serialize_optional_duration")]
+    pub max_deregistration_delay: Option<Duration>,
+
+    /// Drain the pods no longer than this when they have the target health readiness gate,
+    /// but none of their TargetGroupBindings is found, e.g. since it is deleted with its Ingress.
+    /// They are drained as if they're still registered otherwise, only to be conservative.
+    #[arg(long, value_parser = parse_delete_after)]
+    #[serde(serialize_with = "serialize_optional_duration")]
+    pub orphan_target_gate_delay: Option<Duration>,
+
+    /// Drain StatefulSet pods no longer than this.
+    /// The StatefulSet can't recreate the pod of the same ordinal until the pod is deleted.
+    #[arg(long, value_parser = parse_delete_after)]
+    #[serde(serialize_with = "serialize_optional_duration")]
+    pub stateful_set_delete_after: Option<Duration>,
+
+    /// Subtract the `terminationGracePeriodSeconds` of the pods with `preStop` hooks from their drain,
+    /// since their hooks already keep them serving during the grace period. It bounds the total teardown time.
+    #[arg(long, default_value = "false")]
+    pub respect_termination_grace: bool,
+
+    /// Never read the nodes, so the cluster-wide `nodes` permission isn't needed.
+    /// The spot interruptions aren't detected, so the pods on the terminating nodes are drained as usual,
+    /// and their admissions might be delayed or denied past the termination of the nodes.
+    #[arg(
+        long,
+        default_value = "false",
+        conflicts_with = "pre_isolate_on_cordon"
+    )]
+    pub no_node_checks: bool,
+
+    /// Nodes with this taint are about to be terminated by a spot interruption.
+    /// Pods on them are drained only until the time in the node's `pod-graceful-drain/terminate-at` annotation.
+    #[arg(long)]
+    pub spot_interruption_taint: Option<String>,
+
+    /// Node condition types that mark the node as draining while they are `True`, like the cordon does.
+    /// e.g. `DrainInProgress`, set by the drain tools that don't cordon the nodes. It can be repeated.
+    /// It only has an effect with `--pre-isolate-on-cordon`, which is the only one to act on the draining nodes.
+    #[arg(long = "draining-node-condition", value_delimiter = ',')]
+    pub draining_node_conditions: Vec<String>,
+
+    /// Re-check the node of the pod at this interval while the admission is delayed,
+    /// and stop delaying a few seconds ahead of the terminate-at of the node once it is being terminated by a spot interruption.
+    #[arg(long, requires = "spot_interruption_taint", value_parser = parse_positive_duration)]
+    #[serde(serialize_with = "serialize_optional_duration")]
+    pub node_recheck_interval: Option<Duration>,
+
+    /// When the node of the pod still can't be checked after a few retries, e.g. while the api server is throttling,
+    /// drain the pod without the spot interruption deadline instead of failing the admission, which denies it.
+    #[arg(long, default_value = "false")]
+    pub tolerate_node_check_errors: bool,
+
+    /// The webhook timeout to assume when the api server doesn't pass one.
+    /// Admissions are delayed no longer than this minus a few seconds of overhead.
+    #[arg(long, default_value = "30s", value_parser = parse_positive_duration)]
+    #[serde(serialize_with = "serialize_duration")]
+    pub fallback_admission_delay_timeout: Duration,
+
+    /// Discover the `timeoutSeconds` of the webhooks from the ValidatingWebhookConfiguration and
+    /// the MutatingWebhookConfiguration of this name, and assume it when the api server doesn't pass the timeout,
+    /// ahead of `--fallback-admission-delay-timeout`. (default: disabled)
+    #[arg(long)]
+    pub webhook_configuration_name: Option<String>,
+
+    /// Admissions are delayed no longer than this, even if the api server would wait longer.
+    /// The rest of the drain of the evicted pods is done by the controller, but the deleted pods are
+    /// deleted when the truncated delay ends, while they are still draining.
+    #[arg(long, value_parser = parse_positive_duration)]
+    #[serde(serialize_with = "serialize_optional_duration")]
+    pub max_admission_block: Option<Duration>,
+
+    /// Keep the isolated pods for this long after their targets are deregistered, for the long-lived connections
+    /// that outlive the deregistration. It is applied when all of their `target-health.elbv2.k8s.aws` conditions
+    /// turn from `True` while they are draining, and delays the deletion past the drain-until if needed.
+    /// It only applies to the pods that the controller deletes, e.g. the evicted ones. The deleted pods are
+    /// deleted when their in-line delay ends, which is decided at the admission before the targets are deregistered.
+    #[arg(long, value_parser = parse_positive_duration)]
+    #[serde(serialize_with = "serialize_optional_duration")]
+    pub post_deregistration_delay: Option<Duration>,
+
+    /// Re-check the target health conditions when the isolated pods are about to be deleted,
+    /// and extend their drain by this much while any of their targets is still deregistering.
+    /// It only applies to the pods that the controller deletes, e.g. the evicted ones, not to the deleted ones.
+    #[arg(long, value_parser = parse_positive_duration)]
+    #[serde(serialize_with = "serialize_optional_duration")]
+    pub drain_extension_interval: Option<Duration>,
+
+    /// The drain is extended no longer than this past the deletion time with `--drain-extension-interval`.
+    #[arg(long, default_value = "2m", value_parser = parse_positive_duration)]
+    #[serde(serialize_with = "serialize_duration")]
+    pub max_drain_extension: Duration,
+
+    /// Isolated pods are deleted after this regardless of their drain-until annotation.
+    #[arg(long, default_value = "10m", value_parser = parse_positive_duration)]
+    #[serde(serialize_with = "serialize_duration")]
+    pub max_isolation_time: Duration,
+
+    /// The first interval of the exponential backoff to retry the patches of pods on conflicts or transient errors.
+    #[arg(long, default_value = "500ms", value_parser = parse_positive_duration)]
+    #[serde(serialize_with = "serialize_duration")]
+    pub patch_backoff_initial_interval: Duration,
+
+    /// The factor to grow the patch retry interval by.
+    #[arg(long, default_value = "1.5", value_parser = parse_backoff_multiplier)]
+    pub patch_backoff_multiplier: f64,
+
+    /// The cap of the patch retry interval.
+    #[arg(long, default_value = "60s", value_parser = parse_positive_duration)]
+    #[serde(serialize_with = "serialize_duration")]
+    pub patch_backoff_max_interval: Duration,
+
+    /// Give up patching a pod after this many retries.
+    #[arg(long, default_value = "5")]
+    pub patch_max_retries: usize,
+
+    /// The shortest interval to retry the deletions of pods on transient errors.
+    /// It grows in proportion to how long the deletion has been failing.
+    #[arg(long, default_value = "5s", value_parser = parse_positive_duration)]
+    #[serde(serialize_with = "serialize_duration")]
+    pub delete_retry_min_interval: Duration,
+
+    /// The longest interval to retry the deletions of pods on transient errors.
+    #[arg(long, default_value = "60s", value_parser = parse_positive_duration)]
+    #[serde(serialize_with = "serialize_duration")]
+    pub delete_retry_max_interval: Duration,
+
+    /// How to decide whether a pod should be drained before it is deleted.
+    #[arg(long, value_enum, default_value = "exposed")]
+    pub drain_predicate: DrainPredicate,
+
+    /// Pods with this annotation set to `true` are drained when `--drain-predicate=annotation`.
+    #[arg(long, required_if_eq("drain_predicate", "annotation"))]
+    pub drain_annotation: Option<String>,
+
+    /// Only drain pods in these namespaces, in addition to the webhook's `namespaceSelector`. (default: all namespaces)
+    /// It is checked at the admission. The reflectors and the controller still watch every namespace.
+    #[arg(long, value_delimiter = ',')]
+    pub watch_namespaces: Vec<String>,
+
+    /// Only drain pods matching this label selector, in addition to the webhook's `objectSelector`.
+    /// e.g. `team=payments,tier!=batch`
+    #[arg(long)]
+    pub pod_selector: Option<PodSelector>,
+
+    /// Don't drain pods controlled by these kinds of owners, e.g. `Job`.
+    /// Their completion gets confused by the delay and the cut owner references. Pods of CronJobs are owned by their Jobs.
+    #[arg(long, value_delimiter = ',')]
+    pub ignore_owner_kinds: Vec<String>,
+
+    /// Don't drain pods whose containers all have an image containing one of these, or a name of `--exclude-container-names`,
+    /// e.g. `datadog/agent`. Sidecar-only pods, e.g. monitoring agents, might be selected by the services incidentally.
+    /// Pods with any other container are drained as usual.
+    #[arg(long, value_delimiter = ',')]
+    pub exclude_container_images: Vec<String>,
+
+    /// Don't drain pods whose containers all have one of these names, or an image of `--exclude-container-images`.
+    #[arg(long, value_delimiter = ',')]
+    pub exclude_container_names: Vec<String>,
+
+    /// Only drain pods within these hours of a day, e.g. `09:00-18:00` or `22:00-02:00,12:00-13:00`.
+    /// Pods are deleted without delay outside of them, e.g. for the overnight batch churn. (default: always)
+    #[arg(long)]
+    pub active_hours: Option<ActiveHours>,
+
+    /// The UTC offset of `--active-hours`. e.g. `+09:00`
+    #[arg(long, default_value = "+00:00")]
+    #[serde(serialize_with = "serialize_utc_offset")]
+    pub active_hours_utc_offset: FixedOffset,
+
+    /// Export admission traces to this OTLP gRPC endpoint. e.g. `http://otel-collector:4317`
+    #[arg(long)]
+    pub otlp_endpoint: Option<String>,
+
+    /// Format of the logs on the stdout.
+    #[arg(long, value_enum, default_value = "text")]
+    pub log_format: LogFormat,
+
+    /// strftime format of the log timestamps in UTC. e.g. `%Y-%m-%dT%H:%M:%S%.3fZ` (default: RFC 3339 in microseconds)
+    #[arg(long, value_parser = parse_strftime_format)]
+    pub log_timestamp_format: Option<String>,
+
+    /// Put the fields of the JSON logs, including the `message`, at the top level instead of under `fields`.
+    #[arg(long, default_value = "false")]
+    pub log_json_flatten_event: bool,
+
+    /// Only report how the pods would have been drained, and allow them to be deleted immediately.
+    #[arg(long, default_value = "false")]
+    pub observe_only: bool,
+
+    /// Template of the event notes for the delayed deletions and the intercepted evictions. e.g. to link a runbook.
+    /// `{message}`, `{drain_until}`, `{remaining}` and `{reason}` are substituted.
+    #[arg(long)]
+    pub delay_message_template: Option<String>,
+
+    /// Limit the rate of deleting drained pods, to ease the api server during mass rollouts. (default: unlimited)
+    #[arg(long, value_parser = parse_qps)]
+    pub delete_qps: Option<f64>,
+
+    /// Number of deletions allowed in a burst when `--delete-qps` is set.
+    #[arg(long, default_value = "10")]
+    pub delete_burst: u32,
+
+    /// Leave drained pods isolated for manual inspection, instead of deleting them.
+    /// Only their draining label is disabled after the drain. Deletions requested by the users still go through.
+    #[arg(long, default_value = "false")]
+    pub no_auto_delete: bool,
+
+    /// Remove the drained pods by evicting them instead of deleting them, so that the PodDisruptionBudgets are still respected.
+    /// The isolated pods have lost their labels, so the budgets are checked by their original labels before the eviction.
+    /// The eviction is retried while the budgets block it, up to the retry limit of the deletion.
+    #[arg(long, default_value = "false")]
+    pub final_removal_via_eviction: bool,
+
+    /// Isolate the pods on a node as soon as it is cordoned, ahead of the evictions of the node drain.
+    /// After the drain, they are removed if they have been evicted or their node is still cordoned,
+    /// and released if the node has been uncordoned.
+    #[arg(long, default_value = "false")]
+    pub pre_isolate_on_cordon: bool,
+
+    /// Clear the `controller` of the ReplicaSet owner references of the isolated pods, so the ReplicaSet stops
+    /// counting them and creates their replacements while they are drained. The owner references are kept, so the
+    /// garbage collector still deletes the pods with their ReplicaSet, and the webhook delays it like the others.
+    /// With `--cut-owner-references=false`, the ReplicaSet keeps counting the isolated pods until they are deleted.
+    #[arg(long, default_value = "true", action = clap::ArgAction::Set)]
+    pub cut_owner_references: bool,
+
+    /// Exit after checking that the webhook server serves a certificate valid for its Service's DNS name by the
+    /// `caBundle`, and that the Service targets its port, without running the controller.
+    /// The webhook is found in `--webhook-configuration-name`, and isn't verified without it.
+    #[arg(long, default_value = "false")]
+    pub verify_webhook: bool,
+
+    /// Isolate and delete a canary pod in this namespace at startup, and fail to start if it doesn't work.
+    #[arg(long)]
+    pub self_test_namespace: Option<String>,
+
+    /// Enable the admin api, `POST /delete?namespace=&name=`, authenticated by the bearer token in this file.
+    /// It deletes an isolated pod right away, without waiting for the drain. (default: disabled)
+    #[arg(long)]
+    pub admin_token_file: Option<PathBuf>,
+
+    /// Serve the validating webhook that intercepts the pod deletions.
+    /// With `--enable-pod-webhook=false`, it is not served, and its ValidatingWebhookConfiguration shouldn't be registered.
+    #[arg(long, default_value = "true", action = clap::ArgAction::Set)]
+    pub enable_pod_webhook: bool,
+
+    /// Serve the mutating webhook that intercepts the pod evictions.
+    /// With `--enable-eviction-webhook=false`, the evictions are left to the api server, e.g. to not interfere with
+    /// the PodDisruptionBudgets. Its MutatingWebhookConfiguration shouldn't be registered then.
+    #[arg(long, default_value = "true", action = clap::ArgAction::Set)]
+    pub enable_eviction_webhook: bool,
+
+    /// Serve the validating webhook for the pod deletions at this path.
+    /// The path in the ValidatingWebhookConfiguration, or of the proxy in front of it, should route here.
+    #[arg(long, default_value = "/webhook/validate", value_parser = parse_webhook_path)]
+    pub validate_webhook_path: String,
+
+    /// Serve the mutating webhook for the pod evictions at this path.
+    /// The path in the MutatingWebhookConfiguration, or of the proxy in front of it, should route here.
+    #[arg(long, default_value = "/webhook/mutate", value_parser = parse_webhook_path)]
+    pub mutate_webhook_path: String,
+
+    /// What to do with the pods isolated by this instance that are still draining, when it is shut down.
+    #[arg(long, value_enum, default_value = "wait")]
+    pub on_shutdown: OnShutdown,
+}
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq, ValueEnum, Serialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum DrainPredicate {
+    /// Pods exposed by AWS load balancers, or by ingresses with `--experimental-general-ingress`.
+    Exposed,
+    /// Pods annotated by the user's own load balancer controller. e.g. MetalLB
+    Annotation,
+}
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq, ValueEnum, Serialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum LogFormat {
+    /// Human-readable lines.
+    Text,
+    /// A JSON object per line, for the log pipelines.
+    Json,
+}
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq, ValueEnum, Serialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum OnShutdown {
+    /// Leave them to the other instances, or to this one after the restart.
+    Wait,
+    /// Delete them right away, even if they're still registered to the load balancers.
+    ForceDelete,
+    /// Restore their labels and owner references, and leave them.
+    /// Deletions already delayed by the webhook still go through.
+    Release,
+}
+
+impl Default for Config {
+    /// Same as the command line defaults.
+    fn default() -> Self {
+        Self::parse_from([CONTROLLER_NAME])
+    }
+}
+
+impl Config {
+    /// Invalid combinations of the options, which can't be told by each of them alone.
+    pub fn validate(&self) -> Result<()> {
+        if let Some(max_deregistration_delay) = self.max_deregistration_delay {
+            if max_deregistration_delay > self.max_isolation_time {
+                return Err(eyre!(
+                    "max-deregistration-delay '{}' should be <= max-isolation-time '{}'",
+                    format_duration(max_deregistration_delay),
+                    format_duration(self.max_isolation_time),
+                ));
+            }
+        }
+
+        // The server can't route the same path twice.
+        for path in [&self.validate_webhook_path, &self.mutate_webhook_path] {
+            if RESERVED_PATHS.contains(&path.as_str()) {
+                return Err(eyre!("webhook path '{path}' is reserved"));
+            }
+        }
+        if self.validate_webhook_path == self.mutate_webhook_path {
+            return Err(eyre!(
+                "validate-webhook-path and mutate-webhook-path should be different"
+            ));
+        }
+
+        Ok(())
+    }
+
+    /// Valid, but possibly unintended combinations of the options.
+    pub fn warnings(&self) -> Vec<String> {
+        let mut warnings = Vec::new();
+
+        let max_delete_after = [
+            Some(self.delete_after),
+            self.local_traffic_policy_delete_after,
+            self.max_deregistration_delay,
+        ]
+        .into_iter()
+        .flatten()
+        .max()
+        .unwrap_or(self.delete_after);
+        let max_admission_delay = self
+            .fallback_admission_delay_timeout
+            .saturating_sub(ADMISSION_TIMEOUT_OVERHEAD);
+        if max_delete_after > max_admission_delay {
+            warnings.push(format!(
+                "delete-after '{}' is longer than fallback-admission-delay-timeout '{}' allows. \
+                Admissions without the timeout will be delayed for '{}' at most, \
+                and the pods will be deleted while they are still draining",
+                format_duration(max_delete_after),
+                format_duration(self.fallback_admission_delay_timeout),
+                format_duration(max_admission_delay),
+            ));
+        }
+
+        if self.pre_isolate_on_cordon && self.observe_only {
+            warnings.push(String::from(
+                "pre-isolate-on-cordon has no effect with observe-only, since nothing is isolated",
+            ));
+        }
+
+        if !self.draining_node_conditions.is_empty() && !self.pre_isolate_on_cordon {
+            warnings.push(String::from(
+                "draining-node-condition has no effect without pre-isolate-on-cordon",
+            ));
+        }
+
+        warnings
+    }
 }
 
-fn parse_delete_after(input: &str) -> Result<Duration> {
+pub(crate) fn parse_delete_after(input: &str) -> Result<Duration> {
     let duration = parse_duration(input)?;
     if duration > Duration::from_secs(25) {
-        return Err(eyre!("delete-after should be >=1s, <= 25s"));
+        return Err(eyre!("delete-after should be <= 25s"));
+    }
+
+    Ok(duration)
+}
+
+fn parse_positive_duration(input: &str) -> Result<Duration> {
+    let duration = parse_duration(input)?;
+    if duration.is_zero() {
+        return Err(eyre!("duration should be positive"));
     }
 
     Ok(duration)
 }
+
+fn parse_backoff_multiplier(input: &str) -> Result<f64> {
+    let multiplier: f64 = input.parse()?;
+    if !(multiplier >= 1.0 && multiplier.is_finite()) {
+        return Err(eyre!("multiplier should be at least 1"));
+    }
+
+    Ok(multiplier)
+}
+
+fn parse_fraction(input: &str) -> Result<f64> {
+    let fraction: f64 = input.parse()?;
+    if !(fraction > 0.0 && fraction <= 1.0) {
+        return Err(eyre!("fraction should be in (0, 1]"));
+    }
+
+    Ok(fraction)
+}
+
+fn parse_deny_status_code(input: &str) -> Result<u16> {
+    let code: u16 = input.parse()?;
+    if !(400..=599).contains(&code) {
+        return Err(eyre!("status code of the denial should be 4xx or 5xx"));
+    }
+
+    Ok(code)
+}
+
+fn parse_webhook_path(input: &str) -> Result<String> {
+    if !input.starts_with('/') {
+        return Err(eyre!("webhook path should start with '/'"));
+    }
+
+    Ok(String::from(input))
+}
+
+fn parse_strftime_format(input: &str) -> Result<String> {
+    let has_error = StrftimeItems::new(input).any(|item| matches!(item, Item::Error));
+    if has_error {
+        return Err(eyre!("invalid strftime format"));
+    }
+
+    Ok(String::from(input))
+}
+
+fn parse_qps(input: &str) -> Result<f64> {
+    let qps: f64 = input.parse()?;
+    if !(qps > 0.0 && qps.is_finite()) {
+        return Err(eyre!("qps should be positive"));
+    }
+
+    Ok(qps)
+}
+
+/// Durations are shown in a human-readable form. e.g. `25s`
+fn serialize_duration<S: Serializer>(
+    duration: &Duration,
+    serializer: S,
+) -> Result<S::Ok, S::Error> {
+    serializer.collect_str(&format_duration(*duration))
+}
+
+fn serialize_utc_offset<S: Serializer>(
+    offset: &FixedOffset,
+    serializer: S,
+) -> Result<S::Ok, S::Error> {
+    serializer.collect_str(offset)
+}
+
+fn serialize_optional_duration<S: Serializer>(
+    duration: &Option<Duration>,
+    serializer: S,
+) -> Result<S::Ok, S::Error> {
+    match duration {
+        Some(duration) => serialize_duration(duration, serializer),
+        None => serializer.serialize_none(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn should_warn_delete_after_longer_than_fallback_timeout() {
+        let config = Config {
+            delete_after: Duration::from_secs(20),
+            fallback_admission_delay_timeout: Duration::from_secs(10),
+            ..Config::default()
+        };
+
+        assert_eq!(config.warnings().len(), 1);
+    }
+
+    #[test]
+    fn should_not_warn_with_defaults() {
+        assert!(Config::default().warnings().is_empty());
+    }
+
+    #[test]
+    fn max_deregistration_delay_should_be_bounded_by_max_isolation_time() {
+        let config = Config::parse_from([
+            CONTROLLER_NAME,
+            "--max-deregistration-delay=300s",
+            "--max-isolation-time=10m",
+        ]);
+        assert!(config.validate().is_ok());
+
+        let config = Config {
+            max_isolation_time: Duration::from_secs(120),
+            ..config
+        };
+        assert!(config.validate().is_err());
+
+        assert!(
+            Config::try_parse_from([CONTROLLER_NAME, "--max-deregistration-delay=0s"]).is_err()
+        );
+    }
+
+    #[test]
+    fn webhook_paths_should_be_distinct_and_not_reserved() {
+        assert!(Config::default().validate().is_ok());
+
+        let config = Config::parse_from([
+            CONTROLLER_NAME,
+            "--validate-webhook-path=/webhook",
+            "--mutate-webhook-path=/webhook",
+        ]);
+        assert!(config.validate().is_err(), "duplicate");
+
+        for path in RESERVED_PATHS {
+            let config =
+                Config::parse_from([CONTROLLER_NAME, &format!("--validate-webhook-path={path}")]);
+            assert!(config.validate().is_err(), "{path}");
+        }
+    }
+
+    #[test]
+    fn durations_should_be_serialized_human_readable() {
+        let config = Config {
+            delete_after: Duration::from_secs(20),
+            local_traffic_policy_delete_after: None,
+            ..Config::default()
+        };
+
+        let value = serde_json::to_value(&config).unwrap();
+        assert_eq!(value["delete_after"], "20s");
+        assert_eq!(
+            value["local_traffic_policy_delete_after"],
+            serde_json::Value::Null
+        );
+    }
+
+    #[test]
+    fn log_timestamp_format_should_be_valid_strftime() {
+        assert!(parse_strftime_format("%Y-%m-%dT%H:%M:%S%.3fZ").is_ok());
+        assert!(parse_strftime_format("%Y-%m-%dT%").is_err());
+    }
+}
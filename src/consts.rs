@@ -1,8 +1,28 @@
 pub const CONTROLLER_NAME: &str = "pod-graceful-drain";
 
 pub const DRAINING_LABEL_KEY: &str = "pod-graceful-drain/draining";
+/// The draining label value of the pods that are being deleted right away, distinct from the disabled ones.
+pub const DRAINING_LABEL_DELETING_VALUE: &str = "deleting";
+/// The label set to `true` just before the drained pods are deleted, for the other controllers to gate on.
+pub const DRAINED_LABEL_KEY: &str = "pod-graceful-drain/drained";
 
 pub const DRAIN_UNTIL_ANNOTATION_KEY: &str = "pod-graceful-drain/drain-until";
+pub const ISOLATED_AT_ANNOTATION_KEY: &str = "pod-graceful-drain/isolated-at";
+pub const PRE_ISOLATED_ANNOTATION_KEY: &str = "pod-graceful-drain/pre-isolated";
+pub const REQUESTED_BY_ANNOTATION_KEY: &str = "pod-graceful-drain/requested-by";
 pub const ORIGINAL_LABELS_ANNOTATION_KEY: &str = "pod-graceful-drain/original-labels";
+pub const ORIGINAL_OWNER_REFERENCES_ANNOTATION_KEY: &str =
+    "pod-graceful-drain/original-owner-references";
 pub const DRAIN_CONTROLLER_ANNOTATION_KEY: &str = "pod-graceful-drain/controller";
+pub const TAKEN_OVER_AT_ANNOTATION_KEY: &str = "pod-graceful-drain/taken-over-at";
 pub const DELETE_OPTIONS_ANNOTATION_KEY: &str = "pod-graceful-drain/delete-options";
+pub const TARGET_GROUPS_ANNOTATION_KEY: &str = "pod-graceful-drain/target-groups";
+pub const NO_DENY_ANNOTATION_KEY: &str = "pod-graceful-drain/no-deny";
+pub const SERVICE_ENABLED_ANNOTATION_KEY: &str = "pod-graceful-drain/enabled";
+pub const DELETE_AFTER_ANNOTATION_KEY: &str = "pod-graceful-drain/delete-after";
+pub const GATEWAY_LOAD_BALANCER_ANNOTATION_KEY: &str = "pod-graceful-drain/gateway-load-balancer";
+
+/// The pod condition that is `False` while the pod is draining, and flips to `True` before it is deleted.
+pub const DRAIN_COMPLETE_CONDITION_TYPE: &str = "pod-graceful-drain/DrainComplete";
+
+pub const NODE_TERMINATE_AT_ANNOTATION_KEY: &str = "pod-graceful-drain/terminate-at";
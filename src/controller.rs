@@ -1,51 +1,97 @@
+use std::collections::HashMap;
 use std::ops::Add;
-use std::sync::Arc;
+use std::sync::{Arc, Mutex};
 use std::time::Duration;
 
-use chrono::Utc;
+use chrono::{DateTime, Utc};
 use eyre::Result;
 use futures::StreamExt;
-use k8s_openapi::api::core::v1::Pod;
-use kube::api::{DeleteParams, EvictParams, Preconditions};
+use k8s_openapi::api::core::v1::{Pod, PodCondition};
+use k8s_openapi::api::policy::v1::PodDisruptionBudget;
+use k8s_openapi::apimachinery::pkg::apis::meta::v1::Time;
+use kube::api::{DeleteParams, EvictParams, ListParams, Patch, PatchParams, Preconditions};
+use kube::error::ErrorResponse;
 use kube::runtime::controller::Action;
+use kube::runtime::events::{Event, EventType, Recorder, Reporter};
 use kube::runtime::reflector::ObjectRef;
-use kube::runtime::watcher::Config;
 use kube::runtime::{controller, watcher, Controller};
-use kube::{Api, ResourceExt};
+use kube::{Api, Resource, ResourceExt};
 use rand::Rng;
 use thiserror::Error;
 use tracing::{debug, error, info, span, trace, Level};
 
 use crate::api_resolver::ApiResolver;
-use crate::consts::DRAINING_LABEL_KEY;
+use crate::clock::Clock;
+use crate::consts::{
+    CONTROLLER_NAME, DRAINED_LABEL_KEY, DRAINING_LABEL_DELETING_VALUE, DRAINING_LABEL_KEY,
+};
 use crate::loadbalancing::LoadBalancingConfig;
-use crate::pod_draining_info::{get_pod_draining_info, PodDrainingInfo};
+use crate::node_state::is_pod_node_draining;
+use crate::pod_disruption_budget::would_violate_pod_disruption_budget_by_labels;
+use crate::pod_draining_info::{
+    get_pod_draining_info, get_pod_isolated_at, get_pod_taken_over_at, is_pod_pre_isolated,
+    PodDrainingInfo,
+};
 use crate::pod_evict_params::get_pod_evict_params;
+use crate::pod_state::{get_original_labels, get_targets_deregistered_at, is_target_deregistering};
+use crate::rate_limiter::RateLimiter;
 use crate::shutdown::Shutdown;
 use crate::spawn_service::spawn_service;
 use crate::status::{
-    is_404_not_found_error, is_409_conflict_error, is_410_gone_error, is_transient_error,
+    is_404_not_found_error, is_409_conflict_error, is_410_gone_error,
+    is_generic_server_response_422_invalid_for_json_patch_error, is_transient_error,
 };
-use crate::{instrumented, ServiceRegistry};
+use crate::webhooks::{patch_pod_release, patch_pod_takeover};
+use crate::{instrumented, metrics, try_some, Config, OnShutdown, ServiceRegistry};
 
 /// Start a controller that deletes deregistered pods.
+///
+/// It watches every pod with the draining label, including the ones left by other instances,
+/// and deletes them regardless of their owners. So the isolated pods that the garbage collector
+/// can no longer reach, because their owner references were cut, are cleaned up even if their owner is gone.
 pub fn start_controller(
     api_resolver: &ApiResolver,
+    config: &Config,
     service_registry: &ServiceRegistry,
     loadbalancing: &LoadBalancingConfig,
+    clock: &Clock,
     shutdown: &Shutdown,
 ) -> Result<()> {
     let api_resolver = api_resolver.clone();
 
     let context = Arc::new(ReconcilerContext {
         api_resolver: api_resolver.clone(),
+        config: config.clone(),
         loadbalancing: loadbalancing.clone(),
+        clock: clock.clone(),
+        delete_limiter: RateLimiter::new(config.delete_qps, config.delete_burst),
+        seen_at: Mutex::default(),
+        event_reporter: Reporter {
+            controller: String::from(CONTROLLER_NAME),
+            instance: hostname::get()
+                .ok()
+                .and_then(|n| n.to_str().map(String::from)),
+        },
     });
 
     let pods: Api<Pod> = api_resolver.all();
-    let controller = Controller::new(pods, Config::default().labels(DRAINING_LABEL_KEY))
+    let controller = Controller::new(pods, watcher::Config::default().labels(DRAINING_LABEL_KEY))
         .graceful_shutdown_on(shutdown.wait_shutdown_triggered());
 
+    if config.on_shutdown != OnShutdown::Wait {
+        spawn_service(shutdown, "controller-on-shutdown", {
+            let shutdown = shutdown.clone();
+            let context = context.clone();
+            async move {
+                let drain_token = shutdown.delay_drain_token();
+                shutdown.wait_drain_triggered().await;
+                handle_isolations_on_shutdown(&context).await;
+                drop(drain_token);
+                shutdown.wait_shutdown_triggered().await;
+            }
+        })?;
+    }
+
     let signal = service_registry.register("controller");
     spawn_service(shutdown, "controller", {
         let shutdown = shutdown.clone();
@@ -64,7 +110,14 @@ pub fn start_controller(
 
 struct ReconcilerContext {
     api_resolver: ApiResolver,
+    config: Config,
     loadbalancing: LoadBalancingConfig,
+    clock: Clock,
+    delete_limiter: RateLimiter,
+    event_reporter: Reporter,
+    /// When this instance first saw the drains, by the pod uid.
+    /// It bounds the drains that can't be bounded by their isolated-at annotation.
+    seen_at: Mutex<HashMap<String, DateTime<Utc>>>,
 }
 
 #[derive(Error, Debug)]
@@ -75,8 +128,8 @@ enum ReconcileError {
 
 const CONTROLLER_EXCLUSIVE_DURATION: Duration = Duration::from_secs(10);
 const CONTROLLER_TIMEOUT_JITTER: Duration = Duration::from_secs(10);
-const DEFAULT_TRANSIENT_ERROR_RECONCILE: Duration = Duration::from_secs(5);
 const DEFAULT_RECONCILE_DURATION: Duration = Duration::from_secs(3600);
+const MAX_DELETE_RETRY_DURATION: Duration = Duration::from_secs(600);
 
 async fn reconcile(
     pod: Arc<Pod>,
@@ -84,41 +137,446 @@ async fn reconcile(
 ) -> Result<Action, ReconcileError> {
     let span = span!(Level::ERROR, "reconciler", object_ref = %ObjectRef::from_obj(pod.as_ref()));
     instrumented!(span, async move {
+        if is_deletion_interrupted(&pod) {
+            // e.g. the instance was gone between marking the pod and deleting it.
+            info!("resuming the interrupted deletion");
+            context.delete_limiter.acquire().await;
+            delete_pod(&context.api_resolver, &pod).await?;
+            return Ok(Action::requeue(DEFAULT_RECONCILE_DURATION));
+        }
+
         if let PodDrainingInfo::DrainUntil(drain_until) = get_pod_draining_info(&pod) {
-            let remaining = drain_until - Utc::now();
-            if let Ok(remaining) = remaining.to_std() {
-                return Ok(Action::requeue(remaining));
+            let now = context.clock.now();
+            let seen_at = get_seen_at(&context, &pod, now);
+            let delete_at = get_delete_at(&context.config, &pod, drain_until, seen_at);
+            if delete_at < drain_until {
+                debug!(%drain_until, %delete_at, "drain is capped by the max isolation time");
             }
 
-            let expire = (-remaining).to_std().expect("should be expired");
-            if expire < CONTROLLER_EXCLUSIVE_DURATION && !context.loadbalancing.controls(&pod) {
-                // Let the original controller handle first.
-                let requeue_duration = rand::thread_rng().gen_range(
-                    CONTROLLER_EXCLUSIVE_DURATION
-                        ..CONTROLLER_EXCLUSIVE_DURATION.add(CONTROLLER_TIMEOUT_JITTER),
-                );
+            let expire = match get_remaining(delete_at, now) {
+                Ok(remaining) => {
+                    if context.loadbalancing.controls(&pod) {
+                        update_drain_complete_condition(
+                            &context.api_resolver,
+                            &pod,
+                            DrainCompletion::Draining,
+                            now,
+                        )
+                        .await;
+                    }
+                    return Ok(Action::requeue(remaining));
+                }
+                Err(expire) => expire,
+            };
 
+            if let Some(extension) = get_drain_extension(&context.config, &pod, delete_at, now) {
+                info!(
+                    ?expire,
+                    ?extension,
+                    "targets are still deregistering, extending the drain"
+                );
+                return Ok(Action::requeue(extension));
+            }
+            let unclaimed = get_unclaimed_duration(&pod, expire, now);
+            if let Some(requeue_duration) =
+                get_takeover_delay(&context.loadbalancing, &pod, unclaimed)
+            {
                 return Ok(Action::requeue(requeue_duration));
             }
 
-            // TODO: possible bottleneck of the reconciler.
-            let result = if let Some(evict_params) = get_pod_evict_params(&pod) {
-                evict_pod(&context.api_resolver, &pod, &evict_params).await
+            let pod = if context.loadbalancing.controls(&pod) {
+                pod
+            } else {
+                // e.g. left by the previous run, which has been gone before the deletion.
+                info!(?expire, "recovering expired isolated pod");
+                match patch_pod_takeover(&context.api_resolver, &context.loadbalancing, &pod, now)
+                    .await
+                {
+                    Ok(pod) => Arc::new(pod),
+                    Err(err) => {
+                        if is_taken_over_by_others(&err) {
+                            debug!(?err, "another instance has taken over the pod");
+                        } else {
+                            error!(?err, "failed to take over the pod");
+                        }
+                        return Ok(Action::requeue(CONTROLLER_EXCLUSIVE_DURATION));
+                    }
+                }
+            };
+
+            if is_pod_pre_isolated(&pod) && !context.config.no_auto_delete {
+                let node_draining =
+                    is_pod_node_draining(&context.config, &context.api_resolver, &pod).await?;
+                if !is_pre_isolation_followed(&pod, node_draining) {
+                    info!("node is uncordoned without the eviction, releasing pre-isolated pod");
+                    if let Err(err) =
+                        patch_pod_release(&context.api_resolver, &context.config, &pod).await
+                    {
+                        error!(?err, "failed to release the pre-isolated pod");
+                        return Ok(Action::requeue(CONTROLLER_EXCLUSIVE_DURATION));
+                    }
+                    return Ok(Action::requeue(DEFAULT_RECONCILE_DURATION));
+                }
+            }
+
+            let leave_isolated = context.config.no_auto_delete;
+            let completion = if leave_isolated {
+                DrainCompletion::LeftIsolated
+            } else if get_removal_evict_params(&context.config, &pod).is_some() {
+                DrainCompletion::Evicting
             } else {
-                delete_pod(&context.api_resolver, &pod).await
+                DrainCompletion::Deleting
             };
+            update_drain_complete_condition(&context.api_resolver, &pod, completion, now).await;
+
+            // TODO: possible bottleneck of the reconciler.
+            let result = instrumented!(span!(Level::ERROR, "delete", %delete_at), async {
+                context.delete_limiter.acquire().await;
+                if leave_isolated {
+                    disable_draining(&context.api_resolver, &pod).await
+                } else {
+                    remove_drained_pod(&context.api_resolver, &context.config, &pod).await
+                }
+            });
 
             if let Err(err) = result {
-                if is_transient_error(&err) {
-                    return Ok(Action::requeue(DEFAULT_TRANSIENT_ERROR_RECONCILE));
+                if !is_transient_error(&err) {
+                    on_delete_failed(&context, &pod, &err, "failed to delete pod").await;
+                } else if let Some(retry_after) = get_delete_retry_delay(&context.config, expire) {
+                    debug!(?err, ?retry_after, "retrying to delete pod");
+                    return Ok(Action::requeue(retry_after));
+                } else {
+                    on_delete_failed(&context, &pod, &err, "failed to delete pod after retries")
+                        .await;
+                }
+            } else if !leave_isolated {
+                metrics::POD_DELETED_TOTAL.inc();
+                if let Some(drain_duration) = get_drain_duration(&pod, context.clock.now()) {
+                    metrics::DRAIN_DURATION_SECONDS.observe(drain_duration);
                 }
             }
-        };
+        } else {
+            forget_seen_at(&context, &pod);
+        }
 
         Ok(Action::requeue(DEFAULT_RECONCILE_DURATION))
     })
 }
 
+/// What happens to the pod, told by the DrainComplete condition.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+enum DrainCompletion {
+    Draining,
+    Deleting,
+    Evicting,
+    /// By `--no-auto-delete`.
+    LeftIsolated,
+}
+
+/// Lets the other controllers react to the drain through the status, e.g. to scale up ahead of the deletion.
+/// The condition is informational, so the failures don't hold back the drain.
+async fn update_drain_complete_condition(
+    api_resolver: &ApiResolver,
+    pod: &Pod,
+    completion: DrainCompletion,
+    now: DateTime<Utc>,
+) {
+    let complete = completion != DrainCompletion::Draining;
+    if get_drain_complete_condition(pod) == Some(complete) {
+        return;
+    }
+
+    let api = api_resolver.api_for(pod);
+    let name = pod.name_any();
+    let patch = serde_json::json!({
+        "status": {
+            "conditions": [make_drain_complete_condition(completion, now)],
+        },
+    });
+
+    // The conditions are merged by their type.
+    let result = api
+        .patch_status(&name, &PatchParams::default(), &Patch::Strategic(&patch))
+        .await;
+    match result {
+        Ok(_) => debug!(complete, "drain complete condition is updated"),
+        Err(err) if is_404_not_found_error(&err) || is_410_gone_error(&err) => {}
+        Err(err) => error!(?err, "failed to update the drain complete condition"),
+    }
+}
+
+fn get_drain_complete_condition(pod: &Pod) -> Option<bool> {
+    let conditions = try_some!(pod.status?.conditions?)?;
+    let condition = conditions
+        .iter()
+        .find(|condition| condition.type_ == DRAIN_COMPLETE_CONDITION_TYPE)?;
+    Some(condition.status == "True")
+}
+
+fn make_drain_complete_condition(completion: DrainCompletion, now: DateTime<Utc>) -> PodCondition {
+    let (status, reason, message) = match completion {
+        DrainCompletion::Draining => ("False", "Draining", "The pod is isolated and draining"),
+        DrainCompletion::Deleting => (
+            "True",
+            "Drained",
+            "The pod is drained and about to be deleted",
+        ),
+        DrainCompletion::Evicting => (
+            "True",
+            "Drained",
+            "The pod is drained and about to be evicted",
+        ),
+        DrainCompletion::LeftIsolated => {
+            ("True", "Drained", "The pod is drained and left isolated")
+        }
+    };
+
+    PodCondition {
+        type_: String::from(DRAIN_COMPLETE_CONDITION_TYPE),
+        status: String::from(status),
+        reason: Some(String::from(reason)),
+        message: Some(String::from(message)),
+        last_transition_time: Some(Time(now)),
+        ..PodCondition::default()
+    }
+}
+
+/// Every replica reconciles every draining pod, but only the replica that isolated the pod deletes it
+/// at first, so they don't race. Others take it over only when the original one seems to be gone.
+fn get_takeover_delay(
+    loadbalancing: &LoadBalancingConfig,
+    pod: &Pod,
+    unclaimed: Duration,
+) -> Option<Duration> {
+    if unclaimed >= CONTROLLER_EXCLUSIVE_DURATION || loadbalancing.controls(pod) {
+        return None;
+    }
+
+    // Let the original controller handle first.
+    Some(rand::thread_rng().gen_range(
+        CONTROLLER_EXCLUSIVE_DURATION..CONTROLLER_EXCLUSIVE_DURATION.add(CONTROLLER_TIMEOUT_JITTER),
+    ))
+}
+
+/// How long the deletion has been left to the controller of the pod.
+/// A takeover gives the new controller the same exclusive duration as the original one.
+fn get_unclaimed_duration(pod: &Pod, expire: Duration, now: DateTime<Utc>) -> Duration {
+    match get_pod_taken_over_at(pod) {
+        Some(taken_over_at) => (now - taken_over_at).to_std().unwrap_or_default(),
+        None => expire,
+    }
+}
+
+/// The takeover patch tests the resource version, which fails when another instance has claimed the pod first.
+fn is_taken_over_by_others(err: &eyre::Report) -> bool {
+    err.downcast_ref::<kube::Error>().is_some_and(|err| {
+        is_generic_server_response_422_invalid_for_json_patch_error(err)
+            || is_409_conflict_error(err)
+            || is_404_not_found_error(err)
+            || is_410_gone_error(err)
+    })
+}
+
+/// The pod is left isolated after the failure, so make it visible on the pod as well.
+async fn on_delete_failed(
+    context: &ReconcilerContext,
+    pod: &Pod,
+    err: &kube::Error,
+    message: &str,
+) {
+    metrics::POD_DELETION_FAILED_TOTAL.inc();
+    error!(?err, "{message}");
+
+    let recorder = Recorder::new(
+        context.api_resolver.client.clone(),
+        context.event_reporter.clone(),
+        pod.object_ref(&()),
+    );
+
+    // ignore the error of diagnostic events
+    let _ = recorder.publish(get_delete_failed_event(err)).await;
+}
+
+fn get_delete_failed_event(err: &kube::Error) -> Event {
+    Event {
+        type_: EventType::Warning,
+        action: String::from("Delete"),
+        reason: String::from("DeletionFailed"),
+        note: Some(format!("Failed to delete the drained pod: {err}")),
+        secondary: None,
+    }
+}
+
+/// Back off in proportion to how long the deletion has been failing, and give up eventually.
+fn get_delete_retry_delay(config: &Config, expire: Duration) -> Option<Duration> {
+    if expire >= MAX_DELETE_RETRY_DURATION {
+        return None;
+    }
+
+    // not `clamp`, which panics on the misconfigured range.
+    Some(
+        expire
+            .max(config.delete_retry_min_interval)
+            .min(config.delete_retry_max_interval),
+    )
+}
+
+/// How long until the deletion, or how long ago it has expired.
+fn get_remaining(delete_at: DateTime<Utc>, now: DateTime<Utc>) -> Result<Duration, Duration> {
+    let remaining = delete_at - now;
+    remaining
+        .to_std()
+        .map_err(|_| (-remaining).to_std().unwrap_or_default())
+}
+
+fn get_drain_duration(pod: &Pod, now: DateTime<Utc>) -> Option<Duration> {
+    let isolated_at = get_pod_isolated_at(pod)?;
+    (now - isolated_at).to_std().ok()
+}
+
+fn get_seen_at(context: &ReconcilerContext, pod: &Pod, now: DateTime<Utc>) -> DateTime<Utc> {
+    let Some(uid) = pod.uid() else {
+        return now;
+    };
+
+    let mut seen_at = context.seen_at.lock().unwrap();
+    *seen_at.entry(uid).or_insert(now)
+}
+
+fn forget_seen_at(context: &ReconcilerContext, pod: &Pod) {
+    if let Some(uid) = pod.uid() {
+        context.seen_at.lock().unwrap().remove(&uid);
+    }
+}
+
+/// Isolated pods shouldn't stay longer than the max isolation time,
+/// even if the drain-until annotation is miscalculated or tampered with.
+///
+/// The isolated-at annotation can't be trusted either if it is later than when this instance first saw the drain,
+/// e.g. by a skewed clock, or missing on the pods isolated by older versions.
+/// Then the drain is bounded since it was first seen, e.g. after the restart.
+fn get_delete_at(
+    config: &Config,
+    pod: &Pod,
+    drain_until: DateTime<Utc>,
+    seen_at: DateTime<Utc>,
+) -> DateTime<Utc> {
+    let drain_until = match get_post_deregistration_until(config, pod) {
+        Some(post_deregistration_until) => drain_until.max(post_deregistration_until),
+        None => drain_until,
+    };
+
+    let isolated_at = get_pod_isolated_at(pod)
+        .filter(|isolated_at| *isolated_at <= seen_at)
+        .unwrap_or(seen_at);
+    let max_isolated_until = chrono::Duration::from_std(config.max_isolation_time)
+        .ok()
+        .and_then(|max_isolation_time| isolated_at.checked_add_signed(max_isolation_time));
+
+    match max_isolated_until {
+        Some(max_isolated_until) => drain_until.min(max_isolated_until),
+        None => drain_until,
+    }
+}
+
+/// The targets might still be deregistering at the deletion, e.g. with a longer deregistration delay.
+/// The drain is extended while they are, up to the max extension past the deletion time.
+/// The DELETE admissions are allowed when their delay ends, so they aren't extended.
+fn get_drain_extension(
+    config: &Config,
+    pod: &Pod,
+    delete_at: DateTime<Utc>,
+    now: DateTime<Utc>,
+) -> Option<Duration> {
+    let interval = config.drain_extension_interval?;
+    if !is_target_deregistering(pod) {
+        return None;
+    }
+
+    let max_extension = chrono::Duration::from_std(config.max_drain_extension).ok()?;
+    let extended_until = delete_at.checked_add_signed(max_extension)?;
+    let remaining = (extended_until - now).to_std().ok()?;
+    Some(interval.min(remaining)).filter(|extension| !extension.is_zero())
+}
+
+/// The pod is updated when its target health conditions change, so this is re-evaluated on the flip.
+/// The DELETE admissions don't wait for it, since their delay is decided before the deregistration.
+fn get_post_deregistration_until(config: &Config, pod: &Pod) -> Option<DateTime<Utc>> {
+    let post_deregistration_delay =
+        chrono::Duration::from_std(config.post_deregistration_delay?).ok()?;
+    let deregistered_at = get_targets_deregistered_at(pod)?;
+    deregistered_at.checked_add_signed(post_deregistration_delay)
+}
+
+/// Handle the pods that this instance is still draining, according to `--on-shutdown`.
+async fn handle_isolations_on_shutdown(context: &ReconcilerContext) {
+    let api: Api<Pod> = context.api_resolver.all();
+    let pods = match api
+        .list(&ListParams::default().labels(DRAINING_LABEL_KEY))
+        .await
+    {
+        Ok(pods) => pods.items,
+        Err(err) => {
+            error!(?err, "failed to list isolated pods on shutdown");
+            return;
+        }
+    };
+
+    let now = context.clock.now();
+    for pod in pods {
+        let Some(action) = get_shutdown_action(
+            context.config.on_shutdown,
+            &context.loadbalancing,
+            &pod,
+            now,
+        ) else {
+            continue;
+        };
+
+        let span =
+            span!(Level::ERROR, "on-shutdown", object_ref = %ObjectRef::from_obj(&pod), ?action);
+        let result: Result<()> = instrumented!(span, async {
+            match action {
+                OnShutdown::Wait => {}
+                OnShutdown::ForceDelete => {
+                    if let Some(evict_params) = get_removal_evict_params(&context.config, &pod) {
+                        evict_pod(&context.api_resolver, &pod, &evict_params).await?;
+                    } else {
+                        delete_pod(&context.api_resolver, &pod).await?;
+                    }
+                }
+                OnShutdown::Release => {
+                    info!("releasing pod");
+                    patch_pod_release(&context.api_resolver, &context.config, &pod).await?;
+                }
+            }
+
+            Ok(())
+        });
+
+        if let Err(err) = result {
+            error!(?err, object_ref = %ObjectRef::from_obj(&pod), "failed to handle isolated pod on shutdown");
+        }
+    }
+}
+
+/// Only the pods isolated by this instance and still draining. Others are handled by their own controllers.
+fn get_shutdown_action(
+    on_shutdown: OnShutdown,
+    loadbalancing: &LoadBalancingConfig,
+    pod: &Pod,
+    now: DateTime<Utc>,
+) -> Option<OnShutdown> {
+    if on_shutdown == OnShutdown::Wait || !loadbalancing.controls(pod) {
+        return None;
+    }
+
+    match get_pod_draining_info(pod) {
+        PodDrainingInfo::DrainUntil(drain_until) if now < drain_until => Some(on_shutdown),
+        _ => None,
+    }
+}
+
 fn error_policy(_pod: Arc<Pod>, err: &ReconcileError, _context: Arc<ReconcilerContext>) -> Action {
     match err {
         ReconcileError::KubeError(err) => {
@@ -153,7 +611,7 @@ async fn log_reconcile_result(
     })
 }
 
-async fn delete_pod(api_resolver: &ApiResolver, pod: &Pod) -> kube::Result<()> {
+pub(crate) async fn delete_pod(api_resolver: &ApiResolver, pod: &Pod) -> kube::Result<()> {
     let api = api_resolver.api_for(pod);
     let name = pod.name_any();
 
@@ -180,6 +638,162 @@ async fn delete_pod(api_resolver: &ApiResolver, pod: &Pod) -> kube::Result<()> {
     }
 }
 
+/// The drained label is set just before the removal, so that the other controllers can gate on it,
+/// e.g. the rollout controllers that tear down the old replica sets after the drain.
+async fn remove_drained_pod(
+    api_resolver: &ApiResolver,
+    config: &Config,
+    pod: &Pod,
+) -> kube::Result<()> {
+    if config.final_removal_via_eviction
+        && get_pod_evict_params(pod).is_none()
+        && would_removal_violate_pod_disruption_budget(api_resolver, config, pod).await?
+    {
+        // The same as the api server would respond, so it is retried like the blocked evictions.
+        return Err(kube::Error::Api(ErrorResponse {
+            status: String::from("Failure"),
+            message: String::from(
+                "Cannot evict pod as it would violate the pod's disruption budget.",
+            ),
+            reason: String::from("TooManyRequests"),
+            code: 429,
+        }));
+    }
+
+    mark_pod_drained(api_resolver, pod).await?;
+    match get_removal_evict_params(config, pod) {
+        Some(evict_params) => evict_pod(api_resolver, pod, &evict_params).await,
+        None => delete_pod(api_resolver, pod).await,
+    }
+}
+
+/// The isolated pods are out of their PodDisruptionBudgets, so the api server doesn't enforce the budgets
+/// on their evictions. They are judged by their original labels here instead.
+async fn would_removal_violate_pod_disruption_budget(
+    api_resolver: &ApiResolver,
+    config: &Config,
+    pod: &Pod,
+) -> kube::Result<bool> {
+    let Some(namespace) = pod.namespace() else {
+        return Ok(false);
+    };
+
+    let pdbs: Api<PodDisruptionBudget> = Api::namespaced(api_resolver.client.clone(), &namespace);
+    let pdbs = pdbs.list(&ListParams::default()).await?.items;
+    if pdbs.is_empty() {
+        return Ok(false);
+    }
+
+    let pods = api_resolver
+        .api_for(pod)
+        .list(&ListParams::default())
+        .await?
+        .items;
+    Ok(would_violate_pod_disruption_budget_by_labels(
+        config,
+        &pdbs.iter().collect::<Vec<_>>(),
+        &pods.iter().collect::<Vec<_>>(),
+        pod,
+        &get_original_labels(pod),
+    ))
+}
+
+/// The webhook marks the deleted pods as well, before it allows their deletions.
+pub(crate) async fn mark_pod_drained(api_resolver: &ApiResolver, pod: &Pod) -> kube::Result<()> {
+    debug!("labelling pod as drained");
+    patch_pod_label(api_resolver, pod, DRAINED_LABEL_KEY, "true").await
+}
+
+/// The pods evicted by the users are evicted again with their options. With `--final-removal-via-eviction`,
+/// the deleted ones are evicted as well, after their PodDisruptionBudgets are checked by their original labels.
+fn get_removal_evict_params(config: &Config, pod: &Pod) -> Option<EvictParams> {
+    if let Some(evict_params) = get_pod_evict_params(pod) {
+        return Some(evict_params);
+    }
+
+    if !config.final_removal_via_eviction {
+        return None;
+    }
+
+    Some(EvictParams {
+        delete_options: Some(DeleteParams {
+            preconditions: Some(Preconditions {
+                uid: pod.uid(),
+                ..Preconditions::default()
+            }),
+            ..DeleteParams::default()
+        }),
+        ..EvictParams::default()
+    })
+}
+
+/// Complete the drain of the isolated pod right away, e.g. by the admin api.
+/// Its wait is disabled first by marking it as deleting, so that the webhooks don't delay the deletion again,
+/// and the controllers resume the deletion if it is interrupted.
+pub(crate) async fn disable_wait_and_delete_pod(
+    api_resolver: &ApiResolver,
+    pod: &Pod,
+) -> kube::Result<()> {
+    info!("disabling the wait of pod");
+    patch_pod_label(
+        api_resolver,
+        pod,
+        DRAINING_LABEL_KEY,
+        DRAINING_LABEL_DELETING_VALUE,
+    )
+    .await?;
+    delete_pod(api_resolver, pod).await
+}
+
+/// The pre-isolated pods are removed once the node drain has followed them, either by their evictions
+/// or by the node that is still draining. Otherwise, the node has been uncordoned, and they are released.
+fn is_pre_isolation_followed(pod: &Pod, node_draining: bool) -> bool {
+    get_pod_evict_params(pod).is_some() || node_draining
+}
+
+/// Unlike the disabled pods, which are left as they are, the marked pods are still to be deleted.
+fn is_deletion_interrupted(pod: &Pod) -> bool {
+    matches!(get_pod_draining_info(pod), PodDrainingInfo::Deleting)
+}
+
+/// Leave the pod for manual inspection. It won't be reconciled again, since it is no longer draining.
+async fn disable_draining(api_resolver: &ApiResolver, pod: &Pod) -> kube::Result<()> {
+    info!("disabling draining of pod");
+    patch_pod_label(api_resolver, pod, DRAINING_LABEL_KEY, "false").await?;
+    debug!("pod is left isolated");
+    Ok(())
+}
+
+async fn patch_pod_label(
+    api_resolver: &ApiResolver,
+    pod: &Pod,
+    key: &str,
+    value: &str,
+) -> kube::Result<()> {
+    let api = api_resolver.api_for(pod);
+    let name = pod.name_any();
+
+    let patch = serde_json::json!({
+        "metadata": {
+            "labels": {
+                key: value,
+            },
+        },
+    });
+
+    let result = api
+        .patch(&name, &PatchParams::default(), &Patch::Merge(&patch))
+        .await;
+    match result {
+        Ok(_) => Ok(()),
+        Err(err) if is_404_not_found_error(&err) || is_410_gone_error(&err) => {
+            debug!("pod is gone anyway");
+            Ok(())
+        }
+        Err(err) => Err(err),
+    }
+}
+
 async fn evict_pod(
     api_resolver: &ApiResolver,
     pod: &Pod,
@@ -202,3 +816,1028 @@ async fn evict_pod(
         Err(err) => Err(err),
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    use uuid::Uuid;
+
+    use crate::from_json;
+    use crate::test_utils::{pod_routes, FakeApiServer};
+
+    fn datetime(str: &str) -> DateTime<Utc> {
+        DateTime::parse_from_rfc3339(str)
+            .unwrap()
+            .with_timezone(&Utc)
+    }
+
+    #[test]
+    fn delete_failure_should_be_reported_as_warning() {
+        let err = kube::Error::Api(kube::error::ErrorResponse {
+            status: String::from("Failure"),
+            message: String::from("forbidden"),
+            reason: String::from("Forbidden"),
+            code: 403,
+        });
+
+        let event = get_delete_failed_event(&err);
+        assert!(matches!(event.type_, EventType::Warning));
+        assert_eq!(event.reason, "DeletionFailed");
+        assert!(event.note.unwrap().contains("forbidden"));
+    }
+
+    #[test]
+    fn delete_retry_should_back_off() {
+        let config = Config::default();
+        assert_eq!(
+            get_delete_retry_delay(&config, Duration::from_secs(0)),
+            Some(config.delete_retry_min_interval)
+        );
+        assert_eq!(
+            get_delete_retry_delay(&config, Duration::from_secs(20)),
+            Some(Duration::from_secs(20))
+        );
+        assert_eq!(
+            get_delete_retry_delay(&config, Duration::from_secs(300)),
+            Some(config.delete_retry_max_interval)
+        );
+    }
+
+    #[test]
+    fn delete_retry_should_follow_configured_intervals() {
+        let config = Config {
+            delete_retry_min_interval: Duration::from_secs(1),
+            delete_retry_max_interval: Duration::from_secs(10),
+            ..Config::default()
+        };
+        assert_eq!(
+            get_delete_retry_delay(&config, Duration::from_secs(0)),
+            Some(Duration::from_secs(1))
+        );
+        assert_eq!(
+            get_delete_retry_delay(&config, Duration::from_secs(20)),
+            Some(Duration::from_secs(10))
+        );
+    }
+
+    #[test]
+    fn delete_retry_should_give_up_eventually() {
+        let config = Config::default();
+        let mut expire = Duration::ZERO;
+        let mut retries = 0;
+        while let Some(retry_after) = get_delete_retry_delay(&config, expire) {
+            expire += retry_after;
+            retries += 1;
+            assert!(retries < 100, "should give up");
+        }
+
+        assert!(expire >= MAX_DELETE_RETRY_DURATION);
+    }
+
+    #[test]
+    fn should_cap_drain_until_by_max_isolation_time() {
+        let config = Config {
+            max_isolation_time: Duration::from_secs(600),
+            ..Config::default()
+        };
+        let pod: Pod = from_json!({
+            "metadata": {
+                "labels": {
+                    "pod-graceful-drain/draining": "true",
+                },
+                "annotations": {
+                    "pod-graceful-drain/isolated-at": "2023-02-08T15:00:00Z",
+                    "pod-graceful-drain/drain-until": "2099-01-01T00:00:00Z",
+                },
+            }
+        });
+
+        let delete_at = get_delete_at(
+            &config,
+            &pod,
+            datetime("2099-01-01T00:00:00Z"),
+            datetime("2023-02-08T15:00:01Z"),
+        );
+        assert_eq!(delete_at, datetime("2023-02-08T15:10:00Z"));
+    }
+
+    #[test]
+    fn post_deregistration_delay_should_be_applied_after_target_health_flips() {
+        let config = Config {
+            post_deregistration_delay: Some(Duration::from_secs(20)),
+            ..Config::default()
+        };
+        let pod = |target_health: &str, last_transition_time: &str| -> Pod {
+            from_json!({
+                "metadata": {
+                    "annotations": {
+                        "pod-graceful-drain/isolated-at": "2023-02-08T15:00:00Z",
+                        "pod-graceful-drain/drain-until": "2023-02-08T15:00:30Z",
+                    },
+                },
+                "status": {
+                    "conditions": [{
+                        "type": "target-health.elbv2.k8s.aws/tgb",
+                        "status": target_health,
+                        "lastTransitionTime": last_transition_time,
+                    }],
+                },
+            })
+        };
+        let drain_until = datetime("2023-02-08T15:00:30Z");
+        let seen_at = datetime("2023-02-08T15:00:00Z");
+
+        let deregistered = pod("False", "2023-02-08T15:00:25Z");
+        assert_eq!(
+            get_delete_at(&config, &deregistered, drain_until, seen_at),
+            datetime("2023-02-08T15:00:45Z")
+        );
+        assert_eq!(
+            get_delete_at(&Config::default(), &deregistered, drain_until, seen_at),
+            drain_until,
+            "disabled"
+        );
+
+        let deregistered_early = pod("False", "2023-02-08T15:00:05Z");
+        assert_eq!(
+            get_delete_at(&config, &deregistered_early, drain_until, seen_at),
+            drain_until
+        );
+
+        let still_registered = pod("True", "2023-02-08T14:00:00Z");
+        assert_eq!(
+            get_delete_at(&config, &still_registered, drain_until, seen_at),
+            drain_until
+        );
+
+        let unhealthy_before_isolation = pod("False", "2023-02-08T14:00:00Z");
+        assert_eq!(
+            get_delete_at(&config, &unhealthy_before_isolation, drain_until, seen_at),
+            drain_until
+        );
+    }
+
+    #[test]
+    fn drain_should_be_extended_while_targets_are_deregistering() {
+        let config = Config {
+            drain_extension_interval: Some(Duration::from_secs(10)),
+            max_drain_extension: Duration::from_secs(30),
+            ..Config::default()
+        };
+        let pod = |reason: &str| -> Pod {
+            from_json!({
+                "status": {
+                    "conditions": [{
+                        "type": "target-health.elbv2.k8s.aws/tgb",
+                        "status": "False",
+                        "reason": reason,
+                    }],
+                },
+            })
+        };
+        let delete_at = datetime("2023-02-08T15:00:30Z");
+
+        let draining = pod("Target.DeregistrationInProgress");
+        assert_eq!(
+            get_drain_extension(&config, &draining, delete_at, delete_at),
+            Some(Duration::from_secs(10))
+        );
+        assert_eq!(
+            get_drain_extension(
+                &config,
+                &draining,
+                delete_at,
+                datetime("2023-02-08T15:00:55Z")
+            ),
+            Some(Duration::from_secs(5)),
+            "up to the max extension"
+        );
+        assert_eq!(
+            get_drain_extension(
+                &config,
+                &draining,
+                delete_at,
+                datetime("2023-02-08T15:01:00Z")
+            ),
+            None,
+            "extended enough"
+        );
+        assert_eq!(
+            get_drain_extension(&Config::default(), &draining, delete_at, delete_at),
+            None,
+            "disabled"
+        );
+
+        let deregistered = pod("Target.NotRegistered");
+        assert_eq!(
+            get_drain_extension(&config, &deregistered, delete_at, delete_at),
+            None
+        );
+    }
+
+    #[test]
+    fn pod_should_expire_when_the_clock_passes_delete_at() {
+        let clock = Clock::fake(datetime("2024-01-01T00:00:00Z"));
+        let pod = pod_isolated_by(Uuid::new_v4(), "2024-01-01T00:00:30Z");
+        let PodDrainingInfo::DrainUntil(drain_until) = get_pod_draining_info(&pod) else {
+            panic!("pod should be draining");
+        };
+        let delete_at = get_delete_at(&Config::default(), &pod, drain_until, clock.now());
+
+        assert_eq!(
+            get_remaining(delete_at, clock.now()),
+            Ok(Duration::from_secs(30))
+        );
+
+        clock.advance(chrono::Duration::seconds(20));
+        assert_eq!(
+            get_remaining(delete_at, clock.now()),
+            Ok(Duration::from_secs(10))
+        );
+
+        clock.advance(chrono::Duration::seconds(15));
+        assert_eq!(
+            get_remaining(delete_at, clock.now()),
+            Err(Duration::from_secs(5)),
+            "expired"
+        );
+    }
+
+    #[test]
+    fn should_cap_drain_until_since_seen_without_isolated_at() {
+        let config = Config {
+            max_isolation_time: Duration::from_secs(600),
+            ..Config::default()
+        };
+        let pod: Pod = from_json!({
+            "metadata": {
+                "labels": {
+                    "pod-graceful-drain/draining": "true",
+                },
+                "annotations": {
+                    "pod-graceful-drain/drain-until": "2099-01-01T00:00:00Z",
+                },
+            }
+        });
+
+        let delete_at = get_delete_at(
+            &config,
+            &pod,
+            datetime("2099-01-01T00:00:00Z"),
+            datetime("2023-02-08T15:00:00Z"),
+        );
+        assert_eq!(delete_at, datetime("2023-02-08T15:10:00Z"));
+    }
+
+    #[test]
+    fn should_cap_drain_until_since_seen_with_skewed_isolated_at() {
+        let config = Config {
+            max_isolation_time: Duration::from_secs(600),
+            ..Config::default()
+        };
+        let pod: Pod = from_json!({
+            "metadata": {
+                "labels": {
+                    "pod-graceful-drain/draining": "true",
+                },
+                "annotations": {
+                    "pod-graceful-drain/isolated-at": "2098-12-31T23:59:00Z",
+                    "pod-graceful-drain/drain-until": "2099-01-01T00:00:00Z",
+                },
+            }
+        });
+        let seen_at = datetime("2023-02-08T15:00:00Z");
+
+        let delete_at = get_delete_at(&config, &pod, datetime("2099-01-01T00:00:00Z"), seen_at);
+        assert_eq!(delete_at, datetime("2023-02-08T15:10:00Z"));
+        assert_eq!(
+            get_remaining(delete_at, seen_at),
+            Ok(config.max_isolation_time),
+            "never waits beyond the max isolation time"
+        );
+    }
+
+    fn pod_isolated_by(instance_id: Uuid, drain_until: &str) -> Pod {
+        from_json!({
+            "metadata": {
+                "labels": {
+                    "pod-graceful-drain/draining": "true",
+                },
+                "annotations": {
+                    "pod-graceful-drain/controller": instance_id.to_string(),
+                    "pod-graceful-drain/drain-until": drain_until,
+                },
+            }
+        })
+    }
+
+    #[test]
+    fn only_the_isolating_controller_should_delete_at_first() {
+        let instance_id = Uuid::new_v4();
+        let pod = pod_isolated_by(instance_id, "2023-02-08T15:30:00Z");
+
+        let owner = LoadBalancingConfig::new(instance_id);
+        assert_eq!(
+            get_takeover_delay(&owner, &pod, Duration::from_secs(0)),
+            None
+        );
+
+        let other = LoadBalancingConfig::new(Uuid::new_v4());
+        let delay = get_takeover_delay(&other, &pod, Duration::from_secs(0))
+            .expect("should wait for the owner");
+        assert!(delay >= CONTROLLER_EXCLUSIVE_DURATION);
+        assert_eq!(
+            get_takeover_delay(&other, &pod, CONTROLLER_EXCLUSIVE_DURATION),
+            None,
+            "should take over when the owner is gone"
+        );
+    }
+
+    #[test]
+    fn taken_over_pod_should_be_exclusive_to_the_new_controller() {
+        let original = Uuid::new_v4();
+        let first = LoadBalancingConfig::new(Uuid::new_v4());
+        let second = LoadBalancingConfig::new(Uuid::new_v4());
+        let pod = pod_isolated_by(original, "2023-02-08T15:30:00Z");
+        let now = datetime("2023-02-08T15:31:00Z");
+        let expire = Duration::from_secs(60);
+
+        let unclaimed = get_unclaimed_duration(&pod, expire, now);
+        assert_eq!(get_takeover_delay(&first, &pod, unclaimed), None);
+        assert_eq!(get_takeover_delay(&second, &pod, unclaimed), None);
+
+        // the first one has claimed it.
+        let mut pod = pod;
+        pod.annotations_mut().insert(
+            String::from("pod-graceful-drain/controller"),
+            first.get_id(),
+        );
+        pod.annotations_mut().insert(
+            String::from("pod-graceful-drain/taken-over-at"),
+            String::from("2023-02-08T15:31:00Z"),
+        );
+
+        let unclaimed = get_unclaimed_duration(&pod, expire, now);
+        assert_eq!(get_takeover_delay(&first, &pod, unclaimed), None);
+        assert!(
+            get_takeover_delay(&second, &pod, unclaimed).is_some(),
+            "should wait for the new controller"
+        );
+
+        let later = now + chrono::Duration::from_std(CONTROLLER_EXCLUSIVE_DURATION).unwrap();
+        let unclaimed = get_unclaimed_duration(&pod, expire, later);
+        assert_eq!(
+            get_takeover_delay(&second, &pod, unclaimed),
+            None,
+            "should take over when the new controller is gone too"
+        );
+    }
+
+    #[test]
+    fn only_the_interrupted_deletion_should_be_resumed() {
+        let pod_labeled = |label: &str| -> Pod {
+            from_json!({
+                "metadata": {
+                    "labels": {
+                        "pod-graceful-drain/draining": label,
+                    },
+                    "annotations": {
+                        "pod-graceful-drain/drain-until": "2023-02-08T15:30:00Z",
+                    },
+                }
+            })
+        };
+
+        assert!(is_deletion_interrupted(&pod_labeled("deleting")));
+        assert!(
+            !is_deletion_interrupted(&pod_labeled("false")),
+            "disabled pods are left isolated"
+        );
+        assert!(!is_deletion_interrupted(&pod_labeled("true")));
+
+        let mut terminating = pod_labeled("deleting");
+        terminating.metadata.deletion_timestamp = Some(
+            k8s_openapi::apimachinery::pkg::apis::meta::v1::Time(datetime("2023-02-08T15:31:00Z")),
+        );
+        assert!(
+            !is_deletion_interrupted(&terminating),
+            "no redundant deletion once it is terminating"
+        );
+    }
+
+    #[tokio::test]
+    async fn drained_label_should_be_set_before_deletion() {
+        let pod_json = serde_json::json!({
+            "apiVersion": "v1",
+            "kind": "Pod",
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "uid": "uid1234",
+            },
+        });
+        let server = FakeApiServer::serve(pod_routes(pod_json.clone())).await;
+
+        let pod: Pod = serde_json::from_value(pod_json).unwrap();
+        remove_drained_pod(&server.api_resolver, &Config::default(), &pod)
+            .await
+            .unwrap();
+
+        let requests = server.pod_requests();
+        assert_eq!(requests.len(), 2, "{requests:?}");
+        assert!(
+            requests[0].starts_with("PATCH /api/v1/namespaces/ns/pods/pod")
+                && requests[0].contains(r#""pod-graceful-drain/drained":"true""#),
+            "{}",
+            requests[0]
+        );
+        assert!(requests[1].starts_with("DELETE /api/v1/namespaces/ns/pods/pod"));
+    }
+
+    #[tokio::test]
+    async fn evicted_pre_isolated_pod_should_be_evicted_after_drain() {
+        let pre_isolated = |annotations: serde_json::Value| -> serde_json::Value {
+            serde_json::json!({
+                "apiVersion": "v1",
+                "kind": "Pod",
+                "metadata": {
+                    "name": "pod",
+                    "namespace": "ns",
+                    "uid": "uid1234",
+                    "labels": {
+                        "pod-graceful-drain/draining": "true",
+                    },
+                    "annotations": annotations,
+                },
+                "spec": {
+                    "nodeName": "node",
+                },
+            })
+        };
+
+        // The node is cordoned, and the pod is pre-isolated.
+        let pod: Pod = serde_json::from_value(pre_isolated(serde_json::json!({
+            "pod-graceful-drain/drain-until": "2023-02-08T15:30:00Z",
+            "pod-graceful-drain/pre-isolated": "true",
+        })))
+        .unwrap();
+        assert!(is_pre_isolation_followed(&pod, true), "still cordoned");
+        assert!(!is_pre_isolation_followed(&pod, false), "uncordoned");
+
+        // The node drain evicts it, and the eviction is recorded.
+        let pod_json = pre_isolated(serde_json::json!({
+            "pod-graceful-drain/drain-until": "2023-02-08T15:30:00Z",
+            "pod-graceful-drain/pre-isolated": "true",
+            "pod-graceful-drain/delete-options": "{}",
+        }));
+        let pod: Pod = serde_json::from_value(pod_json.clone()).unwrap();
+        assert!(is_pre_isolation_followed(&pod, false));
+
+        // It expires, and it is evicted rather than being left isolated.
+        let server = FakeApiServer::serve(pod_routes(pod_json)).await;
+        remove_drained_pod(&server.api_resolver, &Config::default(), &pod)
+            .await
+            .unwrap();
+
+        let requests = server.pod_requests();
+        assert_eq!(requests.len(), 2, "{requests:?}");
+        assert!(requests[0].starts_with("PATCH /api/v1/namespaces/ns/pods/pod"));
+        assert!(
+            requests[1].starts_with("POST /api/v1/namespaces/ns/pods/pod/eviction"),
+            "{}",
+            requests[1]
+        );
+    }
+
+    fn reconciler_context(
+        api_resolver: &ApiResolver,
+        config: Config,
+        loadbalancing: LoadBalancingConfig,
+        clock: Clock,
+    ) -> Arc<ReconcilerContext> {
+        Arc::new(ReconcilerContext {
+            api_resolver: api_resolver.clone(),
+            delete_limiter: RateLimiter::new(config.delete_qps, config.delete_burst),
+            config,
+            loadbalancing,
+            clock,
+            event_reporter: Reporter {
+                controller: String::from(CONTROLLER_NAME),
+                instance: None,
+            },
+            seen_at: Mutex::default(),
+        })
+    }
+
+    /// The deletions observe the global metrics, so they don't overlap the tests that count them.
+    static DELETIONS: tokio::sync::Mutex<()> = tokio::sync::Mutex::const_new(());
+
+    #[tokio::test]
+    async fn reconcile_should_delete_pod_when_the_clock_passes_the_drain() {
+        let _deletions = DELETIONS.lock().await;
+        let instance_id = Uuid::new_v4();
+        let pod_json = serde_json::json!({
+            "apiVersion": "v1",
+            "kind": "Pod",
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "uid": "uid1234",
+                "labels": {
+                    "pod-graceful-drain/draining": "true",
+                },
+                "annotations": {
+                    "pod-graceful-drain/controller": instance_id.to_string(),
+                    "pod-graceful-drain/isolated-at": "2023-02-08T15:30:00Z",
+                    "pod-graceful-drain/drain-until": "2023-02-08T15:30:30Z",
+                },
+            },
+        });
+        let pod: Arc<Pod> = Arc::new(serde_json::from_value(pod_json.clone()).unwrap());
+
+        let server = FakeApiServer::serve(pod_routes(pod_json)).await;
+        let clock = Clock::fake(datetime("2023-02-08T15:30:00Z"));
+        let context = reconciler_context(
+            &server.api_resolver,
+            Config::default(),
+            LoadBalancingConfig::new(instance_id),
+            clock.clone(),
+        );
+
+        let action = reconcile(pod.clone(), context.clone()).await.unwrap();
+        assert_eq!(action, Action::requeue(Duration::from_secs(30)));
+
+        clock.advance(chrono::Duration::seconds(20));
+        let action = reconcile(pod.clone(), context.clone()).await.unwrap();
+        assert_eq!(action, Action::requeue(Duration::from_secs(10)));
+        assert!(
+            !server
+                .pod_requests()
+                .iter()
+                .any(|request| request.starts_with("DELETE ")),
+            "should be deleted only after the drain"
+        );
+
+        clock.advance(chrono::Duration::seconds(10));
+        reconcile(pod, context).await.unwrap();
+        let requests = server.pod_requests();
+        assert!(
+            requests
+                .last()
+                .is_some_and(|request| request.starts_with("DELETE /api/v1/namespaces/ns/pods/pod")),
+            "{requests:?}"
+        );
+    }
+
+    /// Reconciles the pod isolated by this instance until 2023-02-08T15:30:30Z, once while it drains and once after.
+    async fn reconcile_through_drain(config: Config) -> FakeApiServer {
+        let _deletions = DELETIONS.lock().await;
+        let instance_id = Uuid::new_v4();
+        let pod_json = serde_json::json!({
+            "apiVersion": "v1",
+            "kind": "Pod",
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "uid": "uid1234",
+                "labels": {
+                    "pod-graceful-drain/draining": "true",
+                },
+                "annotations": {
+                    "pod-graceful-drain/controller": instance_id.to_string(),
+                    "pod-graceful-drain/isolated-at": "2023-02-08T15:30:00Z",
+                    "pod-graceful-drain/drain-until": "2023-02-08T15:30:30Z",
+                },
+            },
+        });
+        let pod: Arc<Pod> = Arc::new(serde_json::from_value(pod_json.clone()).unwrap());
+
+        let server = FakeApiServer::serve(pod_routes(pod_json)).await;
+        let clock = Clock::fake(datetime("2023-02-08T15:30:00Z"));
+        let context = reconciler_context(
+            &server.api_resolver,
+            config,
+            LoadBalancingConfig::new(instance_id),
+            clock.clone(),
+        );
+
+        reconcile(pod.clone(), context.clone()).await.unwrap();
+        clock.advance(chrono::Duration::seconds(30));
+        reconcile(pod, context).await.unwrap();
+        server
+    }
+
+    fn is_drain_complete_patch(request: &str, status: &str, message: &str) -> bool {
+        request.starts_with("PATCH /api/v1/namespaces/ns/pods/pod/status")
+            && request.contains(r#""type":"pod-graceful-drain/DrainComplete""#)
+            && request.contains(&format!(r#""status":"{status}""#))
+            && request.contains(message)
+    }
+
+    #[tokio::test]
+    async fn drain_complete_condition_should_flip_before_deletion() {
+        let server = reconcile_through_drain(Config::default()).await;
+
+        let requests = server.pod_requests();
+        assert_eq!(requests.len(), 4, "{requests:?}");
+        assert!(
+            is_drain_complete_patch(&requests[0], "False", "The pod is isolated and draining"),
+            "{}",
+            requests[0]
+        );
+        assert!(
+            is_drain_complete_patch(
+                &requests[1],
+                "True",
+                "The pod is drained and about to be deleted"
+            ),
+            "{}",
+            requests[1]
+        );
+        assert!(
+            requests[2].starts_with("PATCH /api/v1/namespaces/ns/pods/pod")
+                && requests[2].contains(r#""pod-graceful-drain/drained":"true""#),
+            "{}",
+            requests[2]
+        );
+        assert!(
+            requests[3].starts_with("DELETE /api/v1/namespaces/ns/pods/pod"),
+            "{}",
+            requests[3]
+        );
+    }
+
+    #[tokio::test]
+    async fn drain_complete_condition_should_tell_pod_is_left_isolated() {
+        let config = Config {
+            no_auto_delete: true,
+            ..Config::default()
+        };
+        let server = reconcile_through_drain(config).await;
+
+        let requests = server.pod_requests();
+        assert_eq!(requests.len(), 3, "{requests:?}");
+        assert!(
+            is_drain_complete_patch(&requests[0], "False", "The pod is isolated and draining"),
+            "{}",
+            requests[0]
+        );
+        assert!(
+            is_drain_complete_patch(&requests[1], "True", "The pod is drained and left isolated"),
+            "{}",
+            requests[1]
+        );
+        assert!(
+            requests[2].starts_with("PATCH /api/v1/namespaces/ns/pods/pod")
+                && requests[2].contains(r#""pod-graceful-drain/draining":"false""#),
+            "{}",
+            requests[2]
+        );
+    }
+
+    #[tokio::test]
+    async fn reconcile_should_cap_the_drain_by_the_clock_since_isolated() {
+        let instance_id = Uuid::new_v4();
+        let pod_json = serde_json::json!({
+            "apiVersion": "v1",
+            "kind": "Pod",
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "uid": "uid1234",
+                "labels": {
+                    "pod-graceful-drain/draining": "true",
+                },
+                "annotations": {
+                    "pod-graceful-drain/controller": instance_id.to_string(),
+                    "pod-graceful-drain/isolated-at": "2023-02-08T15:30:00Z",
+                    "pod-graceful-drain/drain-until": "2023-02-08T18:30:00Z",
+                },
+            },
+        });
+        let pod: Arc<Pod> = Arc::new(serde_json::from_value(pod_json.clone()).unwrap());
+
+        let server = FakeApiServer::serve(pod_routes(pod_json)).await;
+        let clock = Clock::fake(datetime("2023-02-08T15:30:10Z"));
+        let config = Config {
+            max_isolation_time: Duration::from_secs(60),
+            ..Config::default()
+        };
+        let context = reconciler_context(
+            &server.api_resolver,
+            config,
+            LoadBalancingConfig::new(instance_id),
+            clock,
+        );
+
+        let action = reconcile(pod, context).await.unwrap();
+        assert_eq!(
+            action,
+            Action::requeue(Duration::from_secs(50)),
+            "capped since the isolated-at, not since the drain-until"
+        );
+    }
+
+    #[tokio::test]
+    async fn deletion_should_observe_drain_duration_since_isolation() {
+        let _deletions = DELETIONS.lock().await;
+        let instance_id = Uuid::new_v4();
+        let pod_json = serde_json::json!({
+            "apiVersion": "v1",
+            "kind": "Pod",
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "uid": "uid1234",
+                "labels": {
+                    "pod-graceful-drain/draining": "true",
+                },
+                "annotations": {
+                    "pod-graceful-drain/controller": instance_id.to_string(),
+                    "pod-graceful-drain/isolated-at": "2023-02-08T15:00:00Z",
+                    "pod-graceful-drain/drain-until": "2023-02-08T15:00:30Z",
+                },
+            },
+        });
+        let pod: Arc<Pod> = Arc::new(serde_json::from_value(pod_json.clone()).unwrap());
+
+        let server = FakeApiServer::serve(pod_routes(pod_json)).await;
+        let clock = Clock::fake(datetime("2023-02-08T15:00:31Z"));
+        let context = reconciler_context(
+            &server.api_resolver,
+            Config::default(),
+            LoadBalancingConfig::new(instance_id),
+            clock,
+        );
+
+        let count = metrics::DRAIN_DURATION_SECONDS.get_count();
+        let sum = metrics::DRAIN_DURATION_SECONDS.get_sum();
+        reconcile(pod, context).await.unwrap();
+        assert_eq!(metrics::DRAIN_DURATION_SECONDS.get_count(), count + 1);
+        assert_eq!(
+            metrics::DRAIN_DURATION_SECONDS.get_sum() - sum,
+            Duration::from_secs(31),
+            "since the isolated-at, not since the drain-until"
+        );
+    }
+
+    #[tokio::test]
+    async fn reconcile_should_take_over_and_delete_orphaned_pod() {
+        let _deletions = DELETIONS.lock().await;
+        // Isolated by an instance that is gone, and owned by a ReplicaSet that is gone as well.
+        let pod_json = serde_json::json!({
+            "apiVersion": "v1",
+            "kind": "Pod",
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "uid": "uid1234",
+                "resourceVersion": "1",
+                "labels": {
+                    "pod-graceful-drain/draining": "true",
+                },
+                "annotations": {
+                    "pod-graceful-drain/controller": Uuid::new_v4().to_string(),
+                    "pod-graceful-drain/isolated-at": "2023-02-08T15:30:00Z",
+                    "pod-graceful-drain/drain-until": "2023-02-08T15:30:30Z",
+                },
+                "ownerReferences": [{
+                    "apiVersion": "apps/v1",
+                    "kind": "ReplicaSet",
+                    "name": "app-5d8f9c",
+                    "uid": "rs1234",
+                    "blockOwnerDeletion": true,
+                }],
+            },
+        });
+        let pod: Arc<Pod> = Arc::new(serde_json::from_value(pod_json.clone()).unwrap());
+
+        let server = FakeApiServer::serve(pod_routes(pod_json)).await;
+        let clock = Clock::fake(datetime("2023-02-08T15:31:00Z"));
+        let context = reconciler_context(
+            &server.api_resolver,
+            Config::default(),
+            LoadBalancingConfig::new(Uuid::new_v4()),
+            clock,
+        );
+
+        reconcile(pod, context).await.unwrap();
+        let requests = server.requests();
+        let takeover = requests
+            .iter()
+            .position(|request| {
+                request.starts_with("PATCH /api/v1/namespaces/ns/pods/pod")
+                    && request.contains("pod-graceful-drain~1taken-over-at")
+            })
+            .expect("should take over the pod");
+        let delete = requests
+            .iter()
+            .position(|request| request.starts_with("DELETE /api/v1/namespaces/ns/pods/pod"))
+            .expect("should delete the pod");
+        assert!(takeover < delete, "{requests:?}");
+        assert!(
+            !requests
+                .iter()
+                .any(|request| request.contains("replicasets")),
+            "the owner isn't needed: {requests:?}"
+        );
+    }
+
+    #[test]
+    fn should_leave_isolated_pods_on_shutdown_wait() {
+        let instance_id = Uuid::new_v4();
+        let loadbalancing = LoadBalancingConfig::new(instance_id);
+        let pod = pod_isolated_by(instance_id, "2023-02-08T15:30:00Z");
+
+        let action = get_shutdown_action(
+            OnShutdown::Wait,
+            &loadbalancing,
+            &pod,
+            datetime("2023-02-08T15:29:00Z"),
+        );
+        assert_eq!(action, None);
+    }
+
+    #[test]
+    fn should_delete_draining_pods_on_shutdown_force_delete() {
+        let instance_id = Uuid::new_v4();
+        let loadbalancing = LoadBalancingConfig::new(instance_id);
+        let pod = pod_isolated_by(instance_id, "2023-02-08T15:30:00Z");
+
+        let action = get_shutdown_action(
+            OnShutdown::ForceDelete,
+            &loadbalancing,
+            &pod,
+            datetime("2023-02-08T15:29:00Z"),
+        );
+        assert_eq!(action, Some(OnShutdown::ForceDelete));
+
+        let action = get_shutdown_action(
+            OnShutdown::ForceDelete,
+            &loadbalancing,
+            &pod,
+            datetime("2023-02-08T15:31:00Z"),
+        );
+        assert_eq!(action, None, "drained pods are deleted by the reconciler");
+    }
+
+    #[test]
+    fn final_removal_should_be_eviction_if_configured() {
+        let pod: Pod = from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "uid": "uid1234",
+            },
+        });
+        assert!(
+            get_removal_evict_params(&Config::default(), &pod).is_none(),
+            "deleted by default"
+        );
+
+        let config = Config {
+            final_removal_via_eviction: true,
+            ..Config::default()
+        };
+        let evict_params = get_removal_evict_params(&config, &pod).expect("should be evicted");
+        let preconditions = evict_params.delete_options.unwrap().preconditions.unwrap();
+        assert_eq!(preconditions.uid.as_deref(), Some("uid1234"));
+    }
+
+    /// The drained pod was `app: test` before the isolation, and another pod of the app is listed with it.
+    async fn serve_drained_pod_with_pdb(min_available: i32) -> (FakeApiServer, Pod) {
+        let pod_json = serde_json::json!({
+            "apiVersion": "v1",
+            "kind": "Pod",
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "uid": "uid1234",
+                "labels": {
+                    "pod-graceful-drain/draining": "true",
+                },
+                "annotations": {
+                    "pod-graceful-drain/original-labels": "{\"app\":\"test\"}",
+                },
+            },
+            "status": {
+                "conditions": [{ "type": "Ready", "status": "True" }],
+            },
+        });
+        let other_json = serde_json::json!({
+            "apiVersion": "v1",
+            "kind": "Pod",
+            "metadata": {
+                "name": "other",
+                "namespace": "ns",
+                "labels": { "app": "test" },
+            },
+            "status": {
+                "conditions": [{ "type": "Ready", "status": "True" }],
+            },
+        });
+        let pdb_json = serde_json::json!({
+            "apiVersion": "policy/v1",
+            "kind": "PodDisruptionBudget",
+            "metadata": { "name": "pdb", "namespace": "ns" },
+            "spec": {
+                "minAvailable": min_available,
+                "selector": { "matchLabels": { "app": "test" } },
+            },
+        });
+
+        let pod: Pod = serde_json::from_value(pod_json.clone()).unwrap();
+        let pods = serde_json::json!({
+            "apiVersion": "v1",
+            "kind": "PodList",
+            "metadata": {},
+            "items": [pod_json, other_json],
+        });
+        let pdbs = serde_json::json!({
+            "apiVersion": "policy/v1",
+            "kind": "PodDisruptionBudgetList",
+            "metadata": {},
+            "items": [pdb_json],
+        });
+        let app = pod_routes(pod_json)
+            .route(
+                "/api/v1/namespaces/:namespace/pods",
+                axum::routing::get(move || async move { axum::Json(pods) }),
+            )
+            .route(
+                "/apis/policy/v1/namespaces/:namespace/poddisruptionbudgets",
+                axum::routing::get(move || async move { axum::Json(pdbs) }),
+            );
+        (FakeApiServer::serve(app).await, pod)
+    }
+
+    #[tokio::test]
+    async fn final_removal_should_issue_eviction_instead_of_delete() {
+        let (server, pod) = serve_drained_pod_with_pdb(1).await;
+        let config = Config {
+            final_removal_via_eviction: true,
+            ..Config::default()
+        };
+
+        remove_drained_pod(&server.api_resolver, &config, &pod)
+            .await
+            .unwrap();
+
+        let requests = server.pod_requests();
+        assert_eq!(requests.len(), 2, "{requests:?}");
+        assert!(requests[0].starts_with("PATCH /api/v1/namespaces/ns/pods/pod"));
+        assert!(
+            requests[1].starts_with("POST /api/v1/namespaces/ns/pods/pod/eviction"),
+            "{}",
+            requests[1]
+        );
+        assert!(!requests.iter().any(|request| request.starts_with("DELETE")));
+    }
+
+    #[tokio::test]
+    async fn final_removal_should_be_blocked_by_pdb_of_original_labels() {
+        let (server, pod) = serve_drained_pod_with_pdb(2).await;
+        let config = Config {
+            final_removal_via_eviction: true,
+            ..Config::default()
+        };
+
+        let err = remove_drained_pod(&server.api_resolver, &config, &pod)
+            .await
+            .unwrap_err();
+
+        assert!(
+            is_transient_error(&err),
+            "retried like the blocked evictions"
+        );
+        assert!(
+            server.pod_requests().is_empty(),
+            "neither labelled nor evicted"
+        );
+    }
+
+    #[test]
+    fn should_release_draining_pods_on_shutdown_release() {
+        let instance_id = Uuid::new_v4();
+        let loadbalancing = LoadBalancingConfig::new(instance_id);
+        let pod = pod_isolated_by(instance_id, "2023-02-08T15:30:00Z");
+
+        let action = get_shutdown_action(
+            OnShutdown::Release,
+            &loadbalancing,
+            &pod,
+            datetime("2023-02-08T15:29:00Z"),
+        );
+        assert_eq!(action, Some(OnShutdown::Release));
+
+        let others = pod_isolated_by(Uuid::new_v4(), "2023-02-08T15:30:00Z");
+        let action = get_shutdown_action(
+            OnShutdown::Release,
+            &loadbalancing,
+            &others,
+            datetime("2023-02-08T15:29:00Z"),
+        );
+        assert_eq!(action, None, "pods of the other instances are left");
+    }
+}
@@ -35,6 +35,9 @@ pub enum TargetType {
 #[serde(rename_all = "camelCase")]
 pub struct ServiceReference {
     pub name: String,
+    /// The namespace of the TargetGroupBinding if omitted.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub namespace: Option<String>,
     pub port: IntOrString,
 }
 
@@ -1,3 +1,14 @@
 pub mod apis;
 
 pub const TARGET_HEALTH_POD_CONDITION_TYPE_PREFIX: &str = "target-health.elbv2.k8s.aws";
+/// The reason of the target health condition while the target is `draining`.
+pub const TARGET_DEREGISTRATION_IN_PROGRESS_REASON: &str = "Target.DeregistrationInProgress";
+pub const TARGET_GROUP_ATTRIBUTES_ANNOTATION_KEY: &str =
+    "service.beta.kubernetes.io/aws-load-balancer-target-group-attributes";
+pub const DEREGISTRATION_DELAY_ATTRIBUTE_KEY: &str = "deregistration_delay.timeout_seconds";
+/// Services of `type: LoadBalancer` with this annotation set to `ip` register the pods to the target groups of their NLBs.
+pub const NLB_TARGET_TYPE_ANNOTATION_KEY: &str =
+    "service.beta.kubernetes.io/aws-load-balancer-nlb-target-type";
+/// The legacy way to do the same, with `nlb-ip`.
+pub const LOAD_BALANCER_TYPE_ANNOTATION_KEY: &str =
+    "service.beta.kubernetes.io/aws-load-balancer-type";
@@ -0,0 +1,262 @@
+use std::collections::BTreeSet;
+
+use eyre::Result;
+use k8s_openapi::api::core::v1::Pod;
+use k8s_openapi::api::discovery::v1::EndpointSlice;
+use kube::api::ListParams;
+use kube::{Api, ResourceExt};
+
+use crate::api_resolver::ApiResolver;
+use crate::pod_state::{get_selecting_service_names, is_pod_ready};
+use crate::reflector::Stores;
+use crate::Config;
+
+const SERVICE_NAME_LABEL_KEY: &str = "kubernetes.io/service-name";
+
+/// Whether the pod is receiving the traffic.
+///
+/// With `--use-endpointslice-readiness`, it is whether the pod is a ready endpoint of the services that select it,
+/// since the EndpointSlices can lag behind the pod conditions in both directions.
+pub async fn is_pod_serving(
+    config: &Config,
+    api_resolver: &ApiResolver,
+    stores: &Stores,
+    pod: &Pod,
+) -> Result<bool> {
+    if !config.use_endpointslice_readiness {
+        return Ok(is_pod_ready(config, pod));
+    }
+
+    let service_names = get_selecting_service_names(stores, pod);
+    if service_names.is_empty() {
+        return Ok(false);
+    }
+
+    let Some(namespace) = pod.namespace() else {
+        return Ok(false);
+    };
+
+    // Only the slices of the selecting services, rather than the whole namespace.
+    let label_selector = format!(
+        "{SERVICE_NAME_LABEL_KEY} in ({})",
+        Vec::from_iter(service_names.iter().map(String::as_str)).join(",")
+    );
+    let api: Api<EndpointSlice> = api_resolver.namespaced(&namespace);
+    let endpoint_slices = api
+        .list(&ListParams::default().labels(&label_selector))
+        .await?;
+
+    Ok(is_ready_endpoint(
+        &endpoint_slices.items,
+        &service_names,
+        pod,
+    ))
+}
+
+fn is_ready_endpoint(
+    endpoint_slices: &[EndpointSlice],
+    service_names: &BTreeSet<String>,
+    pod: &Pod,
+) -> bool {
+    endpoint_slices
+        .iter()
+        .filter(|endpoint_slice| {
+            endpoint_slice
+                .labels()
+                .get(SERVICE_NAME_LABEL_KEY)
+                .is_some_and(|service_name| service_names.contains(service_name))
+        })
+        .flat_map(|endpoint_slice| endpoint_slice.endpoints.iter())
+        .filter(|endpoint| {
+            endpoint.target_ref.as_ref().is_some_and(|target_ref| {
+                target_ref.kind.as_deref() == Some("Pod")
+                    && target_ref.uid.is_some()
+                    && target_ref.uid == pod.metadata.uid
+            })
+        })
+        // Unknown readiness should be interpreted as ready.
+        .any(|endpoint| {
+            let ready = endpoint
+                .conditions
+                .as_ref()
+                .and_then(|conditions| conditions.ready);
+            ready != Some(false)
+        })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    use crate::from_json;
+
+    fn endpoint_slice(service_name: &str, endpoints: serde_json::Value) -> EndpointSlice {
+        from_json!({
+            "metadata": {
+                "name": format!("{service_name}-abcde"),
+                "namespace": "ns",
+                "labels": {
+                    "kubernetes.io/service-name": service_name,
+                },
+            },
+            "addressType": "IPv4",
+            "endpoints": endpoints,
+        })
+    }
+
+    fn endpoint(uid: &str, ready: bool) -> serde_json::Value {
+        ::serde_json::json!({
+            "addresses": ["10.0.0.1"],
+            "conditions": {
+                "ready": ready,
+            },
+            "targetRef": {
+                "kind": "Pod",
+                "name": "pod",
+                "namespace": "ns",
+                "uid": uid,
+            },
+        })
+    }
+
+    #[test]
+    fn pod_should_be_serving_if_ready_endpoint() {
+        let pod: Pod = from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "uid": "uid1234",
+            },
+        });
+        let service_names = BTreeSet::from([String::from("svc")]);
+
+        let slices = [endpoint_slice(
+            "svc",
+            ::serde_json::json!([endpoint("uid1234", true)]),
+        )];
+        assert!(is_ready_endpoint(&slices, &service_names, &pod));
+
+        let slices = [endpoint_slice(
+            "svc",
+            ::serde_json::json!([endpoint("uid1234", false)]),
+        )];
+        assert!(!is_ready_endpoint(&slices, &service_names, &pod));
+
+        let slices = [endpoint_slice(
+            "other",
+            ::serde_json::json!([endpoint("uid1234", true)]),
+        )];
+        assert!(
+            !is_ready_endpoint(&slices, &service_names, &pod),
+            "endpoint of unrelated service"
+        );
+    }
+
+    #[test]
+    fn ready_pod_absent_from_endpoint_slice_should_not_be_serving() {
+        let pod: Pod = from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "uid": "uid1234",
+            },
+            "status": {
+                "conditions": [{
+                    "type": "Ready",
+                    "status": "True",
+                }],
+            },
+        });
+        assert!(is_pod_ready(&Config::default(), &pod));
+
+        let service_names = BTreeSet::from([String::from("svc")]);
+        let slices = [endpoint_slice(
+            "svc",
+            ::serde_json::json!([endpoint("other-uid", true)]),
+        )];
+        assert!(!is_ready_endpoint(&slices, &service_names, &pod));
+    }
+
+    #[tokio::test]
+    async fn endpoint_slices_should_be_listed_by_the_selecting_services() {
+        use std::collections::HashMap;
+
+        use axum::extract::Query;
+        use axum::routing::get;
+        use axum::{Json, Router};
+        use k8s_openapi::api::core::v1::Service;
+
+        use crate::test_utils::{store_from, FakeApiServer};
+
+        let pod: Pod = from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "uid": "uid1234",
+                "labels": {
+                    "app": "test",
+                },
+            },
+        });
+        let service = |name: &str| -> Service {
+            from_json!({
+                "metadata": {
+                    "name": name,
+                    "namespace": "ns",
+                },
+                "spec": {
+                    "selector": {
+                        "app": "test",
+                    },
+                },
+            })
+        };
+        let stores = Stores::new(
+            store_from([]),
+            store_from([service("svc1"), service("svc2")]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+        );
+
+        // Lists the slices only for the expected selector.
+        let server = FakeApiServer::serve(Router::new().route(
+            "/apis/discovery.k8s.io/v1/namespaces/ns/endpointslices",
+            get(|Query(params): Query<HashMap<String, String>>| async move {
+                let selected = params.get("labelSelector").map(String::as_str)
+                    == Some("kubernetes.io/service-name in (svc1,svc2)");
+                let items = if selected {
+                    ::serde_json::json!([{
+                        "metadata": {
+                            "name": "svc1-abcde",
+                            "namespace": "ns",
+                            "labels": {
+                                "kubernetes.io/service-name": "svc1",
+                            },
+                        },
+                        "addressType": "IPv4",
+                        "endpoints": [endpoint("uid1234", true)],
+                    }])
+                } else {
+                    ::serde_json::json!([])
+                };
+                Json(::serde_json::json!({
+                    "apiVersion": "discovery.k8s.io/v1",
+                    "kind": "EndpointSliceList",
+                    "metadata": {},
+                    "items": items,
+                }))
+            }),
+        ))
+        .await;
+
+        let config = Config {
+            use_endpointslice_readiness: true,
+            ..Config::default()
+        };
+        let serving = is_pod_serving(&config, &server.api_resolver, &stores, &pod)
+            .await
+            .unwrap();
+        assert!(serving, "{:?}", server.requests());
+    }
+}
@@ -1,28 +1,51 @@
+mod active_hours;
 mod api_resolver;
+mod clock;
+mod concurrent_drains;
 mod config;
 mod consts;
 mod controller;
 mod elbv2;
+mod endpoint_slice;
 mod loadbalancing;
+mod logging;
+mod metrics;
+mod node_state;
+mod pod_disruption_budget;
 mod pod_draining_info;
 mod pod_evict_params;
+mod pod_selector;
 mod pod_state;
+mod pre_isolator;
+mod rate_limiter;
 mod reflector;
+mod self_test;
 mod service_registry;
 mod shutdown;
 mod spawn_service;
 mod status;
+mod telemetry;
+#[cfg(test)]
+mod test_utils;
 mod utils;
+mod webhook_configuration;
 pub mod webhooks;
 
 pub use crate::api_resolver::ApiResolver;
-pub use crate::config::Config;
+pub use crate::clock::Clock;
+pub use crate::concurrent_drains::DrainReservations;
+pub use crate::config::{Config, DrainPredicate, LogFormat, OnShutdown};
 pub use crate::controller::start_controller;
 pub use crate::loadbalancing::LoadBalancingConfig;
+pub use crate::logging::fmt_layer;
+pub use crate::metrics::log_drain_summary;
+pub use crate::pre_isolator::start_pre_isolator;
 pub use crate::reflector::{start_reflectors, Stores};
+pub use crate::self_test::run_self_test;
 pub use crate::service_registry::ServiceRegistry;
 pub use crate::shutdown::Shutdown;
-pub use crate::webhooks::{start_webhook, WebhookConfig};
+pub use crate::telemetry::{otlp_layer, shutdown_otlp};
+pub use crate::webhooks::{start_webhook, verify_webhook_reachable, WebhookConfig};
 
 #[cfg(test)]
 pub use crate::webhooks::patch_pod_isolate;
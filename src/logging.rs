@@ -0,0 +1,125 @@
+use std::io;
+
+use chrono::Utc;
+use tracing::Subscriber;
+use tracing_subscriber::fmt::format::Writer;
+use tracing_subscriber::fmt::time::{FormatTime, SystemTime};
+use tracing_subscriber::fmt::MakeWriter;
+use tracing_subscriber::registry::LookupSpan;
+use tracing_subscriber::Layer;
+
+use crate::{Config, LogFormat};
+
+/// A layer that writes the logs to the stdout in the configured format.
+pub fn fmt_layer<S>(config: &Config) -> Box<dyn Layer<S> + Send + Sync>
+where
+    S: Subscriber + for<'span> LookupSpan<'span>,
+{
+    make_fmt_layer(config, io::stdout)
+}
+
+fn make_fmt_layer<S, W>(config: &Config, make_writer: W) -> Box<dyn Layer<S> + Send + Sync>
+where
+    S: Subscriber + for<'span> LookupSpan<'span>,
+    W: for<'writer> MakeWriter<'writer> + Send + Sync + 'static,
+{
+    let layer = tracing_subscriber::fmt::layer()
+        .with_writer(make_writer)
+        .with_timer(Timer {
+            format: config.log_timestamp_format.clone(),
+        });
+
+    match config.log_format {
+        LogFormat::Text => Box::new(layer),
+        LogFormat::Json => Box::new(layer.json().flatten_event(config.log_json_flatten_event)),
+    }
+}
+
+/// Formats the timestamps in UTC with the strftime format, or the same as the default of `tracing_subscriber`.
+struct Timer {
+    format: Option<String>,
+}
+
+impl FormatTime for Timer {
+    fn format_time(&self, w: &mut Writer<'_>) -> std::fmt::Result {
+        match &self.format {
+            Some(format) => write!(w, "{}", Utc::now().format(format)),
+            None => SystemTime.format_time(w),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    use std::sync::{Arc, Mutex};
+
+    use chrono::DateTime;
+    use serde_json::Value;
+    use tracing::info;
+    use tracing_subscriber::layer::SubscriberExt;
+
+    #[derive(Clone, Default)]
+    struct CapturedWriter(Arc<Mutex<Vec<u8>>>);
+
+    impl io::Write for CapturedWriter {
+        fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+            self.0.lock().unwrap().extend_from_slice(buf);
+            Ok(buf.len())
+        }
+
+        fn flush(&mut self) -> io::Result<()> {
+            Ok(())
+        }
+    }
+
+    impl<'writer> MakeWriter<'writer> for CapturedWriter {
+        type Writer = CapturedWriter;
+
+        fn make_writer(&'writer self) -> Self::Writer {
+            self.clone()
+        }
+    }
+
+    fn capture_log(config: &Config) -> String {
+        let writer = CapturedWriter::default();
+        let subscriber =
+            tracing_subscriber::registry().with(make_fmt_layer(config, writer.clone()));
+        tracing::subscriber::with_default(subscriber, || {
+            info!(pod = "ns/pod", "pod is isolated");
+        });
+
+        let buf = writer.0.lock().unwrap();
+        String::from_utf8(buf.clone()).unwrap()
+    }
+
+    #[test]
+    fn logger_should_emit_json_when_configured() {
+        let config = Config {
+            log_format: LogFormat::Json,
+            log_timestamp_format: Some(String::from("%Y-%m-%dT%H:%M:%S%.3fZ")),
+            log_json_flatten_event: true,
+            ..Config::default()
+        };
+
+        let log = capture_log(&config);
+        let line: Value = serde_json::from_str(log.trim()).expect("json");
+        assert_eq!(line["level"], "INFO");
+        assert_eq!(line["message"], "pod is isolated");
+        assert_eq!(line["pod"], "ns/pod");
+
+        let timestamp = line["timestamp"].as_str().unwrap();
+        assert!(
+            DateTime::parse_from_rfc3339(timestamp).is_ok(),
+            "{timestamp}"
+        );
+    }
+
+    #[test]
+    fn logger_should_emit_text_by_default() {
+        let log = capture_log(&Config::default());
+        assert!(serde_json::from_str::<Value>(log.trim()).is_err());
+        assert!(log.contains("pod is isolated"));
+    }
+}
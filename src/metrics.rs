@@ -0,0 +1,464 @@
+use std::fmt::Write;
+use std::sync::atomic::{AtomicI64, AtomicU64, Ordering};
+use std::time::Duration;
+
+use tracing::info;
+
+const PREFIX: &str = "pod_graceful_drain";
+
+pub static ADMISSION_OVERLOADED_TOTAL: Counter = Counter::new(
+    "admission_overloaded_total",
+    "Number of admissions allowed without delay due to the concurrency limit",
+);
+
+pub static POD_DELETION_FAILED_TOTAL: Counter = Counter::new(
+    "pod_deletion_failed_total",
+    "Number of drained pods that the controller failed to delete",
+);
+
+pub static ADMISSION_DELAYED_TOTAL: Counter = Counter::new(
+    "admission_delayed_total",
+    "Number of admissions delayed to drain the pods",
+);
+
+pub static ADMISSION_DELAY_TRUNCATED_TOTAL: Counter = Counter::new(
+    "admission_delay_truncated_total",
+    "Number of delayed admissions truncated by the webhook timeout",
+);
+
+pub static ADMISSION_INTERRUPTED_TOTAL: Counter = Counter::new(
+    "admission_interrupted_total",
+    "Number of delayed admissions interrupted before the delay, e.g. by the shutdown",
+);
+
+pub static PATCH_RETRIES_TOTAL: Counter = Counter::new(
+    "patch_retries_total",
+    "Number of retries to patch the pods due to conflicts or transient errors",
+);
+
+pub static POD_DELETED_TOTAL: Counter = Counter::new(
+    "pod_deleted_total",
+    "Number of drained pods that the controller deleted",
+);
+
+pub static ADMISSION_SHORT_CIRCUITED_TOTAL: Counter = Counter::new(
+    "admission_short_circuited_total",
+    "Number of admissions allowed without delay while the circuit breaker is open",
+);
+
+pub static CIRCUIT_BREAKER_TRIPPED_TOTAL: Counter = Counter::new(
+    "circuit_breaker_tripped_total",
+    "Number of times the circuit breaker tripped on the admission errors",
+);
+
+pub static ADMISSION_REENTRY_TOTAL: LabeledCounter<2> = LabeledCounter::new(
+    "admission_reentry_total",
+    "Number of admissions for the pods that are already draining, by the outcome",
+    "outcome",
+    [
+        ReentryOutcome::Intercept.as_str(),
+        ReentryOutcome::Allow.as_str(),
+    ],
+);
+
+/// The outcome of the admission for the pod that is already draining.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum ReentryOutcome {
+    /// Delayed or intercepted again, until the drain ends.
+    Intercept,
+    /// Allowed, since the drain has ended.
+    Allow,
+}
+
+impl ReentryOutcome {
+    pub const fn as_str(self) -> &'static str {
+        match self {
+            ReentryOutcome::Intercept => "intercept",
+            ReentryOutcome::Allow => "allow",
+        }
+    }
+}
+
+pub static DRAIN_DURATION_SECONDS: Histogram<9> = Histogram::new(
+    "drain_duration_seconds",
+    "How long the pods stayed isolated until the controller deleted them",
+    [5.0, 10.0, 20.0, 30.0, 60.0, 120.0, 300.0, 600.0, 1200.0],
+);
+
+pub static ADMISSION_BLOCK_SECONDS: Histogram<9> = Histogram::new(
+    "admission_block_seconds",
+    "How long the delayed admissions actually blocked, to tune the webhook timeout",
+    [1.0, 2.0, 5.0, 10.0, 15.0, 20.0, 25.0, 30.0, 60.0],
+);
+
+pub static DELAYED_TASKS_SCHEDULED_TOTAL: Counter = Counter::new(
+    "delayed_tasks_scheduled_total",
+    "Number of delayed admissions scheduled, including the retries of the same pod",
+);
+
+pub static DELAYED_TASKS_ACTIVE: Gauge = Gauge::new(
+    "delayed_tasks_active",
+    "Number of delayed admissions that are currently waiting",
+);
+
+pub static DELAYED_TASK_WAIT_SECONDS: Histogram<9> = Histogram::new(
+    "delayed_task_wait_seconds",
+    "How long the delayed admissions were scheduled to wait, to size the controller. \
+    Unlike admission_block_seconds, which is how long they actually blocked, \
+    it isn't shortened by the interruptions and the cancellations",
+    [1.0, 2.0, 5.0, 10.0, 15.0, 20.0, 25.0, 30.0, 60.0],
+);
+
+static METRICS: &[&(dyn Metric + Sync)] = &[
+    &ADMISSION_OVERLOADED_TOTAL,
+    &ADMISSION_DELAYED_TOTAL,
+    &ADMISSION_DELAY_TRUNCATED_TOTAL,
+    &ADMISSION_INTERRUPTED_TOTAL,
+    &ADMISSION_REENTRY_TOTAL,
+    &ADMISSION_SHORT_CIRCUITED_TOTAL,
+    &CIRCUIT_BREAKER_TRIPPED_TOTAL,
+    &PATCH_RETRIES_TOTAL,
+    &POD_DELETED_TOTAL,
+    &POD_DELETION_FAILED_TOTAL,
+    &DRAIN_DURATION_SECONDS,
+    &ADMISSION_BLOCK_SECONDS,
+    &DELAYED_TASKS_SCHEDULED_TOTAL,
+    &DELAYED_TASKS_ACTIVE,
+    &DELAYED_TASK_WAIT_SECONDS,
+];
+
+trait Metric {
+    fn render(&self, out: &mut String);
+}
+
+/// Render all metrics in the Prometheus text exposition format.
+pub fn render() -> String {
+    let mut out = String::new();
+    for metric in METRICS {
+        metric.render(&mut out);
+    }
+
+    out
+}
+
+/// Totals over the lifetime of the process.
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq)]
+pub struct DrainSummary {
+    pub delayed: u64,
+    pub truncated: u64,
+    pub interrupted: u64,
+    pub deleted: u64,
+    pub deletion_failed: u64,
+}
+
+impl DrainSummary {
+    pub fn collect() -> Self {
+        Self {
+            delayed: ADMISSION_DELAYED_TOTAL.get(),
+            truncated: ADMISSION_DELAY_TRUNCATED_TOTAL.get(),
+            interrupted: ADMISSION_INTERRUPTED_TOTAL.get(),
+            deleted: POD_DELETED_TOTAL.get(),
+            deletion_failed: POD_DELETION_FAILED_TOTAL.get(),
+        }
+    }
+}
+
+/// Log what happened during the lifetime, for a quick post-mortem without scraping the metrics.
+pub fn log_drain_summary() {
+    let summary = DrainSummary::collect();
+    info!(
+        delayed = summary.delayed,
+        truncated = summary.truncated,
+        interrupted = summary.interrupted,
+        deleted = summary.deleted,
+        deletion_failed = summary.deletion_failed,
+        "Drain summary"
+    );
+}
+
+fn write_header(out: &mut String, name: &str, help: &str, type_: &str) {
+    let _ = writeln!(out, "# HELP {PREFIX}_{name} {help}");
+    let _ = writeln!(out, "# TYPE {PREFIX}_{name} {type_}");
+}
+
+pub struct Counter {
+    name: &'static str,
+    help: &'static str,
+    value: AtomicU64,
+}
+
+impl Counter {
+    pub const fn new(name: &'static str, help: &'static str) -> Self {
+        Self {
+            name,
+            help,
+            value: AtomicU64::new(0),
+        }
+    }
+
+    pub fn inc(&self) {
+        self.value.fetch_add(1, Ordering::Relaxed);
+    }
+
+    pub fn get(&self) -> u64 {
+        self.value.load(Ordering::Relaxed)
+    }
+}
+
+impl Metric for Counter {
+    fn render(&self, out: &mut String) {
+        write_header(out, self.name, self.help, "counter");
+        let _ = writeln!(out, "{PREFIX}_{} {}", self.name, self.get());
+    }
+}
+
+pub struct Gauge {
+    name: &'static str,
+    help: &'static str,
+    value: AtomicI64,
+}
+
+impl Gauge {
+    pub const fn new(name: &'static str, help: &'static str) -> Self {
+        Self {
+            name,
+            help,
+            value: AtomicI64::new(0),
+        }
+    }
+
+    pub fn inc(&self) {
+        self.value.fetch_add(1, Ordering::Relaxed);
+    }
+
+    pub fn dec(&self) {
+        self.value.fetch_sub(1, Ordering::Relaxed);
+    }
+
+    pub fn get(&self) -> i64 {
+        self.value.load(Ordering::Relaxed)
+    }
+}
+
+impl Metric for Gauge {
+    fn render(&self, out: &mut String) {
+        write_header(out, self.name, self.help, "gauge");
+        let _ = writeln!(out, "{PREFIX}_{} {}", self.name, self.get());
+    }
+}
+
+/// A counter partitioned by the fixed values of a label.
+pub struct LabeledCounter<const N: usize> {
+    name: &'static str,
+    help: &'static str,
+    label: &'static str,
+    values: [&'static str; N],
+    counts: [AtomicU64; N],
+}
+
+impl<const N: usize> LabeledCounter<N> {
+    pub const fn new(
+        name: &'static str,
+        help: &'static str,
+        label: &'static str,
+        values: [&'static str; N],
+    ) -> Self {
+        #[allow(clippy::declare_interior_mutable_const)]
+        const ZERO: AtomicU64 = AtomicU64::new(0);
+        Self {
+            name,
+            help,
+            label,
+            values,
+            counts: [ZERO; N],
+        }
+    }
+
+    pub fn inc(&self, value: &str) {
+        let Some(count) = self.find(value) else {
+            debug_assert!(false, "unknown label value '{value}' of '{}'", self.name);
+            return;
+        };
+        count.fetch_add(1, Ordering::Relaxed);
+    }
+
+    pub fn get(&self, value: &str) -> u64 {
+        self.find(value)
+            .map(|count| count.load(Ordering::Relaxed))
+            .unwrap_or_default()
+    }
+
+    fn find(&self, value: &str) -> Option<&AtomicU64> {
+        let index = self.values.iter().position(|it| *it == value)?;
+        Some(&self.counts[index])
+    }
+}
+
+impl<const N: usize> Metric for LabeledCounter<N> {
+    fn render(&self, out: &mut String) {
+        write_header(out, self.name, self.help, "counter");
+        for (value, count) in self.values.iter().zip(&self.counts) {
+            let _ = writeln!(
+                out,
+                "{PREFIX}_{}{{{}=\"{value}\"}} {}",
+                self.name,
+                self.label,
+                count.load(Ordering::Relaxed)
+            );
+        }
+    }
+}
+
+pub struct Histogram<const N: usize> {
+    name: &'static str,
+    help: &'static str,
+    buckets: [f64; N],
+    /// cumulative counts of the observations less than or equal to the bucket.
+    bucket_counts: [AtomicU64; N],
+    count: AtomicU64,
+    sum_millis: AtomicU64,
+}
+
+impl<const N: usize> Histogram<N> {
+    pub const fn new(name: &'static str, help: &'static str, buckets: [f64; N]) -> Self {
+        #[allow(clippy::declare_interior_mutable_const)]
+        const ZERO: AtomicU64 = AtomicU64::new(0);
+        Self {
+            name,
+            help,
+            buckets,
+            bucket_counts: [ZERO; N],
+            count: ZERO,
+            sum_millis: ZERO,
+        }
+    }
+
+    pub fn observe(&self, duration: Duration) {
+        let seconds = duration.as_secs_f64();
+        for (bucket, bucket_count) in self.buckets.iter().zip(&self.bucket_counts) {
+            if seconds <= *bucket {
+                bucket_count.fetch_add(1, Ordering::Relaxed);
+            }
+        }
+        self.count.fetch_add(1, Ordering::Relaxed);
+        self.sum_millis
+            .fetch_add(duration.as_millis() as u64, Ordering::Relaxed);
+    }
+
+    pub fn get_count(&self) -> u64 {
+        self.count.load(Ordering::Relaxed)
+    }
+
+    pub fn get_sum(&self) -> Duration {
+        Duration::from_millis(self.sum_millis.load(Ordering::Relaxed))
+    }
+}
+
+impl<const N: usize> Metric for Histogram<N> {
+    fn render(&self, out: &mut String) {
+        write_header(out, self.name, self.help, "histogram");
+        for (bucket, bucket_count) in self.buckets.iter().zip(&self.bucket_counts) {
+            let _ = writeln!(
+                out,
+                "{PREFIX}_{}_bucket{{le=\"{bucket}\"}} {}",
+                self.name,
+                bucket_count.load(Ordering::Relaxed)
+            );
+        }
+        let count = self.get_count();
+        let sum = self.sum_millis.load(Ordering::Relaxed) as f64 / 1000.0;
+        let _ = writeln!(out, "{PREFIX}_{}_bucket{{le=\"+Inf\"}} {count}", self.name);
+        let _ = writeln!(out, "{PREFIX}_{}_sum {sum}", self.name);
+        let _ = writeln!(out, "{PREFIX}_{}_count {count}", self.name);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn counter_should_render() {
+        let counter = Counter::new("test_total", "Test counter");
+        counter.inc();
+        counter.inc();
+
+        let mut out = String::new();
+        counter.render(&mut out);
+        assert_eq!(
+            out,
+            "# HELP pod_graceful_drain_test_total Test counter\n\
+            # TYPE pod_graceful_drain_test_total counter\n\
+            pod_graceful_drain_test_total 2\n"
+        );
+    }
+
+    #[test]
+    fn gauge_should_render() {
+        let gauge = Gauge::new("test_active", "Test gauge");
+        gauge.inc();
+        gauge.inc();
+        gauge.dec();
+
+        let mut out = String::new();
+        gauge.render(&mut out);
+        assert_eq!(
+            out,
+            "# HELP pod_graceful_drain_test_active Test gauge\n\
+            # TYPE pod_graceful_drain_test_active gauge\n\
+            pod_graceful_drain_test_active 1\n"
+        );
+    }
+
+    #[test]
+    fn labeled_counter_should_render() {
+        let counter = LabeledCounter::new("test_total", "Test counter", "outcome", ["a", "b"]);
+        counter.inc("b");
+        counter.inc("b");
+
+        let mut out = String::new();
+        counter.render(&mut out);
+        assert_eq!(
+            out,
+            "# HELP pod_graceful_drain_test_total Test counter\n\
+            # TYPE pod_graceful_drain_test_total counter\n\
+            pod_graceful_drain_test_total{outcome=\"a\"} 0\n\
+            pod_graceful_drain_test_total{outcome=\"b\"} 2\n"
+        );
+    }
+
+    #[test]
+    fn histogram_should_render() {
+        let histogram = Histogram::new("test_seconds", "Test histogram", [10.0, 60.0]);
+        histogram.observe(Duration::from_secs(5));
+        histogram.observe(Duration::from_millis(30500));
+        histogram.observe(Duration::from_secs(100));
+
+        let mut out = String::new();
+        histogram.render(&mut out);
+        assert_eq!(
+            out,
+            "# HELP pod_graceful_drain_test_seconds Test histogram\n\
+            # TYPE pod_graceful_drain_test_seconds histogram\n\
+            pod_graceful_drain_test_seconds_bucket{le=\"10\"} 1\n\
+            pod_graceful_drain_test_seconds_bucket{le=\"60\"} 2\n\
+            pod_graceful_drain_test_seconds_bucket{le=\"+Inf\"} 3\n\
+            pod_graceful_drain_test_seconds_sum 135.5\n\
+            pod_graceful_drain_test_seconds_count 3\n"
+        );
+    }
+
+    #[test]
+    fn summary_should_reflect_counters() {
+        let before = DrainSummary::collect();
+        ADMISSION_DELAYED_TOTAL.inc();
+        ADMISSION_DELAYED_TOTAL.inc();
+        ADMISSION_DELAY_TRUNCATED_TOTAL.inc();
+        POD_DELETED_TOTAL.inc();
+
+        let after = DrainSummary::collect();
+        assert_eq!(after.delayed - before.delayed, 2);
+        assert_eq!(after.truncated - before.truncated, 1);
+        assert_eq!(after.deleted - before.deleted, 1);
+    }
+}
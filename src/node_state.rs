@@ -0,0 +1,389 @@
+use std::time::Duration;
+
+use chrono::{DateTime, Utc};
+use eyre::Result;
+use k8s_openapi::api::core::v1::{Node, Pod};
+use kube::{Api, ResourceExt};
+use tracing::{debug, warn};
+
+use crate::api_resolver::ApiResolver;
+use crate::consts::NODE_TERMINATE_AT_ANNOTATION_KEY;
+use crate::pod_state::get_node_name;
+use crate::status::is_transient_error;
+use crate::try_some;
+use crate::Config;
+
+/// Returns when the pod's node is expected to be terminated by a spot interruption.
+///
+/// Draining past that time is futile, since the node dies regardless.
+pub async fn get_spot_interruption_deadline(
+    config: &Config,
+    api_resolver: &ApiResolver,
+    pod: &Pod,
+) -> Result<Option<DateTime<Utc>>> {
+    if config.no_node_checks {
+        return Ok(None);
+    }
+
+    let Some(taint_key) = config.spot_interruption_taint.as_ref() else {
+        return Ok(None);
+    };
+
+    let Some(node_name) = get_node_name(pod) else {
+        debug!("pod is not scheduled to a node");
+        return Ok(None);
+    };
+
+    let node = match get_node(api_resolver, node_name).await {
+        Ok(Some(node)) => node,
+        Ok(None) => {
+            debug!(node_name, "node is not found");
+            return Ok(None);
+        }
+        Err(err) if config.tolerate_node_check_errors && is_transient_error(&err) => {
+            warn!(
+                ?err,
+                node_name, "failed to check the node, draining without the deadline"
+            );
+            return Ok(None);
+        }
+        Err(err) => return Err(err.into()),
+    };
+
+    Ok(get_node_terminate_at(taint_key, &node))
+}
+
+const NODE_GET_ATTEMPTS: u32 = 3;
+const NODE_GET_BACKOFF: Duration = Duration::from_millis(100);
+
+/// The admission is failed and denied by a single throttled request otherwise, e.g. in the middle of a node drain.
+async fn get_node(api_resolver: &ApiResolver, node_name: &str) -> kube::Result<Option<Node>> {
+    let api: Api<Node> = Api::all(api_resolver.client.clone());
+    let mut attempt = 1;
+    loop {
+        match api.get_opt(node_name).await {
+            Err(err) if is_transient_error(&err) && attempt < NODE_GET_ATTEMPTS => {
+                let backoff = NODE_GET_BACKOFF * 2u32.pow(attempt - 1);
+                debug!(?err, ?backoff, "retrying to get the node");
+                tokio::time::sleep(backoff).await;
+                attempt += 1;
+            }
+            result => return result,
+        }
+    }
+}
+
+/// The pre-isolated pods are removed only if their node is still draining at the end of the drain.
+pub async fn is_pod_node_draining(
+    config: &Config,
+    api_resolver: &ApiResolver,
+    pod: &Pod,
+) -> kube::Result<bool> {
+    let Some(node_name) = get_node_name(pod) else {
+        return Ok(false);
+    };
+
+    let Some(node) = get_node(api_resolver, node_name).await? else {
+        debug!(node_name, "node is not found");
+        return Ok(false);
+    };
+
+    Ok(is_node_draining(config, &node))
+}
+
+/// Cordoned, or has one of the `--draining-node-condition`s `True`.
+pub fn is_node_draining(config: &Config, node: &Node) -> bool {
+    is_node_cordoned(node) || has_draining_condition(config, node)
+}
+
+fn is_node_cordoned(node: &Node) -> bool {
+    try_some!(node.spec?.unschedulable?) == Some(&true)
+}
+
+fn has_draining_condition(config: &Config, node: &Node) -> bool {
+    try_some!(node.status?.conditions?)
+        .unwrap_or(&vec![])
+        .iter()
+        .any(|condition| {
+            condition.status == "True" && config.draining_node_conditions.contains(&condition.type_)
+        })
+}
+
+fn get_node_terminate_at(taint_key: &str, node: &Node) -> Option<DateTime<Utc>> {
+    let taints = try_some!(node.spec?.taints?)?;
+    if !taints.iter().any(|taint| taint.key == taint_key) {
+        return None;
+    }
+
+    let terminate_at = node.annotations().get(NODE_TERMINATE_AT_ANNOTATION_KEY)?;
+    let terminate_at = DateTime::parse_from_rfc3339(terminate_at).ok()?;
+    Some(terminate_at.with_timezone(&Utc))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    use crate::from_json;
+    use crate::test_utils::FakeApiServer;
+
+    const TAINT_KEY: &str = "aws.amazon.com/spot-instance-terminating";
+
+    #[test]
+    fn should_return_terminate_at_of_interrupted_node() {
+        let node: Node = from_json!({
+            "metadata": {
+                "name": "node",
+                "annotations": {
+                    "pod-graceful-drain/terminate-at": "2024-01-01T00:02:00Z"
+                }
+            },
+            "spec": {
+                "taints": [{
+                    "key": TAINT_KEY,
+                    "effect": "NoSchedule"
+                }]
+            }
+        });
+
+        let expected = DateTime::parse_from_rfc3339("2024-01-01T00:02:00Z").unwrap();
+        assert_eq!(
+            get_node_terminate_at(TAINT_KEY, &node),
+            Some(expected.into())
+        );
+    }
+
+    #[tokio::test]
+    async fn should_not_get_node_without_node_checks() {
+        let config = Config {
+            no_node_checks: true,
+            spot_interruption_taint: Some(String::from(TAINT_KEY)),
+            ..Config::default()
+        };
+        // Any request to this api server fails.
+        let api_resolver =
+            ApiResolver::try_new(kube::Config::new("http://127.0.0.1:9".parse().unwrap())).unwrap();
+        let pod: Pod = from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+            },
+            "spec": {
+                "nodeName": "node",
+            },
+        });
+
+        let deadline = get_spot_interruption_deadline(&config, &api_resolver, &pod).await;
+        assert_eq!(deadline.unwrap(), None);
+    }
+
+    /// A fake api server that answers the node with `statuses` in order, and repeats the last one.
+    async fn serve_node(statuses: Vec<axum::http::StatusCode>) -> FakeApiServer {
+        use std::sync::atomic::{AtomicUsize, Ordering};
+        use std::sync::Arc;
+
+        let index = Arc::new(AtomicUsize::new(0));
+        let app = axum::Router::new().route(
+            "/api/v1/nodes/:name",
+            axum::routing::get(move || {
+                let index = index.fetch_add(1, Ordering::SeqCst);
+                let status = statuses[index.min(statuses.len() - 1)];
+                async move {
+                    let body = if status.is_success() {
+                        serde_json::json!({
+                            "apiVersion": "v1",
+                            "kind": "Node",
+                            "metadata": {
+                                "name": "node",
+                                "annotations": {
+                                    "pod-graceful-drain/terminate-at": "2024-01-01T00:02:00Z"
+                                }
+                            },
+                            "spec": {
+                                "taints": [{ "key": TAINT_KEY, "effect": "NoSchedule" }]
+                            }
+                        })
+                    } else {
+                        serde_json::json!({
+                            "apiVersion": "v1",
+                            "kind": "Status",
+                            "status": "Failure",
+                            "message": status.to_string(),
+                            "reason": status.canonical_reason(),
+                            "code": status.as_u16(),
+                        })
+                    };
+                    (status, axum::Json(body))
+                }
+            }),
+        );
+
+        FakeApiServer::serve(app).await
+    }
+
+    fn scheduled_pod() -> Pod {
+        from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+            },
+            "spec": {
+                "nodeName": "node",
+            },
+        })
+    }
+
+    fn config_with_taint() -> Config {
+        Config {
+            spot_interruption_taint: Some(String::from(TAINT_KEY)),
+            ..Config::default()
+        }
+    }
+
+    #[tokio::test]
+    async fn throttled_node_check_should_be_retried() {
+        use axum::http::StatusCode;
+
+        let server = serve_node(vec![
+            StatusCode::TOO_MANY_REQUESTS,
+            StatusCode::TOO_MANY_REQUESTS,
+            StatusCode::OK,
+        ])
+        .await;
+        let api_resolver = &server.api_resolver;
+
+        let deadline =
+            get_spot_interruption_deadline(&config_with_taint(), api_resolver, &scheduled_pod())
+                .await;
+        let expected = DateTime::parse_from_rfc3339("2024-01-01T00:02:00Z").unwrap();
+        assert_eq!(deadline.unwrap(), Some(expected.into()));
+        assert_eq!(server.requests().len(), 3);
+    }
+
+    #[tokio::test]
+    async fn throttled_node_check_should_fail_unless_tolerated() {
+        use axum::http::StatusCode;
+
+        let server = serve_node(vec![StatusCode::TOO_MANY_REQUESTS]).await;
+        let api_resolver = &server.api_resolver;
+
+        let deadline =
+            get_spot_interruption_deadline(&config_with_taint(), api_resolver, &scheduled_pod())
+                .await;
+        assert!(deadline.is_err());
+        assert_eq!(server.requests().len(), NODE_GET_ATTEMPTS as usize);
+
+        let config = Config {
+            tolerate_node_check_errors: true,
+            ..config_with_taint()
+        };
+        let deadline =
+            get_spot_interruption_deadline(&config, api_resolver, &scheduled_pod()).await;
+        assert_eq!(deadline.unwrap(), None, "drained without the deadline");
+    }
+
+    #[tokio::test]
+    async fn missing_node_should_not_be_retried() {
+        use axum::http::StatusCode;
+
+        let server = serve_node(vec![StatusCode::NOT_FOUND]).await;
+        let api_resolver = &server.api_resolver;
+
+        let deadline =
+            get_spot_interruption_deadline(&config_with_taint(), api_resolver, &scheduled_pod())
+                .await;
+        assert_eq!(deadline.unwrap(), None);
+        assert_eq!(server.requests().len(), 1);
+    }
+
+    #[test]
+    fn should_ignore_node_without_taint() {
+        let node: Node = from_json!({
+            "metadata": {
+                "name": "node",
+                "annotations": {
+                    "pod-graceful-drain/terminate-at": "2024-01-01T00:02:00Z"
+                }
+            },
+        });
+
+        assert_eq!(get_node_terminate_at(TAINT_KEY, &node), None);
+    }
+
+    #[test]
+    fn should_ignore_node_without_terminate_at() {
+        let node: Node = from_json!({
+            "metadata": {
+                "name": "node",
+            },
+            "spec": {
+                "taints": [{
+                    "key": TAINT_KEY,
+                    "effect": "NoSchedule"
+                }]
+            }
+        });
+
+        assert_eq!(get_node_terminate_at(TAINT_KEY, &node), None);
+    }
+
+    #[test]
+    fn node_should_be_cordoned_when_unschedulable() {
+        let node: Node = from_json!({
+            "metadata": {
+                "name": "node",
+            },
+            "spec": {
+                "unschedulable": true,
+            },
+        });
+        assert!(is_node_cordoned(&node));
+
+        let node: Node = from_json!({
+            "metadata": {
+                "name": "node",
+            },
+            "spec": {},
+        });
+        assert!(!is_node_cordoned(&node));
+    }
+
+    #[test]
+    fn node_should_be_draining_by_the_draining_condition() {
+        let config = Config {
+            draining_node_conditions: vec![String::from("DrainInProgress")],
+            ..Config::default()
+        };
+        let node_with_condition = |status: &str| -> Node {
+            from_json!({
+                "metadata": {
+                    "name": "node",
+                },
+                "spec": {},
+                "status": {
+                    "conditions": [{
+                        "type": "DrainInProgress",
+                        "status": status,
+                    }],
+                },
+            })
+        };
+
+        assert!(is_node_draining(&config, &node_with_condition("True")));
+        assert!(!is_node_draining(&config, &node_with_condition("False")));
+        assert!(
+            !is_node_draining(&Config::default(), &node_with_condition("True")),
+            "not configured"
+        );
+
+        let cordoned: Node = from_json!({
+            "metadata": {
+                "name": "node",
+            },
+            "spec": {
+                "unschedulable": true,
+            },
+        });
+        assert!(is_node_draining(&config, &cordoned), "still by the cordon");
+    }
+}
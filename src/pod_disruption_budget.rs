@@ -0,0 +1,273 @@
+use std::collections::BTreeMap;
+
+use k8s_openapi::api::core::v1::Pod;
+use k8s_openapi::api::policy::v1::PodDisruptionBudget;
+use k8s_openapi::apimachinery::pkg::util::intstr::IntOrString;
+use kube::ResourceExt;
+
+use crate::pod_draining_info::{get_pod_draining_info, PodDrainingInfo};
+use crate::pod_state::is_pod_ready;
+use crate::reflector::Stores;
+use crate::utils::matches_label_selector;
+use crate::{try_some, Config};
+
+/// Returns true if isolating the pod would leave fewer healthy pods than its PodDisruptionBudgets require.
+///
+/// Isolated pods lose their labels, so the budgets stop counting them as soon as they're isolated.
+/// In that case, we'd better let the eviction go through so that the api server can enforce the budget.
+pub fn would_violate_pod_disruption_budget(config: &Config, stores: &Stores, pod: &Pod) -> bool {
+    let pdbs = stores.pod_disruption_budgets();
+    let pods = stores.pods();
+    would_violate_pod_disruption_budget_by_labels(
+        config,
+        &pdbs.iter().map(AsRef::as_ref).collect::<Vec<_>>(),
+        &pods.iter().map(AsRef::as_ref).collect::<Vec<_>>(),
+        pod,
+        pod.labels(),
+    )
+}
+
+/// The pod is judged by the given labels, as if it had them and were still counted by the budgets.
+/// e.g. the isolated pods by their original labels, since the api server no longer enforces the budgets on them.
+pub fn would_violate_pod_disruption_budget_by_labels(
+    config: &Config,
+    pdbs: &[&PodDisruptionBudget],
+    pods: &[&Pod],
+    pod: &Pod,
+    labels: &BTreeMap<String, String>,
+) -> bool {
+    let pod_namespace = pod.namespace();
+    let pdbs: Vec<_> = pdbs
+        .iter()
+        .filter(|pdb| pdb.namespace() == pod_namespace && is_selected_by(pdb, labels))
+        .collect();
+    if pdbs.is_empty() {
+        return false;
+    }
+
+    for pdb in pdbs {
+        let mut expected = 0;
+        let mut healthy = 0;
+        for other in pods.iter() {
+            if other.namespace() != pod_namespace
+                || other.name_any() == pod.name_any()
+                || !is_selected_by(pdb, other.labels())
+            {
+                continue;
+            }
+
+            // isolated pods are already out of the budget.
+            if !matches!(get_pod_draining_info(other), PodDrainingInfo::None) {
+                continue;
+            }
+
+            expected += 1;
+            if is_pod_ready(config, other) {
+                healthy += 1;
+            }
+        }
+
+        // The pod itself is counted by the given labels.
+        expected += 1;
+        if is_pod_ready(config, pod) {
+            healthy += 1;
+        }
+
+        let Some(desired_healthy) = get_desired_healthy(pdb, expected) else {
+            // We can't tell. Let the api server judge.
+            return true;
+        };
+
+        if healthy <= desired_healthy {
+            return true;
+        }
+    }
+
+    false
+}
+
+fn is_selected_by(pdb: &PodDisruptionBudget, labels: &BTreeMap<String, String>) -> bool {
+    // null selector selects nothing, while empty selector selects everything.
+    let Some(selector) = try_some!(pdb.spec?.selector?) else {
+        return false;
+    };
+
+    matches_label_selector(selector, labels)
+}
+
+fn get_desired_healthy(pdb: &PodDisruptionBudget, expected: i32) -> Option<i32> {
+    let spec = pdb.spec.as_ref()?;
+    if let Some(min_available) = spec.min_available.as_ref() {
+        return get_scaled_value(min_available, expected);
+    }
+
+    if let Some(max_unavailable) = spec.max_unavailable.as_ref() {
+        let max_unavailable = get_scaled_value(max_unavailable, expected)?;
+        return Some((expected - max_unavailable).max(0));
+    }
+
+    Some(0)
+}
+
+fn get_scaled_value(value: &IntOrString, total: i32) -> Option<i32> {
+    match value {
+        IntOrString::Int(value) => Some(*value),
+        IntOrString::String(value) => {
+            let percent: i32 = value.strip_suffix('%')?.parse().ok()?;
+            // round up, as the disruption controller does.
+            Some((percent * total + 99) / 100)
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    use crate::from_json;
+    use crate::test_utils::store_from;
+
+    fn ready_pod(name: &str) -> Pod {
+        from_json!({
+            "metadata": {
+                "name": name,
+                "namespace": "ns",
+                "labels": {
+                    "app": "test"
+                }
+            },
+            "status": {
+                "conditions": [
+                    {
+                        "status": "True",
+                        "type": "Ready"
+                    },
+                ],
+            }
+        })
+    }
+
+    fn stores_with(pods: Vec<Pod>, pdb: PodDisruptionBudget) -> Stores {
+        Stores::new(
+            store_from(pods),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+            store_from([pdb]),
+        )
+    }
+
+    #[test]
+    fn should_violate_when_min_available_is_not_met() {
+        let pod = ready_pod("pod1");
+        let stores = stores_with(
+            vec![pod.clone(), ready_pod("pod2")],
+            from_json!({
+                "metadata": {
+                    "name": "pdb",
+                    "namespace": "ns",
+                },
+                "spec": {
+                    "minAvailable": 2,
+                    "selector": {
+                        "matchLabels": {
+                            "app": "test"
+                        }
+                    }
+                }
+            }),
+        );
+
+        assert!(would_violate_pod_disruption_budget(
+            &Config::default(),
+            &stores,
+            &pod
+        ));
+    }
+
+    #[test]
+    fn should_not_violate_when_min_available_is_met() {
+        let pod = ready_pod("pod1");
+        let stores = stores_with(
+            vec![pod.clone(), ready_pod("pod2")],
+            from_json!({
+                "metadata": {
+                    "name": "pdb",
+                    "namespace": "ns",
+                },
+                "spec": {
+                    "minAvailable": 1,
+                    "selector": {
+                        "matchLabels": {
+                            "app": "test"
+                        }
+                    }
+                }
+            }),
+        );
+
+        assert!(!would_violate_pod_disruption_budget(
+            &Config::default(),
+            &stores,
+            &pod
+        ));
+    }
+
+    #[test]
+    fn should_violate_when_max_unavailable_percent_is_exceeded() {
+        let pod = ready_pod("pod1");
+        let stores = stores_with(
+            vec![pod.clone(), ready_pod("pod2"), ready_pod("pod3")],
+            from_json!({
+                "metadata": {
+                    "name": "pdb",
+                    "namespace": "ns",
+                },
+                "spec": {
+                    "maxUnavailable": "0%",
+                    "selector": {
+                        "matchExpressions": [{
+                            "key": "app",
+                            "operator": "In",
+                            "values": ["test"]
+                        }]
+                    }
+                }
+            }),
+        );
+
+        assert!(would_violate_pod_disruption_budget(
+            &Config::default(),
+            &stores,
+            &pod
+        ));
+    }
+
+    #[test]
+    fn should_not_violate_when_pdb_does_not_select() {
+        let pod = ready_pod("pod1");
+        let stores = stores_with(
+            vec![pod.clone()],
+            from_json!({
+                "metadata": {
+                    "name": "pdb",
+                    "namespace": "ns",
+                },
+                "spec": {
+                    "minAvailable": 1,
+                    "selector": {
+                        "matchLabels": {
+                            "app": "another"
+                        }
+                    }
+                }
+            }),
+        );
+
+        assert!(!would_violate_pod_disruption_budget(
+            &Config::default(),
+            &stores,
+            &pod
+        ));
+    }
+}
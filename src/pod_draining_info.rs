@@ -2,15 +2,24 @@ use chrono::{DateTime, Utc};
 use k8s_openapi::api::core::v1::Pod;
 use kube::ResourceExt;
 
-use crate::consts::{DRAINING_LABEL_KEY, DRAIN_UNTIL_ANNOTATION_KEY};
+use crate::consts::{
+    DRAINING_LABEL_DELETING_VALUE, DRAINING_LABEL_KEY, DRAIN_UNTIL_ANNOTATION_KEY,
+    ISOLATED_AT_ANNOTATION_KEY, PRE_ISOLATED_ANNOTATION_KEY, TAKEN_OVER_AT_ANNOTATION_KEY,
+};
 
 #[derive(Debug)]
 pub enum PodDrainingInfo {
     None,
     DrainUntil(DateTime<Utc>),
     Deleted,
+    /// The pod was marked to be deleted right away, but it might have been interrupted before the deletion.
+    Deleting,
     DrainDisabled,
-    AnnotationParseError { message: String },
+    /// The pod was isolated, but someone cleared the draining label to skip the drain.
+    LabelCleared,
+    AnnotationParseError {
+        message: String,
+    },
 }
 
 pub fn get_pod_draining_info(pod: &Pod) -> PodDrainingInfo {
@@ -18,12 +27,16 @@ pub fn get_pod_draining_info(pod: &Pod) -> PodDrainingInfo {
         return PodDrainingInfo::Deleted;
     }
 
-    if let Some(label) = pod.labels().get(DRAINING_LABEL_KEY) {
-        if !label.eq_ignore_ascii_case("true") || label == "0" || label.is_empty() {
+    let has_drain_until = pod.annotations().contains_key(DRAIN_UNTIL_ANNOTATION_KEY);
+    match pod.labels().get(DRAINING_LABEL_KEY) {
+        None if has_drain_until => return PodDrainingInfo::LabelCleared,
+        None => return PodDrainingInfo::None,
+        Some(label) if label.is_empty() && has_drain_until => return PodDrainingInfo::LabelCleared,
+        Some(label) if label == DRAINING_LABEL_DELETING_VALUE => return PodDrainingInfo::Deleting,
+        Some(label) if !label.eq_ignore_ascii_case("true") || label == "0" || label.is_empty() => {
             return PodDrainingInfo::DrainDisabled;
         }
-    } else {
-        return PodDrainingInfo::None;
+        Some(_) => {}
     }
 
     let Some(str) = pod.annotations().get(DRAIN_UNTIL_ANNOTATION_KEY) else {
@@ -46,16 +59,30 @@ pub fn get_pod_draining_info(pod: &Pod) -> PodDrainingInfo {
     }
 }
 
+/// Isolated ahead of the node drain, by `--pre-isolate-on-cordon`.
+pub fn is_pod_pre_isolated(pod: &Pod) -> bool {
+    pod.annotations().contains_key(PRE_ISOLATED_ANNOTATION_KEY)
+}
+
+/// Pods isolated by older versions don't have it.
+pub fn get_pod_isolated_at(pod: &Pod) -> Option<DateTime<Utc>> {
+    let str = pod.annotations().get(ISOLATED_AT_ANNOTATION_KEY)?;
+    let datetime = DateTime::parse_from_rfc3339(str).ok()?;
+    Some(datetime.with_timezone(&Utc))
+}
+
+/// When another instance has taken over the deletion from the one that isolated the pod.
+pub fn get_pod_taken_over_at(pod: &Pod) -> Option<DateTime<Utc>> {
+    let str = pod.annotations().get(TAKEN_OVER_AT_ANNOTATION_KEY)?;
+    let datetime = DateTime::parse_from_rfc3339(str).ok()?;
+    Some(datetime.with_timezone(&Utc))
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
     use crate::assert_matches;
-
-    macro_rules! from_json {
-        ($($json:tt)+) => {
-            ::serde_json::from_value(::serde_json::json!($($json)+)).expect("Invalid json")
-        };
-    }
+    use crate::from_json;
 
     #[test]
     fn should_return_some_drain_until() {
@@ -155,4 +182,73 @@ mod tests {
         let info = get_pod_draining_info(&pod);
         assert_matches!(info, PodDrainingInfo::Deleted);
     }
+
+    #[test]
+    fn should_return_some_deleted_when_terminating_without_drain_until() {
+        let pod: Pod = from_json! ({
+            "metadata": {
+                "deletionTimestamp": "2023-02-09T15:30:45Z",
+                "labels": {
+                    "pod-graceful-drain/draining": "true",
+                },
+            }
+        });
+
+        let info = get_pod_draining_info(&pod);
+        assert_matches!(info, PodDrainingInfo::Deleted);
+    }
+
+    #[test]
+    fn deleting_pod_should_be_distinguished_from_disabled_one() {
+        let pod_labeled = |label: &str| -> Pod {
+            from_json! ({
+                "metadata": {
+                    "labels": {
+                        "pod-graceful-drain/draining": label,
+                    },
+                    "annotations": {
+                        "pod-graceful-drain/drain-until": "2023-02-09T15:30:45Z",
+                    },
+                }
+            })
+        };
+
+        let info = get_pod_draining_info(&pod_labeled("deleting"));
+        assert_matches!(info, PodDrainingInfo::Deleting);
+
+        let info = get_pod_draining_info(&pod_labeled("false"));
+        assert_matches!(info, PodDrainingInfo::DrainDisabled);
+    }
+
+    #[test]
+    fn should_return_label_cleared_when_label_is_removed() {
+        let pod: Pod = from_json! ({
+            "metadata": {
+                "labels": {},
+                "annotations": {
+                    "pod-graceful-drain/drain-until": "2023-02-09T15:30:45Z",
+                },
+            }
+        });
+
+        let info = get_pod_draining_info(&pod);
+        assert_matches!(info, PodDrainingInfo::LabelCleared);
+    }
+
+    #[test]
+    fn should_return_label_cleared_when_label_is_emptied() {
+        let pod: Pod = from_json! ({
+            "metadata": {
+                "labels": {
+                    "pod-graceful-drain/draining": "",
+                },
+                "annotations": {
+                    "pod-graceful-drain/drain-until": "2023-02-09T15:30:45Z",
+                },
+            }
+        });
+
+        let info = get_pod_draining_info(&pod);
+        assert_matches!(info, PodDrainingInfo::LabelCleared);
+    }
 }
@@ -0,0 +1,131 @@
+use std::collections::BTreeMap;
+use std::fmt::{Display, Formatter};
+use std::str::FromStr;
+
+use eyre::{eyre, Result};
+use serde::{Serialize, Serializer};
+
+/// Equality-based label selector. e.g. `team=payments,tier!=batch,canary,!legacy`
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct PodSelector {
+    raw: String,
+    requirements: Vec<Requirement>,
+}
+
+#[derive(Clone, Debug, PartialEq, Eq)]
+enum Requirement {
+    Equals(String, String),
+    NotEquals(String, String),
+    Exists(String),
+    DoesNotExist(String),
+}
+
+impl PodSelector {
+    pub fn matches(&self, labels: &BTreeMap<String, String>) -> bool {
+        self.requirements
+            .iter()
+            .all(|requirement| requirement.matches(labels))
+    }
+}
+
+impl Requirement {
+    fn matches(&self, labels: &BTreeMap<String, String>) -> bool {
+        match self {
+            Requirement::Equals(key, value) => labels.get(key) == Some(value),
+            Requirement::NotEquals(key, value) => labels.get(key) != Some(value),
+            Requirement::Exists(key) => labels.contains_key(key),
+            Requirement::DoesNotExist(key) => !labels.contains_key(key),
+        }
+    }
+}
+
+impl FromStr for PodSelector {
+    type Err = eyre::Report;
+
+    fn from_str(input: &str) -> Result<Self> {
+        let mut requirements = Vec::new();
+        for term in input.split(',').map(str::trim) {
+            if term.is_empty() {
+                return Err(eyre!("empty term in the selector '{input}'"));
+            }
+
+            let requirement = if let Some((key, value)) = term.split_once("!=") {
+                Requirement::NotEquals(parse_key(key)?, String::from(value.trim()))
+            } else if let Some((key, value)) = term.split_once("==") {
+                Requirement::Equals(parse_key(key)?, String::from(value.trim()))
+            } else if let Some((key, value)) = term.split_once('=') {
+                Requirement::Equals(parse_key(key)?, String::from(value.trim()))
+            } else if let Some(key) = term.strip_prefix('!') {
+                Requirement::DoesNotExist(parse_key(key)?)
+            } else {
+                Requirement::Exists(parse_key(term)?)
+            };
+            requirements.push(requirement);
+        }
+
+        Ok(Self {
+            raw: String::from(input),
+            requirements,
+        })
+    }
+}
+
+fn parse_key(key: &str) -> Result<String> {
+    let key = key.trim();
+    if key.is_empty() {
+        return Err(eyre!("empty label key"));
+    }
+
+    Ok(String::from(key))
+}
+
+impl Display for PodSelector {
+    fn fmt(&self, f: &mut Formatter<'_>) -> std::fmt::Result {
+        f.write_str(&self.raw)
+    }
+}
+
+impl Serialize for PodSelector {
+    fn serialize<S: Serializer>(&self, serializer: S) -> Result<S::Ok, S::Error> {
+        serializer.collect_str(self)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn labels(pairs: &[(&str, &str)]) -> BTreeMap<String, String> {
+        pairs
+            .iter()
+            .map(|(key, value)| (String::from(*key), String::from(*value)))
+            .collect()
+    }
+
+    #[test]
+    fn selector_should_match_labels() {
+        let selector: PodSelector = "team=payments, tier!=batch, canary, !legacy"
+            .parse()
+            .unwrap();
+
+        assert!(selector.matches(&labels(&[("team", "payments"), ("canary", "")])));
+        assert!(!selector.matches(&labels(&[("team", "search"), ("canary", "")])));
+        assert!(!selector.matches(&labels(&[
+            ("team", "payments"),
+            ("tier", "batch"),
+            ("canary", "")
+        ])));
+        assert!(!selector.matches(&labels(&[("team", "payments")])));
+        assert!(!selector.matches(&labels(&[
+            ("team", "payments"),
+            ("canary", ""),
+            ("legacy", "true")
+        ])));
+    }
+
+    #[test]
+    fn selector_should_reject_empty_terms() {
+        assert!("team=payments,".parse::<PodSelector>().is_err());
+        assert!("=payments".parse::<PodSelector>().is_err());
+    }
+}
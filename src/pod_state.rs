@@ -1,20 +1,46 @@
+use std::sync::Arc;
+use std::time::Duration;
+
+use chrono::{DateTime, Utc};
 use genawaiter::{rc::gen, yield_};
-use k8s_openapi::api::core::v1::{Pod, Service};
+use k8s_openapi::api::core::v1::{Pod, Service, ServicePort};
+use k8s_openapi::apimachinery::pkg::apis::meta::v1::OwnerReference;
+use k8s_openapi::apimachinery::pkg::util::intstr::IntOrString;
 use kube::runtime::reflector::ObjectRef;
 use kube::{Resource, ResourceExt};
-use std::collections::{HashMap, HashSet};
+use std::collections::{BTreeMap, BTreeSet, HashMap, HashSet};
+use tracing::debug;
 
-use crate::elbv2::apis::TargetType;
-use crate::elbv2::TARGET_HEALTH_POD_CONDITION_TYPE_PREFIX;
+use crate::config::{parse_delete_after, DrainPredicate};
+use crate::consts::{
+    DELETE_AFTER_ANNOTATION_KEY, GATEWAY_LOAD_BALANCER_ANNOTATION_KEY,
+    ORIGINAL_LABELS_ANNOTATION_KEY, ORIGINAL_OWNER_REFERENCES_ANNOTATION_KEY,
+    SERVICE_ENABLED_ANNOTATION_KEY,
+};
+use crate::elbv2::apis::{TargetGroupBinding, TargetType};
+use crate::elbv2::{
+    DEREGISTRATION_DELAY_ATTRIBUTE_KEY, LOAD_BALANCER_TYPE_ANNOTATION_KEY,
+    NLB_TARGET_TYPE_ANNOTATION_KEY, TARGET_DEREGISTRATION_IN_PROGRESS_REASON,
+    TARGET_GROUP_ATTRIBUTES_ANNOTATION_KEY, TARGET_HEALTH_POD_CONDITION_TYPE_PREFIX,
+};
+use crate::pod_draining_info::get_pod_isolated_at;
 use crate::reflector::Stores;
 use crate::utils::get_object_ref_from_name;
 use crate::{try_some, Config};
 
-pub fn is_pod_ready(pod: &Pod) -> bool {
+pub fn is_pod_ready(config: &Config, pod: &Pod) -> bool {
+    // The conditions of the completed pods might be stale.
+    if is_pod_completed(pod) {
+        return false;
+    }
+
     let readiness_gates = {
         let mut result = HashSet::new();
         // "Ready" is required even if not listed in readiness gate
         result.insert("Ready");
+        for condition_type in &config.required_ready_conditions {
+            result.insert(condition_type.as_str());
+        }
 
         if let Some(readiness_gates) = try_some!(pod.spec?.readiness_gates?) {
             for readiness_gate in readiness_gates {
@@ -45,16 +71,407 @@ pub fn is_pod_ready(pod: &Pod) -> bool {
     true
 }
 
+/// The pods that have run to completion, e.g. with `restartPolicy: Never`, aren't serving anymore.
+pub fn is_pod_completed(pod: &Pod) -> bool {
+    matches!(
+        try_some!(pod.status?.phase?).map(String::as_str),
+        Some("Succeeded" | "Failed")
+    )
+}
+
+/// The node the pod is scheduled to. The api server might give an empty name to the unscheduled pods.
+pub fn get_node_name(pod: &Pod) -> Option<&str> {
+    try_some!(pod.spec?.node_name?)
+        .map(String::as_str)
+        .filter(|node_name| !node_name.is_empty())
+}
+
+/// Some service meshes flip the readiness gate to pre-drain connections before deleting the pod.
+/// The target might still be deregistering even if the pod is not ready.
+pub fn is_pod_possibly_deregistering(config: &Config, pod: &Pod) -> bool {
+    config.delay_not_ready_with_target_gate && has_target_health_readiness_gate(pod)
+}
+
+/// Returns true if the pod became ready less than `config.min_ready_age` ago.
+pub fn is_pod_recently_ready(config: &Config, pod: &Pod, now: DateTime<Utc>) -> bool {
+    if config.min_ready_age.is_zero() {
+        return false;
+    }
+
+    let Some(conditions) = try_some!(pod.status?.conditions?) else {
+        return false;
+    };
+
+    let ready_since = conditions
+        .iter()
+        .find(|condition| condition.type_ == "Ready" && condition.status == "True")
+        .and_then(|condition| condition.last_transition_time.as_ref());
+    let Some(ready_since) = ready_since else {
+        return false;
+    };
+
+    match (now - ready_since.0).to_std() {
+        Ok(ready_age) => ready_age < config.min_ready_age,
+        // clock skew
+        Err(_) => true,
+    }
+}
+
+/// Pods outside of `--watch-namespaces` and `--pod-selector` are left alone.
+///
+/// The scope is checked when the pods are admitted or pre-isolated. The reflectors and the controller still
+/// watch every namespace, so the pods isolated before the scope was narrowed are drained to the end.
+pub fn is_pod_in_scope(config: &Config, pod: &Pod) -> bool {
+    if !config.watch_namespaces.is_empty() {
+        let in_namespace = pod
+            .namespace()
+            .is_some_and(|namespace| config.watch_namespaces.contains(&namespace));
+        if !in_namespace {
+            return false;
+        }
+    }
+
+    match &config.pod_selector {
+        Some(selector) => selector.matches(pod.labels()),
+        None => true,
+    }
+}
+
+/// Pods are drained only within `--active-hours`.
+pub fn is_within_active_hours(config: &Config, now: DateTime<Utc>) -> bool {
+    match &config.active_hours {
+        Some(active_hours) => {
+            active_hours.contains(now.with_timezone(&config.active_hours_utc_offset).time())
+        }
+        None => true,
+    }
+}
+
+/// Returns true if the pod should be drained before it is deleted, according to `config.drain_predicate`.
+pub fn should_drain_pod(config: &Config, stores: &Stores, pod: &Pod) -> bool {
+    match config.drain_predicate {
+        DrainPredicate::Exposed => is_pod_exposed(config, stores, pod),
+        DrainPredicate::Annotation => is_pod_annotated_to_drain(config, pod),
+    }
+}
+
+fn is_pod_annotated_to_drain(config: &Config, pod: &Pod) -> bool {
+    let Some(key) = config.drain_annotation.as_ref() else {
+        return false;
+    };
+
+    matches!(pod.annotations().get(key), Some(value) if value.eq_ignore_ascii_case("true"))
+}
+
 pub fn is_pod_exposed(config: &Config, stores: &Stores, pod: &Pod) -> bool {
     // TODO: Find better way to determine whether a pod is exposed.
     // e.g. Examine EndpointSlice, etc.
-    if config.experimental_general_ingress {
+    let exposed = if config.experimental_general_ingress {
         is_exposed_by_ingress(stores, pod)
     } else {
-        is_exposed_by_target_group_binding(stores, pod)
+        is_exposed_by_target_group_binding(config, stores, pod)
+            && (!config.verify_target_membership || is_registered_target(pod))
+    };
+
+    exposed
+        || (config.local_traffic_policy_delete_after.is_some()
+            && is_exposed_by_local_traffic_policy_service(stores, pod))
+}
+
+/// How long the pod should be drained before it is deleted.
+pub fn get_delete_after(config: &Config, stores: &Stores, pod: &Pod) -> Duration {
+    let mut delete_after = config.delete_after;
+    if let Some(annotated_delete_after) = get_annotated_delete_after(stores, pod) {
+        delete_after = annotated_delete_after;
+    } else if let Some(max_deregistration_delay) = config.max_deregistration_delay {
+        let deregistration_delays = get_deregistration_delays(stores, pod);
+        if let Some(deregistration_delay) = deregistration_delays.values().max() {
+            delete_after = (*deregistration_delay).min(max_deregistration_delay);
+            debug!(
+                ?delete_after,
+                ?deregistration_delays,
+                "drain for the longest deregistration delay of the load balancers"
+            );
+        }
+    }
+
+    delete_after = match config.orphan_target_gate_delay {
+        Some(orphan_delay) if is_exposed_only_by_orphan_target_gate(config, stores, pod) => {
+            debug!(
+                ?orphan_delay,
+                "drain shortly since the TargetGroupBindings are gone"
+            );
+            delete_after.min(orphan_delay)
+        }
+        _ => delete_after,
+    };
+
+    delete_after = match config.local_traffic_policy_delete_after {
+        Some(local_delete_after) if is_exposed_by_local_traffic_policy_service(stores, pod) => {
+            delete_after.max(local_delete_after)
+        }
+        _ => delete_after,
+    };
+
+    delete_after = match config.gateway_load_balancer_delete_after {
+        Some(gwlb_delete_after) if is_exposed_by_gateway_load_balancer(config, stores, pod) => {
+            delete_after.max(gwlb_delete_after)
+        }
+        _ => delete_after,
+    };
+
+    delete_after = match config.stateful_set_delete_after {
+        Some(stateful_set_delete_after) if is_owned_by_stateful_set(pod) => {
+            delete_after.min(stateful_set_delete_after)
+        }
+        _ => delete_after,
+    };
+
+    if config.respect_termination_grace {
+        if let Some(grace_period) = get_pre_stop_grace_period(pod) {
+            let adjusted = delete_after.saturating_sub(grace_period);
+            debug!(
+                ?delete_after,
+                ?grace_period,
+                ?adjusted,
+                "drain less by the termination grace period of the preStop hook"
+            );
+            delete_after = adjusted;
+        }
+    }
+
+    delete_after
+}
+
+/// The grace period that the pod would keep serving during its preStop hook after the deletion.
+fn get_pre_stop_grace_period(pod: &Pod) -> Option<Duration> {
+    let spec = pod.spec.as_ref()?;
+    let has_pre_stop_hook = spec
+        .containers
+        .iter()
+        .any(|container| try_some!(container.lifecycle?.pre_stop?).is_some());
+    if !has_pre_stop_hook {
+        return None;
+    }
+
+    // The api server defaults it to 30 seconds.
+    let grace_period_seconds = spec.termination_grace_period_seconds.unwrap_or(30);
+    Some(Duration::from_secs(grace_period_seconds.max(0) as u64))
+}
+
+/// Identifies the rollout revision that the pod belongs to.
+#[derive(Debug, Default, PartialEq, Eq)]
+pub struct RolloutRevision {
+    pub replica_set: Option<String>,
+    pub pod_template_hash: Option<String>,
+}
+
+/// The isolation wipes the labels and may cut the owner references, so they are read from the backups if any.
+pub fn get_rollout_revision(pod: &Pod) -> RolloutRevision {
+    let annotations = pod.annotations();
+    let owner_references = annotations
+        .get(ORIGINAL_OWNER_REFERENCES_ANNOTATION_KEY)
+        .and_then(|json| serde_json::from_str::<Vec<OwnerReference>>(json).ok())
+        .unwrap_or_else(|| pod.owner_references().to_vec());
+    let labels = get_original_labels(pod);
+
+    RolloutRevision {
+        replica_set: owner_references
+            .into_iter()
+            .find(|owner| owner.controller == Some(true) && owner.kind == "ReplicaSet")
+            .map(|owner| owner.name),
+        pod_template_hash: labels.get("pod-template-hash").cloned(),
+    }
+}
+
+/// The labels of the pod before the isolation wiped them.
+pub fn get_original_labels(pod: &Pod) -> BTreeMap<String, String> {
+    pod.annotations()
+        .get(ORIGINAL_LABELS_ANNOTATION_KEY)
+        .and_then(|json| serde_json::from_str(json).ok())
+        .unwrap_or_else(|| pod.labels().clone())
+}
+
+/// StatefulSet pods have stable names, so they are recreated only after they are deleted.
+pub fn is_owned_by_stateful_set(pod: &Pod) -> bool {
+    pod.owner_references()
+        .iter()
+        .any(|owner| owner.controller == Some(true) && owner.kind == "StatefulSet")
+}
+
+/// Pods controlled by one of `--ignore-owner-kinds` are deleted without the drain.
+pub fn is_owned_by_ignored_kind(config: &Config, pod: &Pod) -> bool {
+    pod.owner_references().iter().any(|owner| {
+        owner.controller == Some(true) && config.ignore_owner_kinds.contains(&owner.kind)
+    })
+}
+
+/// Pods whose containers all match `--exclude-container-images` or `--exclude-container-names` are deleted without the drain.
+/// A serving container next to the excluded sidecars, e.g. a monitoring agent, still needs the drain.
+pub fn has_only_excluded_containers(config: &Config, pod: &Pod) -> bool {
+    if config.exclude_container_images.is_empty() && config.exclude_container_names.is_empty() {
+        return false;
+    }
+
+    let Some(containers) = try_some!(&pod.spec?.containers) else {
+        return false;
+    };
+
+    !containers.is_empty()
+        && containers.iter().all(|container| {
+            config.exclude_container_names.contains(&container.name)
+                || container.image.as_ref().is_some_and(|image| {
+                    config
+                        .exclude_container_images
+                        .iter()
+                        .any(|excluded| image.contains(excluded.as_str()))
+                })
+        })
+}
+
+/// The names of the services that select the pod.
+pub fn get_selecting_service_names(stores: &Stores, pod: &Pod) -> BTreeSet<String> {
+    let pod_namespace = pod.metadata.namespace.as_ref();
+    stores
+        .services()
+        .iter()
+        .filter(|service| {
+            service.meta().namespace.as_ref() == pod_namespace
+                && is_selected_by_service(service, pod)
+        })
+        .map(|service| service.name_any())
+        .collect()
+}
+
+/// The `pod-graceful-drain/delete-after` annotation of the pod, or else the longest one of the services
+/// that select it, takes precedence over `--delete-after` and the deregistration delays.
+/// The other adjustments still apply to it.
+fn get_annotated_delete_after(stores: &Stores, pod: &Pod) -> Option<Duration> {
+    if let Some(delete_after) = parse_delete_after_annotation(pod.annotations()) {
+        debug!(
+            ?delete_after,
+            "drain for the delete-after annotation of the pod"
+        );
+        return Some(delete_after);
+    }
+
+    let pod_namespace = pod.metadata.namespace.as_ref();
+    let service_delete_afters: BTreeMap<_, _> = stores
+        .services()
+        .iter()
+        .filter(|service| {
+            service.meta().namespace.as_ref() == pod_namespace
+                && is_selected_by_service(service, pod)
+        })
+        .filter_map(|service| {
+            let delete_after = parse_delete_after_annotation(service.annotations())?;
+            Some((service.name_any(), delete_after))
+        })
+        .collect();
+    let delete_after = *service_delete_afters.values().max()?;
+    debug!(
+        ?delete_after,
+        ?service_delete_afters,
+        "drain for the longest delete-after annotation of the services"
+    );
+    Some(delete_after)
+}
+
+fn parse_delete_after_annotation(annotations: &BTreeMap<String, String>) -> Option<Duration> {
+    let value = annotations.get(DELETE_AFTER_ANNOTATION_KEY)?;
+    match parse_delete_after(value) {
+        Ok(delete_after) => Some(delete_after),
+        Err(err) => {
+            debug!(?err, value, "ignoring invalid delete-after annotation");
+            None
+        }
     }
 }
 
+/// The deregistration delays of the target groups of the services that select the pod, by the service names.
+/// A pod can be behind multiple load balancers, and it should be drained for the longest one.
+fn get_deregistration_delays(stores: &Stores, pod: &Pod) -> BTreeMap<String, Duration> {
+    let pod_namespace = pod.metadata.namespace.as_ref();
+    stores
+        .services()
+        .iter()
+        .filter(|service| {
+            service.meta().namespace.as_ref() == pod_namespace
+                && is_selected_by_service(service, pod)
+        })
+        .filter_map(|service| {
+            let attributes = service
+                .annotations()
+                .get(TARGET_GROUP_ATTRIBUTES_ANNOTATION_KEY)?;
+            let deregistration_delay = parse_deregistration_delay(attributes)?;
+            Some((service.name_any(), deregistration_delay))
+        })
+        .collect()
+}
+
+/// e.g. `deregistration_delay.timeout_seconds=30,stickiness.enabled=true`
+fn parse_deregistration_delay(attributes: &str) -> Option<Duration> {
+    attributes.split(',').find_map(|attribute| {
+        let (key, value) = attribute.split_once('=')?;
+        if key.trim() != DEREGISTRATION_DELAY_ATTRIBUTE_KEY {
+            return None;
+        }
+
+        let seconds: u64 = value.trim().parse().ok()?;
+        Some(Duration::from_secs(seconds))
+    })
+}
+
+/// Services with `externalTrafficPolicy: Local` route only to node-local endpoints.
+/// The load balancer keeps sending traffic to the node until its health check marks the node unhealthy.
+fn is_exposed_by_local_traffic_policy_service(stores: &Stores, pod: &Pod) -> bool {
+    let pod_namespace = pod.metadata.namespace.as_ref();
+    stores.services().iter().any(|service| {
+        service.meta().namespace.as_ref() == pod_namespace
+            && try_some!(service.spec?.external_traffic_policy?).map(String::as_str)
+                == Some("Local")
+            && is_selected_by_service(service, pod)
+    })
+}
+
+/// Services of `type: LoadBalancer` that register the pods to their NLBs as the IP targets.
+fn is_exposed_by_ip_target_load_balancer_service(
+    config: &Config,
+    stores: &Stores,
+    pod: &Pod,
+) -> bool {
+    is_exposed_by_selecting_service(config, stores, pod, |service| {
+        let annotations = service.annotations();
+        let is_ip_target = matches!(
+            annotations.get(NLB_TARGET_TYPE_ANNOTATION_KEY),
+            Some(value) if value.eq_ignore_ascii_case("ip")
+        ) || matches!(
+            annotations.get(LOAD_BALANCER_TYPE_ANNOTATION_KEY),
+            Some(value) if value.eq_ignore_ascii_case("nlb-ip")
+        );
+
+        try_some!(service.spec?.type_?).map(String::as_str) == Some("LoadBalancer") && is_ip_target
+    })
+}
+
+/// The fallbacks can't tell which TargetGroupBinding the pod is registered by, so they judge it by the services
+/// that select it, with the same opt-in and port checks as the TargetGroupBindings.
+fn is_exposed_by_selecting_service(
+    config: &Config,
+    stores: &Stores,
+    pod: &Pod,
+    filter: impl Fn(&Service) -> bool,
+) -> bool {
+    let pod_namespace = pod.metadata.namespace.as_ref();
+    stores.services().iter().any(|service| {
+        service.meta().namespace.as_ref() == pod_namespace
+            && filter(service)
+            && is_selected_by_service(service, pod)
+            && is_exposing_any_service_port(service, pod)
+            && (!config.require_service_optin || has_service_optin_annotation(service))
+    })
+}
+
 fn is_exposed_by_ingress(stores: &Stores, pod: &Pod) -> bool {
     // TODO: Build inverted index in reconciler incrementally?
     let ingress_exposed_services = gen!({
@@ -100,42 +517,162 @@ fn is_exposed_by_ingress(stores: &Stores, pod: &Pod) -> bool {
         .any(|service_ref| is_exposing_service(stores, pod, service_ref))
 }
 
-fn is_exposed_by_target_group_binding(stores: &Stores, pod: &Pod) -> bool {
+fn is_exposed_by_target_group_binding(config: &Config, stores: &Stores, pod: &Pod) -> bool {
+    if !get_exposing_target_group_bindings(config, stores, pod).is_empty() {
+        return true;
+    }
+
+    // The TargetGroupBindings of the NLBs might not be visible, e.g. to the narrowed RBAC.
+    if is_exposed_by_ip_target_load_balancer_service(config, stores, pod) {
+        return true;
+    }
+
+    // The pod once had corresponding TargetGroupBinding, but it is somehow gone.
+    // We don't know whether its TargetType was IP or not.
+    // But, true is more conservative than false, as long as one of its services could have registered it.
+    has_target_health_readiness_gate(pod)
+        && is_exposed_by_selecting_service(config, stores, pod, |_| true)
+}
+
+/// The pod has the readiness gate of the target health, but none of its TargetGroupBindings is found.
+fn is_exposed_only_by_orphan_target_gate(config: &Config, stores: &Stores, pod: &Pod) -> bool {
+    !config.experimental_general_ingress
+        && has_target_health_readiness_gate(pod)
+        && get_exposing_target_group_bindings(config, stores, pod).is_empty()
+        && !is_exposed_by_ip_target_load_balancer_service(config, stores, pod)
+        && is_exposed_by_selecting_service(config, stores, pod, |_| true)
+}
+
+/// Gateway Load Balancers forward the flows to the appliances, which drop them if they are deregistered too fast.
+/// Their target groups can't be told apart from the TargetGroupBindings, so they are annotated.
+fn is_exposed_by_gateway_load_balancer(config: &Config, stores: &Stores, pod: &Pod) -> bool {
+    get_exposing_target_group_bindings(config, stores, pod)
+        .iter()
+        .any(|tgb| {
+            matches!(
+                tgb.annotations().get(GATEWAY_LOAD_BALANCER_ANNOTATION_KEY),
+                Some(value) if value.eq_ignore_ascii_case("true")
+            )
+        })
+}
+
+/// The target groups that the pod is registered to, which the drain is waiting for.
+pub fn get_exposing_target_group_arns(config: &Config, stores: &Stores, pod: &Pod) -> Vec<String> {
+    let target_group_arns: BTreeSet<_> = get_exposing_target_group_bindings(config, stores, pod)
+        .iter()
+        .filter_map(|tgb| try_some!(&tgb.spec?.target_group_arn).cloned())
+        .collect();
+    target_group_arns.into_iter().collect()
+}
+
+pub fn get_exposing_target_group_bindings(
+    config: &Config,
+    stores: &Stores,
+    pod: &Pod,
+) -> Vec<Arc<TargetGroupBinding>> {
     // TODO: Build inverted index in reconciler incrementally?
-    let tgb_exposed_service = gen!({
-        let mut seen = HashSet::new();
+    let tgb_exposed_service_ports = gen!({
         let pod_namespace = pod.metadata.namespace.as_ref();
         for tgb in stores.target_group_bindings() {
-            if tgb.meta().namespace.as_ref() != pod_namespace {
+            let Some(service) = try_some!(&tgb.spec?.service_ref?) else {
                 continue;
-            }
+            };
 
-            if try_some!(tgb.spec?.target_type?) != Some(&TargetType::Ip) {
+            // The service might be in another namespace than the TargetGroupBinding's.
+            let service_namespace = service.namespace.clone().or_else(|| tgb.namespace());
+            if service_namespace.as_ref() != pod_namespace {
                 continue;
             }
 
-            if let Some(service_name) = try_some!(&tgb.spec?.service_ref?.name) {
-                let service_ref =
-                    get_object_ref_from_name::<Service>(&service_name, tgb.namespace().as_ref());
-                if !seen.insert(service_ref.clone()) {
-                    continue;
+            let is_pod_target = match try_some!(tgb.spec?.target_type?) {
+                Some(TargetType::Ip) => true,
+                // hostNetwork pods share the node's IP, so the instance target is the pod.
+                Some(TargetType::Instance) => {
+                    config.drain_host_network_instance_targets && is_host_network_pod(pod)
                 }
-
-                yield_!(service_ref);
+                None => false,
+            };
+            if !is_pod_target {
+                continue;
             }
+
+            let service_ref =
+                get_object_ref_from_name::<Service>(&service.name, service_namespace.as_ref());
+            let port = service.port.clone();
+            yield_!((tgb.clone(), service_ref, port));
         }
     });
 
-    let is_exposed_by_tgb = tgb_exposed_service
+    tgb_exposed_service_ports
         .into_iter()
-        .any(|service_ref| is_exposing_service(stores, pod, service_ref));
-    if is_exposed_by_tgb {
+        .filter(|(_, service_ref, port)| {
+            is_exposing_service_port(stores, pod, service_ref.clone(), port)
+                && (!config.require_service_optin || is_service_opted_in(stores, service_ref))
+        })
+        .map(|(tgb, _, _)| tgb)
+        .collect()
+}
+
+/// The AWS load balancer controller sets the target health condition `True` once the target is healthy.
+/// A pod that has just started and isn't registered yet doesn't need to be drained.
+fn is_registered_target(pod: &Pod) -> bool {
+    if !has_target_health_readiness_gate(pod) {
         return true;
     }
 
-    // The pod once had corresponding TargetGroupBinding, but it is somehow gone.
-    // We don't know whether its TargetType was IP or not.
-    // But, true is more conservative than false.
+    try_some!(pod.status?.conditions?)
+        .unwrap_or(&vec![])
+        .iter()
+        .any(|condition| {
+            condition
+                .type_
+                .starts_with(TARGET_HEALTH_POD_CONDITION_TYPE_PREFIX)
+                && condition.status == "True"
+        })
+}
+
+/// When the targets of the pod were deregistered after its isolation,
+/// i.e. the last time its target health conditions turned from `True`.
+pub fn get_targets_deregistered_at(pod: &Pod) -> Option<DateTime<Utc>> {
+    let isolated_at = get_pod_isolated_at(pod)?;
+    let conditions: Vec<_> = try_some!(pod.status?.conditions?)
+        .unwrap_or(&vec![])
+        .iter()
+        .filter(|condition| {
+            condition
+                .type_
+                .starts_with(TARGET_HEALTH_POD_CONDITION_TYPE_PREFIX)
+        })
+        .collect();
+    if conditions.is_empty()
+        || conditions
+            .iter()
+            .any(|condition| condition.status == "True")
+    {
+        return None;
+    }
+
+    let deregistered_at = conditions
+        .iter()
+        .filter_map(|condition| Some(condition.last_transition_time.as_ref()?.0))
+        .max()?;
+    (deregistered_at > isolated_at).then_some(deregistered_at)
+}
+
+/// Whether any of the targets of the pod is still `draining` in its target group.
+pub fn is_target_deregistering(pod: &Pod) -> bool {
+    try_some!(pod.status?.conditions?)
+        .unwrap_or(&vec![])
+        .iter()
+        .any(|condition| {
+            condition
+                .type_
+                .starts_with(TARGET_HEALTH_POD_CONDITION_TYPE_PREFIX)
+                && condition.reason.as_deref() == Some(TARGET_DEREGISTRATION_IN_PROGRESS_REASON)
+        })
+}
+
+fn has_target_health_readiness_gate(pod: &Pod) -> bool {
     try_some!(pod.spec?.readiness_gates?)
         .unwrap_or(&vec![])
         .iter()
@@ -151,6 +688,93 @@ fn is_exposing_service(stores: &Stores, pod: &Pod, service_ref: ObjectRef<Servic
         return false;
     };
 
+    is_selected_by_service(&service, pod)
+}
+
+fn is_host_network_pod(pod: &Pod) -> bool {
+    try_some!(pod.spec?.host_network?) == Some(&true)
+}
+
+/// A pod can be selected by multiple services, but only the port of the service that
+/// the TargetGroupBinding refers to is registered to the target group.
+fn is_exposing_service_port(
+    stores: &Stores,
+    pod: &Pod,
+    service_ref: ObjectRef<Service>,
+    port: &IntOrString,
+) -> bool {
+    let Some(service) = stores.get_service(&service_ref) else {
+        return false;
+    };
+
+    if !is_selected_by_service(&service, pod) {
+        return false;
+    }
+
+    let service_port = try_some!(service.spec?.ports?).and_then(|ports| {
+        ports.iter().find(|service_port| match port {
+            IntOrString::Int(port) => service_port.port == *port,
+            IntOrString::String(name) => service_port.name.as_ref() == Some(name),
+        })
+    });
+    let Some(service_port) = service_port else {
+        // We don't know which port is registered, but true is more conservative than false.
+        return true;
+    };
+
+    is_exposing_target_port(pod, service_port)
+}
+
+/// The services without the ports can't be told apart, but true is more conservative than false.
+fn is_exposing_any_service_port(service: &Service, pod: &Pod) -> bool {
+    match try_some!(service.spec?.ports?) {
+        Some(ports) if !ports.is_empty() => ports
+            .iter()
+            .any(|service_port| is_exposing_target_port(pod, service_port)),
+        _ => true,
+    }
+}
+
+fn is_exposing_target_port(pod: &Pod, service_port: &ServicePort) -> bool {
+    let container_ports: Vec<_> = try_some!(&pod.spec?.containers)
+        .into_iter()
+        .flatten()
+        .flat_map(|container| container.ports.iter().flatten())
+        .collect();
+    let target_port = service_port
+        .target_port
+        .clone()
+        .unwrap_or(IntOrString::Int(service_port.port));
+    match target_port {
+        IntOrString::String(name) => container_ports
+            .iter()
+            .any(|container_port| container_port.name.as_ref() == Some(&name)),
+        // Declaring the container ports is optional, so the pod might listen on undeclared ones.
+        IntOrString::Int(target_port) => {
+            container_ports.is_empty()
+                || container_ports
+                    .iter()
+                    .any(|container_port| container_port.container_port == target_port)
+        }
+    }
+}
+
+fn is_service_opted_in(stores: &Stores, service_ref: &ObjectRef<Service>) -> bool {
+    let Some(service) = stores.get_service(service_ref) else {
+        return false;
+    };
+
+    has_service_optin_annotation(&service)
+}
+
+fn has_service_optin_annotation(service: &Service) -> bool {
+    matches!(
+        service.annotations().get(SERVICE_ENABLED_ANNOTATION_KEY),
+        Some(value) if value.eq_ignore_ascii_case("true")
+    )
+}
+
+fn is_selected_by_service(service: &Service, pod: &Pod) -> bool {
     let Some(selector) = try_some!(service.spec?.selector?) else {
         return false;
     };
@@ -167,42 +791,171 @@ fn is_exposing_service(stores: &Stores, pod: &Pod, service_ref: ObjectRef<Servic
 #[cfg(test)]
 mod tests {
     use super::*;
-    use std::hash::Hash;
     use std::time::Duration;
 
-    use kube::runtime::reflector::{store, Store};
-    use kube::runtime::watcher::Event;
-
-    macro_rules! from_json {
-        ($($json:tt)+) => {
-            ::serde_json::from_value(::serde_json::json!($($json)+)).expect("Invalid json")
-        };
-    }
-
-    fn store_from<K>(iter: impl IntoIterator<Item = K>) -> Store<K>
-    where
-        K: 'static + Resource + Clone,
-        K::DynamicType: Hash + Eq + Clone + Default,
-    {
-        let (reader, mut writer) = store();
-        writer.apply_watcher_event(&Event::Init);
-        for item in iter.into_iter() {
-            writer.apply_watcher_event(&Event::InitApply(item));
-        }
-        writer.apply_watcher_event(&Event::InitDone);
-        reader
-    }
+    use crate::clock::Clock;
+    use crate::elbv2::apis::TargetGroupBinding;
+    use crate::from_json;
+    use crate::test_utils::store_from;
 
     fn get_test_experimental_general_ingress_config() -> Config {
         Config {
             experimental_general_ingress: true,
             delete_after: Duration::from_secs(30),
+            ..Config::default()
         }
     }
 
+    #[test]
+    fn pods_should_be_drained_only_within_active_hours() {
+        let config = Config {
+            active_hours: Some("09:00-18:00".parse().unwrap()),
+            active_hours_utc_offset: "+09:00".parse().unwrap(),
+            ..Config::default()
+        };
+        let clock = Clock::fake(
+            DateTime::parse_from_rfc3339("2024-01-01T08:00:00+09:00")
+                .unwrap()
+                .with_timezone(&Utc),
+        );
+        assert!(!is_within_active_hours(&config, clock.now()));
+        assert!(is_within_active_hours(&Config::default(), clock.now()));
+
+        clock.advance(chrono::Duration::hours(2));
+        assert!(is_within_active_hours(&config, clock.now()), "10:00");
+
+        clock.advance(chrono::Duration::hours(8));
+        assert!(!is_within_active_hours(&config, clock.now()), "18:00");
+    }
+
+    #[test]
+    fn unscheduled_pod_should_not_have_node_name() {
+        let pod: Pod = from_json!({
+            "spec": {
+                "nodeName": "node",
+            },
+        });
+        assert_eq!(get_node_name(&pod), Some("node"));
+
+        let pod: Pod = from_json!({
+            "spec": {
+                "nodeName": "",
+            },
+        });
+        assert_eq!(get_node_name(&pod), None);
+
+        let pod: Pod = from_json!({
+            "spec": {},
+        });
+        assert_eq!(get_node_name(&pod), None);
+    }
+
     #[test]
     fn pod_is_ready() {
-        assert!(is_pod_ready(&from_json!({
+        assert!(is_pod_ready(
+            &Config::default(),
+            &from_json!({
+                "status": {
+                    "conditions": [
+                        {
+                            "status": "True",
+                            "type": "Ready"
+                        },
+                    ],
+                }
+            })
+        ));
+
+        assert!(!is_pod_ready(
+            &Config::default(),
+            &from_json!({
+                "status": {
+                    "conditions": [
+                        {
+                            "status": "False",
+                            "type": "Ready"
+                        },
+                    ],
+                }
+            })
+        ));
+
+        assert!(is_pod_ready(
+            &Config::default(),
+            &from_json!({
+                "status": {
+                    "conditions": [
+                        {
+                            "status": "False",
+                            "type": "some-unknown-condition"
+                        },
+                        {
+                            "status": "True",
+                            "type": "Ready"
+                        },
+                    ],
+                }
+            })
+        ));
+
+        assert!(!is_pod_ready(
+            &Config::default(),
+            &from_json!({
+                "spec": {
+                    "readinessGates": [
+                        {
+                            "conditionType": "some-readiness-gate-condition"
+                        },
+                    ],
+                },
+                "status": {
+                    "conditions": [
+                        {
+                            "status": "False",
+                            "type": "some-readiness-gate-condition"
+                        },
+                        {
+                            "status": "True",
+                            "type": "Ready"
+                        },
+                    ],
+                }
+            })
+        ));
+
+        assert!(is_pod_ready(
+            &Config::default(),
+            &from_json!({
+                "spec": {
+                    "readinessGates": [
+                        {
+                            "conditionType": "some-readiness-gate-condition"
+                        },
+                    ],
+                },
+                "status": {
+                    "conditions": [
+                        {
+                            "status": "True",
+                            "type": "some-readiness-gate-condition"
+                        },
+                        {
+                            "status": "True",
+                            "type": "Ready"
+                        },
+                    ],
+                }
+            })
+        ));
+    }
+
+    #[test]
+    fn pod_missing_required_ready_condition_is_not_ready() {
+        let config = Config {
+            required_ready_conditions: vec![String::from("example.com/warmed-up")],
+            ..Config::default()
+        };
+        let pod: Pod = from_json!({
             "status": {
                 "conditions": [
                     {
@@ -211,25 +964,16 @@ mod tests {
                     },
                 ],
             }
-        })));
-
-        assert!(!is_pod_ready(&from_json!({
-            "status": {
-                "conditions": [
-                    {
-                        "status": "False",
-                        "type": "Ready"
-                    },
-                ],
-            }
-        })));
+        });
+        assert!(is_pod_ready(&Config::default(), &pod));
+        assert!(!is_pod_ready(&config, &pod));
 
-        assert!(is_pod_ready(&from_json!({
+        let pod: Pod = from_json!({
             "status": {
                 "conditions": [
                     {
-                        "status": "False",
-                        "type": "some-unknown-condition"
+                        "status": "True",
+                        "type": "example.com/warmed-up"
                     },
                     {
                         "status": "True",
@@ -237,13 +981,106 @@ mod tests {
                     },
                 ],
             }
-        })));
+        });
+        assert!(is_pod_ready(&config, &pod));
+    }
+
+    #[test]
+    fn job_pod_should_be_ignored_if_configured() {
+        let pod: Pod = from_json!({
+            "metadata": {
+                "ownerReferences": [{
+                    "apiVersion": "batch/v1",
+                    "kind": "Job",
+                    "name": "some-job",
+                    "uid": "uid1234",
+                    "controller": true,
+                }],
+            },
+        });
+        assert!(!is_owned_by_ignored_kind(&Config::default(), &pod));
+
+        let config = Config {
+            ignore_owner_kinds: vec![String::from("Job"), String::from("CronJob")],
+            ..Config::default()
+        };
+        assert!(is_owned_by_ignored_kind(&config, &pod));
+
+        let pod: Pod = from_json!({
+            "metadata": {
+                "ownerReferences": [{
+                    "apiVersion": "apps/v1",
+                    "kind": "ReplicaSet",
+                    "name": "some-rs",
+                    "uid": "uid1234",
+                    "controller": true,
+                }],
+            },
+        });
+        assert!(!is_owned_by_ignored_kind(&config, &pod));
+    }
+
+    #[test]
+    fn pod_with_only_excluded_containers_should_be_matched() {
+        let pod: Pod = from_json!({
+            "spec": {
+                "containers": [
+                    { "name": "agent", "image": "public.ecr.aws/datadog/agent:7" },
+                    { "name": "log-router", "image": "fluent/fluent-bit:3" },
+                ],
+            },
+        });
+        assert!(!has_only_excluded_containers(&Config::default(), &pod));
+
+        let by_image = Config {
+            exclude_container_images: vec![
+                String::from("datadog/agent"),
+                String::from("fluent-bit"),
+            ],
+            ..Config::default()
+        };
+        assert!(has_only_excluded_containers(&by_image, &pod));
+
+        let by_name_and_image = Config {
+            exclude_container_images: vec![String::from("fluent-bit")],
+            exclude_container_names: vec![String::from("agent")],
+            ..Config::default()
+        };
+        assert!(has_only_excluded_containers(&by_name_and_image, &pod));
+
+        let partially = Config {
+            exclude_container_images: vec![String::from("datadog/agent")],
+            ..Config::default()
+        };
+        assert!(!has_only_excluded_containers(&partially, &pod));
+    }
 
-        assert!(!is_pod_ready(&from_json!({
+    #[test]
+    fn app_pod_with_excluded_sidecar_should_be_drained() {
+        let pod: Pod = from_json!({
+            "spec": {
+                "containers": [
+                    { "name": "app", "image": "example.com/app:1.0" },
+                    { "name": "agent", "image": "public.ecr.aws/datadog/agent:7" },
+                ],
+            },
+        });
+
+        let config = Config {
+            exclude_container_images: vec![String::from("datadog/agent")],
+            exclude_container_names: vec![String::from("agent")],
+            ..Config::default()
+        };
+        assert!(!has_only_excluded_containers(&config, &pod));
+    }
+
+    #[test]
+    fn pod_is_possibly_deregistering() {
+        let pod: Pod = from_json!({
             "spec": {
                 "readinessGates": [
                     {
-                        "conditionType": "some-readiness-gate-condition"
+                        "conditionType": "target-health.elbv2.k8s.aws/some-tgb"
                     },
                 ],
             },
@@ -251,37 +1088,102 @@ mod tests {
                 "conditions": [
                     {
                         "status": "False",
-                        "type": "some-readiness-gate-condition"
+                        "type": "target-health.elbv2.k8s.aws/some-tgb"
                     },
                     {
-                        "status": "True",
+                        "status": "False",
                         "type": "Ready"
                     },
                 ],
             }
-        })));
+        });
 
-        assert!(is_pod_ready(&from_json!({
-            "spec": {
-                "readinessGates": [
-                    {
-                        "conditionType": "some-readiness-gate-condition"
-                    },
-                ],
+        assert!(!is_pod_ready(&Config::default(), &pod));
+        assert!(!is_pod_possibly_deregistering(&Config::default(), &pod));
+        assert!(is_pod_possibly_deregistering(
+            &Config {
+                delay_not_ready_with_target_gate: true,
+                ..Config::default()
             },
+            &pod
+        ));
+
+        let pod_without_gate: Pod = from_json!({
             "status": {
                 "conditions": [
                     {
-                        "status": "True",
-                        "type": "some-readiness-gate-condition"
-                    },
-                    {
-                        "status": "True",
+                        "status": "False",
                         "type": "Ready"
                     },
                 ],
             }
-        })));
+        });
+        assert!(!is_pod_possibly_deregistering(
+            &Config {
+                delay_not_ready_with_target_gate: true,
+                ..Config::default()
+            },
+            &pod_without_gate
+        ));
+    }
+
+    #[test]
+    fn pod_is_recently_ready() {
+        let config = Config {
+            min_ready_age: Duration::from_secs(10),
+            ..Config::default()
+        };
+        let now = DateTime::parse_from_rfc3339("2023-02-08T15:30:00Z")
+            .unwrap()
+            .with_timezone(&Utc);
+
+        assert!(is_pod_recently_ready(
+            &config,
+            &from_json!({
+                "status": {
+                    "conditions": [
+                        {
+                            "status": "True",
+                            "type": "Ready",
+                            "lastTransitionTime": "2023-02-08T15:29:59Z"
+                        },
+                    ],
+                }
+            }),
+            now
+        ));
+
+        assert!(!is_pod_recently_ready(
+            &config,
+            &from_json!({
+                "status": {
+                    "conditions": [
+                        {
+                            "status": "True",
+                            "type": "Ready",
+                            "lastTransitionTime": "2023-02-08T15:00:00Z"
+                        },
+                    ],
+                }
+            }),
+            now
+        ));
+
+        assert!(!is_pod_recently_ready(
+            &Config::default(),
+            &from_json!({
+                "status": {
+                    "conditions": [
+                        {
+                            "status": "True",
+                            "type": "Ready",
+                            "lastTransitionTime": "2023-02-08T15:29:59Z"
+                        },
+                    ],
+                }
+            }),
+            now
+        ));
     }
 
     #[test]
@@ -333,6 +1235,7 @@ mod tests {
             store_from([service]),
             store_from([ingress]),
             store_from([]),
+            store_from([]),
         );
 
         assert!(is_pod_exposed(
@@ -353,52 +1256,1006 @@ mod tests {
                 }
             },
         });
-
-        let service = from_json!({
+
+        let service = from_json!({
+            "metadata": {
+                "name": "svc",
+                "namespace": "ns",
+            },
+            "spec": {
+                "selector": {
+                    "app": "test",
+                },
+            },
+        });
+
+        let tgb = from_json!({
+            "metadata": {
+                "name": "tgb",
+                "namespace": "ns",
+            },
+            "spec": {
+                "networking": {
+                    // snip
+                },
+                "serviceRef": {
+                    "name": "svc",
+                    "port": "http"
+                },
+                "targetGroupARN": "some-target-group-arn",
+                "targetType": "ip"
+            }
+        });
+
+        let stores = Stores::new(
+            store_from([pod.clone()]),
+            store_from([service]),
+            store_from([]),
+            store_from([tgb]),
+            store_from([]),
+        );
+
+        assert!(is_pod_exposed(
+            &Config {
+                delete_after: Duration::from_secs(30),
+                experimental_general_ingress: false,
+                ..Config::default()
+            },
+            &stores,
+            &pod
+        ))
+    }
+
+    #[test]
+    fn orphan_target_gate_should_be_drained_for_separate_delay() {
+        let pod: Pod = from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "labels": {
+                    "app": "test"
+                }
+            },
+            "spec": {
+                "readinessGates": [
+                    { "conditionType": "target-health.elbv2.k8s.aws/some-tgb" },
+                ],
+            },
+        });
+        let service: Service = from_json!({
+            "metadata": {
+                "name": "svc",
+                "namespace": "ns",
+            },
+            "spec": {
+                "selector": {
+                    "app": "test",
+                },
+            },
+        });
+        let tgb: TargetGroupBinding = from_json!({
+            "metadata": {
+                "name": "tgb",
+                "namespace": "ns",
+            },
+            "spec": {
+                "serviceRef": {
+                    "name": "svc",
+                    "port": "http"
+                },
+                "targetGroupARN": "some-target-group-arn",
+                "targetType": "ip"
+            }
+        });
+        let config = Config {
+            delete_after: Duration::from_secs(20),
+            orphan_target_gate_delay: Some(Duration::from_secs(3)),
+            ..Config::default()
+        };
+
+        let orphaned = Stores::new(
+            store_from([pod.clone()]),
+            store_from([service.clone()]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+        );
+        assert!(is_pod_exposed(&config, &orphaned, &pod));
+        assert_eq!(
+            get_delete_after(&config, &orphaned, &pod),
+            Duration::from_secs(3)
+        );
+        assert_eq!(
+            get_delete_after(&Config::default(), &orphaned, &pod),
+            Config::default().delete_after,
+            "full drain unless configured"
+        );
+
+        let registered = Stores::new(
+            store_from([pod.clone()]),
+            store_from([service]),
+            store_from([]),
+            store_from([tgb]),
+            store_from([]),
+        );
+        assert_eq!(
+            get_delete_after(&config, &registered, &pod),
+            Duration::from_secs(20)
+        );
+    }
+
+    #[test]
+    fn pod_is_exposed_by_cross_namespace_tgb() {
+        let pod: Pod = from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "app",
+                "labels": {
+                    "app": "test"
+                }
+            },
+        });
+
+        let service: Service = from_json!({
+            "metadata": {
+                "name": "svc",
+                "namespace": "app",
+            },
+            "spec": {
+                "selector": {
+                    "app": "test",
+                },
+            },
+        });
+
+        let tgb = |service_namespace: Option<&str>| -> TargetGroupBinding {
+            from_json!({
+                "metadata": {
+                    "name": "tgb",
+                    "namespace": "infra",
+                },
+                "spec": {
+                    "serviceRef": {
+                        "name": "svc",
+                        "namespace": service_namespace,
+                        "port": 80
+                    },
+                    "targetGroupARN": "some-target-group-arn",
+                    "targetType": "ip"
+                }
+            })
+        };
+
+        let stores = |tgb: TargetGroupBinding| {
+            Stores::new(
+                store_from([pod.clone()]),
+                store_from([service.clone()]),
+                store_from([]),
+                store_from([tgb]),
+                store_from([]),
+            )
+        };
+
+        assert!(is_pod_exposed(
+            &Config::default(),
+            &stores(tgb(Some("app"))),
+            &pod
+        ));
+        assert!(
+            !is_pod_exposed(&Config::default(), &stores(tgb(None)), &pod),
+            "defaults to the namespace of the TargetGroupBinding"
+        );
+    }
+
+    #[test]
+    fn target_group_arns_should_list_matched_tgbs() {
+        let pod: Pod = from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "labels": {
+                    "app": "test"
+                }
+            },
+        });
+
+        let service: Service = from_json!({
+            "metadata": {
+                "name": "svc",
+                "namespace": "ns",
+            },
+            "spec": {
+                "selector": {
+                    "app": "test",
+                },
+            },
+        });
+
+        let tgb = |name: &str, service_name: &str, arn: &str| -> TargetGroupBinding {
+            from_json!({
+                "metadata": {
+                    "name": name,
+                    "namespace": "ns",
+                },
+                "spec": {
+                    "serviceRef": {
+                        "name": service_name,
+                        "port": 80
+                    },
+                    "targetGroupARN": arn,
+                    "targetType": "ip"
+                }
+            })
+        };
+
+        let stores = Stores::new(
+            store_from([pod.clone()]),
+            store_from([service]),
+            store_from([]),
+            store_from([
+                tgb("tgb2", "svc", "arn:tg2"),
+                tgb("tgb1", "svc", "arn:tg1"),
+                tgb("other", "other-svc", "arn:other"),
+            ]),
+            store_from([]),
+        );
+
+        assert_eq!(
+            get_exposing_target_group_arns(&Config::default(), &stores, &pod),
+            vec![String::from("arn:tg1"), String::from("arn:tg2")]
+        );
+    }
+
+    #[test]
+    fn pod_behind_gateway_load_balancer_should_be_drained_longer() {
+        let config = Config {
+            delete_after: Duration::from_secs(10),
+            gateway_load_balancer_delete_after: Some(Duration::from_secs(25)),
+            ..Config::default()
+        };
+
+        let pod: Pod = from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "labels": {
+                    "app": "appliance"
+                }
+            },
+        });
+
+        let service: Service = from_json!({
+            "metadata": {
+                "name": "svc",
+                "namespace": "ns",
+            },
+            "spec": {
+                "selector": {
+                    "app": "appliance",
+                },
+            },
+        });
+
+        let tgb = |annotations: serde_json::Value| -> TargetGroupBinding {
+            from_json!({
+                "metadata": {
+                    "name": "tgb",
+                    "namespace": "ns",
+                    "annotations": annotations,
+                },
+                "spec": {
+                    "serviceRef": {
+                        "name": "svc",
+                        "port": 6081
+                    },
+                    "targetGroupARN": "some-geneve-target-group-arn",
+                    "targetType": "ip"
+                }
+            })
+        };
+
+        let stores = |tgb: TargetGroupBinding| {
+            Stores::new(
+                store_from([pod.clone()]),
+                store_from([service.clone()]),
+                store_from([]),
+                store_from([tgb]),
+                store_from([]),
+            )
+        };
+
+        let gwlb = stores(tgb(
+            ::serde_json::json!({ "pod-graceful-drain/gateway-load-balancer": "true" }),
+        ));
+        assert!(is_pod_exposed(&config, &gwlb, &pod));
+        assert_eq!(
+            get_delete_after(&config, &gwlb, &pod),
+            Duration::from_secs(25)
+        );
+
+        let alb = stores(tgb(::serde_json::json!({})));
+        assert_eq!(
+            get_delete_after(&config, &alb, &pod),
+            Duration::from_secs(10)
+        );
+    }
+
+    #[test]
+    fn delete_after_annotations_should_take_precedence() {
+        let config = Config {
+            delete_after: Duration::from_secs(10),
+            ..Config::default()
+        };
+
+        let pod = |annotations: serde_json::Value| -> Pod {
+            from_json!({
+                "metadata": {
+                    "name": "pod",
+                    "namespace": "ns",
+                    "labels": {
+                        "app": "test"
+                    },
+                    "annotations": annotations,
+                },
+            })
+        };
+        let service = |name: &str, annotations: serde_json::Value| -> Service {
+            from_json!({
+                "metadata": {
+                    "name": name,
+                    "namespace": "ns",
+                    "annotations": annotations,
+                },
+                "spec": {
+                    "selector": {
+                        "app": "test",
+                    },
+                },
+            })
+        };
+
+        let stores = Stores::new(
+            store_from([]),
+            store_from([
+                service(
+                    "svc1",
+                    ::serde_json::json!({ "pod-graceful-drain/delete-after": "15s" }),
+                ),
+                service(
+                    "svc2",
+                    ::serde_json::json!({ "pod-graceful-drain/delete-after": "20s" }),
+                ),
+            ]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+        );
+        let no_annotated_services = Stores::new(
+            store_from([]),
+            store_from([service("svc", ::serde_json::json!({}))]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+        );
+
+        let annotated = pod(::serde_json::json!({ "pod-graceful-drain/delete-after": "5s" }));
+        let not_annotated = pod(::serde_json::json!({}));
+        assert_eq!(
+            get_delete_after(&config, &stores, &annotated),
+            Duration::from_secs(5),
+            "pod annotation"
+        );
+        assert_eq!(
+            get_delete_after(&config, &stores, &not_annotated),
+            Duration::from_secs(20),
+            "longest service annotation"
+        );
+        assert_eq!(
+            get_delete_after(&config, &no_annotated_services, &not_annotated),
+            Duration::from_secs(10),
+            "flag"
+        );
+
+        let invalid = pod(::serde_json::json!({ "pod-graceful-drain/delete-after": "soon" }));
+        assert_eq!(
+            get_delete_after(&config, &stores, &invalid),
+            Duration::from_secs(20),
+            "invalid pod annotation is ignored"
+        );
+
+        let too_long = pod(::serde_json::json!({ "pod-graceful-drain/delete-after": "30s" }));
+        assert_eq!(
+            get_delete_after(&config, &stores, &too_long),
+            Duration::from_secs(20),
+            "pod annotation longer than 25s is ignored"
+        );
+    }
+
+    #[test]
+    fn rollout_revision_should_survive_isolation() {
+        let expected = RolloutRevision {
+            replica_set: Some(String::from("app-5d9c7b8f4")),
+            pod_template_hash: Some(String::from("5d9c7b8f4")),
+        };
+
+        let pod: Pod = from_json!({
+            "metadata": {
+                "labels": {
+                    "pod-template-hash": "5d9c7b8f4",
+                },
+                "ownerReferences": [{
+                    "apiVersion": "apps/v1",
+                    "controller": true,
+                    "kind": "ReplicaSet",
+                    "name": "app-5d9c7b8f4",
+                    "uid": "12345",
+                }],
+            }
+        });
+        assert_eq!(get_rollout_revision(&pod), expected);
+
+        let isolated: Pod = from_json!({
+            "metadata": {
+                "labels": {
+                    "pod-graceful-drain/draining": "true",
+                },
+                "annotations": {
+                    "pod-graceful-drain/original-labels": "{\"pod-template-hash\":\"5d9c7b8f4\"}",
+                    "pod-graceful-drain/original-owner-references": "[{\"apiVersion\":\"apps/v1\",\"controller\":true,\"kind\":\"ReplicaSet\",\"name\":\"app-5d9c7b8f4\",\"uid\":\"12345\"}]",
+                },
+            }
+        });
+        assert_eq!(get_rollout_revision(&isolated), expected);
+
+        assert_eq!(
+            get_rollout_revision(&from_json!({ "metadata": {} })),
+            RolloutRevision::default()
+        );
+    }
+
+    #[test]
+    fn host_network_pod_is_exposed_by_instance_target_tgb() {
+        let pod = |host_network: bool| -> Pod {
+            from_json!({
+                "metadata": {
+                    "name": "pod",
+                    "namespace": "ns",
+                    "labels": {
+                        "app": "ingress"
+                    }
+                },
+                "spec": {
+                    "hostNetwork": host_network,
+                    "containers": [],
+                },
+            })
+        };
+
+        let service: Service = from_json!({
+            "metadata": {
+                "name": "svc",
+                "namespace": "ns",
+            },
+            "spec": {
+                "type": "NodePort",
+                "selector": {
+                    "app": "ingress",
+                },
+            },
+        });
+
+        let tgb: TargetGroupBinding = from_json!({
+            "metadata": {
+                "name": "tgb",
+                "namespace": "ns",
+            },
+            "spec": {
+                "serviceRef": {
+                    "name": "svc",
+                    "port": 80,
+                },
+                "targetGroupARN": "some-target-group-arn",
+                "targetType": "instance"
+            }
+        });
+
+        let config = Config {
+            drain_host_network_instance_targets: true,
+            ..Config::default()
+        };
+
+        let stores = Stores::new(
+            store_from([pod(true), pod(false)]),
+            store_from([service]),
+            store_from([]),
+            store_from([tgb]),
+            store_from([]),
+        );
+
+        assert!(is_pod_exposed(&config, &stores, &pod(true)));
+        assert!(!is_pod_exposed(&config, &stores, &pod(false)));
+        assert!(!is_pod_exposed(&Config::default(), &stores, &pod(true)));
+    }
+
+    #[test]
+    fn pod_is_not_exposed_by_tgb_of_other_port() {
+        let pod: Pod = from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "labels": {
+                    "app": "test"
+                }
+            },
+            "spec": {
+                "containers": [{
+                    "name": "app",
+                    "ports": [{
+                        "name": "http",
+                        "containerPort": 8080,
+                    }],
+                }],
+            },
+        });
+
+        let service: Service = from_json!({
+            "metadata": {
+                "name": "svc",
+                "namespace": "ns",
+            },
+            "spec": {
+                "selector": {
+                    "app": "test",
+                },
+                "ports": [
+                    {
+                        "name": "http",
+                        "port": 80,
+                        "targetPort": "http",
+                    },
+                    {
+                        "name": "metrics",
+                        "port": 9090,
+                        "targetPort": "metrics",
+                    },
+                ],
+            },
+        });
+
+        let tgb = |port: &str| -> TargetGroupBinding {
+            from_json!({
+                "metadata": {
+                    "name": "tgb",
+                    "namespace": "ns",
+                },
+                "spec": {
+                    "serviceRef": {
+                        "name": "svc",
+                        "port": port,
+                    },
+                    "targetGroupARN": "some-target-group-arn",
+                    "targetType": "ip"
+                }
+            })
+        };
+
+        let stores = |tgb: TargetGroupBinding| {
+            Stores::new(
+                store_from([pod.clone()]),
+                store_from([service.clone()]),
+                store_from([]),
+                store_from([tgb]),
+                store_from([]),
+            )
+        };
+
+        assert!(is_pod_exposed(
+            &Config::default(),
+            &stores(tgb("http")),
+            &pod
+        ));
+        assert!(!is_pod_exposed(
+            &Config::default(),
+            &stores(tgb("metrics")),
+            &pod
+        ));
+    }
+
+    #[test]
+    fn pod_is_exposed_only_by_opted_in_service() {
+        let pod: Pod = from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "labels": {
+                    "app": "test"
+                }
+            },
+        });
+
+        let service = |annotations: serde_json::Value| -> Service {
+            from_json!({
+                "metadata": {
+                    "name": "svc",
+                    "namespace": "ns",
+                    "annotations": annotations,
+                },
+                "spec": {
+                    "selector": {
+                        "app": "test",
+                    },
+                },
+            })
+        };
+
+        let tgb: TargetGroupBinding = from_json!({
+            "metadata": {
+                "name": "tgb",
+                "namespace": "ns",
+            },
+            "spec": {
+                "networking": {
+                    // snip
+                },
+                "serviceRef": {
+                    "name": "svc",
+                    "port": "http"
+                },
+                "targetGroupARN": "some-target-group-arn",
+                "targetType": "ip"
+            }
+        });
+
+        let config = Config {
+            require_service_optin: true,
+            ..Config::default()
+        };
+
+        let stores = Stores::new(
+            store_from([pod.clone()]),
+            store_from([service(serde_json::json!({}))]),
+            store_from([]),
+            store_from([tgb.clone()]),
+            store_from([]),
+        );
+        assert!(!is_pod_exposed(&config, &stores, &pod));
+        assert!(is_pod_exposed(&Config::default(), &stores, &pod));
+
+        let stores = Stores::new(
+            store_from([pod.clone()]),
+            store_from([service(serde_json::json!({
+                "pod-graceful-drain/enabled": "true"
+            }))]),
+            store_from([]),
+            store_from([tgb]),
+            store_from([]),
+        );
+        assert!(is_pod_exposed(&config, &stores, &pod));
+    }
+
+    #[test]
+    fn gated_pod_is_exposed_only_by_opted_in_service_exposing_its_port() {
+        let pod: Pod = from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "labels": {
+                    "app": "test"
+                }
+            },
+            "spec": {
+                "containers": [{
+                    "name": "app",
+                    "ports": [{ "name": "http", "containerPort": 8080 }],
+                }],
+                "readinessGates": [
+                    { "conditionType": "target-health.elbv2.k8s.aws/some-tgb" },
+                ],
+            },
+        });
+
+        let service = |annotations: serde_json::Value, target_port: &str| -> Service {
+            from_json!({
+                "metadata": {
+                    "name": "svc",
+                    "namespace": "ns",
+                    "annotations": annotations,
+                },
+                "spec": {
+                    "selector": {
+                        "app": "test",
+                    },
+                    "ports": [{ "port": 80, "targetPort": target_port }],
+                },
+            })
+        };
+        let stores_with = |service: Service| {
+            Stores::new(
+                store_from([pod.clone()]),
+                store_from([service]),
+                store_from([]),
+                store_from([]),
+                store_from([]),
+            )
+        };
+        let config = Config {
+            require_service_optin: true,
+            ..Config::default()
+        };
+
+        // The TargetGroupBinding is gone, and its service hasn't opted in.
+        let stores = stores_with(service(serde_json::json!({}), "http"));
+        assert!(is_pod_exposed(&Config::default(), &stores, &pod));
+        assert!(!is_pod_exposed(&config, &stores, &pod));
+
+        let stores = stores_with(service(
+            serde_json::json!({ "pod-graceful-drain/enabled": "true" }),
+            "http",
+        ));
+        assert!(is_pod_exposed(&config, &stores, &pod));
+
+        let stores = stores_with(service(
+            serde_json::json!({ "pod-graceful-drain/enabled": "true" }),
+            "metrics",
+        ));
+        assert!(
+            !is_pod_exposed(&config, &stores, &pod),
+            "the pod doesn't expose the port"
+        );
+        assert!(!is_pod_exposed(&Config::default(), &stores, &pod));
+    }
+
+    #[test]
+    fn pod_is_not_exposed_when_not_registered_target() {
+        let pod = |target_health: &str| -> Pod {
+            from_json!({
+                "metadata": {
+                    "name": "pod",
+                    "namespace": "ns",
+                    "labels": {
+                        "app": "test"
+                    }
+                },
+                "spec": {
+                    "readinessGates": [{
+                        "conditionType": "target-health.elbv2.k8s.aws/tgb"
+                    }]
+                },
+                "status": {
+                    "conditions": [{
+                        "type": "target-health.elbv2.k8s.aws/tgb",
+                        "status": target_health,
+                    }]
+                }
+            })
+        };
+
+        let service = from_json!({
+            "metadata": {
+                "name": "svc",
+                "namespace": "ns",
+            },
+            "spec": {
+                "selector": {
+                    "app": "test",
+                },
+            },
+        });
+
+        let tgb = from_json!({
+            "metadata": {
+                "name": "tgb",
+                "namespace": "ns",
+            },
+            "spec": {
+                "serviceRef": {
+                    "name": "svc",
+                    "port": "http"
+                },
+                "targetGroupARN": "some-target-group-arn",
+                "targetType": "ip"
+            }
+        });
+
+        let stores = Stores::new(
+            store_from([]),
+            store_from([service]),
+            store_from([]),
+            store_from([tgb]),
+            store_from([]),
+        );
+
+        let config = Config {
+            verify_target_membership: true,
+            ..Config::default()
+        };
+        assert!(!is_pod_exposed(&config, &stores, &pod("False")));
+        assert!(is_pod_exposed(&config, &stores, &pod("True")));
+        assert!(is_pod_exposed(&Config::default(), &stores, &pod("False")));
+    }
+
+    #[test]
+    fn pod_is_exposed_by_local_traffic_policy_service() {
+        let pod: Pod = from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "labels": {
+                    "app": "test"
+                }
+            },
+        });
+
+        let service = from_json!({
+            "metadata": {
+                "name": "svc",
+                "namespace": "ns",
+            },
+            "spec": {
+                "type": "LoadBalancer",
+                "externalTrafficPolicy": "Local",
+                "selector": {
+                    "app": "test",
+                },
+            },
+        });
+
+        let stores = Stores::new(
+            store_from([pod.clone()]),
+            store_from([service]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+        );
+
+        let disabled_config = get_test_experimental_general_ingress_config();
+        assert!(!is_pod_exposed(&disabled_config, &stores, &pod));
+        assert_eq!(
+            get_delete_after(&disabled_config, &stores, &pod),
+            Duration::from_secs(30)
+        );
+
+        let config = Config {
+            delete_after: Duration::from_secs(10),
+            local_traffic_policy_delete_after: Some(Duration::from_secs(20)),
+            ..get_test_experimental_general_ingress_config()
+        };
+        assert!(is_pod_exposed(&config, &stores, &pod));
+        assert_eq!(
+            get_delete_after(&config, &stores, &pod),
+            Duration::from_secs(20)
+        );
+    }
+
+    #[test]
+    fn completed_pod_should_not_be_ready_even_if_exposed() {
+        let pod: Pod = from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "labels": {
+                    "app": "test"
+                }
+            },
+            "status": {
+                "phase": "Succeeded",
+                "conditions": [
+                    { "type": "Ready", "status": "True" },
+                ],
+            },
+        });
+        let service: Service = from_json!({
             "metadata": {
                 "name": "svc",
                 "namespace": "ns",
+                "annotations": {
+                    "service.beta.kubernetes.io/aws-load-balancer-nlb-target-type": "ip",
+                },
             },
             "spec": {
+                "type": "LoadBalancer",
                 "selector": {
                     "app": "test",
                 },
             },
         });
+        let stores = Stores::new(
+            store_from([pod.clone()]),
+            store_from([service]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+        );
 
-        let tgb = from_json!({
+        assert!(is_pod_exposed(&Config::default(), &stores, &pod));
+        assert!(is_pod_completed(&pod));
+        assert!(
+            !is_pod_ready(&Config::default(), &pod),
+            "stale ready condition"
+        );
+
+        let mut failed = pod.clone();
+        failed.status.as_mut().unwrap().phase = Some(String::from("Failed"));
+        assert!(is_pod_completed(&failed));
+
+        let mut running = pod;
+        running.status.as_mut().unwrap().phase = Some(String::from("Running"));
+        assert!(!is_pod_completed(&running));
+        assert!(is_pod_ready(&Config::default(), &running));
+    }
+
+    #[test]
+    fn pod_is_exposed_by_ip_target_load_balancer_service_without_tgb() {
+        let pod: Pod = from_json!({
             "metadata": {
-                "name": "tgb",
+                "name": "pod",
                 "namespace": "ns",
+                "labels": {
+                    "app": "test"
+                }
             },
-            "spec": {
-                "networking": {
-                    // snip
-                },
-                "serviceRef": {
+        });
+
+        let service = |annotations: serde_json::Value| -> Service {
+            from_json!({
+                "metadata": {
                     "name": "svc",
-                    "port": "http"
+                    "namespace": "ns",
+                    "annotations": annotations,
                 },
-                "targetGroupARN": "some-target-group-arn",
-                "targetType": "ip"
-            }
-        });
+                "spec": {
+                    "type": "LoadBalancer",
+                    "selector": {
+                        "app": "test",
+                    },
+                },
+            })
+        };
+        let stores_with = |service: Service| {
+            Stores::new(
+                store_from([pod.clone()]),
+                store_from([service]),
+                store_from([]),
+                store_from([]),
+                store_from([]),
+            )
+        };
 
-        let stores = Stores::new(
-            store_from([pod.clone()]),
-            store_from([service]),
-            store_from([]),
-            store_from([tgb]),
+        let stores = stores_with(service(serde_json::json!({
+            "service.beta.kubernetes.io/aws-load-balancer-nlb-target-type": "ip",
+        })));
+        assert!(is_pod_exposed(&Config::default(), &stores, &pod));
+
+        let stores = stores_with(service(serde_json::json!({
+            "service.beta.kubernetes.io/aws-load-balancer-type": "nlb-ip",
+        })));
+        assert!(is_pod_exposed(&Config::default(), &stores, &pod));
+
+        let stores = stores_with(service(serde_json::json!({
+            "service.beta.kubernetes.io/aws-load-balancer-nlb-target-type": "instance",
+        })));
+        assert!(
+            !is_pod_exposed(&Config::default(), &stores, &pod),
+            "instance targets are the nodes"
         );
 
-        assert!(is_pod_exposed(
-            &Config {
-                delete_after: Duration::from_secs(30),
-                experimental_general_ingress: false,
-            },
-            &stores,
-            &pod
-        ))
+        let config = Config {
+            require_service_optin: true,
+            ..Config::default()
+        };
+        let stores = stores_with(service(serde_json::json!({
+            "service.beta.kubernetes.io/aws-load-balancer-nlb-target-type": "ip",
+        })));
+        assert!(
+            !is_pod_exposed(&config, &stores, &pod),
+            "the service hasn't opted in"
+        );
+
+        let stores = stores_with(service(serde_json::json!({
+            "service.beta.kubernetes.io/aws-load-balancer-nlb-target-type": "ip",
+            "pod-graceful-drain/enabled": "true",
+        })));
+        assert!(is_pod_exposed(&config, &stores, &pod));
     }
 
     #[test]
@@ -430,6 +2287,7 @@ mod tests {
             store_from([service]),
             store_from([]),
             store_from([]),
+            store_from([]),
         );
 
         assert!(!is_pod_exposed(
@@ -489,6 +2347,7 @@ mod tests {
             store_from([service]),
             store_from([ingress]),
             store_from([]),
+            store_from([]),
         );
 
         assert!(!is_pod_exposed(
@@ -547,6 +2406,7 @@ mod tests {
             store_from([service]),
             store_from([ingress]),
             store_from([]),
+            store_from([]),
         );
 
         assert!(!is_pod_exposed(
@@ -555,4 +2415,390 @@ mod tests {
             &pod
         ))
     }
+
+    #[test]
+    fn pod_should_be_drained_by_annotation() {
+        let config = Config {
+            drain_predicate: DrainPredicate::Annotation,
+            drain_annotation: Some(String::from("metallb.example.com/drain")),
+            ..Config::default()
+        };
+        let stores = Stores::new(
+            store_from([]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+        );
+
+        let annotated: Pod = from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "annotations": {
+                    "metallb.example.com/drain": "true"
+                }
+            },
+        });
+        assert!(should_drain_pod(&config, &stores, &annotated));
+
+        let not_annotated: Pod = from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+            },
+        });
+        assert!(!should_drain_pod(&config, &stores, &not_annotated));
+    }
+
+    #[test]
+    fn delete_after_should_follow_deregistration_delay() {
+        let config = Config {
+            delete_after: Duration::from_secs(10),
+            max_deregistration_delay: Some(Duration::from_secs(20)),
+            ..Config::default()
+        };
+
+        let pod: Pod = from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "labels": {
+                    "app": "test"
+                }
+            },
+        });
+
+        let service_with_delay = |name: &str, attributes: &str| -> Service {
+            from_json!({
+                "metadata": {
+                    "name": name,
+                    "namespace": "ns",
+                    "annotations": {
+                        "service.beta.kubernetes.io/aws-load-balancer-target-group-attributes": attributes,
+                    },
+                },
+                "spec": {
+                    "selector": {
+                        "app": "test",
+                    },
+                },
+            })
+        };
+
+        let stores = Stores::new(
+            store_from([pod.clone()]),
+            store_from([service_with_delay(
+                "svc",
+                "stickiness.enabled=true, deregistration_delay.timeout_seconds=15",
+            )]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+        );
+        assert_eq!(
+            get_delete_after(&config, &stores, &pod),
+            Duration::from_secs(15)
+        );
+
+        let stores = Stores::new(
+            store_from([pod.clone()]),
+            store_from([service_with_delay(
+                "svc",
+                "deregistration_delay.timeout_seconds=300",
+            )]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+        );
+        assert_eq!(
+            get_delete_after(&config, &stores, &pod),
+            Duration::from_secs(20),
+            "should be capped"
+        );
+    }
+
+    #[test]
+    fn delete_after_should_follow_default_deregistration_delay_of_target_groups() {
+        let config = Config {
+            max_deregistration_delay: Some(Duration::from_secs(600)),
+            ..Config::default()
+        };
+
+        let pod: Pod = from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "labels": {
+                    "app": "test"
+                }
+            },
+        });
+        let service: Service = from_json!({
+            "metadata": {
+                "name": "svc",
+                "namespace": "ns",
+                "annotations": {
+                    "service.beta.kubernetes.io/aws-load-balancer-target-group-attributes":
+                        "deregistration_delay.timeout_seconds=300",
+                },
+            },
+            "spec": {
+                "selector": {
+                    "app": "test",
+                },
+            },
+        });
+
+        let stores = Stores::new(
+            store_from([pod.clone()]),
+            store_from([service]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+        );
+        assert_eq!(
+            get_delete_after(&config, &stores, &pod),
+            Duration::from_secs(300)
+        );
+    }
+
+    #[test]
+    fn delete_after_should_be_longest_of_load_balancers() {
+        let config = Config {
+            delete_after: Duration::from_secs(5),
+            max_deregistration_delay: Some(Duration::from_secs(25)),
+            ..Config::default()
+        };
+
+        let pod: Pod = from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "labels": {
+                    "app": "test"
+                }
+            },
+        });
+
+        let service_with_delay = |name: &str, seconds: u64| -> Service {
+            from_json!({
+                "metadata": {
+                    "name": name,
+                    "namespace": "ns",
+                    "annotations": {
+                        "service.beta.kubernetes.io/aws-load-balancer-target-group-attributes":
+                            format!("deregistration_delay.timeout_seconds={seconds}"),
+                    },
+                },
+                "spec": {
+                    "selector": {
+                        "app": "test",
+                    },
+                },
+            })
+        };
+
+        let stores = Stores::new(
+            store_from([pod.clone()]),
+            store_from([service_with_delay("alb", 10), service_with_delay("nlb", 20)]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+        );
+
+        let delays = get_deregistration_delays(&stores, &pod);
+        assert_eq!(delays.len(), 2);
+        assert_eq!(delays["alb"], Duration::from_secs(10));
+        assert_eq!(delays["nlb"], Duration::from_secs(20));
+        assert_eq!(
+            get_delete_after(&config, &stores, &pod),
+            Duration::from_secs(20)
+        );
+    }
+
+    #[test]
+    fn delete_after_should_be_reduced_for_stateful_set_pods() {
+        let config = Config {
+            delete_after: Duration::from_secs(20),
+            stateful_set_delete_after: Some(Duration::from_secs(5)),
+            ..Config::default()
+        };
+
+        let pod: Pod = from_json!({
+            "metadata": {
+                "name": "pod-0",
+                "namespace": "ns",
+                "ownerReferences": [{
+                    "apiVersion": "apps/v1",
+                    "kind": "StatefulSet",
+                    "name": "pod",
+                    "uid": "12345",
+                    "controller": true,
+                }]
+            },
+        });
+        let stores = Stores::new(
+            store_from([pod.clone()]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+        );
+
+        assert!(is_owned_by_stateful_set(&pod));
+        assert_eq!(
+            get_delete_after(&config, &stores, &pod),
+            Duration::from_secs(5)
+        );
+    }
+
+    #[test]
+    fn delete_after_annotation_should_be_adjusted_for_stateful_set_pods() {
+        let config = Config {
+            delete_after: Duration::from_secs(20),
+            stateful_set_delete_after: Some(Duration::from_secs(10)),
+            respect_termination_grace: true,
+            ..Config::default()
+        };
+
+        let pod = |delete_after: &str| -> Pod {
+            from_json!({
+                "metadata": {
+                    "name": "pod-0",
+                    "namespace": "ns",
+                    "annotations": {
+                        "pod-graceful-drain/delete-after": delete_after,
+                    },
+                    "ownerReferences": [{
+                        "apiVersion": "apps/v1",
+                        "kind": "StatefulSet",
+                        "name": "pod",
+                        "uid": "12345",
+                        "controller": true,
+                    }]
+                },
+                "spec": {
+                    "terminationGracePeriodSeconds": 3,
+                    "containers": [{
+                        "name": "app",
+                        "lifecycle": {
+                            "preStop": { "exec": { "command": ["sleep", "3"] } },
+                        },
+                    }],
+                },
+            })
+        };
+        let stores = Stores::new(
+            store_from([]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+        );
+
+        // Capped by --stateful-set-delete-after, then reduced by the preStop hook.
+        assert_eq!(
+            get_delete_after(&config, &stores, &pod("15s")),
+            Duration::from_secs(7)
+        );
+        // Only reduced by the preStop hook.
+        assert_eq!(
+            get_delete_after(&config, &stores, &pod("5s")),
+            Duration::from_secs(2)
+        );
+    }
+
+    #[test]
+    fn pod_should_be_in_scope() {
+        let config = Config {
+            watch_namespaces: vec![String::from("ours")],
+            pod_selector: Some("team=payments".parse().unwrap()),
+            ..Config::default()
+        };
+
+        let pod = |namespace: &str, team: &str| -> Pod {
+            from_json!({
+                "metadata": {
+                    "name": "pod",
+                    "namespace": namespace,
+                    "labels": {
+                        "team": team,
+                    },
+                },
+            })
+        };
+
+        assert!(is_pod_in_scope(&config, &pod("ours", "payments")));
+        assert!(!is_pod_in_scope(&config, &pod("theirs", "payments")));
+        assert!(!is_pod_in_scope(&config, &pod("ours", "search")));
+        assert!(is_pod_in_scope(
+            &Config::default(),
+            &pod("theirs", "search")
+        ));
+    }
+
+    #[test]
+    fn delete_after_should_be_reduced_by_termination_grace_period() {
+        let config = Config {
+            delete_after: Duration::from_secs(60),
+            respect_termination_grace: true,
+            ..Config::default()
+        };
+        let stores = Stores::new(
+            store_from([]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+        );
+
+        let pod = |termination_grace_period_seconds: i64, pre_stop: bool| -> Pod {
+            let lifecycle = if pre_stop {
+                ::serde_json::json!({ "preStop": { "exec": { "command": ["sleep", "10"] } } })
+            } else {
+                ::serde_json::Value::Null
+            };
+            from_json!({
+                "metadata": {
+                    "name": "pod",
+                    "namespace": "ns",
+                },
+                "spec": {
+                    "containers": [{
+                        "name": "app",
+                        "lifecycle": lifecycle,
+                    }],
+                    "terminationGracePeriodSeconds": termination_grace_period_seconds,
+                },
+            })
+        };
+
+        assert_eq!(
+            get_delete_after(&config, &stores, &pod(20, true)),
+            Duration::from_secs(40)
+        );
+        assert_eq!(
+            get_delete_after(&config, &stores, &pod(600, true)),
+            Duration::ZERO,
+            "large grace period"
+        );
+        assert_eq!(
+            get_delete_after(&config, &stores, &pod(600, false)),
+            Duration::from_secs(60),
+            "without preStop hook"
+        );
+        assert_eq!(
+            get_delete_after(
+                &Config {
+                    respect_termination_grace: false,
+                    ..config.clone()
+                },
+                &stores,
+                &pod(600, true)
+            ),
+            Duration::from_secs(60),
+            "disabled"
+        );
+    }
 }
@@ -0,0 +1,467 @@
+use std::collections::HashSet;
+
+use chrono::{DateTime, Utc};
+use eyre::{Context, Result};
+use futures::StreamExt;
+use k8s_openapi::api::core::v1::{Node, Pod};
+use kube::runtime::{watcher, WatchStreamExt};
+use kube::{Api, ResourceExt};
+use tracing::{debug, error, info, span, Level};
+
+use crate::api_resolver::ApiResolver;
+use crate::clock::Clock;
+use crate::concurrent_drains::{DrainReservation, DrainReservations};
+use crate::node_state::is_node_draining;
+use crate::pod_disruption_budget::would_violate_pod_disruption_budget;
+use crate::pod_draining_info::{get_pod_draining_info, is_pod_pre_isolated, PodDrainingInfo};
+use crate::pod_evict_params::get_pod_evict_params;
+use crate::pod_state::{
+    get_delete_after, get_exposing_target_group_arns, has_only_excluded_containers,
+    is_owned_by_ignored_kind, is_pod_in_scope, is_pod_ready, is_within_active_hours,
+    should_drain_pod,
+};
+use crate::reflector::Stores;
+use crate::shutdown::Shutdown;
+use crate::spawn_service::spawn_service;
+use crate::webhooks::{patch_pod_pre_isolate, patch_pod_release};
+use crate::{instrumented, try_some, Config, LoadBalancingConfig, ServiceRegistry};
+
+/// Start a service that isolates the pods on a node as soon as it is cordoned,
+/// so that their targets start to deregister before the evictions.
+///
+/// `drain_reservations` should be shared with the webhook, so the concurrent drains are counted together.
+#[allow(clippy::too_many_arguments)]
+pub fn start_pre_isolator(
+    api_resolver: &ApiResolver,
+    config: &Config,
+    stores: &Stores,
+    service_registry: &ServiceRegistry,
+    loadbalancing: &LoadBalancingConfig,
+    drain_reservations: &DrainReservations,
+    clock: &Clock,
+    shutdown: &Shutdown,
+) -> Result<()> {
+    let api: Api<Node> = Api::all(api_resolver.client.clone());
+    let nodes = watcher(api, watcher::Config::default())
+        .default_backoff()
+        .applied_objects();
+
+    let signal = service_registry.register("pre-isolator");
+    spawn_service(shutdown, "pre-isolator", {
+        let api_resolver = api_resolver.clone();
+        let config = config.clone();
+        let stores = stores.clone();
+        let loadbalancing = loadbalancing.clone();
+        let drain_reservations = drain_reservations.clone();
+        let clock = clock.clone();
+        let shutdown = shutdown.clone();
+
+        async move {
+            signal.ready();
+
+            let mut nodes = Box::pin(nodes.take_until(shutdown.wait_shutdown_triggered()));
+            let mut cordoned = HashSet::new();
+            while let Some(result) = nodes.next().await {
+                let node = match result {
+                    Ok(node) => node,
+                    Err(err) => {
+                        error!(?err, "failed to watch nodes");
+                        continue;
+                    }
+                };
+
+                let node_name = node.name_any();
+                if !is_node_draining(&config, &node) {
+                    if cordoned.remove(&node_name) {
+                        release_pods_on(&api_resolver, &config, &stores, &node_name).await;
+                    }
+                    continue;
+                }
+
+                // Only on the transition.
+                if !cordoned.insert(node_name.clone()) {
+                    continue;
+                }
+
+                pre_isolate_pods_on(
+                    &api_resolver,
+                    &config,
+                    &stores,
+                    &loadbalancing,
+                    &drain_reservations,
+                    &clock,
+                    &node_name,
+                )
+                .await;
+            }
+        }
+    })?;
+
+    Ok(())
+}
+
+async fn pre_isolate_pods_on(
+    api_resolver: &ApiResolver,
+    config: &Config,
+    stores: &Stores,
+    loadbalancing: &LoadBalancingConfig,
+    drain_reservations: &DrainReservations,
+    clock: &Clock,
+    node_name: &str,
+) {
+    let span = span!(Level::ERROR, "pre-isolator", node_name);
+    instrumented!(span, async move {
+        let pods = get_pods_to_pre_isolate(config, stores, node_name);
+        info!(
+            count = pods.len(),
+            "pre-isolating pods on the cordoned node"
+        );
+        for pod in pods {
+            if let Err(err) = pre_isolate_pod(
+                api_resolver,
+                config,
+                stores,
+                loadbalancing,
+                drain_reservations,
+                clock,
+                &pod,
+            )
+            .await
+            {
+                error!(?err, pod = pod.name_any(), "failed to pre-isolate pod");
+            }
+        }
+    })
+}
+
+fn get_pods_to_pre_isolate(config: &Config, stores: &Stores, node_name: &str) -> Vec<Pod> {
+    stores
+        .pods()
+        .into_iter()
+        .filter(|pod| try_some!(pod.spec?.node_name?).map(String::as_str) == Some(node_name))
+        .filter(|pod| matches!(get_pod_draining_info(pod), PodDrainingInfo::None))
+        .filter(|pod| is_pod_in_scope(config, pod) && !is_owned_by_ignored_kind(config, pod))
+        .filter(|pod| !has_only_excluded_containers(config, pod))
+        .filter(|pod| is_pod_ready(config, pod) && should_drain_pod(config, stores, pod))
+        .map(|pod| pod.as_ref().clone())
+        .collect()
+}
+
+/// The node is uncordoned before the evictions, so the pods that haven't been evicted are served again.
+async fn release_pods_on(
+    api_resolver: &ApiResolver,
+    config: &Config,
+    stores: &Stores,
+    node_name: &str,
+) {
+    let span = span!(Level::ERROR, "pre-isolator", node_name);
+    instrumented!(span, async move {
+        let pods = get_pods_to_release(stores, node_name);
+        info!(count = pods.len(), "releasing pods on the uncordoned node");
+        for pod in pods {
+            if let Err(err) = patch_pod_release(api_resolver, config, &pod).await {
+                error!(?err, pod = pod.name_any(), "failed to release pod");
+            }
+        }
+    })
+}
+
+fn get_pods_to_release(stores: &Stores, node_name: &str) -> Vec<Pod> {
+    stores
+        .pods()
+        .into_iter()
+        .filter(|pod| try_some!(pod.spec?.node_name?).map(String::as_str) == Some(node_name))
+        .filter(|pod| matches!(get_pod_draining_info(pod), PodDrainingInfo::DrainUntil(_)))
+        .filter(|pod| is_pod_pre_isolated(pod) && get_pod_evict_params(pod).is_none())
+        .map(|pod| pod.as_ref().clone())
+        .collect()
+}
+
+/// The pods that the evictions wouldn't drain are left to be evicted as they are.
+fn try_reserve_pre_isolation(
+    config: &Config,
+    stores: &Stores,
+    drain_reservations: &DrainReservations,
+    pod: &Pod,
+    now: DateTime<Utc>,
+) -> Option<DrainReservation> {
+    if !is_within_active_hours(config, now) {
+        debug!(
+            pod = pod.name_any(),
+            "not pre-isolating outside the active hours"
+        );
+        return None;
+    }
+
+    if would_violate_pod_disruption_budget(config, stores, pod) {
+        debug!(
+            pod = pod.name_any(),
+            "not pre-isolating since it would violate the PodDisruptionBudget"
+        );
+        return None;
+    }
+
+    let reservation = drain_reservations.try_reserve(config, stores, pod);
+    if reservation.is_none() {
+        debug!(
+            pod = pod.name_any(),
+            "not pre-isolating since too many pods of the same service are draining"
+        );
+    }
+    reservation
+}
+
+async fn pre_isolate_pod(
+    api_resolver: &ApiResolver,
+    config: &Config,
+    stores: &Stores,
+    loadbalancing: &LoadBalancingConfig,
+    drain_reservations: &DrainReservations,
+    clock: &Clock,
+    pod: &Pod,
+) -> Result<()> {
+    let now = clock.now();
+    let Some(reservation) = try_reserve_pre_isolation(config, stores, drain_reservations, pod, now)
+    else {
+        return Ok(());
+    };
+
+    let delete_after = get_delete_after(config, stores, pod);
+    let drain_until = now + chrono::Duration::from_std(delete_after)?;
+    let target_groups = get_exposing_target_group_arns(config, stores, pod);
+    let result = patch_pod_pre_isolate(
+        api_resolver,
+        config,
+        pod,
+        now,
+        drain_until,
+        loadbalancing,
+        &target_groups,
+    )
+    .await
+    .context("apply patch")?;
+    if result.is_some() {
+        reservation.keep();
+        debug!(pod = pod.name_any(), %drain_until, "pod is pre-isolated");
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    use crate::from_json;
+    use crate::test_utils::store_from;
+
+    fn ready_pod_on(name: &str, node_name: &str) -> Pod {
+        from_json!({
+            "metadata": {
+                "name": name,
+                "namespace": "ns",
+                "annotations": {
+                    "drain": "true"
+                }
+            },
+            "spec": {
+                "nodeName": node_name,
+            },
+            "status": {
+                "conditions": [
+                    {
+                        "status": "True",
+                        "type": "Ready"
+                    },
+                ],
+            }
+        })
+    }
+
+    #[test]
+    fn should_release_pre_isolated_pods_not_evicted_yet() {
+        let pre_isolated = |name: &str, annotations: serde_json::Value| -> Pod {
+            from_json!({
+                "metadata": {
+                    "name": name,
+                    "namespace": "ns",
+                    "labels": {
+                        "pod-graceful-drain/draining": "true",
+                    },
+                    "annotations": annotations,
+                },
+                "spec": {
+                    "nodeName": "node1",
+                },
+            })
+        };
+
+        let stores = Stores::new(
+            store_from([
+                pre_isolated(
+                    "pre-isolated",
+                    serde_json::json!({
+                        "pod-graceful-drain/drain-until": "2023-02-08T15:30:00Z",
+                        "pod-graceful-drain/pre-isolated": "true",
+                    }),
+                ),
+                pre_isolated(
+                    "evicted",
+                    serde_json::json!({
+                        "pod-graceful-drain/drain-until": "2023-02-08T15:30:00Z",
+                        "pod-graceful-drain/pre-isolated": "true",
+                        "pod-graceful-drain/delete-options": "{}",
+                    }),
+                ),
+                pre_isolated(
+                    "deleted",
+                    serde_json::json!({
+                        "pod-graceful-drain/drain-until": "2023-02-08T15:30:00Z",
+                    }),
+                ),
+                ready_pod_on("serving", "node1"),
+            ]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+        );
+
+        let pods = get_pods_to_release(&stores, "node1");
+        assert_eq!(pods.len(), 1);
+        assert_eq!(pods[0].name_any(), "pre-isolated");
+        assert!(get_pods_to_release(&stores, "node2").is_empty());
+    }
+
+    #[test]
+    fn should_pre_isolate_pods_on_the_node() {
+        let config = Config {
+            drain_predicate: crate::DrainPredicate::Annotation,
+            drain_annotation: Some(String::from("drain")),
+            ..Config::default()
+        };
+        let stores = Stores::new(
+            store_from([ready_pod_on("pod1", "node1"), ready_pod_on("pod2", "node2")]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+        );
+
+        let pods = get_pods_to_pre_isolate(&config, &stores, "node1");
+        assert_eq!(pods.len(), 1);
+        assert_eq!(pods[0].name_any(), "pod1");
+    }
+
+    #[test]
+    fn pre_isolation_should_be_checked_like_the_evictions() {
+        let serving_pod = |name: &str| -> Pod {
+            from_json!({
+                "metadata": {
+                    "name": name,
+                    "namespace": "ns",
+                    "labels": {
+                        "app": "test",
+                    },
+                },
+                "spec": {
+                    "nodeName": "node1",
+                },
+                "status": {
+                    "conditions": [{ "status": "True", "type": "Ready" }],
+                },
+            })
+        };
+        let pod = serving_pod("pod1");
+        let now = DateTime::parse_from_rfc3339("2023-02-08T15:30:00Z")
+            .unwrap()
+            .with_timezone(&Utc);
+        let drain_reservations = DrainReservations::default();
+
+        let stores = Stores::new(
+            store_from([pod.clone()]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+        );
+        assert!(try_reserve_pre_isolation(
+            &Config::default(),
+            &stores,
+            &drain_reservations,
+            &pod,
+            now
+        )
+        .is_some());
+
+        let config = Config {
+            active_hours: Some("09:00-10:00".parse().unwrap()),
+            ..Config::default()
+        };
+        assert!(
+            try_reserve_pre_isolation(&config, &stores, &drain_reservations, &pod, now).is_none(),
+            "outside the active hours"
+        );
+
+        let stores_with_pdb = Stores::new(
+            store_from([pod.clone()]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+            store_from([from_json!({
+                "metadata": { "name": "pdb", "namespace": "ns" },
+                "spec": {
+                    "minAvailable": 1,
+                    "selector": { "matchLabels": { "app": "test" } },
+                },
+            })]),
+        );
+        assert!(
+            try_reserve_pre_isolation(
+                &Config::default(),
+                &stores_with_pdb,
+                &drain_reservations,
+                &pod,
+                now
+            )
+            .is_none(),
+            "would violate the PodDisruptionBudget"
+        );
+
+        let config = Config {
+            max_concurrent_drains_fraction: Some(0.5),
+            ..Config::default()
+        };
+        let other = serving_pod("pod2");
+        let stores_with_service = Stores::new(
+            store_from([pod.clone(), other.clone()]),
+            store_from([from_json!({
+                "metadata": { "name": "svc", "namespace": "ns" },
+                "spec": { "selector": { "app": "test" } },
+            })]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+        );
+        try_reserve_pre_isolation(
+            &config,
+            &stores_with_service,
+            &drain_reservations,
+            &other,
+            now,
+        )
+        .unwrap()
+        .keep();
+        assert!(
+            try_reserve_pre_isolation(
+                &config,
+                &stores_with_service,
+                &drain_reservations,
+                &pod,
+                now
+            )
+            .is_none(),
+            "too many pods of the same service are draining"
+        );
+    }
+}
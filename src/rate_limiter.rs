@@ -0,0 +1,102 @@
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+
+use tokio::time::Instant;
+
+/// Token bucket rate limiter. Callers are queued when they run out of the burst.
+#[derive(Clone)]
+pub struct RateLimiter {
+    bucket: Option<Arc<Mutex<TokenBucket>>>,
+}
+
+struct TokenBucket {
+    qps: f64,
+    burst: f64,
+    tokens: f64,
+    last: Instant,
+}
+
+impl RateLimiter {
+    pub fn new(qps: Option<f64>, burst: u32) -> Self {
+        Self {
+            bucket: qps
+                .map(|qps| Arc::new(Mutex::new(TokenBucket::new(qps, burst, Instant::now())))),
+        }
+    }
+
+    pub async fn acquire(&self) {
+        let Some(bucket) = self.bucket.as_ref() else {
+            return;
+        };
+
+        let delay = bucket.lock().unwrap().reserve(Instant::now());
+        if !delay.is_zero() {
+            tokio::time::sleep(delay).await;
+        }
+    }
+}
+
+impl TokenBucket {
+    fn new(qps: f64, burst: u32, now: Instant) -> Self {
+        let burst = f64::from(burst.max(1));
+        Self {
+            qps,
+            burst,
+            tokens: burst,
+            last: now,
+        }
+    }
+
+    /// Take a token, and returns how long to wait for it.
+    fn reserve(&mut self, now: Instant) -> Duration {
+        let elapsed = now.saturating_duration_since(self.last);
+        self.last = self.last.max(now);
+        self.tokens = (self.tokens + elapsed.as_secs_f64() * self.qps).min(self.burst);
+
+        // Tokens go negative while callers are waiting for them.
+        self.tokens -= 1.0;
+        if self.tokens >= 0.0 {
+            Duration::ZERO
+        } else {
+            Duration::from_secs_f64(-self.tokens / self.qps)
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn should_allow_burst() {
+        let now = Instant::now();
+        let mut bucket = TokenBucket::new(1.0, 3, now);
+
+        assert_eq!(bucket.reserve(now), Duration::ZERO);
+        assert_eq!(bucket.reserve(now), Duration::ZERO);
+        assert_eq!(bucket.reserve(now), Duration::ZERO);
+    }
+
+    #[test]
+    fn should_throttle_to_qps() {
+        let now = Instant::now();
+        let mut bucket = TokenBucket::new(2.0, 1, now);
+
+        assert_eq!(bucket.reserve(now), Duration::ZERO);
+        assert_eq!(bucket.reserve(now), Duration::from_millis(500));
+        assert_eq!(bucket.reserve(now), Duration::from_millis(1000));
+        assert_eq!(bucket.reserve(now), Duration::from_millis(1500));
+    }
+
+    #[test]
+    fn should_refill_tokens() {
+        let now = Instant::now();
+        let mut bucket = TokenBucket::new(2.0, 1, now);
+
+        assert_eq!(bucket.reserve(now), Duration::ZERO);
+        assert_eq!(
+            bucket.reserve(now + Duration::from_millis(500)),
+            Duration::ZERO
+        );
+    }
+}
@@ -5,23 +5,37 @@ use std::sync::Arc;
 
 use eyre::Result;
 use futures::{Stream, StreamExt, TryStreamExt};
-use k8s_openapi::api::core::v1::{PodSpec, PodStatus};
+use k8s_openapi::api::admissionregistration::v1::{
+    MutatingWebhookConfiguration, ValidatingWebhookConfiguration,
+};
+use k8s_openapi::api::core::v1::{Container, PodSpec, PodStatus};
 use k8s_openapi::api::{
     core::v1::{Pod, Service},
     networking::v1::Ingress,
+    policy::v1::PodDisruptionBudget,
 };
 use kube::runtime::reflector::store::Writer;
 use kube::runtime::reflector::{store, ObjectRef, Store};
 use kube::runtime::watcher;
 use kube::runtime::watcher::Event;
+use kube::runtime::WatchStreamExt;
 use kube::{Api, Resource};
-use tracing::{error, span, trace, Level};
+use tracing::{debug, error, span, trace, warn, Level};
 
 use crate::api_resolver::ApiResolver;
+use crate::consts::{
+    DELETE_AFTER_ANNOTATION_KEY, GATEWAY_LOAD_BALANCER_ANNOTATION_KEY,
+    SERVICE_ENABLED_ANNOTATION_KEY,
+};
 use crate::elbv2::apis::TargetGroupBinding;
+use crate::elbv2::{
+    LOAD_BALANCER_TYPE_ANNOTATION_KEY, NLB_TARGET_TYPE_ANNOTATION_KEY,
+    TARGET_GROUP_ATTRIBUTES_ANNOTATION_KEY,
+};
 use crate::service_registry::ServiceSignal;
 use crate::shutdown::Shutdown;
 use crate::spawn_service::spawn_service;
+use crate::status::is_missing_resource_error;
 use crate::{instrumented, try_some, Config, ServiceRegistry};
 
 #[derive(Clone)]
@@ -34,6 +48,10 @@ pub struct StoresInner {
     services: Store<Service>,
     ingresses: Store<Ingress>,
     tgbs: Store<TargetGroupBinding>,
+    pdbs: Store<PodDisruptionBudget>,
+    /// Only of this controller, with `--webhook-configuration-name`.
+    validating_webhook_configurations: Store<ValidatingWebhookConfiguration>,
+    mutating_webhook_configurations: Store<MutatingWebhookConfiguration>,
 }
 
 impl Stores {
@@ -42,6 +60,7 @@ impl Stores {
         services: Store<Service>,
         ingresses: Store<Ingress>,
         tgbs: Store<TargetGroupBinding>,
+        pdbs: Store<PodDisruptionBudget>,
     ) -> Self {
         Self {
             inner: Arc::new(StoresInner {
@@ -49,6 +68,9 @@ impl Stores {
                 services,
                 ingresses,
                 tgbs,
+                pdbs,
+                validating_webhook_configurations: store().0,
+                mutating_webhook_configurations: store().0,
             }),
         }
     }
@@ -71,13 +93,31 @@ pub fn start_reflectors(
             event.modify(|pod| {
                 if let Some(spec) = try_some!(mut pod.spec?) {
                     *spec = PodSpec {
+                        // keep the ports to match the target ports of the services, the hooks for the grace period,
+                        // and the names and the images for the exclusions.
+                        containers: spec
+                            .containers
+                            .iter()
+                            .map(|container| Container {
+                                name: container.name.clone(),
+                                image: container.image.clone(),
+                                ports: container.ports.clone(),
+                                lifecycle: container.lifecycle.clone(),
+                                ..Container::default()
+                            })
+                            .collect(),
+                        host_network: spec.host_network,
+                        node_name: spec.node_name.clone(),
                         readiness_gates: spec.readiness_gates.clone(),
+                        termination_grace_period_seconds: spec.termination_grace_period_seconds,
                         ..PodSpec::default()
                     }
                 }
                 if let Some(spec) = try_some!(mut pod.status?) {
+                    // keep the phase to tell the completed pods.
                     *spec = PodStatus {
                         conditions: spec.conditions.clone(),
+                        phase: spec.phase.clone(),
                         ..PodStatus::default()
                     }
                 }
@@ -92,7 +132,21 @@ pub fn start_reflectors(
         let api: Api<Service> = api_proivder.all();
         let stream = watcher(api, Default::default()).map_ok(|ev| {
             ev.modify(|service| {
-                service.metadata.annotations = None;
+                // keep the target group attributes for the deregistration delay, the opt-in, the delete-after,
+                // and the target type of the NLBs.
+                service.metadata.annotations =
+                    service.metadata.annotations.take().map(|annotations| {
+                        annotations
+                            .into_iter()
+                            .filter(|(key, _)| {
+                                key == TARGET_GROUP_ATTRIBUTES_ANNOTATION_KEY
+                                    || key == SERVICE_ENABLED_ANNOTATION_KEY
+                                    || key == DELETE_AFTER_ANNOTATION_KEY
+                                    || key == NLB_TARGET_TYPE_ANNOTATION_KEY
+                                    || key == LOAD_BALANCER_TYPE_ANNOTATION_KEY
+                            })
+                            .collect()
+                    });
                 service.metadata.labels = None;
                 service.status = None;
             })
@@ -119,24 +173,83 @@ pub fn start_reflectors(
     if !config.experimental_general_ingress {
         spawn_service(shutdown, "reflector:TargetGroupBinding", {
             let api: Api<TargetGroupBinding> = api_proivder.all();
-            let stream = watcher(api, Default::default()).map_ok(|ev| {
-                ev.modify(|tgb| {
-                    tgb.metadata.annotations = None;
-                    tgb.metadata.labels = None;
-                    tgb.status = None;
-                })
-            });
+            // The CRD might not be installed yet, so don't retry in a tight loop.
+            let stream = watcher(api, Default::default())
+                .default_backoff()
+                .map_ok(|ev| {
+                    ev.modify(|tgb| {
+                        // keep the mark of the Gateway Load Balancers.
+                        tgb.metadata.annotations =
+                            tgb.metadata.annotations.take().map(|annotations| {
+                                annotations
+                                    .into_iter()
+                                    .filter(|(key, _)| key == GATEWAY_LOAD_BALANCER_ANNOTATION_KEY)
+                                    .collect()
+                            });
+                        tgb.metadata.labels = None;
+                        tgb.status = None;
+                    })
+                });
             let signal = service_registry.register("reflector:TargetGroupBinding");
             run_reflector(shutdown, tgb_writer, stream, signal)
         })?;
     }
 
-    Ok(Stores::new(
-        pod_reader,
-        service_reader,
-        ingress_reader,
-        tgb_reader,
-    ))
+    let (pdb_reader, pdb_writer) = store();
+    spawn_service(shutdown, "reflector:PodDisruptionBudget", {
+        let api: Api<PodDisruptionBudget> = api_proivder.all();
+        let stream = watcher(api, Default::default()).map_ok(|ev| {
+            ev.modify(|pdb| {
+                pdb.metadata.annotations = None;
+                pdb.metadata.labels = None;
+                pdb.status = None;
+            })
+        });
+        let signal = service_registry.register("reflector:PodDisruptionBudget");
+        run_reflector(shutdown, pdb_writer, stream, signal)
+    })?;
+
+    let (validating_reader, validating_writer) = store();
+    let (mutating_reader, mutating_writer) = store();
+    if let Some(name) = config.webhook_configuration_name.as_ref() {
+        let watcher_config = watcher::Config::default().fields(&format!("metadata.name={name}"));
+
+        spawn_service(shutdown, "reflector:ValidatingWebhookConfiguration", {
+            let api: Api<ValidatingWebhookConfiguration> = api_proivder.all();
+            let stream = watcher(api, watcher_config.clone()).map_ok(|ev| {
+                ev.modify(|configuration| {
+                    configuration.metadata.annotations = None;
+                    configuration.metadata.labels = None;
+                })
+            });
+            let signal = service_registry.register("reflector:ValidatingWebhookConfiguration");
+            run_reflector(shutdown, validating_writer, stream, signal)
+        })?;
+
+        spawn_service(shutdown, "reflector:MutatingWebhookConfiguration", {
+            let api: Api<MutatingWebhookConfiguration> = api_proivder.all();
+            let stream = watcher(api, watcher_config).map_ok(|ev| {
+                ev.modify(|configuration| {
+                    configuration.metadata.annotations = None;
+                    configuration.metadata.labels = None;
+                })
+            });
+            let signal = service_registry.register("reflector:MutatingWebhookConfiguration");
+            run_reflector(shutdown, mutating_writer, stream, signal)
+        })?;
+    }
+
+    Ok(Stores {
+        inner: Arc::new(StoresInner {
+            pods: pod_reader,
+            services: service_reader,
+            ingresses: ingress_reader,
+            tgbs: tgb_reader,
+            pdbs: pdb_reader,
+            validating_webhook_configurations: validating_reader,
+            mutating_webhook_configurations: mutating_reader,
+        }),
+    })
 }
 
 fn run_reflector<K>(
@@ -168,6 +281,13 @@ where
                         signal.ready();
                         break;
                     }
+
+                    // There are none until the CRD is installed, and the watcher picks them up after that.
+                    if matches!(&result, Err(err) if is_missing_resource_error(err)) {
+                        warn!("resource is not installed, assuming there are none");
+                        signal.ready();
+                        break;
+                    }
                 }
 
                 while let Some(result) = results.next().await {
@@ -200,6 +320,9 @@ where
                                 trace!("stream restart done");
                             }
                         },
+                        Err(err) if is_missing_resource_error(err) => {
+                            debug!(?err, "resource is not installed");
+                        }
                         Err(err) => {
                             error!(?err, "reflector error");
                         }
@@ -215,10 +338,18 @@ impl Stores {
         self.inner.pods.get(key)
     }
 
+    pub fn pods(&self) -> Vec<Arc<Pod>> {
+        self.inner.pods.state()
+    }
+
     pub fn get_service(&self, key: &ObjectRef<Service>) -> Option<Arc<Service>> {
         self.inner.services.get(key)
     }
 
+    pub fn services(&self) -> Vec<Arc<Service>> {
+        self.inner.services.state()
+    }
+
     pub fn ingresses(&self) -> Vec<Arc<Ingress>> {
         self.inner.ingresses.state()
     }
@@ -226,4 +357,16 @@ impl Stores {
     pub fn target_group_bindings(&self) -> Vec<Arc<TargetGroupBinding>> {
         self.inner.tgbs.state()
     }
+
+    pub fn pod_disruption_budgets(&self) -> Vec<Arc<PodDisruptionBudget>> {
+        self.inner.pdbs.state()
+    }
+
+    pub fn validating_webhook_configurations(&self) -> Vec<Arc<ValidatingWebhookConfiguration>> {
+        self.inner.validating_webhook_configurations.state()
+    }
+
+    pub fn mutating_webhook_configurations(&self) -> Vec<Arc<MutatingWebhookConfiguration>> {
+        self.inner.mutating_webhook_configurations.state()
+    }
 }
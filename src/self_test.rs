@@ -0,0 +1,106 @@
+use eyre::{eyre, Context, Result};
+use k8s_openapi::api::core::v1::Pod;
+use kube::api::{DeleteParams, PostParams};
+use kube::{Api, ResourceExt};
+use tracing::{info, span, warn, Level};
+
+use crate::api_resolver::ApiResolver;
+use crate::clock::Clock;
+use crate::consts::CONTROLLER_NAME;
+use crate::controller::delete_pod;
+use crate::pod_draining_info::{get_pod_draining_info, PodDrainingInfo};
+use crate::status::is_404_not_found_error;
+use crate::webhooks::{patch_pod_isolate, IsolateOptions};
+use crate::{instrumented, Config, LoadBalancingConfig};
+
+const CANARY_IMAGE: &str = "registry.k8s.io/pause:3.9";
+
+/// Isolate and delete a throwaway canary pod through the same path as the drained pods,
+/// so that missing permissions or api incompatibilities fail the startup rather than the drains.
+pub async fn run_self_test(
+    api_resolver: &ApiResolver,
+    config: &Config,
+    loadbalancing: &LoadBalancingConfig,
+    clock: &Clock,
+    namespace: &str,
+) -> Result<()> {
+    let span = span!(Level::ERROR, "self-test", namespace);
+    instrumented!(span, async move {
+        let api: Api<Pod> = Api::namespaced(api_resolver.client.clone(), namespace);
+        let pod = api
+            .create(&PostParams::default(), &make_canary_pod())
+            .await
+            .context("create canary pod")?;
+
+        let result = exercise(api_resolver, config, loadbalancing, clock, &pod).await;
+        if result.is_err() {
+            // don't leave the canary behind.
+            match api.delete(&pod.name_any(), &DeleteParams::default()).await {
+                Err(err) if !is_404_not_found_error(&err) => {
+                    warn!(?err, pod = pod.name_any(), "failed to clean up canary pod");
+                }
+                _ => {}
+            }
+        }
+
+        result?;
+        info!("self-test passed");
+        Ok(())
+    })
+}
+
+async fn exercise(
+    api_resolver: &ApiResolver,
+    config: &Config,
+    loadbalancing: &LoadBalancingConfig,
+    clock: &Clock,
+    pod: &Pod,
+) -> Result<()> {
+    let isolated = patch_pod_isolate(
+        api_resolver,
+        config,
+        pod,
+        clock.now(),
+        clock.now(),
+        loadbalancing,
+        IsolateOptions {
+            cut_owner_references: true,
+            ..IsolateOptions::default()
+        },
+    )
+    .await
+    .context("isolate canary pod")?
+    .ok_or(eyre!("canary pod is gone before the isolation"))?;
+
+    if !matches!(
+        get_pod_draining_info(&isolated),
+        PodDrainingInfo::DrainUntil(_)
+    ) {
+        return Err(eyre!("canary pod is not isolated"));
+    }
+
+    delete_pod(api_resolver, &isolated)
+        .await
+        .context("delete canary pod")?;
+    Ok(())
+}
+
+fn make_canary_pod() -> Pod {
+    serde_json::from_value(serde_json::json!({
+        "metadata": {
+            "generateName": format!("{CONTROLLER_NAME}-self-test-"),
+            "labels": {
+                "app.kubernetes.io/name": CONTROLLER_NAME,
+                "app.kubernetes.io/component": "self-test",
+            },
+        },
+        "spec": {
+            "containers": [{
+                "name": "canary",
+                "image": CANARY_IMAGE,
+            }],
+            "terminationGracePeriodSeconds": 0,
+        },
+    }))
+    .expect("valid pod")
+}
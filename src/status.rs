@@ -1,4 +1,5 @@
 use kube::error::ErrorResponse;
+use kube::runtime::watcher;
 use kube::Error;
 
 const STATUS_CODE_404_NOT_FOUND: u16 = 404;
@@ -42,14 +43,23 @@ pub fn is_410_gone_error(err: &Error) -> bool {
     )
 }
 
+/// The message of the generic server response that the api server wraps the JSON patch failures with.
+/// The validation errors are `422 Invalid` as well, but they have their own messages.
+const GENERIC_SERVER_RESPONSE_422_MESSAGE: &str =
+    "the server rejected our request due to an error in our request";
+
+/// e.g. the `test` operation of the JSON patch failed since the pod has changed in the meantime.
 pub fn is_generic_server_response_422_invalid_for_json_patch_error(err: &Error) -> bool {
     matches!(
         err,
         Error::Api(ErrorResponse {
             code,
             reason,
+            message,
             ..
-        }) if *code == STATUS_CODE_422_UNPROCESSABLE_ENTITY && reason == "Invalid"
+        }) if *code == STATUS_CODE_422_UNPROCESSABLE_ENTITY
+            && reason == "Invalid"
+            && message.starts_with(GENERIC_SERVER_RESPONSE_422_MESSAGE)
     )
 }
 
@@ -70,3 +80,104 @@ pub fn is_transient_error(err: &Error) -> bool {
         _ => false,
     }
 }
+
+/// Returns true if the error is caused by a transient kube api error or a conflict,
+/// so that retrying the whole request would likely succeed.
+pub fn is_retryable(err: &eyre::Report) -> bool {
+    err.chain()
+        .filter_map(|err| err.downcast_ref::<Error>())
+        .any(|err| {
+            is_transient_error(err)
+                || is_409_conflict_error(err)
+                || is_generic_server_response_422_invalid_for_json_patch_error(err)
+        })
+}
+
+/// The api server returns 404 on the list of resources whose CRD isn't installed, e.g. TargetGroupBindings
+/// in a cluster without the AWS load balancer controller yet.
+pub fn is_missing_resource_error(err: &watcher::Error) -> bool {
+    match err {
+        watcher::Error::InitialListFailed(err)
+        | watcher::Error::WatchStartFailed(err)
+        | watcher::Error::WatchFailed(err) => is_404_not_found_error(err),
+        watcher::Error::WatchError(response) => response.code == STATUS_CODE_404_NOT_FOUND,
+        _ => false,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn api_error(code: u16, reason: &str) -> Error {
+        api_error_with_message(code, reason, "message")
+    }
+
+    fn api_error_with_message(code: u16, reason: &str, message: &str) -> Error {
+        Error::Api(ErrorResponse {
+            status: String::from("Failure"),
+            message: String::from(message),
+            reason: String::from(reason),
+            code,
+        })
+    }
+
+    #[test]
+    fn conflict_should_be_retryable() {
+        let err = eyre::Report::new(api_error(STATUS_CODE_409_CONFLICT, "Conflict"))
+            .wrap_err("apply patch");
+        assert!(is_retryable(&err));
+    }
+
+    #[test]
+    fn exhausted_patch_conflicts_should_be_retryable() {
+        let err = eyre::Report::new(api_error_with_message(
+            STATUS_CODE_422_UNPROCESSABLE_ENTITY,
+            "Invalid",
+            "the server rejected our request due to an error in our request",
+        ))
+        .wrap_err("no more retries")
+        .wrap_err("apply patch");
+        assert!(is_retryable(&err));
+    }
+
+    #[test]
+    fn validation_error_should_not_be_retryable() {
+        let err = eyre::Report::new(api_error_with_message(
+            STATUS_CODE_422_UNPROCESSABLE_ENTITY,
+            "Invalid",
+            "Pod \"pod\" is invalid: metadata.labels: Invalid value",
+        ))
+        .wrap_err("apply patch");
+        assert!(!is_retryable(&err));
+    }
+
+    #[test]
+    fn timeout_should_be_retryable() {
+        let err = eyre::Report::new(api_error(STATUS_CODE_504_GATEWAY_TIMEOUT, "Timeout"))
+            .wrap_err("checking permission");
+        assert!(is_retryable(&err));
+    }
+
+    #[test]
+    fn forbidden_should_not_be_retryable() {
+        let err = eyre::Report::new(api_error(403, "Forbidden")).wrap_err("checking permission");
+        assert!(!is_retryable(&err));
+    }
+
+    #[test]
+    fn list_of_missing_crd_should_be_missing_resource() {
+        let err =
+            watcher::Error::InitialListFailed(api_error(STATUS_CODE_404_NOT_FOUND, "NotFound"));
+        assert!(is_missing_resource_error(&err));
+
+        let err = watcher::Error::InitialListFailed(api_error(403, "Forbidden"));
+        assert!(!is_missing_resource_error(&err));
+    }
+
+    #[test]
+    fn decode_error_should_not_be_retryable() {
+        let err = eyre::eyre!("annotation 'pod-graceful-drain/drain-until' has invalid format");
+        assert!(!is_retryable(&err));
+    }
+}
@@ -0,0 +1,100 @@
+use axum::http::HeaderMap;
+use eyre::Result;
+use opentelemetry::propagation::{Extractor, TextMapPropagator};
+use opentelemetry::KeyValue;
+use opentelemetry_otlp::WithExportConfig;
+use opentelemetry_sdk::propagation::TraceContextPropagator;
+use opentelemetry_sdk::{runtime, trace, Resource};
+use tracing::{Span, Subscriber};
+use tracing_opentelemetry::{OpenTelemetryLayer, OpenTelemetrySpanExt};
+use tracing_subscriber::registry::LookupSpan;
+
+use crate::consts::CONTROLLER_NAME;
+
+/// A layer that exports spans to the OTLP collector at the endpoint.
+pub fn otlp_layer<S>(endpoint: &str) -> Result<OpenTelemetryLayer<S, trace::Tracer>>
+where
+    S: Subscriber + for<'span> LookupSpan<'span>,
+{
+    let tracer =
+        opentelemetry_otlp::new_pipeline()
+            .tracing()
+            .with_exporter(
+                opentelemetry_otlp::new_exporter()
+                    .tonic()
+                    .with_endpoint(endpoint),
+            )
+            .with_trace_config(trace::Config::default().with_resource(Resource::new([
+                KeyValue::new("service.name", CONTROLLER_NAME),
+            ])))
+            .install_batch(runtime::TokioCurrentThread)?;
+
+    Ok(tracing_opentelemetry::layer().with_tracer(tracer))
+}
+
+/// Flush the spans that are not exported yet.
+pub fn shutdown_otlp() {
+    opentelemetry::global::shutdown_tracer_provider();
+}
+
+/// Continue the api server's trace if it is propagated with `traceparent` header.
+pub(crate) fn set_parent_from_headers(span: &Span, headers: &HeaderMap) {
+    let context = TraceContextPropagator::new().extract(&HeaderExtractor(headers));
+    span.set_parent(context);
+}
+
+struct HeaderExtractor<'a>(&'a HeaderMap);
+
+impl Extractor for HeaderExtractor<'_> {
+    fn get(&self, key: &str) -> Option<&str> {
+        self.0.get(key)?.to_str().ok()
+    }
+
+    fn keys(&self) -> Vec<&str> {
+        self.0.keys().map(|key| key.as_str()).collect()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    use axum::http::HeaderValue;
+    use opentelemetry::trace::{TraceId, TracerProvider as _};
+    use opentelemetry_sdk::testing::trace::InMemorySpanExporter;
+    use opentelemetry_sdk::trace::TracerProvider;
+    use tracing::{field, span, Level};
+    use tracing_subscriber::layer::SubscriberExt;
+
+    #[test]
+    fn span_should_continue_propagated_trace() {
+        let exporter = InMemorySpanExporter::default();
+        let provider = TracerProvider::builder()
+            .with_simple_exporter(exporter.clone())
+            .build();
+        let subscriber = tracing_subscriber::registry()
+            .with(tracing_opentelemetry::layer().with_tracer(provider.tracer("test")));
+
+        let mut headers = HeaderMap::new();
+        headers.insert(
+            "traceparent",
+            HeaderValue::from_static("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"),
+        );
+
+        tracing::subscriber::with_default(subscriber, || {
+            let span = span!(Level::ERROR, "admission", decision = field::Empty);
+            set_parent_from_headers(&span, &headers);
+            span.record("decision", "delay");
+        });
+
+        let spans = exporter.get_finished_spans().unwrap();
+        assert_eq!(spans.len(), 1);
+        assert_eq!(
+            spans[0].span_context.trace_id(),
+            TraceId::from_hex("0af7651916cd43dd8448eb211c80319c").unwrap()
+        );
+        assert!(spans[0]
+            .attributes
+            .contains(&KeyValue::new("decision", "delay")));
+    }
+}
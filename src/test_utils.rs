@@ -0,0 +1,134 @@
+//! Fixtures shared by the unit tests.
+
+use std::hash::Hash;
+use std::sync::{Arc, Mutex};
+
+use axum::body::Body;
+use axum::extract::{Request, State};
+use axum::middleware::Next;
+use axum::response::Response;
+use axum::routing::{get, post};
+use axum::{Json, Router};
+use kube::runtime::reflector::{store, Store};
+use kube::runtime::watcher::Event;
+use kube::Resource;
+use serde_json::{json, Value};
+
+use crate::ApiResolver;
+
+#[macro_export]
+macro_rules! from_json {
+    ($($json:tt)+) => {
+        ::serde_json::from_value(::serde_json::json!($($json)+)).expect("Invalid json")
+    };
+}
+
+pub fn store_from<K>(iter: impl IntoIterator<Item = K>) -> Store<K>
+where
+    K: 'static + Resource + Clone,
+    K::DynamicType: Hash + Eq + Clone + Default,
+{
+    let (reader, mut writer) = store();
+    writer.apply_watcher_event(&Event::Init);
+    for item in iter.into_iter() {
+        writer.apply_watcher_event(&Event::InitApply(item));
+    }
+    writer.apply_watcher_event(&Event::InitDone);
+    reader
+}
+
+/// A fake api server that records the requests in order, as `METHOD uri body`.
+pub struct FakeApiServer {
+    pub api_resolver: ApiResolver,
+    requests: Arc<Mutex<Vec<String>>>,
+}
+
+impl FakeApiServer {
+    pub async fn serve(app: Router) -> Self {
+        let requests = Arc::new(Mutex::new(Vec::new()));
+        let app = app.layer(axum::middleware::from_fn_with_state(
+            requests.clone(),
+            record_request,
+        ));
+
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        tokio::spawn(async move { axum::serve(listener, app).await.unwrap() });
+
+        let api_resolver =
+            ApiResolver::try_new(kube::Config::new(format!("http://{addr}").parse().unwrap()))
+                .unwrap();
+        Self {
+            api_resolver,
+            requests,
+        }
+    }
+
+    /// Every recorded request.
+    pub fn requests(&self) -> Vec<String> {
+        self.requests.lock().unwrap().clone()
+    }
+
+    /// The recorded requests to the pods, without the events and the other noises.
+    pub fn pod_requests(&self) -> Vec<String> {
+        self.requests()
+            .into_iter()
+            .filter(|request| request.contains("/pods/"))
+            .collect()
+    }
+}
+
+async fn record_request(
+    State(requests): State<Arc<Mutex<Vec<String>>>>,
+    request: Request,
+    next: Next,
+) -> Response {
+    let (parts, body) = request.into_parts();
+    let bytes = axum::body::to_bytes(body, usize::MAX)
+        .await
+        .unwrap_or_default();
+    let entry = format!(
+        "{} {} {}",
+        parts.method,
+        parts.uri,
+        String::from_utf8_lossy(&bytes)
+    );
+    requests
+        .lock()
+        .unwrap()
+        .push(String::from(entry.trim_end()));
+
+    next.run(Request::from_parts(parts, Body::from(bytes)))
+        .await
+}
+
+/// Answers every read and write of the pods with `pod`, as if they succeeded.
+pub fn pod_routes(pod: Value) -> Router {
+    let pod_route = {
+        let pod = pod.clone();
+        move || async move { Json(pod) }
+    };
+
+    Router::new()
+        .route(
+            "/api/v1/namespaces/:namespace/pods/:name",
+            get(pod_route.clone())
+                .patch(pod_route.clone())
+                .delete(pod_route.clone()),
+        )
+        .route(
+            "/api/v1/namespaces/:namespace/pods/:name/status",
+            get(pod_route.clone()).patch(pod_route),
+        )
+        .route(
+            "/api/v1/namespaces/:namespace/pods/:name/eviction",
+            post(|| async {
+                Json(json!({
+                    "apiVersion": "v1",
+                    "kind": "Status",
+                    "metadata": {},
+                    "status": "Success",
+                }))
+            }),
+        )
+}
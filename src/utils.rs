@@ -1,6 +1,8 @@
+use std::collections::BTreeMap;
+
 use eyre::eyre;
 use eyre::Result;
-use k8s_openapi::apimachinery::pkg::apis::meta::v1::DeleteOptions;
+use k8s_openapi::apimachinery::pkg::apis::meta::v1::{DeleteOptions, LabelSelector};
 use kube::api::{DeleteParams, Preconditions, PropagationPolicy};
 use kube::runtime::reflector::ObjectRef;
 use kube::Resource;
@@ -50,6 +52,36 @@ pub(crate) fn to_delete_params(
     })
 }
 
+/// Empty selector matches everything, as the Kubernetes does.
+pub(crate) fn matches_label_selector(
+    selector: &LabelSelector,
+    labels: &BTreeMap<String, String>,
+) -> bool {
+    for (key, value) in selector.match_labels.iter().flatten() {
+        if labels.get(key) != Some(value) {
+            return false;
+        }
+    }
+
+    for requirement in selector.match_expressions.iter().flatten() {
+        let label = labels.get(&requirement.key);
+        let values = requirement.values.as_deref().unwrap_or_default();
+        let matched = match requirement.operator.as_str() {
+            "In" => matches!(label, Some(label) if values.contains(label)),
+            "NotIn" => !matches!(label, Some(label) if values.contains(label)),
+            "Exists" => label.is_some(),
+            "DoesNotExist" => label.is_none(),
+            _ => false,
+        };
+
+        if !matched {
+            return false;
+        }
+    }
+
+    true
+}
+
 #[macro_export]
 macro_rules! instrumented {
     ($span:expr, $($tt:tt)+) => {{
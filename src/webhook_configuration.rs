@@ -0,0 +1,153 @@
+use std::time::Duration;
+
+use k8s_openapi::api::admissionregistration::v1::{
+    MutatingWebhookConfiguration, ValidatingWebhookConfiguration, WebhookClientConfig,
+};
+
+use crate::reflector::Stores;
+use crate::try_some;
+
+/// The api server waits this long for the webhooks without `timeoutSeconds`.
+const DEFAULT_WEBHOOK_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// The `timeoutSeconds` of the validating webhook served at the path, discovered with `--webhook-configuration-name`.
+/// It is for the admissions without the `timeout` parameter, ahead of `--fallback-admission-delay-timeout`.
+pub fn get_validating_webhook_timeout(stores: &Stores, path: &str) -> Option<Duration> {
+    stores
+        .validating_webhook_configurations()
+        .iter()
+        .find_map(|configuration| get_validating_timeout(configuration, path))
+}
+
+/// Same as above, for the mutating webhook.
+pub fn get_mutating_webhook_timeout(stores: &Stores, path: &str) -> Option<Duration> {
+    stores
+        .mutating_webhook_configurations()
+        .iter()
+        .find_map(|configuration| get_mutating_timeout(configuration, path))
+}
+
+fn get_validating_timeout(
+    configuration: &ValidatingWebhookConfiguration,
+    path: &str,
+) -> Option<Duration> {
+    let webhooks = configuration.webhooks.as_ref()?;
+    find_webhook_timeout(
+        webhooks
+            .iter()
+            .map(|webhook| (&webhook.client_config, webhook.timeout_seconds)),
+        path,
+    )
+}
+
+fn get_mutating_timeout(
+    configuration: &MutatingWebhookConfiguration,
+    path: &str,
+) -> Option<Duration> {
+    let webhooks = configuration.webhooks.as_ref()?;
+    find_webhook_timeout(
+        webhooks
+            .iter()
+            .map(|webhook| (&webhook.client_config, webhook.timeout_seconds)),
+        path,
+    )
+}
+
+/// The configuration might have other webhooks, so only the one served at the path counts.
+fn find_webhook_timeout<'a>(
+    webhooks: impl IntoIterator<Item = (&'a WebhookClientConfig, Option<i32>)>,
+    path: &str,
+) -> Option<Duration> {
+    webhooks
+        .into_iter()
+        .find(|(client_config, _)| {
+            try_some!(client_config.service?.path?).map(String::as_str) == Some(path)
+        })
+        .map(|(_, timeout_seconds)| match timeout_seconds {
+            Some(timeout_seconds) => Duration::from_secs(timeout_seconds.max(0) as u64),
+            None => DEFAULT_WEBHOOK_TIMEOUT,
+        })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    use crate::from_json;
+
+    fn make_validating_webhook_configuration(
+        timeout_seconds: Option<i32>,
+    ) -> ValidatingWebhookConfiguration {
+        from_json!({
+            "metadata": {
+                "name": "pod-graceful-drain-webhook",
+            },
+            "webhooks": [
+                {
+                    "name": "other.example.com",
+                    "admissionReviewVersions": ["v1"],
+                    "clientConfig": {
+                        "service": { "namespace": "ns", "name": "other", "path": "/other" },
+                    },
+                    "sideEffects": "None",
+                    "timeoutSeconds": 5,
+                },
+                {
+                    "name": "validate.pod-graceful-drain.io",
+                    "admissionReviewVersions": ["v1"],
+                    "clientConfig": {
+                        "service": { "namespace": "ns", "name": "webhook", "path": "/webhook/validate" },
+                    },
+                    "sideEffects": "None",
+                    "timeoutSeconds": timeout_seconds,
+                },
+            ],
+        })
+    }
+
+    #[test]
+    fn should_discover_custom_timeout_of_the_webhook() {
+        let configuration = make_validating_webhook_configuration(Some(25));
+        assert_eq!(
+            get_validating_timeout(&configuration, "/webhook/validate"),
+            Some(Duration::from_secs(25))
+        );
+        assert_eq!(
+            get_validating_timeout(&configuration, "/webhook/unknown"),
+            None
+        );
+    }
+
+    #[test]
+    fn should_assume_default_timeout_when_unset() {
+        let configuration = make_validating_webhook_configuration(None);
+        assert_eq!(
+            get_validating_timeout(&configuration, "/webhook/validate"),
+            Some(DEFAULT_WEBHOOK_TIMEOUT)
+        );
+    }
+
+    #[test]
+    fn should_discover_timeout_of_mutating_webhook() {
+        let configuration: MutatingWebhookConfiguration = from_json!({
+            "metadata": {
+                "name": "pod-graceful-drain-webhook",
+            },
+            "webhooks": [
+                {
+                    "name": "mutate.pod-graceful-drain.io",
+                    "admissionReviewVersions": ["v1"],
+                    "clientConfig": {
+                        "service": { "namespace": "ns", "name": "webhook", "path": "/webhook/mutate" },
+                    },
+                    "sideEffects": "NoneOnDryRun",
+                    "timeoutSeconds": 20,
+                },
+            ],
+        });
+        assert_eq!(
+            get_mutating_timeout(&configuration, "/webhook/mutate"),
+            Some(Duration::from_secs(20))
+        );
+    }
+}
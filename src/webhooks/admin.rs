@@ -0,0 +1,231 @@
+use std::path::Path;
+
+use axum::extract::{Query, State};
+use axum::http::{header, HeaderMap, StatusCode};
+use eyre::Result;
+use k8s_openapi::api::core::v1::Pod;
+use k8s_openapi::api::policy::v1::Eviction;
+use kube::runtime::reflector::ObjectRef;
+use kube::Api;
+use serde::Deserialize;
+use tracing::{error, info, warn};
+
+use crate::controller::disable_wait_and_delete_pod;
+use crate::pod_draining_info::{get_pod_draining_info, PodDrainingInfo};
+use crate::status::is_404_not_found_error;
+use crate::webhooks::AppState;
+
+#[derive(Debug, Deserialize)]
+pub(super) struct AdminDeleteParams {
+    namespace: String,
+    name: String,
+}
+
+/// `POST /delete?namespace=&name=` completes the drain of an isolated pod right away, for the incident response.
+///
+/// It is authenticated by the bearer token in `--admin-token-file`, and disabled without it.
+/// The delayed admissions of the pod are cancelled, so they go through as well.
+pub(super) async fn admin_delete_handler(
+    State(state): State<AppState>,
+    headers: HeaderMap,
+    Query(params): Query<AdminDeleteParams>,
+) -> (StatusCode, String) {
+    let Some(token_file) = state.config.admin_token_file.as_deref() else {
+        return (StatusCode::NOT_FOUND, String::from("admin api is disabled"));
+    };
+
+    match is_authorized(token_file, &headers).await {
+        Ok(true) => {}
+        Ok(false) => return (StatusCode::UNAUTHORIZED, String::from("unauthorized")),
+        Err(err) => {
+            error!(?err, "failed to read the admin token");
+            return (StatusCode::INTERNAL_SERVER_ERROR, err.to_string());
+        }
+    }
+
+    let api: Api<Pod> = state.api_resolver.namespaced(&params.namespace);
+    let pod = match api.get(&params.name).await {
+        Ok(pod) => pod,
+        Err(err) if is_404_not_found_error(&err) => {
+            return (StatusCode::NOT_FOUND, String::from("pod not found"));
+        }
+        Err(err) => return (StatusCode::BAD_GATEWAY, err.to_string()),
+    };
+
+    // A deletion interrupted in the middle can be retried.
+    if !matches!(
+        get_pod_draining_info(&pod),
+        PodDrainingInfo::DrainUntil(_) | PodDrainingInfo::Deleting
+    ) {
+        return (StatusCode::CONFLICT, String::from("pod is not draining"));
+    }
+
+    warn!(
+        namespace = params.namespace,
+        name = params.name,
+        "deleting pod by the admin api"
+    );
+    if let Err(err) = disable_wait_and_delete_pod(&state.api_resolver, &pod).await {
+        error!(?err, "failed to delete pod by the admin api");
+        return (StatusCode::BAD_GATEWAY, err.to_string());
+    }
+
+    let pod_ref: ObjectRef<Pod> = ObjectRef::new(&params.name).within(&params.namespace);
+    let eviction_ref: ObjectRef<Eviction> = ObjectRef::new(&params.name).within(&params.namespace);
+    let cancelled = state.delayed_tasks.cancel(&pod_ref.to_string())
+        | state.delayed_tasks.cancel(&eviction_ref.to_string());
+    if cancelled {
+        info!("delayed admissions are cancelled");
+    }
+
+    (StatusCode::OK, String::from("pod is deleted"))
+}
+
+/// The token file is read on every request, so that the mounted secret can be rotated.
+async fn is_authorized(token_file: &Path, headers: &HeaderMap) -> Result<bool> {
+    let token = tokio::fs::read_to_string(token_file).await?;
+    let token = token.trim();
+    if token.is_empty() {
+        return Ok(false);
+    }
+
+    let Some(bearer) = headers
+        .get(header::AUTHORIZATION)
+        .and_then(|value| value.to_str().ok())
+        .and_then(|value| value.strip_prefix("Bearer "))
+    else {
+        return Ok(false);
+    };
+
+    Ok(constant_time_eq(bearer.as_bytes(), token.as_bytes()))
+}
+
+/// Not to leak the token through the response times.
+fn constant_time_eq(left: &[u8], right: &[u8]) -> bool {
+    if left.len() != right.len() {
+        return false;
+    }
+
+    left.iter()
+        .zip(right)
+        .fold(0, |acc, (left, right)| acc | (left ^ right))
+        == 0
+}
+
+#[cfg(test)]
+mod tests {
+    use std::io::Write;
+
+    use axum::http::HeaderValue;
+
+    use super::*;
+
+    fn headers_with(authorization: &'static str) -> HeaderMap {
+        let mut headers = HeaderMap::new();
+        headers.insert(
+            header::AUTHORIZATION,
+            HeaderValue::from_static(authorization),
+        );
+        headers
+    }
+
+    #[tokio::test]
+    async fn only_the_bearer_token_should_be_authorized() {
+        let mut token_file = tempfile::NamedTempFile::new().unwrap();
+        writeln!(token_file, "secret").unwrap();
+        let path = token_file.path();
+
+        assert!(is_authorized(path, &headers_with("Bearer secret"))
+            .await
+            .unwrap());
+        assert!(!is_authorized(path, &headers_with("Bearer wrong"))
+            .await
+            .unwrap());
+        assert!(!is_authorized(path, &headers_with("secret")).await.unwrap());
+        assert!(!is_authorized(path, &HeaderMap::new()).await.unwrap());
+    }
+
+    #[tokio::test]
+    async fn empty_token_should_authorize_nothing() {
+        let token_file = tempfile::NamedTempFile::new().unwrap();
+
+        assert!(!is_authorized(token_file.path(), &headers_with("Bearer "))
+            .await
+            .unwrap());
+    }
+
+    #[tokio::test]
+    async fn admin_delete_should_disable_the_wait_then_delete_and_release_the_delay() {
+        use std::time::Duration;
+
+        use crate::clock::Clock;
+        use crate::test_utils::{pod_routes, FakeApiServer};
+        use crate::webhooks::tests::{app_state, pod_stores};
+        use crate::Config;
+
+        let mut token_file = tempfile::NamedTempFile::new().unwrap();
+        writeln!(token_file, "secret").unwrap();
+
+        let pod_json = serde_json::json!({
+            "apiVersion": "v1",
+            "kind": "Pod",
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "uid": "uid1234",
+                "labels": {
+                    "pod-graceful-drain/draining": "true",
+                },
+                "annotations": {
+                    "pod-graceful-drain/drain-until": "2099-01-01T00:00:00Z",
+                },
+            },
+        });
+        let server = FakeApiServer::serve(pod_routes(pod_json)).await;
+        let config = Config {
+            admin_token_file: Some(token_file.path().to_path_buf()),
+            ..Config::default()
+        };
+        let state = app_state(
+            &server.api_resolver,
+            config,
+            pod_stores([]),
+            Clock::default(),
+        );
+
+        // The deletion of the pod is being delayed.
+        let pod_ref: ObjectRef<Pod> = ObjectRef::new("pod").within("ns");
+        let task = state
+            .delayed_tasks
+            .register(pod_ref.to_string(), Duration::from_secs(600));
+
+        let (status, _) = admin_delete_handler(
+            State(state),
+            headers_with("Bearer secret"),
+            Query(AdminDeleteParams {
+                namespace: String::from("ns"),
+                name: String::from("pod"),
+            }),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let requests: Vec<_> = server
+            .pod_requests()
+            .into_iter()
+            .filter(|request| !request.starts_with("GET "))
+            .collect();
+        assert_eq!(requests.len(), 2, "{requests:?}");
+        assert!(
+            requests[0].starts_with("PATCH /api/v1/namespaces/ns/pods/pod")
+                && requests[0].contains(r#""pod-graceful-drain/draining":"deleting""#),
+            "{}",
+            requests[0]
+        );
+        assert!(requests[1].starts_with("DELETE /api/v1/namespaces/ns/pods/pod"));
+
+        tokio::time::timeout(Duration::from_secs(1), task.cancelled())
+            .await
+            .expect("the delay should be released");
+    }
+}
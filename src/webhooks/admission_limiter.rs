@@ -0,0 +1,57 @@
+use std::sync::Arc;
+
+use tokio::sync::{OwnedSemaphorePermit, Semaphore};
+
+/// Limits the number of admissions being handled concurrently.
+#[derive(Clone)]
+pub struct AdmissionLimiter {
+    semaphore: Option<Arc<Semaphore>>,
+}
+
+pub struct AdmissionPermit {
+    _permit: Option<OwnedSemaphorePermit>,
+}
+
+impl AdmissionLimiter {
+    pub fn new(max_concurrent_admissions: Option<usize>) -> Self {
+        Self {
+            semaphore: max_concurrent_admissions.map(|max| Arc::new(Semaphore::new(max))),
+        }
+    }
+
+    /// Returns `None` if it is overloaded.
+    pub fn try_acquire(&self) -> Option<AdmissionPermit> {
+        let Some(semaphore) = self.semaphore.as_ref() else {
+            return Some(AdmissionPermit { _permit: None });
+        };
+
+        let permit = Arc::clone(semaphore).try_acquire_owned().ok()?;
+        Some(AdmissionPermit {
+            _permit: Some(permit),
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn should_reject_past_the_limit() {
+        let limiter = AdmissionLimiter::new(Some(1));
+
+        let permit = limiter.try_acquire();
+        assert!(permit.is_some());
+        assert!(limiter.try_acquire().is_none());
+
+        drop(permit);
+        assert!(limiter.try_acquire().is_some());
+    }
+
+    #[test]
+    fn should_not_limit_when_unlimited() {
+        let limiter = AdmissionLimiter::new(None);
+
+        let _permits: Vec<_> = (0..100).map(|_| limiter.try_acquire().unwrap()).collect();
+    }
+}
@@ -0,0 +1,194 @@
+use std::collections::VecDeque;
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+use tracing::{error, info, warn};
+
+use crate::metrics;
+
+/// The error rate is measured over the admissions in this window.
+const WINDOW: Duration = Duration::from_secs(60);
+/// Too few admissions don't tell whether the dependencies are down.
+const MIN_ADMISSIONS: usize = 10;
+
+/// Stops intercepting the admissions for a while when too many of them fail,
+/// so that an outage of the api server or the load balancer controller doesn't block every deletion in the cluster.
+///
+/// After the cooldown, it is half-open: the admissions are intercepted again,
+/// and the first outcome decides whether it recovers or trips again.
+#[derive(Clone)]
+pub struct CircuitBreaker {
+    inner: Option<Arc<Inner>>,
+}
+
+struct Inner {
+    error_rate: f64,
+    cooldown: Duration,
+    state: Mutex<State>,
+}
+
+#[derive(Debug)]
+enum State {
+    Closed { outcomes: VecDeque<(Instant, bool)> },
+    Open { until: Instant },
+    HalfOpen,
+}
+
+impl CircuitBreaker {
+    pub fn new(error_rate: Option<f64>, cooldown: Duration) -> Self {
+        Self {
+            inner: error_rate.map(|error_rate| {
+                Arc::new(Inner {
+                    error_rate,
+                    cooldown,
+                    state: Mutex::new(State::Closed {
+                        outcomes: VecDeque::new(),
+                    }),
+                })
+            }),
+        }
+    }
+
+    /// Returns false if the admission should be allowed without the interception.
+    pub fn allows(&self, now: Instant) -> bool {
+        let Some(inner) = self.inner.as_ref() else {
+            return true;
+        };
+
+        let mut state = inner.state.lock().unwrap();
+        match *state {
+            State::Closed { .. } | State::HalfOpen => true,
+            State::Open { until } if now < until => false,
+            State::Open { .. } => {
+                info!("circuit breaker is half-open, intercepting the admissions again");
+                *state = State::HalfOpen;
+                true
+            }
+        }
+    }
+
+    pub fn record(&self, now: Instant, succeeded: bool) {
+        let Some(inner) = self.inner.as_ref() else {
+            return;
+        };
+
+        let mut state = inner.state.lock().unwrap();
+        match &mut *state {
+            State::Closed { outcomes } => {
+                outcomes.push_back((now, succeeded));
+                while let Some((at, _)) = outcomes.front() {
+                    if now.saturating_duration_since(*at) <= WINDOW {
+                        break;
+                    }
+                    outcomes.pop_front();
+                }
+
+                if outcomes.len() < MIN_ADMISSIONS {
+                    return;
+                }
+
+                let errors = outcomes.iter().filter(|(_, succeeded)| !succeeded).count();
+                let error_rate = errors as f64 / outcomes.len() as f64;
+                if error_rate > inner.error_rate {
+                    error!(
+                        error_rate,
+                        cooldown = ?inner.cooldown,
+                        "circuit breaker is tripped, admissions are allowed without the drain"
+                    );
+                    metrics::CIRCUIT_BREAKER_TRIPPED_TOTAL.inc();
+                    *state = State::Open {
+                        until: now + inner.cooldown,
+                    };
+                }
+            }
+            State::HalfOpen if succeeded => {
+                info!("circuit breaker is closed, the admissions are recovered");
+                *state = State::Closed {
+                    outcomes: VecDeque::new(),
+                };
+            }
+            State::HalfOpen => {
+                warn!(
+                    cooldown = ?inner.cooldown,
+                    "circuit breaker is tripped again, admissions are still failing"
+                );
+                metrics::CIRCUIT_BREAKER_TRIPPED_TOTAL.inc();
+                *state = State::Open {
+                    until: now + inner.cooldown,
+                };
+            }
+            // e.g. admissions that were in flight when it was tripped.
+            State::Open { .. } => {}
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const COOLDOWN: Duration = Duration::from_secs(30);
+
+    #[test]
+    fn should_trip_on_high_error_rate() {
+        let breaker = CircuitBreaker::new(Some(0.5), COOLDOWN);
+        let now = Instant::now();
+
+        for _ in 0..4 {
+            breaker.record(now, true);
+        }
+        for _ in 0..5 {
+            breaker.record(now, false);
+        }
+        assert!(breaker.allows(now), "too few admissions");
+
+        breaker.record(now, false);
+        assert!(!breaker.allows(now));
+        assert!(!breaker.allows(now + COOLDOWN - Duration::from_secs(1)));
+    }
+
+    #[test]
+    fn should_recover_after_cooldown() {
+        let breaker = CircuitBreaker::new(Some(0.5), COOLDOWN);
+        let now = Instant::now();
+        for _ in 0..MIN_ADMISSIONS {
+            breaker.record(now, false);
+        }
+        assert!(!breaker.allows(now));
+
+        let now = now + COOLDOWN;
+        assert!(breaker.allows(now), "half-open");
+        breaker.record(now, false);
+        assert!(!breaker.allows(now), "tripped again");
+
+        let now = now + COOLDOWN;
+        assert!(breaker.allows(now), "half-open");
+        breaker.record(now, true);
+        assert!(breaker.allows(now + Duration::from_secs(1)), "closed");
+
+        breaker.record(now, false);
+        assert!(breaker.allows(now), "past errors are forgotten");
+    }
+
+    #[test]
+    fn should_forget_errors_out_of_window() {
+        let breaker = CircuitBreaker::new(Some(0.5), COOLDOWN);
+        let now = Instant::now();
+        for _ in 0..MIN_ADMISSIONS - 1 {
+            breaker.record(now, false);
+        }
+
+        breaker.record(now + WINDOW + Duration::from_secs(1), false);
+        assert!(breaker.allows(now + WINDOW + Duration::from_secs(1)));
+    }
+
+    #[test]
+    fn should_not_trip_when_disabled() {
+        let breaker = CircuitBreaker::new(None, COOLDOWN);
+        let now = Instant::now();
+        for _ in 0..100 {
+            breaker.record(now, false);
+        }
+        assert!(breaker.allows(now));
+    }
+}
@@ -2,9 +2,14 @@ use rustls::pki_types::{CertificateDer, PrivateKeyDer};
 use std::net::SocketAddr;
 use std::path::{Path, PathBuf};
 
+use crate::clock::Clock;
+use crate::concurrent_drains::DrainReservations;
+
 pub struct WebhookConfig {
     pub(crate) bind: BindConfig,
     pub(crate) cert: CertConfig,
+    pub(crate) clock: Clock,
+    pub(crate) drain_reservations: DrainReservations,
 }
 
 pub enum BindConfig {
@@ -27,6 +32,8 @@ impl WebhookConfig {
         Self {
             bind: BindConfig::SocketAddr(SocketAddr::from(([0, 0, 0, 0], 9443))),
             cert: CertConfig::CertDir(default_path),
+            clock: Clock::default(),
+            drain_reservations: DrainReservations::default(),
         }
     }
 }
@@ -39,6 +46,21 @@ impl WebhookConfig {
         Self {
             bind: BindConfig::RandomForTest,
             cert: CertConfig::Override(cert, key_pair_der),
+            clock: Clock::default(),
+            drain_reservations: DrainReservations::default(),
+        }
+    }
+
+    /// Read the time of the drains from `clock` instead of the wall clock.
+    pub fn with_clock(self, clock: Clock) -> Self {
+        Self { clock, ..self }
+    }
+
+    /// Count the concurrent drains together with the others that isolate pods, e.g. the pre-isolator.
+    pub fn with_drain_reservations(self, drain_reservations: DrainReservations) -> Self {
+        Self {
+            drain_reservations,
+            ..self
         }
     }
 }
@@ -0,0 +1,275 @@
+use std::collections::BTreeMap;
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+
+use chrono::{SecondsFormat, Utc};
+use serde::Serialize;
+use tokio::sync::watch;
+
+use crate::metrics::{self, Counter, Gauge, Histogram};
+
+/// Registry of in-flight delayed admissions, for debugging stuck drains, and for cancelling them.
+///
+/// The api server retries the admissions that are timed out, so they are keyed by the pod
+/// to not count the retries of the same pod as separate tasks.
+#[derive(Clone)]
+pub struct DelayedTasks {
+    inner: Arc<Mutex<BTreeMap<String, DelayedTask>>>,
+    metrics: TaskMetrics,
+}
+
+/// The tests can count their own tasks apart from the global metrics.
+#[derive(Clone, Copy)]
+struct TaskMetrics {
+    scheduled: &'static Counter,
+    active: &'static Gauge,
+    wait: &'static Histogram<9>,
+}
+
+impl Default for DelayedTasks {
+    fn default() -> Self {
+        Self {
+            inner: Arc::default(),
+            metrics: TaskMetrics {
+                scheduled: &metrics::DELAYED_TASKS_SCHEDULED_TOTAL,
+                active: &metrics::DELAYED_TASKS_ACTIVE,
+                wait: &metrics::DELAYED_TASK_WAIT_SECONDS,
+            },
+        }
+    }
+}
+
+struct DelayedTask {
+    info: DelayedTaskInfo,
+    cancel: watch::Sender<bool>,
+}
+
+#[derive(Clone, Debug, Serialize)]
+pub struct DelayedTaskInfo {
+    pub object_ref: String,
+    pub duration_seconds: f64,
+    pub scheduled_at: String,
+    /// The number of admissions that are waiting for the same pod.
+    pub admissions: usize,
+}
+
+impl DelayedTasks {
+    /// The task is listed until every returned guard of the same object is dropped.
+    pub fn register(&self, object_ref: String, duration: Duration) -> DelayedTaskGuard {
+        self.metrics.scheduled.inc();
+        self.metrics.wait.observe(duration);
+        self.metrics.active.inc();
+
+        let mut inner = self.inner.lock().unwrap();
+        let task = inner
+            .entry(object_ref.clone())
+            .and_modify(|task| {
+                task.info.admissions += 1;
+                // A retry after the cancellation is delayed again, while the cancelled ones keep the last value.
+                if *task.cancel.borrow() {
+                    task.cancel = watch::Sender::new(false);
+                }
+            })
+            .or_insert_with(|| DelayedTask {
+                info: DelayedTaskInfo {
+                    object_ref: object_ref.clone(),
+                    duration_seconds: duration.as_secs_f64(),
+                    scheduled_at: Utc::now().to_rfc3339_opts(SecondsFormat::Secs, true),
+                    admissions: 1,
+                },
+                cancel: watch::Sender::new(false),
+            });
+
+        DelayedTaskGuard {
+            tasks: self.clone(),
+            object_ref,
+            cancelled: task.cancel.subscribe(),
+            completed: false,
+        }
+    }
+
+    pub fn list(&self) -> Vec<DelayedTaskInfo> {
+        let inner = self.inner.lock().unwrap();
+        inner.values().map(|task| task.info.clone()).collect()
+    }
+
+    /// Stop delaying every in-flight admission of the object, so that they are allowed right away,
+    /// e.g. when the pod is deleted by the admin api. Returns false if there is no such task.
+    pub fn cancel(&self, object_ref: &str) -> bool {
+        let inner = self.inner.lock().unwrap();
+        let Some(task) = inner.get(object_ref) else {
+            return false;
+        };
+
+        task.cancel.send_replace(true);
+        true
+    }
+}
+
+pub struct DelayedTaskGuard {
+    tasks: DelayedTasks,
+    object_ref: String,
+    cancelled: watch::Receiver<bool>,
+    completed: bool,
+}
+
+impl DelayedTaskGuard {
+    /// Otherwise, the task is counted as interrupted when it is dropped.
+    pub fn complete(mut self) {
+        self.completed = true;
+    }
+
+    /// Resolves when the task is cancelled.
+    pub async fn cancelled(&self) {
+        let mut cancelled = self.cancelled.clone();
+        // The sender lives as long as this guard, or it is replaced after it is cancelled and keeps the last value.
+        let _ = cancelled.wait_for(|cancelled| *cancelled).await;
+    }
+}
+
+impl Drop for DelayedTaskGuard {
+    fn drop(&mut self) {
+        if !self.completed {
+            metrics::ADMISSION_INTERRUPTED_TOTAL.inc();
+        }
+        self.tasks.metrics.active.dec();
+
+        let mut inner = self.tasks.inner.lock().unwrap();
+        if let Some(task) = inner.get_mut(&self.object_ref) {
+            task.info.admissions -= 1;
+            if task.info.admissions == 0 {
+                inner.remove(&self.object_ref);
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn should_list_running_tasks() {
+        let tasks = DelayedTasks::default();
+        let _guard = tasks.register(String::from("Pod.v1./pod.ns"), Duration::from_secs(10));
+
+        let list = tasks.list();
+        assert_eq!(list.len(), 1);
+        assert_eq!(list[0].object_ref, "Pod.v1./pod.ns");
+        assert_eq!(list[0].duration_seconds, 10.0);
+    }
+
+    #[test]
+    fn completed_task_should_be_removed() {
+        let tasks = DelayedTasks::default();
+        let guard = tasks.register(String::from("Pod.v1./pod.ns"), Duration::from_secs(10));
+        let _other = tasks.register(String::from("Pod.v1./other.ns"), Duration::from_secs(10));
+
+        drop(guard);
+
+        let list = tasks.list();
+        assert_eq!(list.len(), 1);
+        assert_eq!(list[0].object_ref, "Pod.v1./other.ns");
+    }
+
+    #[test]
+    fn readmission_should_not_double_tasks() {
+        let tasks = DelayedTasks::default();
+        let first = tasks.register(String::from("Pod.v1./pod.ns"), Duration::from_secs(10));
+        let retry = tasks.register(String::from("Pod.v1./pod.ns"), Duration::from_secs(5));
+
+        let list = tasks.list();
+        assert_eq!(list.len(), 1);
+        assert_eq!(list[0].duration_seconds, 10.0);
+        assert_eq!(list[0].admissions, 2);
+
+        drop(first);
+        assert_eq!(tasks.list().len(), 1, "retry is still waiting");
+
+        drop(retry);
+        assert!(tasks.list().is_empty());
+    }
+
+    #[test]
+    fn dropped_task_should_be_counted_as_interrupted() {
+        let tasks = DelayedTasks::default();
+        let before = metrics::ADMISSION_INTERRUPTED_TOTAL.get();
+
+        let guard = tasks.register(String::from("Pod.v1./pod.ns"), Duration::from_secs(10));
+        drop(guard);
+
+        assert!(metrics::ADMISSION_INTERRUPTED_TOTAL.get() > before);
+    }
+
+    #[test]
+    fn tasks_should_be_counted_in_metrics() {
+        let metrics = TaskMetrics {
+            scheduled: Box::leak(Box::new(Counter::new("scheduled", "test"))),
+            active: Box::leak(Box::new(Gauge::new("active", "test"))),
+            wait: Box::leak(Box::new(Histogram::new("wait", "test", [0.0; 9]))),
+        };
+        let tasks = DelayedTasks {
+            metrics,
+            ..DelayedTasks::default()
+        };
+
+        let first = tasks.register(String::from("Pod.v1./pod.ns"), Duration::from_secs(10));
+        let retry = tasks.register(String::from("Pod.v1./pod.ns"), Duration::from_secs(5));
+        assert_eq!(metrics.scheduled.get(), 2, "retries are counted");
+        assert_eq!(metrics.wait.get_count(), 2);
+        assert_eq!(metrics.active.get(), 2);
+
+        first.complete();
+        assert_eq!(metrics.active.get(), 1);
+
+        drop(retry);
+        assert_eq!(metrics.active.get(), 0, "interrupted ones are done too");
+        assert_eq!(metrics.scheduled.get(), 2);
+    }
+
+    #[tokio::test(start_paused = true)]
+    async fn retry_after_cancel_should_be_delayed_again() {
+        let tasks = DelayedTasks::default();
+        let cancelled = tasks.register(String::from("Pod.v1./pod.ns"), Duration::from_secs(10));
+        assert!(tasks.cancel("Pod.v1./pod.ns"));
+
+        let retry = tasks.register(String::from("Pod.v1./pod.ns"), Duration::from_secs(10));
+
+        let timeout = Duration::from_secs(10);
+        assert!(tokio::time::timeout(timeout, cancelled.cancelled())
+            .await
+            .is_ok());
+        assert!(
+            tokio::time::timeout(timeout, retry.cancelled())
+                .await
+                .is_err(),
+            "the retry isn't cancelled by the earlier cancel"
+        );
+    }
+
+    #[tokio::test(start_paused = true)]
+    async fn cancel_should_interrupt_only_the_targeted_task() {
+        let tasks = DelayedTasks::default();
+        let target = tasks.register(String::from("Pod.v1./pod.ns"), Duration::from_secs(10));
+        let retry = tasks.register(String::from("Pod.v1./pod.ns"), Duration::from_secs(10));
+        let other = tasks.register(String::from("Pod.v1./other.ns"), Duration::from_secs(10));
+
+        assert!(tasks.cancel("Pod.v1./pod.ns"));
+        assert!(!tasks.cancel("Pod.v1./unknown.ns"));
+
+        // The time is paused, so the timeouts elapse right away if they are not cancelled.
+        let timeout = Duration::from_secs(10);
+        assert!(tokio::time::timeout(timeout, target.cancelled())
+            .await
+            .is_ok());
+        assert!(
+            tokio::time::timeout(timeout, retry.cancelled())
+                .await
+                .is_ok(),
+            "retries of the same pod are cancelled too"
+        );
+        assert!(tokio::time::timeout(timeout, other.cancelled())
+            .await
+            .is_err());
+    }
+}
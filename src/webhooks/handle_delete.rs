@@ -1,18 +1,32 @@
-use chrono::{Duration, SecondsFormat, Utc};
+use chrono::{Duration, SecondsFormat};
 use eyre::{eyre, Context, Result};
 use k8s_openapi::api::authentication::v1::UserInfo;
 use k8s_openapi::api::core::v1::Pod;
 use k8s_openapi::apimachinery::pkg::apis::meta::v1::DeleteOptions;
 use k8s_openapi::apimachinery::pkg::runtime::RawExtension;
-use kube::core::admission::AdmissionRequest;
+use kube::core::admission::{AdmissionRequest, Operation};
 use kube::ResourceExt;
 use serde::Deserialize;
+use tracing::{debug, Span};
 
+use crate::controller::mark_pod_drained;
+use crate::endpoint_slice::is_pod_serving;
+use crate::metrics::ReentryOutcome;
+use crate::node_state::get_spot_interruption_deadline;
 use crate::pod_draining_info::{get_pod_draining_info, PodDrainingInfo};
-use crate::pod_state::{is_pod_exposed, is_pod_ready};
+use crate::pod_state::{
+    get_delete_after, get_exposing_target_group_arns, get_node_name, has_only_excluded_containers,
+    is_owned_by_ignored_kind, is_pod_completed, is_pod_in_scope, is_pod_possibly_deregistering,
+    is_pod_recently_ready, is_within_active_hours, should_drain_pod,
+};
 use crate::utils::to_delete_params;
-use crate::webhooks::report::{debug_report_for, report_for};
-use crate::webhooks::{patch_pod_isolate, AppState, InterceptResult};
+use crate::webhooks::patch::{should_cut_owner_references, IsolateOptions};
+use crate::webhooks::reason_code::ReasonCode;
+use crate::webhooks::report::{debug_report_for, render_delay_note, report_for, warn_report_for};
+use crate::webhooks::{
+    get_drain_duration, patch_pod_isolate, record_reentry, record_rollout_revision, AppState,
+    InterceptResult,
+};
 use crate::ApiResolver;
 
 /// This handler delays the admission of DELETE Pod request.
@@ -33,52 +47,252 @@ use crate::ApiResolver;
 /// * ReplicaSet controller: it can retry and progress.
 /// * `kubectl rollout restart`: It patches the deployment's annotation `kubectl.kubernetes.io/restartedAt`,
 ///    so it is controlled by ReplicaSet controller.
+///
+/// # Why not a finalizer
+///
+/// A finalizer only keeps the pod object in the api server. The kubelet starts to terminate the containers
+/// as soon as the deletion timestamp is set, so the pod would stop serving while the load balancer still
+/// sends traffic to it. So the pod is isolated and kept running until the deletion is admitted.
+///
+/// # Collection deletion
+///
+/// The api server admits `deletecollection` of pods one by one as `DELETE` operations,
+/// so they are delayed in turn just like the individual deletions.
 pub async fn delete_handler(
     state: &AppState,
     request: &AdmissionRequest<Pod>,
     user_info: &UserInfo,
+    timeout: Option<std::time::Duration>,
 ) -> Result<InterceptResult> {
+    if !is_pod_deletion(&request.operation) {
+        // The webhook might be misconfigured to receive other operations.
+        debug!(operation = ?request.operation, "not a deletion");
+        return Ok(InterceptResult::Allow);
+    }
+
     let pod = request
         .old_object
         .as_ref()
         .ok_or(eyre!("old_object for validation is missing"))?;
+    record_rollout_revision(pod);
 
     match get_pod_draining_info(pod) {
         PodDrainingInfo::None => {
-            if !is_pod_exposed(&state.config, &state.stores, pod) {
+            if !is_pod_in_scope(&state.config, pod) {
+                let note = "Deletion is allowed because the pod is out of the scope";
+                debug_report_for(state, pod, "AllowDeletion", "OutOfScope", note.to_string()).await;
+                return Ok(InterceptResult::AllowWithWarning(
+                    ReasonCode::OutOfScope,
+                    note.to_string(),
+                ));
+            }
+
+            if is_owned_by_ignored_kind(&state.config, pod) {
+                let note = "Deletion is allowed because the pod's owner is ignored";
+                debug_report_for(
+                    state,
+                    pod,
+                    "AllowDeletion",
+                    "IgnoredOwner",
+                    note.to_string(),
+                )
+                .await;
+                return Ok(InterceptResult::AllowWithWarning(
+                    ReasonCode::OutOfScope,
+                    note.to_string(),
+                ));
+            }
+
+            if has_only_excluded_containers(&state.config, pod) {
+                let note = "Deletion is allowed because the pod has only excluded containers";
+                debug_report_for(
+                    state,
+                    pod,
+                    "AllowDeletion",
+                    "ExcludedContainer",
+                    note.to_string(),
+                )
+                .await;
+                return Ok(InterceptResult::AllowWithWarning(
+                    ReasonCode::OutOfScope,
+                    note.to_string(),
+                ));
+            }
+
+            if !is_within_active_hours(&state.config, state.clock.now()) {
+                let note = "Deletion is allowed without delay outside the active hours";
                 debug_report_for(
                     state,
                     pod,
                     "AllowDeletion",
-                    "NotExposed",
-                    "Deletion is allowed because the pod is not exposed".to_string(),
+                    "OutOfActiveHours",
+                    note.to_string(),
                 )
                 .await;
-                return Ok(InterceptResult::Allow);
+                return Ok(InterceptResult::AllowWithWarning(
+                    ReasonCode::OutOfActiveHours,
+                    note.to_string(),
+                ));
+            }
+
+            if !should_drain_pod(&state.config, &state.stores, pod) {
+                let note = "Deletion is allowed because the pod is not exposed";
+                debug_report_for(state, pod, "AllowDeletion", "NotExposed", note.to_string()).await;
+                return Ok(InterceptResult::AllowWithWarning(
+                    ReasonCode::NotExposed,
+                    note.to_string(),
+                ));
             }
 
-            if !is_pod_ready(pod) {
+            if get_node_name(pod).is_none() {
+                let note = "Deletion is allowed because the pod is not scheduled to a node";
                 debug_report_for(
                     state,
                     pod,
                     "AllowDeletion",
-                    "NotReady",
-                    "Deletion is allowed because the pod is not ready".to_string(),
+                    "NotScheduled",
+                    note.to_string(),
                 )
                 .await;
-                return Ok(InterceptResult::Allow);
+                return Ok(InterceptResult::AllowWithWarning(
+                    ReasonCode::NotServing,
+                    note.to_string(),
+                ));
             }
 
-            let drain_until = Utc::now() + Duration::from_std(state.config.delete_after)?;
-            check_delete_permission(&state.api_resolver, pod, &request.options, user_info)
+            // Not serving, even with the target health readiness gate, and its conditions might be stale.
+            if is_pod_completed(pod) {
+                let note = "Deletion is allowed because the pod has completed";
+                debug_report_for(state, pod, "AllowDeletion", "Completed", note.to_string()).await;
+                return Ok(InterceptResult::AllowWithWarning(
+                    ReasonCode::NotServing,
+                    note.to_string(),
+                ));
+            }
+
+            let is_serving = is_pod_serving(&state.config, &state.api_resolver, &state.stores, pod)
+                .await
+                .context("checking endpoint slices")?;
+            if !is_serving && !is_pod_possibly_deregistering(&state.config, pod) {
+                let note = if state.config.use_endpointslice_readiness {
+                    "Deletion is allowed because the pod is not serving per its EndpointSlices"
+                } else {
+                    "Deletion is allowed because the pod is not ready"
+                };
+                debug_report_for(state, pod, "AllowDeletion", "NotReady", note.to_string()).await;
+                return Ok(InterceptResult::AllowWithWarning(
+                    ReasonCode::NotServing,
+                    note.to_string(),
+                ));
+            }
+
+            if is_pod_recently_ready(&state.config, pod, state.clock.now()) {
+                let note = "Deletion is allowed because the pod has just become ready";
+                debug_report_for(
+                    state,
+                    pod,
+                    "AllowDeletion",
+                    "RecentlyReady",
+                    note.to_string(),
+                )
+                .await;
+                return Ok(InterceptResult::AllowWithWarning(
+                    ReasonCode::NotServing,
+                    note.to_string(),
+                ));
+            }
+
+            let Some(reservation) =
+                state
+                    .drain_reservations
+                    .try_reserve(&state.config, &state.stores, pod)
+            else {
+                let note = "Deletion is allowed without delay because too many pods of the same service are draining";
+                report_for(
+                    state,
+                    pod,
+                    "AllowDeletion",
+                    "TooManyDraining",
+                    note.to_string(),
+                )
+                .await;
+                return Ok(InterceptResult::AllowWithWarning(
+                    ReasonCode::TooManyDraining,
+                    note.to_string(),
+                ));
+            };
+
+            let delete_after = get_drain_duration(
+                &state.config,
+                get_delete_after(&state.config, &state.stores, pod),
+                timeout,
+            );
+            let mut drain_until = state.clock.now() + Duration::from_std(delete_after)?;
+            if let Some(terminate_at) =
+                get_spot_interruption_deadline(&state.config, &state.api_resolver, pod)
+                    .await
+                    .context("getting spot interruption deadline")?
+            {
+                if terminate_at <= state.clock.now() {
+                    debug_report_for(
+                        state,
+                        pod,
+                        "AllowDeletion",
+                        "SpotInterrupted",
+                        "Deletion is allowed because the node is being terminated".to_string(),
+                    )
+                    .await;
+                    return Ok(InterceptResult::AllowWithReason(
+                        ReasonCode::NodeTerminating,
+                    ));
+                }
+
+                drain_until = drain_until.min(terminate_at);
+            }
+
+            Span::current().record(
+                "drain_until",
+                drain_until
+                    .to_rfc3339_opts(SecondsFormat::Secs, true)
+                    .as_str(),
+            );
+
+            if state.config.observe_only {
+                report_for(
+                    state,
+                    pod,
+                    "AllowDeletion",
+                    "ObserveOnly",
+                    format!(
+                        "Deletion is allowed because of the observe-only mode. It would've been drained until '{}'",
+                        drain_until.to_rfc3339_opts(SecondsFormat::Secs, true),
+                    ),
+                )
+                .await;
+                return Ok(InterceptResult::AllowWithReason(ReasonCode::ObserveOnly));
+            }
+            let delete_options = get_delete_options(&request.options)?;
+            check_delete_permission(&state.api_resolver, pod, &delete_options, user_info)
                 .await
                 .context("checking permission")?;
+            let target_groups = get_exposing_target_group_arns(&state.config, &state.stores, pod);
             let patched_result = patch_pod_isolate(
                 &state.api_resolver,
+                &state.config,
                 pod,
+                state.clock.now(),
                 drain_until,
-                None,
                 &state.loadbalancing,
+                IsolateOptions {
+                    requested_by: user_info.username.as_deref(),
+                    cut_owner_references: should_cut_owner_references(
+                        &state.config,
+                        pod,
+                        Some(&delete_options),
+                    ),
+                    target_groups: &target_groups,
+                    ..IsolateOptions::default()
+                },
             )
             .await
             .context("apply patch")?;
@@ -92,40 +306,68 @@ pub async fn delete_handler(
                     "Pod is already gone".to_string(),
                 )
                 .await;
-                return Ok(InterceptResult::Allow);
+                return Ok(InterceptResult::AllowWithReason(ReasonCode::Deleting));
             }
+            reservation.keep();
 
             report_for(
                 state,
                 pod,
                 "DelayDeletion",
                 "Drain",
-                format!(
-                    "Deletion is delayed, and the pod is isolated. It'll be deleted after '{}'",
-                    drain_until.to_rfc3339_opts(SecondsFormat::Secs, true),
+                render_delay_note(
+                    state.config.delay_message_template.as_deref(),
+                    format!(
+                        "Deletion is delayed, and the pod is isolated. It'll be deleted after '{}'",
+                        drain_until.to_rfc3339_opts(SecondsFormat::Secs, true),
+                    ),
+                    "Drain",
+                    drain_until,
+                    state.clock.now(),
                 ),
             )
             .await;
 
-            let duration = (drain_until - Utc::now()).to_std().unwrap_or_default();
-            Ok(InterceptResult::Delay(duration))
+            let duration = (drain_until - state.clock.now())
+                .to_std()
+                .unwrap_or_default();
+            Ok(InterceptResult::Delay(duration, ReasonCode::Drain))
         }
         PodDrainingInfo::DrainUntil(drain_until) => {
-            if let Ok(duration) = (drain_until - Utc::now()).to_std() {
+            if let Ok(duration) = (drain_until - state.clock.now()).to_std() {
+                record_reentry(ReentryOutcome::Intercept);
                 report_for(
                     state,
                     pod,
                     "DelayDeletion",
                     "Draining",
-                    format!(
-                        "Deletion is delayed. It'll be deleted after '{}'",
-                        drain_until.to_rfc3339_opts(SecondsFormat::Secs, true),
+                    render_delay_note(
+                        state.config.delay_message_template.as_deref(),
+                        format!(
+                            "Deletion is delayed. It'll be deleted after '{}'",
+                            drain_until.to_rfc3339_opts(SecondsFormat::Secs, true),
+                        ),
+                        "Draining",
+                        drain_until,
+                        state.clock.now(),
                     ),
                 )
                 .await;
 
-                Ok(InterceptResult::Delay(duration))
+                Ok(InterceptResult::Delay(duration, ReasonCode::Reentry))
             } else {
+                record_reentry(ReentryOutcome::Allow);
+                // The label is informational, so the failure doesn't hold the deletion back.
+                if let Err(err) = mark_pod_drained(&state.api_resolver, pod).await {
+                    warn_report_for(
+                        state,
+                        pod,
+                        "AllowDeletion",
+                        "TransientError",
+                        format!("failed to label the drained pod: {err}"),
+                    )
+                    .await;
+                }
                 debug_report_for(
                     state,
                     pod,
@@ -135,10 +377,34 @@ pub async fn delete_handler(
                 )
                 .await;
 
-                Ok(InterceptResult::Allow)
+                Ok(InterceptResult::AllowWithReason(ReasonCode::Drained))
             }
         }
-        PodDrainingInfo::Deleted => Ok(InterceptResult::Allow),
+        PodDrainingInfo::Deleted => {
+            // e.g. re-deletion while finalizers are holding the pod. It's already isolated if it ought to be.
+            debug_report_for(
+                state,
+                pod,
+                "AllowDeletion",
+                "Terminating",
+                "Deletion is allowed because the pod is already terminating".to_string(),
+            )
+            .await;
+
+            Ok(InterceptResult::AllowWithReason(ReasonCode::Deleting))
+        }
+        PodDrainingInfo::Deleting => {
+            debug_report_for(
+                state,
+                pod,
+                "AllowDeletion",
+                "Deleting",
+                "Deletion is allowed because the pod is already being deleted".to_string(),
+            )
+            .await;
+
+            Ok(InterceptResult::AllowWithReason(ReasonCode::Deleting))
+        }
         PodDrainingInfo::DrainDisabled => {
             debug_report_for(
                 state,
@@ -149,30 +415,270 @@ pub async fn delete_handler(
             )
             .await;
 
-            Ok(InterceptResult::Allow)
+            Ok(InterceptResult::AllowWithReason(ReasonCode::Disabled))
+        }
+        PodDrainingInfo::LabelCleared => {
+            report_for(
+                state,
+                pod,
+                "AllowDeletion",
+                "LabelCleared",
+                "Deletion is allowed without the drain because the draining label was cleared"
+                    .to_string(),
+            )
+            .await;
+
+            Ok(InterceptResult::AllowWithReason(ReasonCode::Disabled))
         }
         PodDrainingInfo::AnnotationParseError { message } => Err(eyre!(message)),
     }
 }
 
+fn get_delete_options(raw_options: &Option<RawExtension>) -> Result<DeleteOptions> {
+    let delete_options = if let Some(delete_options) = raw_options {
+        DeleteOptions::deserialize(&delete_options.0)?
+    } else {
+        DeleteOptions::default()
+    };
+
+    Ok(delete_options)
+}
+
 async fn check_delete_permission(
     api_resolver: &ApiResolver,
     pod: &Pod,
-    raw_options: &Option<RawExtension>,
+    delete_options: &DeleteOptions,
     user_info: &UserInfo,
 ) -> Result<()> {
     let api = api_resolver
         .impersonate_as(user_info.username.clone(), user_info.groups.clone())?
         .api_for(pod);
 
-    let delete_options = if let Some(delete_options) = raw_options {
-        DeleteOptions::deserialize(&delete_options.0)?
-    } else {
-        DeleteOptions::default()
-    };
-
     let name = pod.name_any();
-    let delete_params = to_delete_params(delete_options, true)?;
+    let delete_params = to_delete_params(delete_options.clone(), true)?;
     api.delete(&name, &delete_params).await?;
     Ok(())
 }
+
+fn is_pod_deletion(operation: &Operation) -> bool {
+    matches!(operation, Operation::Delete)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    use std::time::Duration as StdDuration;
+
+    use axum::http::HeaderMap;
+    use chrono::FixedOffset;
+    use kube::core::admission::AdmissionResponse;
+    use serde_json::{json, Value};
+
+    use crate::test_utils::{pod_routes, FakeApiServer};
+    use crate::webhooks::tests::{
+        app_state, datetime, delete_review, exposing_stores, into_response, reason_code_of,
+        serving_pod, serving_pod_with,
+    };
+    use crate::webhooks::{handle_common, pod_handler};
+    use crate::{Clock, Config};
+
+    /// Deletes `pod` at `now`, and returns the response with the api server it has called.
+    async fn delete_pod_at(
+        config: Config,
+        pod: Value,
+        now: &str,
+    ) -> (FakeApiServer, AdmissionResponse) {
+        let server = FakeApiServer::serve(pod_routes(pod.clone())).await;
+        let state = app_state(
+            &server.api_resolver,
+            config,
+            exposing_stores([serde_json::from_value(pod.clone()).unwrap()]),
+            Clock::fake(datetime(now)),
+        );
+
+        let review = delete_review(&pod);
+        let result = handle_common(
+            pod_handler,
+            &state,
+            &review,
+            Some(StdDuration::from_secs(10)),
+            &HeaderMap::new(),
+        )
+        .await;
+        (server, into_response(result))
+    }
+
+    async fn delete_pod(config: Config, pod: Value) -> AdmissionResponse {
+        let (_, response) = delete_pod_at(config, pod, "2023-02-08T15:30:00Z").await;
+        response
+    }
+
+    #[tokio::test]
+    async fn each_branch_should_be_coded() {
+        let short_drain = Config {
+            delete_after: StdDuration::from_millis(100),
+            ..Config::default()
+        };
+        let cases = [
+            (
+                "out of the scope",
+                Config {
+                    watch_namespaces: vec![String::from("other")],
+                    ..Config::default()
+                },
+                serving_pod(),
+                "OUT_OF_SCOPE",
+            ),
+            (
+                "outside the active hours",
+                Config {
+                    active_hours: Some("09:00-10:00".parse().unwrap()),
+                    ..Config::default()
+                },
+                serving_pod(),
+                "OUT_OF_ACTIVE_HOURS",
+            ),
+            (
+                "not exposed",
+                Config::default(),
+                serving_pod_with(json!({ "metadata": { "labels": { "app": "other" } } })),
+                "NOT_EXPOSED",
+            ),
+            (
+                "not ready",
+                Config::default(),
+                serving_pod_with(json!({ "status": { "conditions": [] } })),
+                "NOT_SERVING",
+            ),
+            (
+                "observe-only",
+                Config {
+                    observe_only: true,
+                    ..Config::default()
+                },
+                serving_pod(),
+                "OBSERVE_ONLY",
+            ),
+            ("drain", short_drain.clone(), serving_pod(), "DRAIN"),
+            (
+                "truncated by the max block",
+                Config {
+                    max_admission_block: Some(StdDuration::from_millis(100)),
+                    ..Config::default()
+                },
+                serving_pod(),
+                "TIMEOUT",
+            ),
+            (
+                "draining",
+                short_drain.clone(),
+                serving_pod_with(json!({
+                    "metadata": {
+                        "labels": { "pod-graceful-drain/draining": "true" },
+                        "annotations": { "pod-graceful-drain/drain-until": "2023-02-08T15:30:00.100Z" },
+                    },
+                })),
+                "REENTRY",
+            ),
+            (
+                "drained",
+                Config::default(),
+                serving_pod_with(json!({
+                    "metadata": {
+                        "labels": { "pod-graceful-drain/draining": "true" },
+                        "annotations": { "pod-graceful-drain/drain-until": "2023-02-08T15:29:00Z" },
+                    },
+                })),
+                "DRAINED",
+            ),
+            (
+                "being deleted",
+                Config::default(),
+                serving_pod_with(
+                    json!({ "metadata": { "labels": { "pod-graceful-drain/draining": "deleting" } } }),
+                ),
+                "DELETING",
+            ),
+            (
+                "terminating",
+                Config::default(),
+                serving_pod_with(
+                    json!({ "metadata": { "deletionTimestamp": "2023-02-08T15:29:00Z" } }),
+                ),
+                "DELETING",
+            ),
+            (
+                "disabled",
+                Config::default(),
+                serving_pod_with(
+                    json!({ "metadata": { "labels": { "pod-graceful-drain/draining": "false" } } }),
+                ),
+                "DISABLED",
+            ),
+        ];
+
+        for (branch, config, pod, expected) in cases {
+            let response = delete_pod(config, pod).await;
+            assert!(response.allowed, "{branch}");
+            assert_eq!(reason_code_of(&response), Some(expected), "{branch}");
+        }
+    }
+
+    #[tokio::test]
+    async fn deletion_should_be_delayed_only_within_active_hours() {
+        let config = Config {
+            delete_after: StdDuration::from_millis(100),
+            active_hours: Some("09:00-18:00".parse().unwrap()),
+            active_hours_utc_offset: FixedOffset::east_opt(9 * 3600).unwrap(),
+            ..Config::default()
+        };
+
+        // 10:30 at +09:00
+        let (server, response) =
+            delete_pod_at(config.clone(), serving_pod(), "2023-02-08T01:30:00Z").await;
+        assert_eq!(reason_code_of(&response), Some("DRAIN"));
+        assert!(
+            server
+                .pod_requests()
+                .iter()
+                .any(|request| request.contains("pod-graceful-drain/drain-until")),
+            "should be isolated"
+        );
+
+        // 00:30 at +09:00
+        let (server, response) = delete_pod_at(config, serving_pod(), "2023-02-08T15:30:00Z").await;
+        assert!(response.allowed);
+        assert_eq!(reason_code_of(&response), Some("OUT_OF_ACTIVE_HOURS"));
+        assert_eq!(
+            server.pod_requests(),
+            Vec::<String>::new(),
+            "should be deleted right away"
+        );
+    }
+
+    #[tokio::test]
+    async fn warning_should_be_prefixed_with_reason_code() {
+        let config = Config {
+            emit_admission_warnings: true,
+            ..Config::default()
+        };
+        let pod = serving_pod_with(json!({ "metadata": { "labels": { "app": "other" } } }));
+
+        let response = delete_pod(config, pod).await;
+        assert_eq!(
+            response.warnings,
+            Some(vec![String::from(
+                "[NOT_EXPOSED] Deletion is allowed because the pod is not exposed"
+            )])
+        );
+    }
+
+    #[test]
+    fn only_deletion_should_be_intercepted() {
+        assert!(is_pod_deletion(&Operation::Delete));
+        assert!(!is_pod_deletion(&Operation::Create));
+        assert!(!is_pod_deletion(&Operation::Update));
+        assert!(!is_pod_deletion(&Operation::Connect));
+    }
+}
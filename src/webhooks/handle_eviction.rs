@@ -1,4 +1,4 @@
-use chrono::{Duration, SecondsFormat, Utc};
+use chrono::{Duration, SecondsFormat};
 use eyre::{eyre, Context, Result};
 use k8s_openapi::api::authentication::v1::UserInfo;
 use k8s_openapi::api::core::v1::{ObjectReference, Pod};
@@ -6,13 +6,30 @@ use k8s_openapi::api::policy::v1::Eviction;
 use kube::api::{EvictParams, PostParams};
 use kube::core::admission::{AdmissionRequest, AdmissionResponse};
 use kube::{Api, ResourceExt};
+use tracing::Span;
 
-use crate::pod_draining_info::{get_pod_draining_info, PodDrainingInfo};
-use crate::pod_state::{is_pod_exposed, is_pod_ready};
+use crate::endpoint_slice::is_pod_serving;
+use crate::metrics::ReentryOutcome;
+use crate::node_state::get_spot_interruption_deadline;
+use crate::pod_disruption_budget::would_violate_pod_disruption_budget;
+use crate::pod_draining_info::{get_pod_draining_info, is_pod_pre_isolated, PodDrainingInfo};
+use crate::pod_evict_params::get_pod_evict_params;
+use crate::pod_state::{
+    get_delete_after, get_exposing_target_group_arns, get_node_name, has_only_excluded_containers,
+    is_owned_by_ignored_kind, is_pod_completed, is_pod_in_scope, is_pod_possibly_deregistering,
+    is_pod_recently_ready, is_within_active_hours, should_drain_pod,
+};
 use crate::utils::{get_object_ref_from_name, to_delete_params};
-use crate::webhooks::patch::make_patch_eviction_to_dry_run;
-use crate::webhooks::report::{debug_report_for, report_for};
-use crate::webhooks::{debug_report_for_ref, patch_pod_isolate, AppState, InterceptResult};
+use crate::webhooks::patch::{
+    make_patch_eviction_to_dry_run, patch_pod_record_eviction, should_cut_owner_references,
+    IsolateOptions,
+};
+use crate::webhooks::reason_code::{with_reason_code, ReasonCode};
+use crate::webhooks::report::{debug_report_for, render_delay_note, report_for};
+use crate::webhooks::{
+    debug_report_for_ref, get_drain_duration, make_allow_response, patch_pod_isolate,
+    record_reentry, record_rollout_revision, AppState, InterceptResult,
+};
 use crate::{try_some, ApiResolver};
 
 /// The handler patches CREATE Eviction request as dry-run.
@@ -27,6 +44,7 @@ pub async fn eviction_handler(
     state: &AppState,
     request: &AdmissionRequest<Eviction>,
     user_info: &UserInfo,
+    timeout: Option<std::time::Duration>,
 ) -> Result<InterceptResult> {
     let eviction = request
         .object
@@ -34,62 +52,264 @@ pub async fn eviction_handler(
         .ok_or(eyre!("object for mutation is missing"))?;
 
     let object_ref = get_object_ref_from_name(&request.name, request.namespace.as_ref());
-    if let Some(dry_run) = try_some!(eviction.delete_options?.dry_run?) {
-        if !dry_run.is_empty() {
-            debug_report_for_ref(
-                state,
-                ObjectReference::from(object_ref),
-                "AllowEviction",
-                "DryRun",
-                format!("Eviction request is allowed because `eviction.deleteOptions.dryRun = {dry_run:?}`"),
-            )
-                .await;
-            return Ok(InterceptResult::Allow);
-        }
+    if is_eviction_dry_run(eviction) {
+        debug_report_for_ref(
+            state,
+            ObjectReference::from(object_ref),
+            "AllowEviction",
+            "DryRun",
+            format!(
+                "Eviction request is allowed because `eviction.deleteOptions.dryRun = {:?}`",
+                try_some!(eviction.delete_options?.dry_run?),
+            ),
+        )
+        .await;
+        return Ok(InterceptResult::Allow);
     }
 
     let pod = state
         .stores
         .get_pod(&object_ref)
         .ok_or(eyre!("pod is not found"))?;
+    record_rollout_revision(&pod);
 
     let draining = get_pod_draining_info(&pod);
-    match draining {
+    let reason_code = match draining {
         PodDrainingInfo::None => {
-            if !is_pod_exposed(&state.config, &state.stores, &pod) {
+            if !is_pod_in_scope(&state.config, &pod) {
+                let note = "Eviction is allowed because the pod is out of the scope";
+                debug_report_for(state, &pod, "AllowEviction", "OutOfScope", note.to_string())
+                    .await;
+                return Ok(InterceptResult::AllowWithWarning(
+                    ReasonCode::OutOfScope,
+                    note.to_string(),
+                ));
+            }
+
+            if is_owned_by_ignored_kind(&state.config, &pod) {
+                let note = "Eviction is allowed because the pod's owner is ignored";
+                debug_report_for(
+                    state,
+                    &pod,
+                    "AllowEviction",
+                    "IgnoredOwner",
+                    note.to_string(),
+                )
+                .await;
+                return Ok(InterceptResult::AllowWithWarning(
+                    ReasonCode::OutOfScope,
+                    note.to_string(),
+                ));
+            }
+
+            if has_only_excluded_containers(&state.config, &pod) {
+                let note = "Eviction is allowed because the pod has only excluded containers";
                 debug_report_for(
                     state,
                     &pod,
                     "AllowEviction",
-                    "NotExposed",
-                    "Eviction is allowed because the pod is not exposed".to_string(),
+                    "ExcludedContainer",
+                    note.to_string(),
                 )
                 .await;
-                return Ok(InterceptResult::Allow);
+                return Ok(InterceptResult::AllowWithWarning(
+                    ReasonCode::OutOfScope,
+                    note.to_string(),
+                ));
             }
 
-            if !is_pod_ready(&pod) {
+            if !is_within_active_hours(&state.config, state.clock.now()) {
+                let note = "Eviction is allowed without delay outside the active hours";
                 debug_report_for(
                     state,
                     &pod,
                     "AllowEviction",
-                    "NotReady",
-                    "Eviction is allowed because the pod is not ready".to_string(),
+                    "OutOfActiveHours",
+                    note.to_string(),
                 )
                 .await;
-                return Ok(InterceptResult::Allow);
+                return Ok(InterceptResult::AllowWithWarning(
+                    ReasonCode::OutOfActiveHours,
+                    note.to_string(),
+                ));
             }
 
-            let drain_until = Utc::now() + Duration::from_std(state.config.delete_after)?;
+            if !should_drain_pod(&state.config, &state.stores, &pod) {
+                let note = "Eviction is allowed because the pod is not exposed";
+                debug_report_for(state, &pod, "AllowEviction", "NotExposed", note.to_string())
+                    .await;
+                return Ok(InterceptResult::AllowWithWarning(
+                    ReasonCode::NotExposed,
+                    note.to_string(),
+                ));
+            }
+
+            if get_node_name(&pod).is_none() {
+                let note = "Eviction is allowed because the pod is not scheduled to a node";
+                debug_report_for(
+                    state,
+                    &pod,
+                    "AllowEviction",
+                    "NotScheduled",
+                    note.to_string(),
+                )
+                .await;
+                return Ok(InterceptResult::AllowWithWarning(
+                    ReasonCode::NotServing,
+                    note.to_string(),
+                ));
+            }
+
+            // Not serving, even with the target health readiness gate, and its conditions might be stale.
+            if is_pod_completed(&pod) {
+                let note = "Eviction is allowed because the pod has completed";
+                debug_report_for(state, &pod, "AllowEviction", "Completed", note.to_string()).await;
+                return Ok(InterceptResult::AllowWithWarning(
+                    ReasonCode::NotServing,
+                    note.to_string(),
+                ));
+            }
+
+            let is_serving =
+                is_pod_serving(&state.config, &state.api_resolver, &state.stores, &pod)
+                    .await
+                    .context("checking endpoint slices")?;
+            if !is_serving && !is_pod_possibly_deregistering(&state.config, &pod) {
+                let note = if state.config.use_endpointslice_readiness {
+                    "Eviction is allowed because the pod is not serving per its EndpointSlices"
+                } else {
+                    "Eviction is allowed because the pod is not ready"
+                };
+                debug_report_for(state, &pod, "AllowEviction", "NotReady", note.to_string()).await;
+                return Ok(InterceptResult::AllowWithWarning(
+                    ReasonCode::NotServing,
+                    note.to_string(),
+                ));
+            }
+
+            if is_pod_recently_ready(&state.config, &pod, state.clock.now()) {
+                let note = "Eviction is allowed because the pod has just become ready";
+                debug_report_for(
+                    state,
+                    &pod,
+                    "AllowEviction",
+                    "RecentlyReady",
+                    note.to_string(),
+                )
+                .await;
+                return Ok(InterceptResult::AllowWithWarning(
+                    ReasonCode::NotServing,
+                    note.to_string(),
+                ));
+            }
+
+            if would_violate_pod_disruption_budget(&state.config, &state.stores, &pod) {
+                let note = "Eviction is allowed because isolating the pod would violate its PodDisruptionBudget";
+                debug_report_for(
+                    state,
+                    &pod,
+                    "AllowEviction",
+                    "DisruptionBudget",
+                    note.to_string(),
+                )
+                .await;
+                return Ok(InterceptResult::AllowWithWarning(
+                    ReasonCode::DisruptionBudget,
+                    note.to_string(),
+                ));
+            }
+
+            let Some(reservation) =
+                state
+                    .drain_reservations
+                    .try_reserve(&state.config, &state.stores, &pod)
+            else {
+                let note = "Eviction is allowed without delay because too many pods of the same service are draining";
+                report_for(
+                    state,
+                    &pod,
+                    "AllowEviction",
+                    "TooManyDraining",
+                    note.to_string(),
+                )
+                .await;
+                return Ok(InterceptResult::AllowWithWarning(
+                    ReasonCode::TooManyDraining,
+                    note.to_string(),
+                ));
+            };
+
+            let delete_after = get_drain_duration(
+                &state.config,
+                get_delete_after(&state.config, &state.stores, &pod),
+                timeout,
+            );
+            let mut drain_until = state.clock.now() + Duration::from_std(delete_after)?;
+            if let Some(terminate_at) =
+                get_spot_interruption_deadline(&state.config, &state.api_resolver, &pod)
+                    .await
+                    .context("getting spot interruption deadline")?
+            {
+                if terminate_at <= state.clock.now() {
+                    debug_report_for(
+                        state,
+                        &pod,
+                        "AllowEviction",
+                        "SpotInterrupted",
+                        "Eviction is allowed because the node is being terminated".to_string(),
+                    )
+                    .await;
+                    return Ok(InterceptResult::AllowWithReason(
+                        ReasonCode::NodeTerminating,
+                    ));
+                }
+
+                drain_until = drain_until.min(terminate_at);
+            }
+
+            Span::current().record(
+                "drain_until",
+                drain_until
+                    .to_rfc3339_opts(SecondsFormat::Secs, true)
+                    .as_str(),
+            );
+
+            if state.config.observe_only {
+                report_for(
+                    state,
+                    &pod,
+                    "AllowEviction",
+                    "ObserveOnly",
+                    format!(
+                        "Eviction is allowed because of the observe-only mode. It would've been drained until '{}'",
+                        drain_until.to_rfc3339_opts(SecondsFormat::Secs, true),
+                    ),
+                )
+                .await;
+                return Ok(InterceptResult::AllowWithReason(ReasonCode::ObserveOnly));
+            }
             check_eviction_permission(&state.api_resolver, eviction, user_info)
                 .await
                 .context("checking permission")?;
+            let target_groups = get_exposing_target_group_arns(&state.config, &state.stores, &pod);
             let patched_result = patch_pod_isolate(
                 &state.api_resolver,
+                &state.config,
                 &pod,
+                state.clock.now(),
                 drain_until,
-                eviction.delete_options.as_ref(),
                 &state.loadbalancing,
+                IsolateOptions {
+                    eviction_delete_options: eviction.delete_options.as_ref(),
+                    requested_by: user_info.username.as_deref(),
+                    cut_owner_references: should_cut_owner_references(
+                        &state.config,
+                        &pod,
+                        eviction.delete_options.as_ref(),
+                    ),
+                    target_groups: &target_groups,
+                    ..IsolateOptions::default()
+                },
             )
             .await
             .context("apply patch")?;
@@ -103,23 +323,32 @@ pub async fn eviction_handler(
                     "Pod is already gone".to_string(),
                 )
                 .await;
-                return Ok(InterceptResult::Allow);
+                return Ok(InterceptResult::AllowWithReason(ReasonCode::Deleting));
             }
+            reservation.keep();
 
             report_for(
                 state,
                 &pod,
                 "InterceptEviction",
                 "Drain",
-                format!(
-                    "Eviction is intercepted, and the pod is isolated. It'll be deleted after '{}'",
-                    drain_until.to_rfc3339_opts(SecondsFormat::Secs, true),
+                render_delay_note(
+                    state.config.delay_message_template.as_deref(),
+                    format!(
+                        "Eviction is intercepted, and the pod is isolated. It'll be deleted after '{}'",
+                        drain_until.to_rfc3339_opts(SecondsFormat::Secs, true),
+                    ),
+                    "Drain",
+                    drain_until,
+                    state.clock.now(),
                 ),
             )
             .await;
+            ReasonCode::Drain
         }
         PodDrainingInfo::DrainUntil(drain_until) => {
-            if Utc::now() > drain_until {
+            if state.clock.now() > drain_until {
+                record_reentry(ReentryOutcome::Allow);
                 debug_report_for(
                     state,
                     &pod,
@@ -129,23 +358,65 @@ pub async fn eviction_handler(
                 )
                 .await;
 
-                return Ok(InterceptResult::Allow);
+                return Ok(InterceptResult::AllowWithReason(ReasonCode::Drained));
             }
 
+            // The node drain has followed the pre-isolation, so the controller evicts it after the drain.
+            if is_pod_pre_isolated(&pod) && get_pod_evict_params(&pod).is_none() {
+                check_eviction_permission(&state.api_resolver, eviction, user_info)
+                    .await
+                    .context("checking permission")?;
+                patch_pod_record_eviction(
+                    &state.api_resolver,
+                    &state.config,
+                    &pod,
+                    eviction.delete_options.as_ref(),
+                )
+                .await
+                .context("recording eviction")?;
+            }
+
+            record_reentry(ReentryOutcome::Intercept);
             report_for(
                 state,
                 &pod,
                 "InterceptEviction",
                 "Draining",
-                format!(
-                    "Eviction is intercepted. It'll be deleted after '{}'",
-                    drain_until.to_rfc3339_opts(SecondsFormat::Secs, true),
+                render_delay_note(
+                    state.config.delay_message_template.as_deref(),
+                    format!(
+                        "Eviction is intercepted. It'll be deleted after '{}'",
+                        drain_until.to_rfc3339_opts(SecondsFormat::Secs, true),
+                    ),
+                    "Draining",
+                    drain_until,
+                    state.clock.now(),
                 ),
             )
             .await;
+            ReasonCode::Reentry
         }
         PodDrainingInfo::Deleted => {
-            return Ok(InterceptResult::Allow);
+            debug_report_for(
+                state,
+                &pod,
+                "AllowEviction",
+                "Terminating",
+                "Eviction is allowed because the pod is already terminating".to_string(),
+            )
+            .await;
+            return Ok(InterceptResult::AllowWithReason(ReasonCode::Deleting));
+        }
+        PodDrainingInfo::Deleting => {
+            debug_report_for(
+                state,
+                &pod,
+                "AllowEviction",
+                "Deleting",
+                "Eviction is allowed because the pod is already being deleted".to_string(),
+            )
+            .await;
+            return Ok(InterceptResult::AllowWithReason(ReasonCode::Deleting));
         }
         PodDrainingInfo::DrainDisabled => {
             debug_report_for(
@@ -156,7 +427,19 @@ pub async fn eviction_handler(
                 "Pod graceful drain is disabled".to_string(),
             )
             .await;
-            return Ok(InterceptResult::Allow);
+            return Ok(InterceptResult::AllowWithReason(ReasonCode::Disabled));
+        }
+        PodDrainingInfo::LabelCleared => {
+            report_for(
+                state,
+                &pod,
+                "AllowEviction",
+                "LabelCleared",
+                "Eviction is allowed without the drain because the draining label was cleared"
+                    .to_string(),
+            )
+            .await;
+            return Ok(InterceptResult::AllowWithReason(ReasonCode::Disabled));
         }
         PodDrainingInfo::AnnotationParseError { message } => {
             return Err(eyre!(message));
@@ -167,6 +450,12 @@ pub async fn eviction_handler(
     let response = AdmissionResponse::from(request)
         .with_patch(eviction_patch)
         .context("attaching patch")?;
+    let response = make_allow_response(
+        &state.config,
+        response,
+        String::from("Eviction is turned into a dry-run, the pod is deleted after the drain"),
+    );
+    let response = with_reason_code(response, reason_code);
 
     Ok(InterceptResult::Patch(Box::new(response)))
 }
@@ -194,3 +483,228 @@ async fn check_eviction_permission(
     api.evict(&name, &evict_params).await?;
     Ok(())
 }
+
+/// The api server only accepts `All` for now, but any value means dry-run.
+fn is_eviction_dry_run(eviction: &Eviction) -> bool {
+    matches!(try_some!(eviction.delete_options?.dry_run?), Some(dry_run) if !dry_run.is_empty())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    use std::time::Duration as StdDuration;
+
+    use axum::http::HeaderMap;
+    use chrono::FixedOffset;
+    use serde_json::{json, Value};
+
+    use crate::test_utils::{pod_routes, FakeApiServer};
+    use crate::webhooks::handle_common;
+    use crate::webhooks::tests::{
+        app_state, datetime, eviction_review, exposing_stores, into_response, reason_code_of,
+        serving_pod, serving_pod_with,
+    };
+    use crate::{from_json, Clock, Config};
+
+    async fn evict(state: &AppState, pod: &Value) -> AdmissionResponse {
+        let review = eviction_review(pod);
+        let result = handle_common(
+            eviction_handler,
+            state,
+            &review,
+            Some(StdDuration::from_secs(10)),
+            &HeaderMap::new(),
+        )
+        .await;
+        into_response(result)
+    }
+
+    /// Evicts `pod` at `now`, and returns the response.
+    async fn evict_pod_at(config: Config, pod: Value, now: &str) -> AdmissionResponse {
+        let server = FakeApiServer::serve(pod_routes(pod.clone())).await;
+        let state = app_state(
+            &server.api_resolver,
+            config,
+            exposing_stores([serde_json::from_value(pod.clone()).unwrap()]),
+            Clock::fake(datetime(now)),
+        );
+        evict(&state, &pod).await
+    }
+
+    async fn evict_pod(config: Config, pod: Value) -> AdmissionResponse {
+        evict_pod_at(config, pod, "2023-02-08T15:30:00Z").await
+    }
+
+    #[tokio::test]
+    async fn each_branch_should_be_coded() {
+        let cases = [
+            (
+                "out of the scope",
+                Config {
+                    watch_namespaces: vec![String::from("other")],
+                    ..Config::default()
+                },
+                serving_pod(),
+                "OUT_OF_SCOPE",
+            ),
+            (
+                "not exposed",
+                Config::default(),
+                serving_pod_with(json!({ "metadata": { "labels": { "app": "other" } } })),
+                "NOT_EXPOSED",
+            ),
+            (
+                "not scheduled",
+                Config::default(),
+                serving_pod_with(json!({ "spec": { "nodeName": null } })),
+                "NOT_SERVING",
+            ),
+            ("drain", Config::default(), serving_pod(), "DRAIN"),
+            (
+                "draining",
+                Config::default(),
+                serving_pod_with(json!({
+                    "metadata": {
+                        "labels": { "pod-graceful-drain/draining": "true" },
+                        "annotations": { "pod-graceful-drain/drain-until": "2023-02-08T15:31:00Z" },
+                    },
+                })),
+                "REENTRY",
+            ),
+            (
+                "drained",
+                Config::default(),
+                serving_pod_with(json!({
+                    "metadata": {
+                        "labels": { "pod-graceful-drain/draining": "true" },
+                        "annotations": { "pod-graceful-drain/drain-until": "2023-02-08T15:29:00Z" },
+                    },
+                })),
+                "DRAINED",
+            ),
+            (
+                "label cleared",
+                Config::default(),
+                serving_pod_with(json!({
+                    "metadata": {
+                        "annotations": { "pod-graceful-drain/drain-until": "2023-02-08T15:31:00Z" },
+                    },
+                })),
+                "DISABLED",
+            ),
+        ];
+
+        for (branch, config, pod, expected) in cases {
+            let response = evict_pod(config, pod).await;
+            assert!(response.allowed, "{branch}");
+            assert_eq!(reason_code_of(&response), Some(expected), "{branch}");
+        }
+    }
+
+    #[tokio::test]
+    async fn eviction_should_be_intercepted_only_within_active_hours() {
+        let config = Config {
+            active_hours: Some("09:00-18:00".parse().unwrap()),
+            active_hours_utc_offset: FixedOffset::east_opt(9 * 3600).unwrap(),
+            ..Config::default()
+        };
+
+        // 10:30 at +09:00
+        let response = evict_pod_at(config.clone(), serving_pod(), "2023-02-08T01:30:00Z").await;
+        assert!(response.patch.is_some(), "turned into a dry-run");
+        assert_eq!(reason_code_of(&response), Some("DRAIN"));
+
+        // 00:30 at +09:00
+        let response = evict_pod_at(config, serving_pod(), "2023-02-08T15:30:00Z").await;
+        assert!(response.allowed);
+        assert!(response.patch.is_none(), "evicted right away");
+        assert_eq!(reason_code_of(&response), Some("OUT_OF_ACTIVE_HOURS"));
+    }
+
+    #[tokio::test]
+    async fn too_many_draining_should_be_coded() {
+        let pod = serving_pod();
+        let other = serving_pod_with(json!({ "metadata": { "name": "other", "uid": "uid5678" } }));
+        let server = FakeApiServer::serve(pod_routes(pod.clone())).await;
+        let state = app_state(
+            &server.api_resolver,
+            Config {
+                max_concurrent_drains_fraction: Some(0.5),
+                ..Config::default()
+            },
+            exposing_stores([
+                serde_json::from_value(pod.clone()).unwrap(),
+                serde_json::from_value(other.clone()).unwrap(),
+            ]),
+            Clock::fake(datetime("2023-02-08T15:30:00Z")),
+        );
+        state
+            .drain_reservations
+            .try_reserve(
+                &state.config,
+                &state.stores,
+                &serde_json::from_value(other).unwrap(),
+            )
+            .unwrap()
+            .keep();
+
+        let response = evict(&state, &pod).await;
+        assert!(response.allowed);
+        assert_eq!(reason_code_of(&response), Some("TOO_MANY_DRAINING"));
+    }
+
+    #[tokio::test]
+    async fn intercepted_eviction_warning_should_be_prefixed_with_reason_code() {
+        let config = Config {
+            emit_admission_warnings: true,
+            ..Config::default()
+        };
+
+        let response = evict_pod(config, serving_pod()).await;
+        assert!(response.patch.is_some());
+        assert_eq!(
+            response.warnings,
+            Some(vec![String::from(
+                "[DRAIN] Eviction is turned into a dry-run, the pod is deleted after the drain"
+            )])
+        );
+    }
+
+    #[test]
+    fn eviction_with_dry_run_delete_options_should_be_dry_run() {
+        let eviction: Eviction = from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+            },
+            "deleteOptions": {
+                "dryRun": ["All"],
+            },
+        });
+
+        assert!(is_eviction_dry_run(&eviction));
+    }
+
+    #[test]
+    fn eviction_without_dry_run_should_not_be_dry_run() {
+        let eviction: Eviction = from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+            },
+            "deleteOptions": {
+                "dryRun": [],
+            },
+        });
+        assert!(!is_eviction_dry_run(&eviction));
+
+        let eviction: Eviction = from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+            },
+        });
+        assert!(!is_eviction_dry_run(&eviction));
+    }
+}
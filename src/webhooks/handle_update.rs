@@ -0,0 +1,359 @@
+use eyre::{eyre, Result};
+use k8s_openapi::api::authentication::v1::UserInfo;
+use k8s_openapi::api::core::v1::Pod;
+use kube::core::admission::{AdmissionRequest, Operation};
+use kube::runtime::reflector::ObjectRef;
+use kube::ResourceExt;
+use tracing::debug;
+
+use crate::pod_draining_info::{get_pod_draining_info, PodDrainingInfo};
+use crate::pod_state::{
+    get_exposing_target_group_bindings, is_pod_exposed, is_pod_in_scope, is_pod_ready,
+};
+use crate::reflector::Stores;
+use crate::webhooks::reason_code::ReasonCode;
+use crate::webhooks::report::{debug_report_for, report_for};
+use crate::webhooks::{record_rollout_revision, AppState, InterceptResult};
+use crate::Config;
+
+/// This handler denies the UPDATE Pod request that removes the pod from the load balancers by its labels,
+/// with `--intercept-label-removal`.
+///
+/// Some controllers take a pod out of the service by removing its labels and delete it soon after.
+/// The deletion isn't delayed since the pod is no longer exposed, while its target is still deregistering.
+/// The denial lets them back off and retry, so they might delete or evict the pod instead, which is drained.
+/// With `--observe-only`, it's only reported and allowed.
+///
+/// The isolation of this controller also removes the labels, but it's told apart by the draining label.
+pub async fn update_handler(
+    state: &AppState,
+    request: &AdmissionRequest<Pod>,
+    _user_info: &UserInfo,
+) -> Result<InterceptResult> {
+    if !is_label_update(&state.config, request) {
+        debug!(operation = ?request.operation, "not an update to intercept");
+        return Ok(InterceptResult::Allow);
+    }
+
+    let old_pod = request
+        .old_object
+        .as_ref()
+        .ok_or(eyre!("old_object for validation is missing"))?;
+    let new_pod = request
+        .object
+        .as_ref()
+        .ok_or(eyre!("object for validation is missing"))?;
+    record_rollout_revision(old_pod);
+
+    if !is_removing_from_load_balancers(&state.config, &state.stores, old_pod, new_pod) {
+        return Ok(InterceptResult::Allow);
+    }
+
+    if !is_pod_ready(&state.config, old_pod) {
+        debug_report_for(
+            state,
+            old_pod,
+            "AllowUpdate",
+            "NotReady",
+            "Label removal is allowed because the pod is not ready".to_string(),
+        )
+        .await;
+        return Ok(InterceptResult::Allow);
+    }
+
+    if state.config.observe_only {
+        report_for(
+            state,
+            old_pod,
+            "AllowUpdate",
+            "ObserveOnly",
+            "Label removal is allowed because of the observe-only mode. It would've been denied since it'd remove the pod from the load balancers without the drain".to_string(),
+        )
+        .await;
+        return Ok(InterceptResult::AllowWithReason(ReasonCode::ObserveOnly));
+    }
+
+    report_for(
+        state,
+        old_pod,
+        "DenyUpdate",
+        "LabelRemoval",
+        "Label removal is denied since it'd remove the pod from the load balancers without the drain. Delete or evict the pod instead".to_string(),
+    )
+    .await;
+    Ok(InterceptResult::Deny(format!(
+        "the update removes the pod '{}' from the load balancers without the drain, delete or evict it instead",
+        old_pod.name_any()
+    )))
+}
+
+/// Every pod UPDATE in the cluster comes to the webhook, so the ones that can't remove the labels are told apart
+/// before the admission limiter and the circuit breaker.
+pub fn is_label_update(config: &Config, request: &AdmissionRequest<Pod>) -> bool {
+    if !config.intercept_label_removal || !matches!(request.operation, Operation::Update) {
+        return false;
+    }
+
+    match (request.old_object.as_ref(), request.object.as_ref()) {
+        (Some(old_pod), Some(new_pod)) => old_pod.labels() != new_pod.labels(),
+        // Let the handler complain.
+        _ => true,
+    }
+}
+
+fn is_removing_from_load_balancers(
+    config: &Config,
+    stores: &Stores,
+    old_pod: &Pod,
+    new_pod: &Pod,
+) -> bool {
+    if old_pod.labels() == new_pod.labels() {
+        return false;
+    }
+
+    // Isolated, or released by this controller.
+    let is_draining = |pod: &Pod| !matches!(get_pod_draining_info(pod), PodDrainingInfo::None);
+    if is_draining(old_pod) || is_draining(new_pod) {
+        return false;
+    }
+
+    if !is_pod_in_scope(config, old_pod) {
+        return false;
+    }
+
+    // The readiness gates are immutable, so the gated pod is still exposed by the fallback without its labels.
+    let new_bindings: Vec<_> = get_exposing_target_group_bindings(config, stores, new_pod)
+        .iter()
+        .map(|tgb| ObjectRef::from_obj(tgb.as_ref()))
+        .collect();
+    let is_leaving_target_groups = get_exposing_target_group_bindings(config, stores, old_pod)
+        .iter()
+        .any(|tgb| !new_bindings.contains(&ObjectRef::from_obj(tgb.as_ref())));
+
+    is_leaving_target_groups
+        || (is_pod_exposed(config, stores, old_pod) && !is_pod_exposed(config, stores, new_pod))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    use k8s_openapi::api::core::v1::Service;
+
+    use crate::elbv2::apis::TargetGroupBinding;
+    use crate::from_json;
+    use crate::test_utils::{pod_routes, store_from, FakeApiServer};
+    use crate::webhooks::tests::{app_state, datetime, exposing_stores, serving_pod};
+    use crate::Clock;
+
+    fn pod_with_labels(labels: serde_json::Value) -> Pod {
+        from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "labels": labels,
+            },
+        })
+    }
+
+    fn gated_pod_with_labels(labels: serde_json::Value) -> Pod {
+        from_json!({
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "labels": labels,
+            },
+            "spec": {
+                "containers": [],
+                "readinessGates": [
+                    {
+                        "conditionType": "target-health.elbv2.k8s.aws/tgb",
+                    },
+                ],
+            },
+        })
+    }
+
+    fn stores() -> Stores {
+        let service: Service = from_json!({
+            "metadata": {
+                "name": "svc",
+                "namespace": "ns",
+            },
+            "spec": {
+                "selector": {
+                    "app": "test",
+                },
+            },
+        });
+        // Not bound to any target group.
+        let other_service: Service = from_json!({
+            "metadata": {
+                "name": "other",
+                "namespace": "ns",
+            },
+            "spec": {
+                "selector": {
+                    "version": "1",
+                },
+            },
+        });
+        let tgb: TargetGroupBinding = from_json!({
+            "metadata": {
+                "name": "tgb",
+                "namespace": "ns",
+            },
+            "spec": {
+                "serviceRef": {
+                    "name": "svc",
+                    "port": 80,
+                },
+                "targetGroupARN": "arn",
+                "targetType": "ip",
+            },
+        });
+
+        Stores::new(
+            store_from([]),
+            store_from([service, other_service]),
+            store_from([]),
+            store_from([tgb]),
+            store_from([]),
+        )
+    }
+
+    #[test]
+    fn update_removing_selector_label_should_be_intercepted() {
+        let config = Config::default();
+        let stores = stores();
+        let old_pod = pod_with_labels(serde_json::json!({ "app": "test", "version": "1" }));
+
+        let removed = pod_with_labels(serde_json::json!({ "version": "1" }));
+        assert!(is_removing_from_load_balancers(
+            &config, &stores, &old_pod, &removed
+        ));
+
+        let unrelated = pod_with_labels(serde_json::json!({ "app": "test", "version": "2" }));
+        assert!(!is_removing_from_load_balancers(
+            &config, &stores, &old_pod, &unrelated
+        ));
+    }
+
+    #[test]
+    fn isolation_should_not_be_intercepted() {
+        let config = Config::default();
+        let stores = stores();
+        let old_pod = pod_with_labels(serde_json::json!({ "app": "test" }));
+        let isolated =
+            pod_with_labels(serde_json::json!({ "pod-graceful-drain/draining": "true" }));
+
+        assert!(!is_removing_from_load_balancers(
+            &config, &stores, &old_pod, &isolated
+        ));
+    }
+
+    #[test]
+    fn update_removing_gated_pod_from_target_group_should_be_intercepted() {
+        let config = Config::default();
+        let stores = stores();
+        let old_pod = gated_pod_with_labels(serde_json::json!({ "app": "test", "version": "1" }));
+
+        // It is still exposed by the gate fallback, since another service selects it.
+        let removed = gated_pod_with_labels(serde_json::json!({ "version": "1" }));
+        assert!(is_pod_exposed(&config, &stores, &removed));
+        assert!(is_removing_from_load_balancers(
+            &config, &stores, &old_pod, &removed
+        ));
+
+        let unrelated = gated_pod_with_labels(serde_json::json!({ "app": "test", "version": "2" }));
+        assert!(!is_removing_from_load_balancers(
+            &config, &stores, &old_pod, &unrelated
+        ));
+    }
+
+    #[test]
+    fn only_label_updates_should_be_handled() {
+        let config = Config {
+            intercept_label_removal: true,
+            ..Config::default()
+        };
+        let update = |old_labels: serde_json::Value, new_labels: serde_json::Value| {
+            let request: AdmissionRequest<Pod> = from_json!({
+                "uid": "uid",
+                "kind": { "group": "", "version": "v1", "kind": "Pod" },
+                "resource": { "group": "", "version": "v1", "resource": "pods" },
+                "name": "pod",
+                "namespace": "ns",
+                "operation": "UPDATE",
+                "userInfo": {},
+                "oldObject": pod_with_labels(old_labels),
+                "object": pod_with_labels(new_labels),
+            });
+            request
+        };
+
+        let relabelled = update(
+            serde_json::json!({ "app": "test" }),
+            serde_json::json!({ "version": "1" }),
+        );
+        assert!(is_label_update(&config, &relabelled));
+        assert!(!is_label_update(&Config::default(), &relabelled));
+
+        let unlabelled = update(
+            serde_json::json!({ "app": "test" }),
+            serde_json::json!({ "app": "test" }),
+        );
+        assert!(!is_label_update(&config, &unlabelled));
+    }
+
+    #[tokio::test]
+    async fn label_removal_should_be_allowed_in_observe_only_mode() {
+        let old_pod = serving_pod();
+        let mut new_pod = old_pod.clone();
+        new_pod["metadata"]["labels"] = serde_json::json!({ "version": "1" });
+        let request: AdmissionRequest<Pod> = from_json!({
+            "uid": "uid",
+            "kind": { "group": "", "version": "v1", "kind": "Pod" },
+            "resource": { "group": "", "version": "v1", "resource": "pods" },
+            "name": "pod",
+            "namespace": "ns",
+            "operation": "UPDATE",
+            "userInfo": {},
+            "oldObject": old_pod,
+            "object": new_pod,
+        });
+
+        let server = FakeApiServer::serve(pod_routes(old_pod.clone())).await;
+        let update = |observe_only: bool| {
+            let config = Config {
+                intercept_label_removal: true,
+                observe_only,
+                ..Config::default()
+            };
+            app_state(
+                &server.api_resolver,
+                config,
+                exposing_stores([serde_json::from_value(old_pod.clone()).unwrap()]),
+                Clock::fake(datetime("2023-02-08T15:30:00Z")),
+            )
+        };
+
+        let result = update_handler(&update(false), &request, &UserInfo::default())
+            .await
+            .unwrap();
+        assert!(matches!(result, InterceptResult::Deny(_)));
+
+        let result = update_handler(&update(true), &request, &UserInfo::default())
+            .await
+            .unwrap();
+        assert!(matches!(
+            result,
+            InterceptResult::AllowWithReason(ReasonCode::ObserveOnly)
+        ));
+        assert_eq!(
+            server.pod_requests(),
+            Vec::<String>::new(),
+            "should not be patched"
+        );
+    }
+}
@@ -1,49 +1,86 @@
+mod admin;
+mod admission_limiter;
+mod circuit_breaker;
 mod config;
+mod delayed_tasks;
 mod handle_delete;
 mod handle_eviction;
+mod handle_update;
 mod patch;
 mod reactive_rustls_config;
+mod reason_code;
 mod report;
+mod self_check;
 mod try_bind;
 
 use std::fmt::Debug;
 use std::future::Future;
 use std::net::SocketAddr;
-use std::time::Duration;
+use std::time::{Duration, Instant};
 
-use axum::http::StatusCode;
+use axum::http::{HeaderMap, StatusCode};
 use axum::response::{IntoResponse, Response};
 use axum::routing::get;
-use axum::{extract::State, routing::post, Json, Router};
-use eyre::Result;
+use axum::{
+    extract::{Query, State},
+    routing::post,
+    Json, Router,
+};
+use eyre::{Context, Result};
+use humantime::parse_duration;
 use k8s_openapi::api::authentication::v1::UserInfo;
 use k8s_openapi::api::core::v1::ObjectReference;
 use k8s_openapi::api::{core::v1::Pod, policy::v1::Eviction};
 use k8s_openapi::serde::Serialize;
-use kube::core::admission::{AdmissionRequest, AdmissionResponse, AdmissionReview};
+use kube::core::admission::{AdmissionRequest, AdmissionResponse, AdmissionReview, Operation};
 use kube::core::DynamicObject;
 use kube::runtime::events::Reporter;
 use kube::runtime::reflector::ObjectRef;
-use kube::Resource;
+use kube::{Resource, ResourceExt};
+use serde::Deserialize;
 use serde_json::{json, Value};
-use tracing::{info, span, trace, Level};
+use tracing::{debug, field, info, span, trace, Level, Span};
 
 use crate::api_resolver::ApiResolver;
+use crate::clock::Clock;
+use crate::concurrent_drains::DrainReservations;
 use crate::config::Config;
-use crate::consts::CONTROLLER_NAME;
+use crate::consts::{CONTROLLER_NAME, NO_DENY_ANNOTATION_KEY};
+use crate::controller::mark_pod_drained;
+use crate::metrics;
+use crate::metrics::ReentryOutcome;
+use crate::node_state::get_spot_interruption_deadline;
+use crate::pod_state::get_rollout_revision;
 use crate::reflector::Stores;
 use crate::shutdown::Shutdown;
 use crate::spawn_service::spawn_service;
+use crate::status::is_retryable;
+use crate::telemetry::set_parent_from_headers;
 use crate::utils::get_object_ref_from_name;
+use crate::webhook_configuration::{get_mutating_webhook_timeout, get_validating_webhook_timeout};
+use crate::webhooks::admin::admin_delete_handler;
+use crate::webhooks::admission_limiter::AdmissionLimiter;
+use crate::webhooks::circuit_breaker::CircuitBreaker;
 pub use crate::webhooks::config::WebhookConfig;
+use crate::webhooks::delayed_tasks::{DelayedTaskInfo, DelayedTasks};
 use crate::webhooks::handle_delete::delete_handler;
 use crate::webhooks::handle_eviction::eviction_handler;
-pub use crate::webhooks::patch::patch_pod_isolate;
+use crate::webhooks::handle_update::{is_label_update, update_handler};
+pub use crate::webhooks::patch::{patch_pod_isolate, IsolateOptions};
+pub(crate) use crate::webhooks::patch::{
+    patch_pod_pre_isolate, patch_pod_release, patch_pod_takeover,
+};
 use crate::webhooks::reactive_rustls_config::build_reactive_rustls_config;
+use crate::webhooks::reason_code::{get_delay_reason_code, with_reason_code, ReasonCode};
 use crate::webhooks::report::{debug_report_for_ref, warn_report_for_ref};
+pub use crate::webhooks::self_check::verify_webhook_reachable;
 use crate::webhooks::try_bind::try_bind;
 use crate::{instrumented, LoadBalancingConfig, ServiceRegistry};
 
+/// Served besides the webhooks, so the webhooks can't be served at them.
+pub(crate) const RESERVED_PATHS: [&str; 5] =
+    ["/healthz", "/metrics", "/debug/tasks", "/config", "/delete"];
+
 /// Start an admission webhook that intercepts pod deletion, pod eviction requests.
 pub async fn start_webhook(
     api_resolver: &ApiResolver,
@@ -54,26 +91,53 @@ pub async fn start_webhook(
     loadbalancing: &LoadBalancingConfig,
     shutdown: &Shutdown,
 ) -> Result<SocketAddr> {
-    let app = Router::new()
+    let mut app = Router::new()
         .route("/healthz", get(healthz_handler))
-        .route("/merics", get(metrics_handler))
-        .route("/webhook/mutate", post(mutate_handler))
-        .route("/webhook/validate", post(validate_handler))
-        .with_state(AppState {
-            api_resolver: api_resolver.clone(),
-            config: config.clone(),
-            stores,
-            service_registry: service_registry.clone(),
-            loadbalancing: loadbalancing.clone(),
-            event_reporter: Reporter {
-                controller: String::from(CONTROLLER_NAME),
-                instance: hostname::get()
-                    .ok()
-                    .and_then(|n| n.to_str().map(String::from)),
-            },
-        });
+        .route("/metrics", get(metrics_handler))
+        .route("/debug/tasks", get(tasks_handler))
+        .route("/config", get(config_handler))
+        .route("/delete", post(admin_delete_handler));
+    // The disabled webhooks are `404 Not Found`, in case they are still registered.
+    if config.enable_eviction_webhook {
+        app = app.route(&config.mutate_webhook_path, post(mutate_handler));
+    } else {
+        info!("eviction webhook is disabled");
+    }
+    if config.enable_pod_webhook {
+        app = app.route(&config.validate_webhook_path, post(validate_handler));
+    } else {
+        info!("pod webhook is disabled");
+    }
 
-    let rustls_config = build_reactive_rustls_config(&webhook_config.cert, shutdown).await?;
+    let app = app.with_state(AppState {
+        api_resolver: api_resolver.clone(),
+        config: config.clone(),
+        stores,
+        service_registry: service_registry.clone(),
+        loadbalancing: loadbalancing.clone(),
+        clock: webhook_config.clock.clone(),
+        delayed_tasks: DelayedTasks::default(),
+        drain_reservations: webhook_config.drain_reservations.clone(),
+        admission_limiter: AdmissionLimiter::new(config.max_concurrent_admissions),
+        circuit_breaker: CircuitBreaker::new(
+            config.circuit_breaker_error_rate,
+            config.circuit_breaker_cooldown,
+        ),
+        event_reporter: Reporter {
+            controller: String::from(CONTROLLER_NAME),
+            instance: hostname::get()
+                .ok()
+                .and_then(|n| n.to_str().map(String::from)),
+        },
+    });
+
+    if config.delete_after.is_zero() {
+        info!("delete-after is 0, pods are drained as long as the webhook timeout allows");
+    }
+
+    let rustls_config = build_reactive_rustls_config(&webhook_config.cert, shutdown)
+        .await
+        .context("loading the webhook certificate")?;
 
     let addr_incoming = try_bind(&webhook_config.bind).await?;
     let local_addr = addr_incoming.local_addr()?;
@@ -89,7 +153,13 @@ pub async fn start_webhook(
     tokio::spawn({
         let shutdown = shutdown.clone();
         let handle = handle.clone();
-        let draining_graceful_period = config.delete_after;
+        // the longest delay that in-flight admissions can have.
+        let draining_graceful_period = get_admission_delay(
+            get_drain_duration(&config, config.delete_after, None),
+            None,
+            config.fallback_admission_delay_timeout,
+            config.max_admission_block,
+        );
 
         async move {
             shutdown.wait_drain_triggered().await;
@@ -120,6 +190,11 @@ struct AppState {
     service_registry: ServiceRegistry,
     event_reporter: Reporter,
     loadbalancing: LoadBalancingConfig,
+    clock: Clock,
+    delayed_tasks: DelayedTasks,
+    drain_reservations: DrainReservations,
+    admission_limiter: AdmissionLimiter,
+    circuit_breaker: CircuitBreaker,
 }
 
 async fn healthz_handler(State(state): State<AppState>) -> (StatusCode, Json<Value>) {
@@ -133,23 +208,71 @@ async fn healthz_handler(State(state): State<AppState>) -> (StatusCode, Json<Val
     (status_code, Json(json!({ "not_ready": not_ready })))
 }
 
-async fn metrics_handler(State(_state): State<AppState>) -> StatusCode {
-    // TODO
-    StatusCode::OK
+async fn metrics_handler(State(_state): State<AppState>) -> String {
+    metrics::render()
+}
+
+async fn config_handler(State(state): State<AppState>) -> Json<Config> {
+    Json(state.config)
+}
+
+async fn tasks_handler(State(state): State<AppState>) -> Json<Vec<DelayedTaskInfo>> {
+    Json(state.delayed_tasks.list())
+}
+
+/// The api server passes its webhook timeout as a query parameter. e.g. `?timeout=10s`
+#[derive(Debug, Deserialize)]
+struct AdmissionParams {
+    timeout: Option<String>,
+}
+
+impl AdmissionParams {
+    fn timeout(&self) -> Option<Duration> {
+        parse_duration(self.timeout.as_ref()?).ok()
+    }
 }
 
 async fn mutate_handler(
     State(state): State<AppState>,
+    Query(params): Query<AdmissionParams>,
+    headers: HeaderMap,
     Json(review): Json<AdmissionReview<Eviction>>,
 ) -> ValueOrStatusCode<AdmissionReview<DynamicObject>> {
-    handle_common(eviction_handler, &state, &review).await
+    let timeout = params
+        .timeout()
+        .or_else(|| get_mutating_webhook_timeout(&state.stores, &state.config.mutate_webhook_path));
+    handle_common(eviction_handler, &state, &review, timeout, &headers).await
 }
 
 async fn validate_handler(
     State(state): State<AppState>,
+    Query(params): Query<AdmissionParams>,
+    headers: HeaderMap,
     Json(review): Json<AdmissionReview<Pod>>,
 ) -> ValueOrStatusCode<AdmissionReview<DynamicObject>> {
-    handle_common(delete_handler, &state, &review).await
+    if let Some(request) = review.request.as_ref().filter(|request| {
+        matches!(request.operation, Operation::Update) && !is_label_update(&state.config, request)
+    }) {
+        trace!("not a label update");
+        return ValueOrStatusCode::Value(AdmissionResponse::from(request).into_review());
+    }
+
+    let timeout = params.timeout().or_else(|| {
+        get_validating_webhook_timeout(&state.stores, &state.config.validate_webhook_path)
+    });
+    handle_common(pod_handler, &state, &review, timeout, &headers).await
+}
+
+async fn pod_handler(
+    state: &AppState,
+    request: &AdmissionRequest<Pod>,
+    user_info: &UserInfo,
+    timeout: Option<Duration>,
+) -> Result<InterceptResult> {
+    match request.operation {
+        Operation::Update => update_handler(state, request, user_info).await,
+        _ => delete_handler(state, request, user_info, timeout).await,
+    }
 }
 
 #[derive(Debug, Clone, Copy)]
@@ -171,15 +294,209 @@ where
 }
 
 enum InterceptResult {
+    /// Not about the drain, e.g. the other operations.
     Allow,
-    Delay(Duration),
+    Delay(Duration, ReasonCode),
     Patch(Box<AdmissionResponse>),
+    Deny(String),
+    /// Allowed without the delay nor the warning, and why.
+    AllowWithReason(ReasonCode),
+    /// Allowed without the delay, and why.
+    AllowWithWarning(ReasonCode, String),
+}
+
+/// Reserved time to respond before the api server gives up on the admission.
+pub(crate) const ADMISSION_TIMEOUT_OVERHEAD: Duration = Duration::from_secs(2);
+
+/// `max_block` caps the delay even if the api server waits longer.
+fn get_admission_delay(
+    delay: Duration,
+    timeout: Option<Duration>,
+    fallback_timeout: Duration,
+    max_block: Option<Duration>,
+) -> Duration {
+    let timeout = timeout.unwrap_or(fallback_timeout);
+    let delay = delay.min(timeout.saturating_sub(ADMISSION_TIMEOUT_OVERHEAD));
+    match max_block {
+        Some(max_block) => delay.min(max_block),
+        None => delay,
+    }
+}
+
+/// `--delete-after=0` means to drain the pods as long as the webhook timeout allows, minus the overhead.
+/// Other delays, e.g. from the annotations or the deregistration delays, are kept.
+fn get_drain_duration(
+    config: &Config,
+    delete_after: Duration,
+    timeout: Option<Duration>,
+) -> Duration {
+    if !config.delete_after.is_zero() || !delete_after.is_zero() {
+        return delete_after;
+    }
+
+    let drain_duration = get_admission_delay(
+        Duration::MAX,
+        timeout,
+        config.fallback_admission_delay_timeout,
+        config.max_admission_block,
+    );
+    debug!(
+        ?drain_duration,
+        ?timeout,
+        "delete-after is 0, the drain is driven by the webhook timeout"
+    );
+    drain_duration
+}
+
+/// `kubectl` prints the warnings, so the users can see why the pod isn't drained.
+fn make_allow_response(
+    config: &Config,
+    mut response: AdmissionResponse,
+    warning: String,
+) -> AdmissionResponse {
+    if config.emit_admission_warnings {
+        response.warnings = Some(vec![warning]);
+    }
+    response
+}
+
+/// Clients back off and retry on 429 by default, while the pod is kept intact.
+fn make_deny_response(
+    config: &Config,
+    response: AdmissionResponse,
+    message: String,
+) -> AdmissionResponse {
+    let mut response = response.deny(message);
+    response.result.code = config.deny_status_code;
+    response.result.reason = config.deny_reason.clone();
+    response
+}
+
+/// Returns true if it has stopped early at an earlier deadline that `get_deadline` has found.
+async fn sleep_unless_cut_short<Fut>(
+    delay: Duration,
+    interval: Option<Duration>,
+    mut get_deadline: impl FnMut() -> Fut,
+) -> bool
+where
+    Fut: Future<Output = Option<tokio::time::Instant>>,
+{
+    let Some(interval) = interval else {
+        tokio::time::sleep(delay).await;
+        return false;
+    };
+
+    let mut deadline = tokio::time::Instant::now() + delay;
+    let mut cut_short = false;
+    loop {
+        let now = tokio::time::Instant::now();
+        if now >= deadline {
+            return cut_short;
+        }
+
+        tokio::time::sleep(interval.min(deadline - now)).await;
+        if let Some(earlier) = get_deadline().await.filter(|earlier| *earlier < deadline) {
+            deadline = earlier;
+            cut_short = true;
+        }
+    }
+}
+
+/// Records how long the admission actually blocked, which might be shorter than the delay when it is interrupted.
+///
+/// It is measured by the tokio clock like the delays, so the paused time of the tests is observed as well.
+async fn observe_block<Fut: Future>(blocking: Fut) -> Fut::Output {
+    let started = tokio::time::Instant::now();
+    let output = blocking.await;
+    metrics::ADMISSION_BLOCK_SECONDS.observe(started.elapsed());
+    output
+}
+
+/// The pod should be deleted, and its connections closed, a while before its node goes down.
+const NODE_TERMINATION_MARGIN: Duration = Duration::from_secs(5);
+
+/// The node might start to be terminated while the admission is delayed.
+/// Then the delay should end a margin before the node's terminate-at.
+async fn get_node_termination_deadline(
+    state: &AppState,
+    name: &str,
+    namespace: Option<&String>,
+) -> Option<tokio::time::Instant> {
+    let object_ref: ObjectRef<Pod> = get_object_ref_from_name(name, namespace);
+    let pod = state.stores.get_pod(&object_ref)?;
+
+    let terminate_at =
+        match get_spot_interruption_deadline(&state.config, &state.api_resolver, &pod).await {
+            Ok(terminate_at) => terminate_at?,
+            Err(err) => {
+                debug!(?err, "failed to re-check the node");
+                return None;
+            }
+        };
+
+    let margin = chrono::Duration::from_std(NODE_TERMINATION_MARGIN).ok()?;
+    let remaining = (terminate_at - margin - state.clock.now())
+        .to_std()
+        .unwrap_or_default();
+    Some(tokio::time::Instant::now() + remaining)
+}
+
+/// The deletions delayed to the end are labelled as drained just before they are allowed,
+/// like the controller's removals.
+/// Only the pods are delayed, and the pod in the store is isolated by then.
+async fn mark_drained(
+    state: &AppState,
+    name: &str,
+    namespace: Option<&String>,
+) -> kube::Result<()> {
+    let object_ref: ObjectRef<Pod> = get_object_ref_from_name(name, namespace);
+    let Some(pod) = state.stores.get_pod(&object_ref) else {
+        debug!("pod is gone anyway");
+        return Ok(());
+    };
+
+    mark_pod_drained(&state.api_resolver, &pod).await
+}
+
+/// Lets the logs of the admission be correlated with the rollout revisions.
+fn record_rollout_revision(pod: &Pod) {
+    let revision = get_rollout_revision(pod);
+    let span = Span::current();
+    if let Some(replica_set) = revision.replica_set {
+        span.record("replica_set", replica_set);
+    }
+    if let Some(pod_template_hash) = revision.pod_template_hash {
+        span.record("pod_template_hash", pod_template_hash);
+    }
+}
+
+/// The api server retries the admission on the webhook timeout, so the draining pods come back again.
+/// A storm of these tells the clients are retrying in a tight loop.
+fn record_reentry(outcome: ReentryOutcome) {
+    metrics::ADMISSION_REENTRY_TOTAL.inc(outcome.as_str());
+    debug!(?outcome, "admission re-entered for the draining pod");
+}
+
+/// Some controllers don't back off on the denial and retry in a tight loop.
+/// Pods annotated with `pod-graceful-drain/no-deny: "true"` are allowed instead.
+fn can_deny_admission(stores: &Stores, name: &str, namespace: Option<&String>) -> bool {
+    let pod_ref: ObjectRef<Pod> = get_object_ref_from_name(name, namespace);
+    let Some(pod) = stores.get_pod(&pod_ref) else {
+        return true;
+    };
+
+    pod.annotations()
+        .get(NO_DENY_ANNOTATION_KEY)
+        .map(String::as_str)
+        != Some("true")
 }
 
 async fn handle_common<'a, K, Fut>(
-    handle: impl FnOnce(&'a AppState, &'a AdmissionRequest<K>, &'a UserInfo) -> Fut,
+    handle: impl FnOnce(&'a AppState, &'a AdmissionRequest<K>, &'a UserInfo, Option<Duration>) -> Fut,
     state: &'a AppState,
     review: &'a AdmissionReview<K>,
+    timeout: Option<Duration>,
+    headers: &HeaderMap,
 ) -> ValueOrStatusCode<AdmissionReview<DynamicObject>>
 where
     K: Resource + Debug + Serialize,
@@ -194,53 +511,775 @@ where
     let object_ref: ObjectRef<K> =
         get_object_ref_from_name(&request.name, request.namespace.as_ref());
     let request_id: u32 = rand::random();
-    instrumented!(
-        span!(Level::ERROR, "admission", %object_ref, operation = ?request.operation, request_id),
-        async move {
-            trace!(user_info=?request.user_info);
+    let span = span!(
+        Level::ERROR,
+        "admission",
+        %object_ref,
+        operation = ?request.operation,
+        request_id,
+        namespace = request.namespace.as_deref(),
+        name = %request.name,
+        decision = field::Empty,
+        drain_until = field::Empty,
+        replica_set = field::Empty,
+        pod_template_hash = field::Empty,
+    );
+    set_parent_from_headers(&span, headers);
+    instrumented!(span, async move {
+        trace!(user_info=?request.user_info);
+
+        if request.dry_run {
+            debug_report_for_ref(
+                state,
+                ObjectReference::from(object_ref),
+                "Allow",
+                "DryRun",
+                format!(
+                    "operation={:?}, kind={}",
+                    request.operation,
+                    <K as Resource>::kind(&Default::default())
+                ),
+            )
+            .await;
+
+            Span::current().record("decision", "allow");
+            return ValueOrStatusCode::Value(AdmissionResponse::from(request).into_review());
+        }
+
+        let Some(_permit) = state.admission_limiter.try_acquire() else {
+            metrics::ADMISSION_OVERLOADED_TOTAL.inc();
+            warn_report_for_ref(
+                state,
+                ObjectReference::from(object_ref),
+                "Allow",
+                "Overloaded",
+                String::from("Allowed without delay since too many admissions are in flight"),
+            )
+            .await;
+
+            Span::current().record("decision", "allow");
+            return ValueOrStatusCode::Value(AdmissionResponse::from(request).into_review());
+        };
 
-            if request.dry_run {
-                debug_report_for_ref(
+        if !state.circuit_breaker.allows(Instant::now()) {
+            metrics::ADMISSION_SHORT_CIRCUITED_TOTAL.inc();
+            warn_report_for_ref(
+                state,
+                ObjectReference::from(object_ref),
+                "Allow",
+                "CircuitOpen",
+                String::from("Allowed without delay since too many admissions are failing"),
+            )
+            .await;
+
+            Span::current().record("decision", "allow");
+            return ValueOrStatusCode::Value(AdmissionResponse::from(request).into_review());
+        }
+
+        let result = handle(state, request, &request.user_info, timeout).await;
+        state.circuit_breaker.record(Instant::now(), result.is_ok());
+
+        match result {
+            Ok(InterceptResult::Allow) => {
+                Span::current().record("decision", "allow");
+                ValueOrStatusCode::Value(AdmissionResponse::from(request).into_review())
+            }
+            Ok(InterceptResult::AllowWithReason(reason_code)) => {
+                Span::current().record("decision", "allow");
+                let response = with_reason_code(AdmissionResponse::from(request), reason_code);
+                ValueOrStatusCode::Value(response.into_review())
+            }
+            Ok(InterceptResult::AllowWithWarning(reason_code, warning)) => {
+                Span::current().record("decision", "allow");
+                let response =
+                    make_allow_response(&state.config, AdmissionResponse::from(request), warning);
+                let response = with_reason_code(response, reason_code);
+                ValueOrStatusCode::Value(response.into_review())
+            }
+            Ok(InterceptResult::Delay(duration, reason_code)) => {
+                Span::current().record("decision", "delay");
+                let delay = get_admission_delay(
+                    duration,
+                    timeout,
+                    state.config.fallback_admission_delay_timeout,
+                    state.config.max_admission_block,
+                );
+                let truncated_by_timeout = delay < duration;
+                debug!(
+                    delete_after = ?state.config.delete_after,
+                    remaining = ?duration,
+                    effective_delay = ?delay,
+                    ?timeout,
+                    truncated_by_timeout,
+                    "delaying admission"
+                );
+                metrics::ADMISSION_DELAYED_TOTAL.inc();
+                if truncated_by_timeout {
+                    metrics::ADMISSION_DELAY_TRUNCATED_TOTAL.inc();
+                    info!(
+                            ?delay,
+                            ?timeout,
+                            "delay is truncated by the webhook timeout, the pod will be deleted while it is still draining"
+                        );
+                }
+
+                let task = state.delayed_tasks.register(object_ref.to_string(), delay);
+                let (node_terminating, cancelled) = observe_block(async {
+                    tokio::select! {
+                        cut_short = sleep_unless_cut_short(delay, state.config.node_recheck_interval, || {
+                            get_node_termination_deadline(state, &request.name, request.namespace.as_ref())
+                        }) => {
+                            if cut_short {
+                                info!("node is about to be terminated, stopped delaying ahead of it");
+                            }
+                            (cut_short, false)
+                        }
+                        _ = task.cancelled() => {
+                            info!("delay is cancelled");
+                            (false, true)
+                        }
+                    }
+                })
+                .await;
+                task.complete();
+
+                // Only the fully drained ones are labelled. The cancelled ones are released by the admin api,
+                // and the truncated ones are deleted while they are still draining.
+                // The label is informational, so the failure doesn't hold the admission back.
+                if !cancelled && !truncated_by_timeout && !node_terminating {
+                    if let Err(err) =
+                        mark_drained(state, &request.name, request.namespace.as_ref()).await
+                    {
+                        warn_report_for_ref(
+                            state,
+                            ObjectReference::from(object_ref),
+                            "Allow",
+                            "TransientError",
+                            format!("failed to label the drained pod: {err}"),
+                        )
+                        .await;
+                    }
+                }
+
+                let reason_code =
+                    get_delay_reason_code(reason_code, truncated_by_timeout, node_terminating);
+                let response = with_reason_code(AdmissionResponse::from(request), reason_code);
+                ValueOrStatusCode::Value(response.into_review())
+            }
+            Ok(InterceptResult::Patch(response)) => {
+                Span::current().record("decision", "patch");
+                ValueOrStatusCode::Value(response.into_review())
+            }
+            Ok(InterceptResult::Deny(message))
+                if can_deny_admission(&state.stores, &request.name, request.namespace.as_ref()) =>
+            {
+                Span::current().record("decision", "deny");
+                let response =
+                    make_deny_response(&state.config, AdmissionResponse::from(request), message);
+                ValueOrStatusCode::Value(response.into_review())
+            }
+            Ok(InterceptResult::Deny(_)) => {
+                Span::current().record("decision", "allow");
+                let response =
+                    with_reason_code(AdmissionResponse::from(request), ReasonCode::NoDeny);
+                ValueOrStatusCode::Value(response.into_review())
+            }
+            Err(err)
+                if is_retryable(&err)
+                    && can_deny_admission(
+                        &state.stores,
+                        &request.name,
+                        request.namespace.as_ref(),
+                    ) =>
+            {
+                warn_report_for_ref(
+                    state,
+                    ObjectReference::from(object_ref),
+                    "Deny",
+                    "TransientError",
+                    format!("{err:#}"),
+                )
+                .await;
+
+                Span::current().record("decision", "deny");
+                let response = make_deny_response(
+                    &state.config,
+                    AdmissionResponse::from(request),
+                    format!("{err:#}"),
+                );
+                ValueOrStatusCode::Value(response.into_review())
+            }
+            Err(err) => {
+                warn_report_for_ref(
                     state,
                     ObjectReference::from(object_ref),
                     "Allow",
-                    "DryRun",
-                    format!(
-                        "operation={:?}, kind={}",
-                        request.operation,
-                        <K as Resource>::kind(&Default::default())
-                    ),
+                    "Error",
+                    format!("{err:#}"),
                 )
                 .await;
 
-                return ValueOrStatusCode::Value(AdmissionResponse::from(request).into_review());
+                // We can't make it by retrying, so don't block the request forever.
+                Span::current().record("decision", "allow");
+                ValueOrStatusCode::Value(AdmissionResponse::from(request).into_review())
             }
+        }
+    })
+}
 
-            let result = handle(state, request, &request.user_info).await;
+#[cfg(test)]
+mod tests {
+    use super::*;
 
-            match result {
-                Ok(InterceptResult::Allow) => {
-                    ValueOrStatusCode::Value(AdmissionResponse::from(request).into_review())
-                }
-                Ok(InterceptResult::Delay(duration)) => {
-                    tokio::time::sleep(duration).await;
-                    ValueOrStatusCode::Value(AdmissionResponse::from(request).into_review())
-                }
-                Ok(InterceptResult::Patch(response)) => {
-                    ValueOrStatusCode::Value(response.into_review())
-                }
-                Err(err) => {
-                    warn_report_for_ref(
-                        state,
-                        ObjectReference::from(object_ref),
-                        "Error",
-                        "Error",
-                        format!("{err:#}"),
-                    )
-                    .await;
-                    ValueOrStatusCode::StatusCode(StatusCode::INTERNAL_SERVER_ERROR)
+    use chrono::{DateTime, Utc};
+    use k8s_openapi::api::core::v1::Service;
+
+    use crate::elbv2::apis::TargetGroupBinding;
+    use crate::from_json;
+    use crate::test_utils::{pod_routes, store_from, FakeApiServer};
+
+    /// The handlers are driven against the fake api server, with the other dependencies left as defaults.
+    pub(super) fn app_state(
+        api_resolver: &ApiResolver,
+        config: Config,
+        stores: Stores,
+        clock: Clock,
+    ) -> AppState {
+        AppState {
+            api_resolver: api_resolver.clone(),
+            admission_limiter: AdmissionLimiter::new(config.max_concurrent_admissions),
+            circuit_breaker: CircuitBreaker::new(None, config.circuit_breaker_cooldown),
+            config,
+            stores,
+            service_registry: ServiceRegistry::default(),
+            event_reporter: Reporter {
+                controller: String::from(CONTROLLER_NAME),
+                instance: None,
+            },
+            loadbalancing: LoadBalancingConfig::new(uuid::Uuid::new_v4()),
+            clock,
+            delayed_tasks: DelayedTasks::default(),
+            drain_reservations: DrainReservations::default(),
+        }
+    }
+
+    pub(super) fn pod_stores(pods: impl IntoIterator<Item = Pod>) -> Stores {
+        Stores::new(
+            store_from(pods),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+        )
+    }
+
+    /// A ready pod of the service `svc`, bound to a target group by its IP.
+    pub(super) fn serving_pod() -> Value {
+        json!({
+            "apiVersion": "v1",
+            "kind": "Pod",
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "uid": "uid1234",
+                "labels": {
+                    "app": "test",
+                },
+            },
+            "spec": {
+                "nodeName": "node",
+                "containers": [],
+            },
+            "status": {
+                "conditions": [{
+                    "type": "Ready",
+                    "status": "True",
+                    "lastTransitionTime": "2023-02-08T15:00:00Z",
+                }],
+            },
+        })
+    }
+
+    pub(super) fn serving_pod_with(patch: Value) -> Value {
+        let mut pod = serving_pod();
+        json_patch::merge(&mut pod, &patch);
+        pod
+    }
+
+    /// The stores where the pods of `app: test` are exposed.
+    pub(super) fn exposing_stores(pods: impl IntoIterator<Item = Pod>) -> Stores {
+        let service: Service = from_json!({
+            "metadata": {
+                "name": "svc",
+                "namespace": "ns",
+            },
+            "spec": {
+                "selector": {
+                    "app": "test",
+                },
+            },
+        });
+        let tgb: TargetGroupBinding = from_json!({
+            "metadata": {
+                "name": "tgb",
+                "namespace": "ns",
+            },
+            "spec": {
+                "serviceRef": {
+                    "name": "svc",
+                    "port": 80,
+                },
+                "targetGroupARN": "arn",
+                "targetType": "ip",
+            },
+        });
+
+        Stores::new(
+            store_from(pods),
+            store_from([service]),
+            store_from([]),
+            store_from([tgb]),
+            store_from([]),
+        )
+    }
+
+    pub(super) fn delete_review(pod: &Value) -> AdmissionReview<Pod> {
+        serde_json::from_value(json!({
+            "apiVersion": "admission.k8s.io/v1",
+            "kind": "AdmissionReview",
+            "request": {
+                "uid": "uid1234",
+                "kind": { "group": "", "version": "v1", "kind": "Pod" },
+                "resource": { "group": "", "version": "v1", "resource": "pods" },
+                "operation": "DELETE",
+                "userInfo": { "username": "user" },
+                "name": pod["metadata"]["name"],
+                "namespace": pod["metadata"]["namespace"],
+                "oldObject": pod,
+            }
+        }))
+        .unwrap()
+    }
+
+    pub(super) fn eviction_review(pod: &Value) -> AdmissionReview<Eviction> {
+        serde_json::from_value(json!({
+            "apiVersion": "admission.k8s.io/v1",
+            "kind": "AdmissionReview",
+            "request": {
+                "uid": "uid1234",
+                "kind": { "group": "policy", "version": "v1", "kind": "Eviction" },
+                "resource": { "group": "", "version": "v1", "resource": "pods" },
+                "subResource": "eviction",
+                "operation": "CREATE",
+                "userInfo": { "username": "user" },
+                "name": pod["metadata"]["name"],
+                "namespace": pod["metadata"]["namespace"],
+                "object": {
+                    "apiVersion": "policy/v1",
+                    "kind": "Eviction",
+                    "metadata": {
+                        "name": pod["metadata"]["name"],
+                        "namespace": pod["metadata"]["namespace"],
+                    },
+                },
+            }
+        }))
+        .unwrap()
+    }
+
+    pub(super) fn into_response(
+        result: ValueOrStatusCode<AdmissionReview<DynamicObject>>,
+    ) -> AdmissionResponse {
+        let ValueOrStatusCode::Value(review) = result else {
+            panic!("expected a review");
+        };
+        review.response.expect("expected a response")
+    }
+
+    pub(super) fn reason_code_of(response: &AdmissionResponse) -> Option<&str> {
+        response
+            .audit_annotations
+            .get("reason-code")
+            .map(String::as_str)
+    }
+
+    pub(super) fn datetime(str: &str) -> DateTime<Utc> {
+        DateTime::parse_from_rfc3339(str)
+            .unwrap()
+            .with_timezone(&Utc)
+    }
+
+    fn draining_pod(drain_until: &str) -> Value {
+        json!({
+            "apiVersion": "v1",
+            "kind": "Pod",
+            "metadata": {
+                "name": "pod",
+                "namespace": "ns",
+                "uid": "uid1234",
+                "labels": {
+                    "pod-graceful-drain/draining": "true",
+                },
+                "annotations": {
+                    "pod-graceful-drain/drain-until": drain_until,
+                },
+            },
+        })
+    }
+
+    async fn delete_draining_pod(drain_until: &str) -> (FakeApiServer, AdmissionResponse) {
+        delete_draining_pod_with(Config::default(), drain_until).await
+    }
+
+    async fn delete_draining_pod_with(
+        config: Config,
+        drain_until: &str,
+    ) -> (FakeApiServer, AdmissionResponse) {
+        let pod = draining_pod(drain_until);
+        let server = FakeApiServer::serve(pod_routes(pod.clone())).await;
+        let state = app_state(
+            &server.api_resolver,
+            config,
+            pod_stores([serde_json::from_value(pod.clone()).unwrap()]),
+            Clock::fake(datetime("2023-02-08T15:30:00Z")),
+        );
+
+        let review = delete_review(&pod);
+        let result = handle_common(
+            pod_handler,
+            &state,
+            &review,
+            Some(Duration::from_secs(10)),
+            &HeaderMap::new(),
+        )
+        .await;
+        (server, into_response(result))
+    }
+
+    fn is_drained_label_patch(request: &str) -> bool {
+        request.starts_with("PATCH /api/v1/namespaces/ns/pods/pod")
+            && request.contains(r#""pod-graceful-drain/drained":"true""#)
+    }
+
+    #[tokio::test]
+    async fn delayed_deletion_should_be_labelled_drained_before_allowed() {
+        let (server, response) = delete_draining_pod("2023-02-08T15:30:00.100Z").await;
+
+        assert!(response.allowed);
+        assert_eq!(reason_code_of(&response), Some("REENTRY"));
+        let requests = server.pod_requests();
+        assert_eq!(requests.len(), 1, "{requests:?}");
+        assert!(is_drained_label_patch(&requests[0]), "{}", requests[0]);
+    }
+
+    #[tokio::test]
+    async fn truncated_deletion_should_not_be_labelled_drained() {
+        let config = Config {
+            max_admission_block: Some(Duration::from_millis(100)),
+            ..Config::default()
+        };
+        let (server, response) = delete_draining_pod_with(config, "2023-02-08T15:30:05Z").await;
+
+        assert!(response.allowed);
+        assert_eq!(reason_code_of(&response), Some("TIMEOUT"));
+        assert_eq!(server.pod_requests(), Vec::<String>::new());
+    }
+
+    #[tokio::test]
+    async fn expired_deletion_should_be_labelled_drained_before_allowed() {
+        let (server, response) = delete_draining_pod("2023-02-08T15:29:00Z").await;
+
+        assert!(response.allowed);
+        let requests = server.pod_requests();
+        assert_eq!(requests.len(), 1, "{requests:?}");
+        assert!(is_drained_label_patch(&requests[0]), "{}", requests[0]);
+    }
+
+    #[test]
+    fn admission_delay_should_be_truncated_by_timeout() {
+        let delay = get_admission_delay(
+            Duration::from_secs(20),
+            Some(Duration::from_secs(10)),
+            Duration::from_secs(30),
+            None,
+        );
+        assert_eq!(delay, Duration::from_secs(10) - ADMISSION_TIMEOUT_OVERHEAD);
+    }
+
+    #[test]
+    fn zero_delete_after_should_drain_as_long_as_timeout_allows() {
+        let config = Config {
+            delete_after: Duration::ZERO,
+            ..Config::default()
+        };
+        let timeout = Some(Duration::from_secs(10));
+
+        let drain_duration = get_drain_duration(&config, Duration::ZERO, timeout);
+        assert_eq!(
+            drain_duration,
+            Duration::from_secs(10) - ADMISSION_TIMEOUT_OVERHEAD
+        );
+        assert_eq!(
+            get_admission_delay(
+                drain_duration,
+                timeout,
+                config.fallback_admission_delay_timeout,
+                config.max_admission_block
+            ),
+            drain_duration,
+            "the pod is deleted when the admission is allowed"
+        );
+
+        assert_eq!(
+            get_drain_duration(&config, Duration::ZERO, None),
+            config.fallback_admission_delay_timeout - ADMISSION_TIMEOUT_OVERHEAD
+        );
+        assert_eq!(
+            get_drain_duration(&config, Duration::from_secs(5), timeout),
+            Duration::from_secs(5),
+            "annotated delays are kept"
+        );
+        assert_eq!(
+            get_drain_duration(&Config::default(), Duration::ZERO, timeout),
+            Duration::ZERO,
+            "only for the zero delete-after"
+        );
+    }
+
+    #[test]
+    fn admission_delay_should_not_be_truncated_within_timeout() {
+        let delay = get_admission_delay(
+            Duration::from_secs(20),
+            Some(Duration::from_secs(30)),
+            Duration::from_secs(10),
+            None,
+        );
+        assert_eq!(delay, Duration::from_secs(20));
+    }
+
+    #[test]
+    fn admission_delay_should_be_truncated_by_fallback_timeout_without_timeout() {
+        let delay =
+            get_admission_delay(Duration::from_secs(20), None, Duration::from_secs(10), None);
+        assert_eq!(delay, Duration::from_secs(10) - ADMISSION_TIMEOUT_OVERHEAD);
+    }
+
+    #[test]
+    fn admission_delay_without_timeout_should_be_bounded_by_max_block() {
+        let delay = get_admission_delay(
+            Duration::from_secs(20),
+            None,
+            Duration::from_secs(30),
+            Some(Duration::from_secs(5)),
+        );
+        assert_eq!(delay, Duration::from_secs(5));
+
+        let delay = get_admission_delay(
+            Duration::from_secs(3),
+            None,
+            Duration::from_secs(30),
+            Some(Duration::from_secs(5)),
+        );
+        assert_eq!(delay, Duration::from_secs(3));
+    }
+
+    #[tokio::test]
+    async fn reentry_should_be_counted_by_outcome() {
+        let reentries =
+            |outcome: ReentryOutcome| metrics::ADMISSION_REENTRY_TOTAL.get(outcome.as_str());
+        let intercepted = reentries(ReentryOutcome::Intercept);
+        let allowed = reentries(ReentryOutcome::Allow);
+
+        delete_draining_pod("2023-02-08T15:30:00.100Z").await;
+        assert!(reentries(ReentryOutcome::Intercept) > intercepted);
+
+        delete_draining_pod("2023-02-08T15:29:00Z").await;
+        assert!(reentries(ReentryOutcome::Allow) > allowed);
+    }
+
+    #[tokio::test(start_paused = true)]
+    async fn blocking_duration_should_be_observed() {
+        let before = metrics::ADMISSION_BLOCK_SECONDS.get_count();
+        let started = tokio::time::Instant::now();
+        observe_block(tokio::time::sleep(Duration::from_secs(10))).await;
+        assert!(metrics::ADMISSION_BLOCK_SECONDS.get_count() > before);
+        assert_eq!(started.elapsed(), Duration::from_secs(10));
+    }
+
+    #[tokio::test(start_paused = true)]
+    async fn delay_should_be_cut_short_ahead_of_node_termination() {
+        let checks = std::sync::atomic::AtomicUsize::new(0);
+        let started = tokio::time::Instant::now();
+        let cut_short = sleep_unless_cut_short(
+            Duration::from_secs(60),
+            Some(Duration::from_secs(10)),
+            || async {
+                // the node is tainted after a check, to be terminated in a while.
+                if checks.fetch_add(1, std::sync::atomic::Ordering::SeqCst) >= 1 {
+                    Some(started + Duration::from_secs(25))
+                } else {
+                    None
                 }
+            },
+        )
+        .await;
+
+        assert!(cut_short);
+        assert_eq!(checks.load(std::sync::atomic::Ordering::SeqCst), 3);
+        assert_eq!(started.elapsed(), Duration::from_secs(25));
+    }
+
+    #[tokio::test(start_paused = true)]
+    async fn delay_should_not_be_extended_by_later_node_termination() {
+        let started = tokio::time::Instant::now();
+        let cut_short = sleep_unless_cut_short(
+            Duration::from_secs(30),
+            Some(Duration::from_secs(10)),
+            || async { Some(started + Duration::from_secs(100)) },
+        )
+        .await;
+
+        assert!(!cut_short);
+        assert_eq!(started.elapsed(), Duration::from_secs(30));
+    }
+
+    #[tokio::test(start_paused = true)]
+    async fn delay_should_not_stop_while_node_is_fine() {
+        let checks = std::sync::atomic::AtomicUsize::new(0);
+        let started = tokio::time::Instant::now();
+        let cut_short = sleep_unless_cut_short(
+            Duration::from_secs(55),
+            Some(Duration::from_secs(10)),
+            || async {
+                checks.fetch_add(1, std::sync::atomic::Ordering::SeqCst);
+                None
+            },
+        )
+        .await;
+
+        assert!(!cut_short);
+        assert_eq!(checks.load(std::sync::atomic::Ordering::SeqCst), 6);
+        assert_eq!(started.elapsed(), Duration::from_secs(55));
+    }
+
+    #[tokio::test(start_paused = true)]
+    async fn delay_should_sleep_through_without_recheck_interval() {
+        let started = tokio::time::Instant::now();
+        let cut_short = sleep_unless_cut_short(Duration::from_secs(600), None, || async {
+            Some(tokio::time::Instant::now())
+        })
+        .await;
+
+        assert!(!cut_short);
+        assert_eq!(started.elapsed(), Duration::from_secs(600));
+    }
+
+    #[test]
+    fn deny_response_should_have_configured_code() {
+        let review: AdmissionReview<Pod> = serde_json::from_value(json!({
+            "apiVersion": "admission.k8s.io/v1",
+            "kind": "AdmissionReview",
+            "request": {
+                "uid": "uid1234",
+                "kind": { "group": "", "version": "v1", "kind": "Pod" },
+                "resource": { "group": "", "version": "v1", "resource": "pods" },
+                "operation": "DELETE",
+                "userInfo": {},
+                "name": "pod",
+                "namespace": "ns",
             }
-        }
-    )
+        }))
+        .unwrap();
+        let request = review.request.unwrap();
+
+        let response = make_deny_response(
+            &Config::default(),
+            AdmissionResponse::from(&request),
+            String::from("conflict"),
+        );
+        assert!(!response.allowed);
+        assert_eq!(response.result.code, 429);
+        assert_eq!(response.result.reason, "TooManyRequests");
+
+        let config = Config {
+            deny_status_code: 503,
+            deny_reason: String::from("ServiceUnavailable"),
+            ..Config::default()
+        };
+        let response = make_deny_response(
+            &config,
+            AdmissionResponse::from(&request),
+            String::from("conflict"),
+        );
+        assert_eq!(response.result.code, 503);
+        assert_eq!(response.result.reason, "ServiceUnavailable");
+        assert_eq!(response.result.message, "conflict");
+    }
+
+    #[test]
+    fn allow_response_should_carry_warning() {
+        let review: AdmissionReview<Pod> = serde_json::from_value(json!({
+            "apiVersion": "admission.k8s.io/v1",
+            "kind": "AdmissionReview",
+            "request": {
+                "uid": "uid1234",
+                "kind": { "group": "", "version": "v1", "kind": "Pod" },
+                "resource": { "group": "", "version": "v1", "resource": "pods" },
+                "operation": "DELETE",
+                "userInfo": {},
+                "name": "pod",
+                "namespace": "ns",
+            }
+        }))
+        .unwrap();
+        let request = review.request.unwrap();
+        let warning = String::from("Deletion is allowed because the pod is not exposed");
+
+        let response = make_allow_response(
+            &Config::default(),
+            AdmissionResponse::from(&request),
+            warning.clone(),
+        );
+        assert!(response.allowed);
+        assert_eq!(response.warnings, None);
+
+        let config = Config {
+            emit_admission_warnings: true,
+            ..Config::default()
+        };
+        let response =
+            make_allow_response(&config, AdmissionResponse::from(&request), warning.clone());
+        assert!(response.allowed);
+        assert_eq!(response.warnings, Some(vec![warning]));
+    }
+
+    #[test]
+    fn no_deny_annotation_should_prevent_denial() {
+        let pod = |name: &str, annotations: Value| -> Pod {
+            serde_json::from_value(json!({
+                "metadata": {
+                    "name": name,
+                    "namespace": "ns",
+                    "annotations": annotations,
+                }
+            }))
+            .unwrap()
+        };
+
+        let stores = Stores::new(
+            store_from([
+                pod("no-deny", json!({ "pod-graceful-drain/no-deny": "true" })),
+                pod("default", json!({})),
+            ]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+            store_from([]),
+        );
+
+        let namespace = String::from("ns");
+        assert!(!can_deny_admission(&stores, "no-deny", Some(&namespace)));
+        assert!(can_deny_admission(&stores, "default", Some(&namespace)));
+        assert!(can_deny_admission(&stores, "unknown", Some(&namespace)));
+    }
 }
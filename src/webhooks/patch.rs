@@ -1,4 +1,6 @@
+use std::collections::BTreeMap;
 use std::fmt::Debug;
+use std::time::Duration;
 
 use backoff::backoff::Backoff;
 use backoff::ExponentialBackoff;
@@ -7,29 +9,33 @@ use eyre::{eyre, Context, Result};
 use json_patch::{Patch, PatchOperation, TestOperation};
 use jsonptr::Pointer;
 use k8s_openapi::api::{core::v1::Pod, policy::v1::Eviction};
-use k8s_openapi::apimachinery::pkg::apis::meta::v1::DeleteOptions;
+use k8s_openapi::apimachinery::pkg::apis::meta::v1::{DeleteOptions, OwnerReference};
 use k8s_openapi::serde::de::DeserializeOwned;
 use k8s_openapi::serde::Serialize;
 use kube::api::PatchParams;
 use kube::core::NamespaceResourceScope;
 use kube::{Resource, ResourceExt};
 use serde_json::Value;
-use tracing::trace;
+use tracing::{span, trace, Level};
 
 use crate::api_resolver::ApiResolver;
 use crate::consts::{
     DELETE_OPTIONS_ANNOTATION_KEY, DRAINING_LABEL_KEY, DRAIN_CONTROLLER_ANNOTATION_KEY,
-    DRAIN_UNTIL_ANNOTATION_KEY, ORIGINAL_LABELS_ANNOTATION_KEY,
+    DRAIN_UNTIL_ANNOTATION_KEY, ISOLATED_AT_ANNOTATION_KEY, ORIGINAL_LABELS_ANNOTATION_KEY,
+    ORIGINAL_OWNER_REFERENCES_ANNOTATION_KEY, PRE_ISOLATED_ANNOTATION_KEY,
+    REQUESTED_BY_ANNOTATION_KEY, TAKEN_OVER_AT_ANNOTATION_KEY, TARGET_GROUPS_ANNOTATION_KEY,
 };
 use crate::pod_draining_info::{get_pod_draining_info, PodDrainingInfo};
+use crate::pod_state::is_owned_by_stateful_set;
 use crate::status::{
     is_404_not_found_error, is_409_conflict_error, is_410_gone_error,
     is_generic_server_response_422_invalid_for_json_patch_error, is_transient_error,
 };
-use crate::LoadBalancingConfig;
+use crate::{instrumented, metrics, try_some, Config, LoadBalancingConfig};
 
 async fn apply_patch<K>(
     api_resolver: &ApiResolver,
+    config: &Config,
     res: &K,
     patch: impl Fn(&K) -> Result<Patch> + Clone,
     check: impl Fn(&K) -> bool + Clone,
@@ -42,7 +48,7 @@ where
     let name = res.name_any();
 
     let mut res = res.clone();
-    let mut backoff = ExponentialBackoff::default();
+    let mut retry = PatchRetry::new(config);
     'patch: while !check(&res) {
         let patch = patch(&res).context("patch")?;
         trace!(?patch, "patching");
@@ -76,10 +82,11 @@ where
 
         // transient errors, conflict errors
         'refresh: loop {
-            if let Some(backoff) = backoff.next_backoff() {
+            if let Some(backoff) = retry.next_backoff() {
                 tokio::time::sleep(backoff).await;
             } else {
-                return Err(eyre!("no more backoff"));
+                // Keep the cause, so the webhook can tell the client to retry later.
+                return Err(eyre::Report::new(err).wrap_err("no more retries"));
             }
 
             let refreshed = api.get(&name).await;
@@ -109,6 +116,40 @@ where
     Ok(Some(res))
 }
 
+/// Under heavy contention, e.g. another controller keeps patching the pod,
+/// give up eventually rather than holding the admission request.
+struct PatchRetry {
+    backoff: ExponentialBackoff,
+    retries: usize,
+    max_retries: usize,
+}
+
+impl PatchRetry {
+    fn new(config: &Config) -> Self {
+        Self {
+            backoff: ExponentialBackoff {
+                current_interval: config.patch_backoff_initial_interval,
+                initial_interval: config.patch_backoff_initial_interval,
+                multiplier: config.patch_backoff_multiplier,
+                max_interval: config.patch_backoff_max_interval,
+                ..ExponentialBackoff::default()
+            },
+            retries: 0,
+            max_retries: config.patch_max_retries,
+        }
+    }
+
+    fn next_backoff(&mut self) -> Option<Duration> {
+        if self.retries >= self.max_retries {
+            return None;
+        }
+
+        self.retries += 1;
+        metrics::PATCH_RETRIES_TOTAL.inc();
+        self.backoff.next_backoff()
+    }
+}
+
 fn make_patch<K: Resource + Clone + Serialize>(
     res: &K,
     modify: impl Fn(&mut K) -> Result<()>,
@@ -145,38 +186,255 @@ fn prepend_uid_and_resource_version_test(mut patch: Patch, pod: &Pod) -> Result<
     Ok(patch)
 }
 
+/// How the pod is isolated, besides when it is drained until.
+#[derive(Clone, Copy, Debug, Default)]
+pub struct IsolateOptions<'a> {
+    /// The delete options of the intercepted eviction, so that the pod is evicted with them after the drain.
+    pub eviction_delete_options: Option<&'a DeleteOptions>,
+    pub requested_by: Option<&'a str>,
+    pub cut_owner_references: bool,
+    /// Isolated ahead of the node drain, rather than by its deletion.
+    pub pre_isolated: bool,
+    pub target_groups: &'a [String],
+}
+
 pub async fn patch_pod_isolate(
     api_resolver: &ApiResolver,
+    config: &Config,
     pod: &Pod,
+    isolated_at: DateTime<Utc>,
+    drain_until: DateTime<Utc>,
+    loadbalancing: &LoadBalancingConfig,
+    options: IsolateOptions<'_>,
+) -> Result<Option<Pod>> {
+    instrumented!(span!(Level::ERROR, "isolate", %drain_until), async move {
+        apply_patch(
+            api_resolver,
+            config,
+            pod,
+            |pod| make_patch_pod_isolate(pod, isolated_at, drain_until, loadbalancing, &options),
+            |pod| !matches!(get_pod_draining_info(pod), PodDrainingInfo::None),
+        )
+        .await
+    })
+}
+
+/// Isolate the pod ahead of its deletion. It is left isolated without being deleted after the drain.
+pub(crate) async fn patch_pod_pre_isolate(
+    api_resolver: &ApiResolver,
+    config: &Config,
+    pod: &Pod,
+    isolated_at: DateTime<Utc>,
     drain_until: DateTime<Utc>,
-    eviction_delete_options: Option<&DeleteOptions>,
     loadbalancing: &LoadBalancingConfig,
+    target_groups: &[String],
 ) -> Result<Option<Pod>> {
-    let res = apply_patch(
-        api_resolver,
-        pod,
-        |pod| make_patch_pod_isolate(pod, drain_until, eviction_delete_options, loadbalancing),
-        |pod| !matches!(get_pod_draining_info(pod), PodDrainingInfo::None),
+    instrumented!(
+        span!(Level::ERROR, "pre-isolate", %drain_until),
+        async move {
+            apply_patch(
+                api_resolver,
+                config,
+                pod,
+                |pod| {
+                    let options = IsolateOptions {
+                        cut_owner_references: should_cut_owner_references(config, pod, None),
+                        pre_isolated: true,
+                        target_groups,
+                        ..IsolateOptions::default()
+                    };
+                    make_patch_pod_isolate(pod, isolated_at, drain_until, loadbalancing, &options)
+                },
+                |pod| !matches!(get_pod_draining_info(pod), PodDrainingInfo::None),
+            )
+            .await
+        }
     )
-    .await?;
-    Ok(res)
+}
+
+/// Record the eviction of the pre-isolated pod, so that the controller evicts it after the drain.
+pub(crate) async fn patch_pod_record_eviction(
+    api_resolver: &ApiResolver,
+    config: &Config,
+    pod: &Pod,
+    eviction_delete_options: Option<&DeleteOptions>,
+) -> Result<Option<Pod>> {
+    let delete_options = eviction_delete_options.cloned().unwrap_or_default();
+    instrumented!(span!(Level::ERROR, "record-eviction"), async move {
+        apply_patch(
+            api_resolver,
+            config,
+            pod,
+            |pod| make_patch_pod_record_eviction(pod, &delete_options),
+            |pod| {
+                pod.annotations()
+                    .contains_key(DELETE_OPTIONS_ANNOTATION_KEY)
+            },
+        )
+        .await
+    })
+}
+
+fn make_patch_pod_record_eviction(pod: &Pod, delete_options: &DeleteOptions) -> Result<Patch> {
+    let patch = make_patch(pod, |pod| set_eviction_delete_options(pod, delete_options))?;
+    prepend_uid_and_resource_version_test(patch, pod)
+}
+
+/// Undo the isolation, so the pod is served again.
+pub(crate) async fn patch_pod_release(
+    api_resolver: &ApiResolver,
+    config: &Config,
+    pod: &Pod,
+) -> Result<Option<Pod>> {
+    instrumented!(span!(Level::ERROR, "release"), async move {
+        apply_patch(api_resolver, config, pod, make_patch_pod_release, |pod| {
+            matches!(get_pod_draining_info(pod), PodDrainingInfo::None)
+        })
+        .await
+    })
+}
+
+fn make_patch_pod_release(pod: &Pod) -> Result<Patch> {
+    let patch = make_patch(pod, |pod| {
+        restore_original_labels(pod).context("restore labels")?;
+        restore_original_owner_references(pod).context("restore owner references")?;
+        let annotations = pod.annotations_mut();
+        for key in [
+            ORIGINAL_LABELS_ANNOTATION_KEY,
+            ORIGINAL_OWNER_REFERENCES_ANNOTATION_KEY,
+            ISOLATED_AT_ANNOTATION_KEY,
+            PRE_ISOLATED_ANNOTATION_KEY,
+            REQUESTED_BY_ANNOTATION_KEY,
+            TARGET_GROUPS_ANNOTATION_KEY,
+            DRAIN_UNTIL_ANNOTATION_KEY,
+            DELETE_OPTIONS_ANNOTATION_KEY,
+            DRAIN_CONTROLLER_ANNOTATION_KEY,
+            TAKEN_OVER_AT_ANNOTATION_KEY,
+        ] {
+            annotations.remove(key);
+        }
+        Ok(())
+    })?;
+    return prepend_uid_and_resource_version_test(patch, pod);
+
+    fn restore_original_labels(pod: &mut Pod) -> Result<()> {
+        pod.labels_mut().remove(DRAINING_LABEL_KEY);
+        let Some(original_labels) = pod.annotations().get(ORIGINAL_LABELS_ANNOTATION_KEY) else {
+            return Ok(());
+        };
+
+        let original_labels: BTreeMap<String, String> =
+            serde_json::from_str(original_labels).context("deserialize original labels")?;
+        *pod.labels_mut() = original_labels;
+        Ok(())
+    }
+
+    fn restore_original_owner_references(pod: &mut Pod) -> Result<()> {
+        let Some(original_owner_references) = pod
+            .annotations()
+            .get(ORIGINAL_OWNER_REFERENCES_ANNOTATION_KEY)
+        else {
+            return Ok(());
+        };
+
+        let original_owner_references: Vec<OwnerReference> =
+            serde_json::from_str(original_owner_references)
+                .context("deserialize original owner references")?;
+        *pod.owner_references_mut() = original_owner_references;
+        Ok(())
+    }
+}
+
+/// Claim the deletion of the drained pod for this instance, when the one that isolated it seems to be gone.
+///
+/// It isn't retried, since the pod is changed when another instance has claimed it first.
+/// Then it fails to test the resource version, and only one of them deletes the pod.
+pub(crate) async fn patch_pod_takeover(
+    api_resolver: &ApiResolver,
+    loadbalancing: &LoadBalancingConfig,
+    pod: &Pod,
+    taken_over_at: DateTime<Utc>,
+) -> Result<Pod> {
+    let api = api_resolver.api_for(pod);
+    let patch = make_patch_pod_takeover(pod, taken_over_at, loadbalancing)?;
+    trace!(?patch, "patching");
+    let pod = api
+        .patch(
+            &pod.name_any(),
+            &PatchParams::default(),
+            &kube::api::Patch::<Pod>::Json(patch),
+        )
+        .await?;
+    Ok(pod)
+}
+
+fn make_patch_pod_takeover(
+    pod: &Pod,
+    taken_over_at: DateTime<Utc>,
+    loadbalancing: &LoadBalancingConfig,
+) -> Result<Patch> {
+    let patch = make_patch(pod, |pod| {
+        let annotations = pod.annotations_mut();
+        annotations.insert(
+            String::from(DRAIN_CONTROLLER_ANNOTATION_KEY),
+            loadbalancing.get_id(),
+        );
+        annotations.insert(
+            String::from(TAKEN_OVER_AT_ANNOTATION_KEY),
+            taken_over_at.to_rfc3339_opts(SecondsFormat::Secs, true),
+        );
+        Ok(())
+    })?;
+    prepend_uid_and_resource_version_test(patch, pod)
+}
+
+fn set_eviction_delete_options(pod: &mut Pod, delete_options: &DeleteOptions) -> Result<()> {
+    let annotation = serde_json::to_string(&DeleteOptions {
+        // this is not dry-run
+        dry_run: None,
+        // preconditions.uid is this pod, so it is duplicate.
+        // preconditions.resourceVersion will be voided by this patch.
+        preconditions: None,
+        kind: None,
+        api_version: None,
+        ..delete_options.clone()
+    })
+    .context("serialize old labels")?;
+
+    pod.annotations_mut()
+        .insert(String::from(DELETE_OPTIONS_ANNOTATION_KEY), annotation);
+    Ok(())
 }
 
 fn make_patch_pod_isolate(
     pod: &Pod,
+    isolated_at: DateTime<Utc>,
     drain_until: DateTime<Utc>,
-    eviction_delete_options: Option<&DeleteOptions>,
     loadbalancing: &LoadBalancingConfig,
+    options: &IsolateOptions,
 ) -> Result<Patch> {
     let patch = make_patch(pod, |pod| {
         backup_original_labels(pod).context("backup")?;
         set_draining_label(pod);
+        set_isolated_at_annotation(pod, isolated_at);
         set_drain_until_annotation(pod, drain_until);
-        if let Some(eviction_delete_options) = eviction_delete_options {
+        if let Some(eviction_delete_options) = options.eviction_delete_options {
             set_eviction_delete_options(pod, eviction_delete_options)?;
         }
+        if let Some(requested_by) = options.requested_by {
+            set_requested_by_annotation(pod, requested_by);
+        }
         set_controller_annotation(pod, loadbalancing);
-        remove_owner_reference(pod);
+        if !options.target_groups.is_empty() {
+            set_target_groups_annotation(pod, options.target_groups);
+        }
+        if options.pre_isolated {
+            set_pre_isolated_annotation(pod);
+        }
+        if options.cut_owner_references {
+            backup_original_owner_references(pod).context("backup owner references")?;
+            remove_owner_reference(pod);
+        }
         Ok(())
     })?;
     return prepend_uid_and_resource_version_test(patch, pod);
@@ -197,28 +455,38 @@ fn make_patch_pod_isolate(
             .insert(String::from(DRAINING_LABEL_KEY), String::from("true"));
     }
 
-    fn set_drain_until_annotation(pod: &mut Pod, drain_until: DateTime<Utc>) {
-        let string = drain_until.to_rfc3339_opts(SecondsFormat::Secs, true);
+    fn set_isolated_at_annotation(pod: &mut Pod, isolated_at: DateTime<Utc>) {
+        let string = isolated_at.to_rfc3339_opts(SecondsFormat::Secs, true);
         pod.annotations_mut()
-            .insert(String::from(DRAIN_UNTIL_ANNOTATION_KEY), string);
+            .insert(String::from(ISOLATED_AT_ANNOTATION_KEY), string);
     }
 
-    fn set_eviction_delete_options(pod: &mut Pod, delete_options: &DeleteOptions) -> Result<()> {
-        let annotation = serde_json::to_string(&DeleteOptions {
-            // this is not dry-run
-            dry_run: None,
-            // preconditions.uid is this pod, so it is duplicate.
-            // preconditions.resourceVersion will be voided by this patch.
-            preconditions: None,
-            kind: None,
-            api_version: None,
-            ..delete_options.clone()
-        })
-        .context("serialize old labels")?;
+    fn set_requested_by_annotation(pod: &mut Pod, requested_by: &str) {
+        pod.annotations_mut().insert(
+            String::from(REQUESTED_BY_ANNOTATION_KEY),
+            String::from(requested_by),
+        );
+    }
+
+    /// So that `kubectl describe` tells which load balancers the drain is waiting for.
+    fn set_target_groups_annotation(pod: &mut Pod, target_groups: &[String]) {
+        pod.annotations_mut().insert(
+            String::from(TARGET_GROUPS_ANNOTATION_KEY),
+            target_groups.join(","),
+        );
+    }
 
+    fn set_pre_isolated_annotation(pod: &mut Pod) {
+        pod.annotations_mut().insert(
+            String::from(PRE_ISOLATED_ANNOTATION_KEY),
+            String::from("true"),
+        );
+    }
+
+    fn set_drain_until_annotation(pod: &mut Pod, drain_until: DateTime<Utc>) {
+        let string = drain_until.to_rfc3339_opts(SecondsFormat::Secs, true);
         pod.annotations_mut()
-            .insert(String::from(DELETE_OPTIONS_ANNOTATION_KEY), annotation);
-        Ok(())
+            .insert(String::from(DRAIN_UNTIL_ANNOTATION_KEY), string);
     }
 
     fn set_controller_annotation(pod: &mut Pod, loadbalancing: &LoadBalancingConfig) {
@@ -228,25 +496,55 @@ fn make_patch_pod_isolate(
         );
     }
 
-    /// To stop the pod controller's GC kicking in, we remove the OwnerReferences.
+    fn backup_original_owner_references(pod: &mut Pod) -> Result<()> {
+        let owner_references = serde_json::to_string(pod.owner_references())
+            .context("serialize old owner references")?;
+        pod.annotations_mut().insert(
+            String::from(ORIGINAL_OWNER_REFERENCES_ANNOTATION_KEY),
+            owner_references,
+        );
+        Ok(())
+    }
+
+    /// Without the controller owner reference, the ReplicaSet no longer counts the pod and creates a replacement.
+    /// The owner reference itself stays, so the garbage collector still deletes the pod with its ReplicaSet.
     fn remove_owner_reference(pod: &mut Pod) {
         for owner_ref in pod.owner_references_mut() {
-            if owner_ref.api_version == "v1" && owner_ref.kind == "ReplicaSet" {
+            if owner_ref.api_version == "apps/v1" && owner_ref.kind == "ReplicaSet" {
                 owner_ref.controller = None;
             }
         }
     }
 }
 
+/// The foreground deletion of the owner waits for its dependents to be deleted,
+/// and there's no point in replacing the pods of a ReplicaSet being deleted.
+///
+/// StatefulSet can't replace the pod before its deletion since the name is the same,
+/// and it'd adopt the orphaned pod back anyway.
+pub(crate) fn should_cut_owner_references(
+    config: &Config,
+    pod: &Pod,
+    delete_options: Option<&DeleteOptions>,
+) -> bool {
+    if !config.cut_owner_references || is_owned_by_stateful_set(pod) {
+        return false;
+    }
+
+    let propagation_policy = try_some!(delete_options?.propagation_policy?);
+    propagation_policy.map(String::as_str) != Some("Foreground")
+}
+
+/// Only `dryRun` is touched, so the other delete options of the eviction are kept as they are.
 pub fn make_patch_eviction_to_dry_run(eviction: &Eviction) -> Result<Patch> {
     return make_patch(eviction, set_dry_run);
 
     fn set_dry_run(eviction: &mut Eviction) -> Result<()> {
-        let delete_options = eviction.delete_options.clone().unwrap_or_default();
-        eviction.delete_options = Some(DeleteOptions {
-            dry_run: Some(vec![String::from("All")]),
-            ..delete_options
-        });
+        let delete_options = eviction.delete_options.get_or_insert_with(Default::default);
+        let dry_run = delete_options.dry_run.get_or_insert_with(Vec::new);
+        if !dry_run.iter().any(|value| value == "All") {
+            dry_run.push(String::from("All"));
+        }
 
         Ok(())
     }
@@ -257,14 +555,12 @@ mod tests {
     use super::*;
 
     use chrono::DateTime;
+    use k8s_openapi::apimachinery::pkg::apis::meta::v1::OwnerReference;
     use serde_json::{json, Value};
     use uuid::Uuid;
 
-    macro_rules! from_json {
-        ($($json:tt)+) => {
-            ::serde_json::from_value(::serde_json::json!($($json)+)).expect("Invalid json")
-        };
-    }
+    use crate::from_json;
+    use crate::pod_evict_params::get_pod_evict_params;
 
     fn apply<K>(res: &K, patch: &Patch) -> Result<Value>
     where
@@ -285,7 +581,7 @@ mod tests {
                     "app": "test"
                 },
                 "ownerReferences": [{
-                    "apiVersion": "v1",
+                    "apiVersion": "apps/v1",
                     "kind": "ReplicaSet",
                     "name": "owner",
                     "uid": "12345",
@@ -294,11 +590,24 @@ mod tests {
             }
         });
 
+        let isolated_at = DateTime::parse_from_rfc3339("2023-02-08T15:29:30Z")
+            .unwrap()
+            .with_timezone(&Utc);
         let drain_until = DateTime::parse_from_rfc3339("2023-02-08T15:30:00Z")
             .unwrap()
             .with_timezone(&Utc);
         let loadbalancing = LoadBalancingConfig::new(Uuid::nil());
-        let patch = make_patch_pod_isolate(&pod, drain_until, None, &loadbalancing).unwrap();
+        let patch = make_patch_pod_isolate(
+            &pod,
+            isolated_at,
+            drain_until,
+            &loadbalancing,
+            &IsolateOptions {
+                cut_owner_references: true,
+                ..IsolateOptions::default()
+            },
+        )
+        .unwrap();
 
         let applied = apply(&pod, &patch).unwrap();
         assert_eq!(
@@ -313,12 +622,14 @@ mod tests {
                         "pod-graceful-drain/draining": "true",
                     },
                     "annotations": {
+                        "pod-graceful-drain/isolated-at": "2023-02-08T15:29:30Z",
                         "pod-graceful-drain/drain-until": "2023-02-08T15:30:00Z",
                         "pod-graceful-drain/controller": "00000000-0000-0000-0000-000000000000",
                         "pod-graceful-drain/original-labels": "{\"app\":\"test\"}",
+                        "pod-graceful-drain/original-owner-references": "[{\"apiVersion\":\"apps/v1\",\"controller\":true,\"kind\":\"ReplicaSet\",\"name\":\"owner\",\"uid\":\"12345\"}]",
                     },
                     "ownerReferences": [{
-                        "apiVersion": "v1",
+                        "apiVersion": "apps/v1",
                         "kind": "ReplicaSet",
                         "name": "owner",
                         "uid": "12345",
@@ -328,6 +639,168 @@ mod tests {
         );
     }
 
+    #[test]
+    fn pod_patch_isolate_should_backup_owner_references() {
+        let pod: Pod = from_json! ({
+            "metadata": {
+                "uid": "uid1234",
+                "resourceVersion": "version1234",
+                "ownerReferences": [{
+                    "apiVersion": "apps/v1",
+                    "kind": "ReplicaSet",
+                    "name": "owner",
+                    "uid": "12345",
+                    "controller": true,
+                    "blockOwnerDeletion": true,
+                }]
+            }
+        });
+
+        let now = Utc::now();
+        let loadbalancing = LoadBalancingConfig::new(Uuid::nil());
+        let patch = make_patch_pod_isolate(
+            &pod,
+            now,
+            now,
+            &loadbalancing,
+            &IsolateOptions {
+                cut_owner_references: true,
+                ..IsolateOptions::default()
+            },
+        )
+        .unwrap();
+
+        let applied: Pod = serde_json::from_value(apply(&pod, &patch).unwrap()).unwrap();
+        let backup = applied
+            .annotations()
+            .get(ORIGINAL_OWNER_REFERENCES_ANNOTATION_KEY)
+            .unwrap();
+        let restored: Vec<OwnerReference> = serde_json::from_str(backup).unwrap();
+        assert_eq!(restored, pod.owner_references());
+    }
+
+    #[test]
+    fn pod_patch_isolate_should_annotate_target_groups() {
+        let pod: Pod = from_json! ({
+            "metadata": {
+                "uid": "uid1234",
+                "resourceVersion": "version1234",
+            }
+        });
+
+        let now = Utc::now();
+        let loadbalancing = LoadBalancingConfig::new(Uuid::nil());
+        let target_groups = [String::from("arn:tg1"), String::from("arn:tg2")];
+        let patch = make_patch_pod_isolate(
+            &pod,
+            now,
+            now,
+            &loadbalancing,
+            &IsolateOptions {
+                cut_owner_references: true,
+                target_groups: &target_groups,
+                ..IsolateOptions::default()
+            },
+        )
+        .unwrap();
+
+        let applied: Pod = serde_json::from_value(apply(&pod, &patch).unwrap()).unwrap();
+        assert_eq!(
+            applied.annotations().get(TARGET_GROUPS_ANNOTATION_KEY),
+            Some(&String::from("arn:tg1,arn:tg2"))
+        );
+
+        let released: Pod = serde_json::from_value(
+            apply(&applied, &make_patch_pod_release(&applied).unwrap()).unwrap(),
+        )
+        .unwrap();
+        assert_eq!(
+            released.annotations().get(TARGET_GROUPS_ANNOTATION_KEY),
+            None
+        );
+    }
+
+    #[test]
+    fn eviction_of_pre_isolated_pod_should_be_recorded() {
+        let pod: Pod = from_json! ({
+            "metadata": {
+                "uid": "uid1234",
+                "resourceVersion": "version1234",
+                "labels": {
+                    "app": "test"
+                },
+            }
+        });
+
+        let now = Utc::now();
+        let loadbalancing = LoadBalancingConfig::new(Uuid::nil());
+        let patch = make_patch_pod_isolate(
+            &pod,
+            now,
+            now,
+            &loadbalancing,
+            &IsolateOptions {
+                pre_isolated: true,
+                ..IsolateOptions::default()
+            },
+        )
+        .unwrap();
+        let pre_isolated: Pod = serde_json::from_value(apply(&pod, &patch).unwrap()).unwrap();
+        assert!(get_pod_evict_params(&pre_isolated).is_none());
+
+        let delete_options = DeleteOptions {
+            grace_period_seconds: Some(5),
+            ..DeleteOptions::default()
+        };
+        let patch = make_patch_pod_record_eviction(&pre_isolated, &delete_options).unwrap();
+        let evicted: Pod = serde_json::from_value(apply(&pre_isolated, &patch).unwrap()).unwrap();
+        let evict_params = get_pod_evict_params(&evicted).expect("eviction is recorded");
+        assert_eq!(
+            try_some!(evict_params.delete_options?.grace_period_seconds?),
+            Some(&5)
+        );
+        assert_eq!(evicted.labels(), pre_isolated.labels(), "still isolated");
+    }
+
+    #[test]
+    fn only_one_instance_should_take_over() {
+        let pod: Pod = from_json! ({
+            "metadata": {
+                "uid": "uid1234",
+                "resourceVersion": "version1234",
+                "labels": {
+                    "pod-graceful-drain/draining": "true",
+                },
+                "annotations": {
+                    "pod-graceful-drain/controller": Uuid::new_v4().to_string(),
+                    "pod-graceful-drain/drain-until": "2023-02-08T15:30:00Z",
+                },
+            }
+        });
+        let taken_over_at = DateTime::parse_from_rfc3339("2023-02-08T15:30:10Z")
+            .unwrap()
+            .with_timezone(&Utc);
+
+        let first = LoadBalancingConfig::new(Uuid::new_v4());
+        let second = LoadBalancingConfig::new(Uuid::new_v4());
+        let first_patch = make_patch_pod_takeover(&pod, taken_over_at, &first).unwrap();
+        let second_patch = make_patch_pod_takeover(&pod, taken_over_at, &second).unwrap();
+
+        let mut claimed: Pod = serde_json::from_value(apply(&pod, &first_patch).unwrap()).unwrap();
+        assert!(first.controls(&claimed));
+        assert_eq!(
+            claimed.annotations().get(TAKEN_OVER_AT_ANNOTATION_KEY),
+            Some(&String::from("2023-02-08T15:30:10Z"))
+        );
+
+        // The api server bumps the resource version on the patch.
+        claimed.metadata.resource_version = Some(String::from("version1235"));
+        assert!(
+            apply(&claimed, &second_patch).is_err(),
+            "the other instance should fail to claim"
+        );
+    }
+
     #[test]
     fn pod_patch_isolate_should_contain_test_resource_version() {
         let pod: Pod = from_json! ({
@@ -337,11 +810,24 @@ mod tests {
             }
         });
 
+        let isolated_at = DateTime::parse_from_rfc3339("2023-02-08T15:29:30Z")
+            .unwrap()
+            .with_timezone(&Utc);
         let drain_until = DateTime::parse_from_rfc3339("2023-02-08T15:30:00Z")
             .unwrap()
             .with_timezone(&Utc);
         let loadbalancing = LoadBalancingConfig::new(Uuid::nil());
-        let patch = make_patch_pod_isolate(&pod, drain_until, None, &loadbalancing).unwrap();
+        let patch = make_patch_pod_isolate(
+            &pod,
+            isolated_at,
+            drain_until,
+            &loadbalancing,
+            &IsolateOptions {
+                cut_owner_references: true,
+                ..IsolateOptions::default()
+            },
+        )
+        .unwrap();
 
         assert_eq!(
             &patch[..2],
@@ -358,6 +844,246 @@ mod tests {
         );
     }
 
+    #[test]
+    fn should_cut_owner_references_unless_foreground() {
+        let pod = Pod::default();
+        assert!(should_cut_owner_references(&Config::default(), &pod, None));
+        assert!(should_cut_owner_references(
+            &Config::default(),
+            &pod,
+            Some(&DeleteOptions::default())
+        ));
+        for (policy, expected) in [
+            ("Orphan", true),
+            ("Background", true),
+            ("Foreground", false),
+        ] {
+            let delete_options = DeleteOptions {
+                propagation_policy: Some(String::from(policy)),
+                ..DeleteOptions::default()
+            };
+            assert_eq!(
+                should_cut_owner_references(&Config::default(), &pod, Some(&delete_options)),
+                expected,
+                "{policy}"
+            );
+        }
+    }
+
+    #[test]
+    fn stateful_set_pod_should_be_isolated_without_cutting_owner_references() {
+        let pod: Pod = from_json!({
+            "metadata": {
+                "name": "pod-0",
+                "ownerReferences": [{
+                    "apiVersion": "apps/v1",
+                    "kind": "StatefulSet",
+                    "name": "pod",
+                    "uid": "12345",
+                    "controller": true,
+                    "blockOwnerDeletion": true,
+                }]
+            }
+        });
+
+        let cut_owner_references = should_cut_owner_references(&Config::default(), &pod, None);
+        assert!(!cut_owner_references);
+
+        let now = Utc::now();
+        let loadbalancing = LoadBalancingConfig::new(Uuid::nil());
+        let patch = make_patch_pod_isolate(
+            &pod,
+            now,
+            now,
+            &loadbalancing,
+            &IsolateOptions {
+                cut_owner_references,
+                ..IsolateOptions::default()
+            },
+        )
+        .unwrap();
+
+        let applied: Pod = serde_json::from_value(apply(&pod, &patch).unwrap()).unwrap();
+        assert_eq!(applied.owner_references(), pod.owner_references());
+        assert!(!applied
+            .annotations()
+            .contains_key(ORIGINAL_OWNER_REFERENCES_ANNOTATION_KEY));
+    }
+
+    #[test]
+    fn owner_references_should_be_preserved_when_not_cutting() {
+        let config = Config {
+            cut_owner_references: false,
+            ..Config::default()
+        };
+        let pod: Pod = from_json!({
+            "metadata": {
+                "name": "pod",
+                "ownerReferences": [{
+                    "apiVersion": "apps/v1",
+                    "kind": "ReplicaSet",
+                    "name": "owner",
+                    "uid": "12345",
+                    "controller": true,
+                    "blockOwnerDeletion": true,
+                }]
+            }
+        });
+
+        let cut_owner_references = should_cut_owner_references(&config, &pod, None);
+        assert!(!cut_owner_references);
+
+        let now = Utc::now();
+        let loadbalancing = LoadBalancingConfig::new(Uuid::nil());
+        let patch = make_patch_pod_isolate(
+            &pod,
+            now,
+            now,
+            &loadbalancing,
+            &IsolateOptions {
+                cut_owner_references,
+                ..IsolateOptions::default()
+            },
+        )
+        .unwrap();
+
+        let applied: Pod = serde_json::from_value(apply(&pod, &patch).unwrap()).unwrap();
+        assert_eq!(applied.owner_references(), pod.owner_references());
+        assert!(!applied
+            .annotations()
+            .contains_key(ORIGINAL_OWNER_REFERENCES_ANNOTATION_KEY));
+    }
+
+    #[test]
+    fn pod_patch_isolate_should_record_requester() {
+        let pod: Pod = from_json!({
+            "metadata": {
+                "uid": "uid1234",
+                "resourceVersion": "version1234",
+            }
+        });
+
+        let now = Utc::now();
+        let loadbalancing = LoadBalancingConfig::new(Uuid::nil());
+        let patch = make_patch_pod_isolate(
+            &pod,
+            now,
+            now,
+            &loadbalancing,
+            &IsolateOptions {
+                requested_by: Some("kubernetes-admin"),
+                ..IsolateOptions::default()
+            },
+        )
+        .unwrap();
+
+        let applied: Pod = serde_json::from_value(apply(&pod, &patch).unwrap()).unwrap();
+        assert_eq!(
+            applied.annotations().get(REQUESTED_BY_ANNOTATION_KEY),
+            Some(&String::from("kubernetes-admin"))
+        );
+    }
+
+    #[test]
+    fn pod_patch_release_should_undo_isolation() {
+        let pod: Pod = from_json!({
+            "metadata": {
+                "uid": "uid1234",
+                "resourceVersion": "version1234",
+                "labels": {
+                    "app": "test",
+                },
+                "ownerReferences": [{
+                    "apiVersion": "apps/v1",
+                    "kind": "ReplicaSet",
+                    "name": "owner",
+                    "uid": "12345",
+                    "controller": true,
+                    "blockOwnerDeletion": true,
+                }]
+            }
+        });
+
+        let now = Utc::now();
+        let loadbalancing = LoadBalancingConfig::new(Uuid::nil());
+        let patch = make_patch_pod_isolate(
+            &pod,
+            now,
+            now,
+            &loadbalancing,
+            &IsolateOptions {
+                requested_by: Some("system:serviceaccount:kube-system:node-drainer"),
+                cut_owner_references: true,
+                ..IsolateOptions::default()
+            },
+        )
+        .unwrap();
+        let isolated: Pod = serde_json::from_value(apply(&pod, &patch).unwrap()).unwrap();
+
+        let patch = make_patch_pod_release(&isolated).unwrap();
+        let released: Pod = serde_json::from_value(apply(&isolated, &patch).unwrap()).unwrap();
+
+        assert_eq!(released.labels(), pod.labels());
+        assert_eq!(released.owner_references(), pod.owner_references());
+        assert!(released.annotations().is_empty());
+        assert!(matches!(
+            get_pod_draining_info(&released),
+            PodDrainingInfo::None
+        ));
+    }
+
+    #[test]
+    fn patch_retry_should_continue_within_limit() {
+        let mut retry = PatchRetry::new(&Config::default());
+        let before = metrics::PATCH_RETRIES_TOTAL.get();
+
+        // e.g. conflicts 3 times, then succeeds.
+        for _ in 0..3 {
+            assert!(retry.next_backoff().is_some());
+        }
+
+        assert!(metrics::PATCH_RETRIES_TOTAL.get() - before >= 3);
+    }
+
+    #[test]
+    fn patch_retry_should_give_up_on_endless_conflicts() {
+        let config = Config::default();
+        let mut retry = PatchRetry::new(&config);
+        let mut retries = 0;
+        while retry.next_backoff().is_some() {
+            retries += 1;
+            assert!(retries <= config.patch_max_retries, "should give up");
+        }
+
+        assert_eq!(retries, config.patch_max_retries);
+    }
+
+    #[test]
+    fn patch_retry_should_follow_configured_backoff() {
+        let config = Config {
+            patch_backoff_initial_interval: Duration::from_millis(100),
+            patch_backoff_multiplier: 2.0,
+            patch_backoff_max_interval: Duration::from_millis(400),
+            patch_max_retries: 8,
+            ..Config::default()
+        };
+        let mut retry = PatchRetry::new(&config);
+
+        let mut backoffs = Vec::new();
+        while let Some(backoff) = retry.next_backoff() {
+            backoffs.push(backoff);
+        }
+
+        assert_eq!(backoffs.len(), 8);
+        // randomized by 50% at most
+        assert!(
+            backoffs[0] >= Duration::from_millis(50) && backoffs[0] <= Duration::from_millis(150)
+        );
+        assert!(backoffs
+            .iter()
+            .all(|backoff| *backoff <= Duration::from_millis(600)));
+    }
+
     #[test]
     fn eviction_patch_none_delete_options() {
         let eviction: Eviction = from_json!({});
@@ -423,4 +1149,58 @@ mod tests {
             })
         );
     }
+
+    #[test]
+    fn eviction_patch_should_preserve_delete_options() {
+        let eviction: Eviction = from_json!({
+            "deleteOptions": {
+                "gracePeriodSeconds": 30,
+                "propagationPolicy": "Background",
+                "preconditions": {
+                    "uid": "uid1234",
+                },
+            },
+        });
+
+        let patch = make_patch_eviction_to_dry_run(&eviction).unwrap();
+        assert_eq!(
+            serde_json::to_value(&patch).unwrap(),
+            json!([{
+                "op": "add",
+                "path": "/deleteOptions/dryRun",
+                "value": ["All"],
+            }])
+        );
+
+        let applied = apply(&eviction, &patch).unwrap();
+        assert_eq!(
+            applied,
+            json!({
+                "apiVersion": "policy/v1",
+                "kind": "Eviction",
+                "metadata": {},
+                "deleteOptions": {
+                    "dryRun": ["All"],
+                    "gracePeriodSeconds": 30,
+                    "propagationPolicy": "Background",
+                    "preconditions": {
+                        "uid": "uid1234",
+                    },
+                },
+            })
+        );
+    }
+
+    #[test]
+    fn eviction_patch_should_be_noop_if_already_dry_run() {
+        let eviction: Eviction = from_json!({
+            "deleteOptions": {
+                "dryRun": ["All"],
+                "gracePeriodSeconds": 0,
+            },
+        });
+
+        let patch = make_patch_eviction_to_dry_run(&eviction).unwrap();
+        assert!(patch.0.is_empty());
+    }
 }
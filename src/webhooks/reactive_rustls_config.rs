@@ -4,7 +4,7 @@ use std::path::Path;
 use std::time::Duration;
 
 use debounced::debounced;
-use eyre::{Context, ContextCompat, Result};
+use eyre::{eyre, Context, ContextCompat, Result};
 use futures::StreamExt;
 use genawaiter::sync::Gen;
 use notify::{RecursiveMode, Watcher};
@@ -110,9 +110,13 @@ async fn load_cert_from(cert_dir: &Path) -> Result<SerializedCertifiedKey> {
         let mut file = File::open(&path).await.context(format!("File({path:?})"))?;
         let mut crt = Vec::new();
         copy(&mut file, &mut crt).await?;
-        rustls_pemfile::certs(&mut Cursor::new(crt))
+        let certs = rustls_pemfile::certs(&mut Cursor::new(crt))
             .collect::<std::io::Result<Vec<_>>>()
-            .context(format!("Cert({path:?})"))?
+            .context(format!("Cert({path:?})"))?;
+        if certs.is_empty() {
+            return Err(eyre!("no certificate in {path:?}"));
+        }
+        certs
     };
 
     let key = {
@@ -127,3 +131,48 @@ async fn load_cert_from(cert_dir: &Path) -> Result<SerializedCertifiedKey> {
 
     Ok(SerializedCertifiedKey::new_with(&certs, &key))
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    use rcgen::generate_simple_self_signed;
+    use tempfile::TempDir;
+
+    fn write_cert_dir(crt: &str, key: Option<&str>) -> TempDir {
+        let dir = tempfile::tempdir().unwrap();
+        std::fs::write(dir.path().join(TLS_CRT), crt).unwrap();
+        if let Some(key) = key {
+            std::fs::write(dir.path().join(TLS_KEY), key).unwrap();
+        }
+        dir
+    }
+
+    #[tokio::test]
+    async fn should_load_cert_from_dir() {
+        let cert_key = generate_simple_self_signed(vec![String::from("localhost")]).unwrap();
+        let dir = write_cert_dir(
+            &cert_key.cert.pem(),
+            Some(&cert_key.key_pair.serialize_pem()),
+        );
+
+        let cert = load_cert_from(dir.path()).await.unwrap();
+        assert_eq!(cert.certs.len(), 1);
+        assert!(RustlsConfig::from_der(cert.certs, cert.key).await.is_ok());
+    }
+
+    #[tokio::test]
+    async fn should_reject_invalid_cert_dir() {
+        let cert_key = generate_simple_self_signed(vec![String::from("localhost")]).unwrap();
+
+        let dir = write_cert_dir("", Some(&cert_key.key_pair.serialize_pem()));
+        let err = load_cert_from(dir.path()).await.err().unwrap();
+        assert!(format!("{err:#}").contains("no certificate"), "{err:#}");
+
+        let dir = write_cert_dir(&cert_key.cert.pem(), None);
+        assert!(load_cert_from(dir.path()).await.is_err(), "missing key");
+
+        let dir = write_cert_dir(&cert_key.cert.pem(), Some(""));
+        assert!(load_cert_from(dir.path()).await.is_err(), "empty key");
+    }
+}
@@ -0,0 +1,153 @@
+use std::fmt::{Display, Formatter};
+
+use kube::core::admission::AdmissionResponse;
+
+/// The audit annotation key of the reason code. The api server prefixes it with the webhook name.
+const REASON_CODE_AUDIT_ANNOTATION_KEY: &str = "reason-code";
+
+/// Machine-readable reasons of the intercepted admissions, for the tools that wrap this controller.
+/// The reports keep the human-readable messages, and the warnings are prefixed with the code, e.g. `[DRAIN] ...`.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum ReasonCode {
+    /// The pod is isolated and the admission is delayed.
+    Drain,
+    /// The admission of the pod that is already draining is delayed again.
+    Reentry,
+    /// The delay is cut short by the webhook timeout.
+    Timeout,
+    /// The delay is cut short, or skipped, since the node is about to be terminated.
+    NodeTerminating,
+    /// The admission would've been denied, but the pod is annotated not to be.
+    NoDeny,
+    /// The pod is out of the scope, or its owner or containers are excluded.
+    OutOfScope,
+    /// The admission is outside the `--active-hours`.
+    OutOfActiveHours,
+    /// The pod is not exposed, so it doesn't need to be drained.
+    NotExposed,
+    /// The pod is not serving, e.g. not scheduled, completed, not ready or just become ready.
+    NotServing,
+    /// Isolating the pod would violate its PodDisruptionBudget.
+    DisruptionBudget,
+    /// Too many pods of the same service are draining.
+    TooManyDraining,
+    /// The pod would've been drained, but only observed.
+    ObserveOnly,
+    /// The pod is drained enough.
+    Drained,
+    /// The pod is already gone, or being deleted.
+    Deleting,
+    /// The drain is disabled for the pod, or its draining label is cleared.
+    Disabled,
+}
+
+impl ReasonCode {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            ReasonCode::Drain => "DRAIN",
+            ReasonCode::Reentry => "REENTRY",
+            ReasonCode::Timeout => "TIMEOUT",
+            ReasonCode::NodeTerminating => "NODE_TERMINATING",
+            ReasonCode::NoDeny => "NO_DENY",
+            ReasonCode::OutOfScope => "OUT_OF_SCOPE",
+            ReasonCode::OutOfActiveHours => "OUT_OF_ACTIVE_HOURS",
+            ReasonCode::NotExposed => "NOT_EXPOSED",
+            ReasonCode::NotServing => "NOT_SERVING",
+            ReasonCode::DisruptionBudget => "DISRUPTION_BUDGET",
+            ReasonCode::TooManyDraining => "TOO_MANY_DRAINING",
+            ReasonCode::ObserveOnly => "OBSERVE_ONLY",
+            ReasonCode::Drained => "DRAINED",
+            ReasonCode::Deleting => "DELETING",
+            ReasonCode::Disabled => "DISABLED",
+        }
+    }
+}
+
+impl Display for ReasonCode {
+    fn fmt(&self, f: &mut Formatter<'_>) -> std::fmt::Result {
+        f.write_str(self.as_str())
+    }
+}
+
+/// Puts the code in the audit annotations, and prefixes the warnings with it.
+/// So it should be called after the warnings are set.
+pub fn with_reason_code(mut response: AdmissionResponse, code: ReasonCode) -> AdmissionResponse {
+    response.audit_annotations.insert(
+        String::from(REASON_CODE_AUDIT_ANNOTATION_KEY),
+        code.to_string(),
+    );
+    if let Some(warnings) = response.warnings.as_mut() {
+        for warning in warnings.iter_mut() {
+            *warning = format!("[{code}] {warning}");
+        }
+    }
+    response
+}
+
+/// The delayed admission is reported by why it ended.
+pub fn get_delay_reason_code(
+    code: ReasonCode,
+    truncated_by_timeout: bool,
+    node_terminating: bool,
+) -> ReasonCode {
+    if node_terminating {
+        ReasonCode::NodeTerminating
+    } else if truncated_by_timeout {
+        ReasonCode::Timeout
+    } else {
+        code
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn reason_codes_should_be_stable() {
+        assert_eq!(ReasonCode::Drain.to_string(), "DRAIN");
+        assert_eq!(ReasonCode::Reentry.to_string(), "REENTRY");
+        assert_eq!(ReasonCode::Timeout.to_string(), "TIMEOUT");
+        assert_eq!(ReasonCode::NodeTerminating.to_string(), "NODE_TERMINATING");
+        assert_eq!(ReasonCode::NoDeny.to_string(), "NO_DENY");
+    }
+
+    #[test]
+    fn delay_should_be_reported_by_why_it_ended() {
+        assert_eq!(
+            get_delay_reason_code(ReasonCode::Drain, false, false),
+            ReasonCode::Drain
+        );
+        assert_eq!(
+            get_delay_reason_code(ReasonCode::Reentry, false, false),
+            ReasonCode::Reentry
+        );
+        assert_eq!(
+            get_delay_reason_code(ReasonCode::Drain, true, false),
+            ReasonCode::Timeout
+        );
+        assert_eq!(
+            get_delay_reason_code(ReasonCode::Reentry, true, true),
+            ReasonCode::NodeTerminating
+        );
+    }
+
+    #[test]
+    fn reason_code_should_be_in_audit_annotations_and_warnings() {
+        let mut response = AdmissionResponse::invalid("test");
+        response.warnings = Some(vec![String::from("Deletion is allowed")]);
+
+        let response = with_reason_code(response, ReasonCode::NoDeny);
+        assert_eq!(
+            response
+                .audit_annotations
+                .get("reason-code")
+                .map(String::as_str),
+            Some("NO_DENY")
+        );
+        assert_eq!(
+            response.warnings,
+            Some(vec![String::from("[NO_DENY] Deletion is allowed")])
+        );
+    }
+}
@@ -1,9 +1,11 @@
+use chrono::{DateTime, SecondsFormat, Utc};
 use k8s_openapi::api::core::v1::{ObjectReference, Pod};
 use kube::runtime::events::{Event, EventType, Recorder};
 use kube::Resource;
 use tracing::{debug, event_enabled, info, warn, Level};
 
 use crate::webhooks::AppState;
+
 async fn report(
     state: &AppState,
     reference: ObjectReference,
@@ -84,6 +86,16 @@ pub async fn warn_report_for_ref(
     report(state, object_ref, EventType::Warning, action, reason, note).await;
 }
 
+pub async fn warn_report_for(
+    state: &AppState,
+    pod: &Pod,
+    action: &str,
+    reason: &str,
+    note: String,
+) {
+    warn_report_for_ref(state, pod.object_ref(&()), action, reason, note).await;
+}
+
 pub async fn report_for(state: &AppState, pod: &Pod, action: &str, reason: &str, note: String) {
     if !event_enabled!(Level::INFO) {
         return;
@@ -100,3 +112,66 @@ pub async fn report_for(state: &AppState, pod: &Pod, action: &str, reason: &str,
     )
     .await;
 }
+
+/// Render the note of the delayed admission with the user's template if it is given.
+pub fn render_delay_note(
+    template: Option<&str>,
+    message: String,
+    reason: &str,
+    drain_until: DateTime<Utc>,
+    now: DateTime<Utc>,
+) -> String {
+    let Some(template) = template else {
+        return message;
+    };
+
+    let remaining = (drain_until - now).to_std().unwrap_or_default();
+    let remaining = std::time::Duration::from_secs(remaining.as_secs());
+    template
+        .replace("{message}", &message)
+        .replace(
+            "{drain_until}",
+            &drain_until.to_rfc3339_opts(SecondsFormat::Secs, true),
+        )
+        .replace(
+            "{remaining}",
+            &humantime::format_duration(remaining).to_string(),
+        )
+        .replace("{reason}", reason)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn should_render_delay_note_template() {
+        let now = DateTime::parse_from_rfc3339("2024-01-01T00:00:00Z")
+            .unwrap()
+            .into();
+        let drain_until = DateTime::parse_from_rfc3339("2024-01-01T00:01:30Z")
+            .unwrap()
+            .into();
+
+        let note = render_delay_note(
+            Some("{message} ({reason}, {remaining} until {drain_until}). See https://runbook"),
+            String::from("Deletion is delayed"),
+            "Drain",
+            drain_until,
+            now,
+        );
+
+        assert_eq!(
+            note,
+            "Deletion is delayed (Drain, 1m 30s until 2024-01-01T00:01:30Z). See https://runbook"
+        );
+    }
+
+    #[test]
+    fn should_fall_back_to_default_note() {
+        let now = Utc::now();
+        let note = render_delay_note(None, String::from("Deletion is delayed"), "Drain", now, now);
+
+        assert_eq!(note, "Deletion is delayed");
+    }
+}
@@ -0,0 +1,342 @@
+use std::io::Cursor;
+use std::net::{Ipv4Addr, Ipv6Addr, SocketAddr};
+use std::sync::Arc;
+use std::time::Duration;
+
+use eyre::{eyre, Context, Result};
+use k8s_openapi::api::admissionregistration::v1::{
+    MutatingWebhookConfiguration, ValidatingWebhookConfiguration, WebhookClientConfig,
+};
+use k8s_openapi::api::core::v1::Service;
+use k8s_openapi::apimachinery::pkg::util::intstr::IntOrString;
+use kube::Api;
+use rustls::pki_types::ServerName;
+use rustls::{ClientConfig, ClientConnection, RootCertStore};
+use tracing::{debug, info, warn};
+
+use crate::api_resolver::ApiResolver;
+use crate::{try_some, Config};
+
+const CONNECT_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// The api server calls the Services on this port when the webhook doesn't specify one.
+const DEFAULT_SERVICE_PORT: i32 = 443;
+
+/// The Service of the webhook served by this server, as the api server calls it.
+#[derive(Debug)]
+struct WebhookService {
+    namespace: String,
+    name: String,
+    port: i32,
+    ca_bundle: Vec<u8>,
+}
+
+impl WebhookService {
+    fn dns_name(&self) -> String {
+        format!("{}.{}.svc", self.name, self.namespace)
+    }
+}
+
+/// Verifies the webhook server the way the api server calls it, so that a misconfigured certificate or Service
+/// fails the startup with a clear error, rather than the api server failing to call the webhook later.
+///
+/// The webhook is found in the webhook configuration of `--webhook-configuration-name` by its path.
+/// Its Service should target the port of this server, and the served certificate should be valid for the
+/// Service's DNS name by the `caBundle`. The handshake is made to this server directly,
+/// since the Service doesn't route to this replica until it is ready.
+pub async fn verify_webhook_reachable(
+    api_resolver: &ApiResolver,
+    config: &Config,
+    local_addr: SocketAddr,
+) -> Result<()> {
+    let Some(webhook) = get_webhook_service(api_resolver, config)
+        .await
+        .context("finding the webhook service")?
+    else {
+        return Ok(());
+    };
+
+    verify_service_port(api_resolver, &webhook, local_addr.port()).await?;
+
+    let addr = get_self_addr(local_addr);
+    let dns_name = webhook.dns_name();
+    verify_tls(addr, &dns_name, &webhook.ca_bundle)
+        .await
+        .with_context(|| {
+            format!("webhook server at {addr} doesn't serve a valid certificate for '{dns_name}'")
+        })?;
+
+    info!(%addr, service = dns_name, port = webhook.port, "webhook server is verified");
+    Ok(())
+}
+
+async fn get_webhook_service(
+    api_resolver: &ApiResolver,
+    config: &Config,
+) -> Result<Option<WebhookService>> {
+    let Some(name) = config.webhook_configuration_name.as_ref() else {
+        warn!("webhook is not verified without webhook-configuration-name");
+        return Ok(None);
+    };
+
+    let client_config = if config.enable_pod_webhook {
+        let api: Api<ValidatingWebhookConfiguration> = Api::all(api_resolver.client.clone());
+        let configuration = api.get(name).await?;
+        configuration.webhooks.and_then(|webhooks| {
+            find_client_config(
+                webhooks.into_iter().map(|webhook| webhook.client_config),
+                &config.validate_webhook_path,
+            )
+        })
+    } else if config.enable_eviction_webhook {
+        let api: Api<MutatingWebhookConfiguration> = Api::all(api_resolver.client.clone());
+        let configuration = api.get(name).await?;
+        configuration.webhooks.and_then(|webhooks| {
+            find_client_config(
+                webhooks.into_iter().map(|webhook| webhook.client_config),
+                &config.mutate_webhook_path,
+            )
+        })
+    } else {
+        warn!("webhook is not verified while no webhook is served");
+        return Ok(None);
+    };
+
+    let Some(client_config) = client_config else {
+        // The webhook might call a proxy in front of this server at another path.
+        warn!(
+            name,
+            "webhook is not verified since no webhook calls this server's path"
+        );
+        return Ok(None);
+    };
+    get_webhook_service_of(client_config).map(Some)
+}
+
+/// The configuration might have other webhooks, so only the one served at the path counts.
+fn find_client_config(
+    client_configs: impl IntoIterator<Item = WebhookClientConfig>,
+    path: &str,
+) -> Option<WebhookClientConfig> {
+    client_configs.into_iter().find(|client_config| {
+        try_some!(client_config.service?.path?).map(String::as_str) == Some(path)
+    })
+}
+
+fn get_webhook_service_of(client_config: WebhookClientConfig) -> Result<WebhookService> {
+    let service = client_config
+        .service
+        .ok_or(eyre!("webhook is not called through a service"))?;
+    let ca_bundle = client_config
+        .ca_bundle
+        .ok_or(eyre!("webhook has no caBundle"))?;
+
+    Ok(WebhookService {
+        namespace: service.namespace,
+        name: service.name,
+        port: service.port.unwrap_or(DEFAULT_SERVICE_PORT),
+        ca_bundle: ca_bundle.0,
+    })
+}
+
+async fn verify_service_port(
+    api_resolver: &ApiResolver,
+    webhook: &WebhookService,
+    local_port: u16,
+) -> Result<()> {
+    let api: Api<Service> = api_resolver.namespaced(&webhook.namespace);
+    let service = api
+        .get_opt(&webhook.name)
+        .await?
+        .ok_or_else(|| eyre!("service '{}' is not found", webhook.dns_name()))?;
+
+    match get_target_port(&service, webhook.port) {
+        None => Err(eyre!(
+            "service '{}' has no port {}",
+            webhook.dns_name(),
+            webhook.port
+        )),
+        Some(IntOrString::Int(target_port)) if target_port != i32::from(local_port) => Err(eyre!(
+            "service '{}' port {} targets {target_port}, but the webhook server listens on {local_port}",
+            webhook.dns_name(),
+            webhook.port,
+        )),
+        Some(IntOrString::Int(_)) => Ok(()),
+        Some(IntOrString::String(name)) => {
+            debug!(name, "named target port can't be verified");
+            Ok(())
+        }
+    }
+}
+
+fn get_target_port(service: &Service, port: i32) -> Option<IntOrString> {
+    // The api server calls the external name on the port as it is.
+    if try_some!(service.spec?.type_?).map(String::as_str) == Some("ExternalName") {
+        return Some(IntOrString::Int(port));
+    }
+
+    let service_port = try_some!(service.spec?.ports?)?
+        .iter()
+        .find(|service_port| service_port.port == port)?;
+    Some(
+        service_port
+            .target_port
+            .clone()
+            .unwrap_or(IntOrString::Int(port)),
+    )
+}
+
+/// Handshakes as the api server does, with the `caBundle` as the only root and the Service's DNS name as the SNI.
+async fn verify_tls(addr: SocketAddr, dns_name: &str, ca_bundle: &[u8]) -> Result<()> {
+    let mut roots = RootCertStore::empty();
+    for cert in rustls_pemfile::certs(&mut Cursor::new(ca_bundle)) {
+        roots
+            .add(cert.context("parsing caBundle")?)
+            .context("adding caBundle")?;
+    }
+    if roots.is_empty() {
+        return Err(eyre!("caBundle has no certificate"));
+    }
+
+    let client_config =
+        ClientConfig::builder_with_provider(Arc::new(rustls::crypto::ring::default_provider()))
+            .with_safe_default_protocol_versions()?
+            .with_root_certificates(roots)
+            .with_no_client_auth();
+    let server_name = ServerName::try_from(dns_name.to_string())?;
+
+    tokio::task::spawn_blocking(move || -> Result<()> {
+        let mut conn = ClientConnection::new(Arc::new(client_config), server_name)?;
+        let mut socket = std::net::TcpStream::connect_timeout(&addr, CONNECT_TIMEOUT)?;
+        socket.set_read_timeout(Some(CONNECT_TIMEOUT))?;
+        socket.set_write_timeout(Some(CONNECT_TIMEOUT))?;
+        while conn.is_handshaking() {
+            conn.complete_io(&mut socket)?;
+        }
+        Ok(())
+    })
+    .await?
+}
+
+/// The unspecified address can't be connected to.
+fn get_self_addr(local_addr: SocketAddr) -> SocketAddr {
+    let mut addr = local_addr;
+    if addr.ip().is_unspecified() {
+        if addr.is_ipv4() {
+            addr.set_ip(Ipv4Addr::LOCALHOST.into());
+        } else {
+            addr.set_ip(Ipv6Addr::LOCALHOST.into());
+        }
+    }
+    addr
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    use axum::Router;
+    use axum_server::tls_rustls::RustlsConfig;
+    use rcgen::generate_simple_self_signed;
+
+    use crate::from_json;
+
+    #[test]
+    fn unspecified_address_should_be_loopback() {
+        let addr = get_self_addr(SocketAddr::from(([0, 0, 0, 0], 9443)));
+        assert_eq!(addr, SocketAddr::from(([127, 0, 0, 1], 9443)));
+    }
+
+    /// Serves the self-signed certificate for `dns_name`, and returns it as the `caBundle`.
+    async fn serve_tls(dns_name: &str) -> (SocketAddr, String) {
+        let cert_key = generate_simple_self_signed(vec![String::from(dns_name)]).unwrap();
+        let rustls_config = RustlsConfig::from_pem(
+            cert_key.cert.pem().into_bytes(),
+            cert_key.key_pair.serialize_pem().into_bytes(),
+        )
+        .await
+        .unwrap();
+
+        let listener = std::net::TcpListener::bind("127.0.0.1:0").unwrap();
+        let addr = listener.local_addr().unwrap();
+        tokio::spawn(async move {
+            axum_server::tls_rustls::from_tcp_rustls(listener, rustls_config)
+                .serve(Router::new().into_make_service())
+                .await
+                .unwrap()
+        });
+
+        (addr, cert_key.cert.pem())
+    }
+
+    #[tokio::test]
+    async fn should_verify_certificate_for_service_dns_name() {
+        let (addr, ca_bundle) = serve_tls("webhook.ns.svc").await;
+
+        verify_tls(addr, "webhook.ns.svc", ca_bundle.as_bytes())
+            .await
+            .unwrap();
+
+        let err = verify_tls(addr, "other.ns.svc", ca_bundle.as_bytes())
+            .await
+            .unwrap_err();
+        assert!(format!("{err:#}").contains("NotValidForName"), "{err:#}");
+    }
+
+    #[tokio::test]
+    async fn should_reject_certificate_not_signed_by_ca_bundle() {
+        let (addr, _) = serve_tls("webhook.ns.svc").await;
+        let other = generate_simple_self_signed(vec![String::from("webhook.ns.svc")]).unwrap();
+
+        assert!(
+            verify_tls(addr, "webhook.ns.svc", other.cert.pem().as_bytes())
+                .await
+                .is_err()
+        );
+        assert!(verify_tls(addr, "webhook.ns.svc", b"").await.is_err());
+    }
+
+    #[test]
+    fn webhook_service_should_be_found_by_path() {
+        let client_configs: Vec<WebhookClientConfig> = from_json!([
+            {
+                "service": { "namespace": "ns", "name": "other", "path": "/other" },
+                "caBundle": "",
+            },
+            {
+                "service": { "namespace": "ns", "name": "webhook", "path": "/webhook/validate" },
+                "caBundle": "",
+            },
+        ]);
+
+        let client_config = find_client_config(client_configs, "/webhook/validate").unwrap();
+        let webhook = get_webhook_service_of(client_config).unwrap();
+        assert_eq!(webhook.dns_name(), "webhook.ns.svc");
+        assert_eq!(webhook.port, DEFAULT_SERVICE_PORT);
+    }
+
+    #[test]
+    fn target_port_should_be_resolved_by_service_port() {
+        let service: Service = from_json!({
+            "metadata": { "namespace": "ns", "name": "webhook" },
+            "spec": {
+                "ports": [
+                    { "port": 443, "targetPort": 9443 },
+                    { "port": 80 },
+                ],
+            },
+        });
+        assert_eq!(get_target_port(&service, 443), Some(IntOrString::Int(9443)));
+        assert_eq!(get_target_port(&service, 80), Some(IntOrString::Int(80)));
+        assert_eq!(get_target_port(&service, 8080), None);
+
+        let external: Service = from_json!({
+            "metadata": { "namespace": "ns", "name": "webhook" },
+            "spec": { "type": "ExternalName", "externalName": "10.0.0.1" },
+        });
+        assert_eq!(
+            get_target_port(&external, 9443),
+            Some(IntOrString::Int(9443))
+        );
+    }
+}
@@ -4,9 +4,10 @@ use chrono::TimeDelta;
 use k8s_openapi::api::core::v1::Pod;
 use k8s_openapi::apimachinery::pkg::apis::meta::v1::DeleteOptions;
 use tokio::time::Duration;
+use uuid::Uuid;
 
-use pod_graceful_drain::webhooks::patch_pod_isolate;
-use pod_graceful_drain::ServiceRegistry;
+use pod_graceful_drain::webhooks::{patch_pod_isolate, IsolateOptions};
+use pod_graceful_drain::{Clock, Config, LoadBalancingConfig, ServiceRegistry};
 
 use crate::testutils::context::{within_test_namespace, TestContext};
 use crate::testutils::operations::install_test_host_service;
@@ -14,13 +15,19 @@ use crate::testutils::operations::install_test_host_service;
 mod testutils;
 
 async fn setup(context: &TestContext) {
+    setup_with_config(context, Config::default()).await;
+}
+
+async fn setup_with_config(context: &TestContext, config: Config) {
     install_test_host_service(context).await;
     let service_registry = ServiceRegistry::default();
 
     pod_graceful_drain::start_controller(
         &context.api_resolver,
+        &config,
         &service_registry,
         &context.loadbalancing,
+        &Clock::default(),
         &context.shutdown,
     )
     .unwrap();
@@ -162,6 +169,142 @@ spec:
     .await;
 }
 
+#[tokio::test]
+async fn controller_shouldnt_delete_expired_pod_when_no_auto_delete() {
+    within_test_namespace(|context| async move {
+        let config = Config {
+            no_auto_delete: true,
+            ..Config::default()
+        };
+        setup_with_config(&context, config).await;
+        apply_yaml!(
+            &context,
+            Pod,
+            r#"
+metadata:
+  name: some-pod
+  labels:
+    app: test
+spec:
+  containers:
+  - name: app
+    image: public.ecr.aws/docker/library/busybox
+    command: ["sleep", "9999"]"#
+        );
+        kubectl!(&context, ["wait", "pod/some-pod", "--for=condition=Ready"]);
+
+        patch_drain_until(&context, "some-pod", TimeDelta::seconds(5), None).await;
+
+        tokio::time::sleep(Duration::from_secs(10)).await;
+        assert!(
+            !pod_has_been_deleted(&context, "some-pod").await,
+            "pod shouldn't be deleted"
+        );
+
+        let pod: Pod = context.api_resolver.all().get("some-pod").await.unwrap();
+        let labels = pod.metadata.labels.unwrap_or_default();
+        assert_eq!(
+            labels
+                .get("pod-graceful-drain/draining")
+                .map(String::as_str),
+            Some("false"),
+            "draining should've been disabled"
+        );
+    })
+    .await;
+}
+
+#[tokio::test]
+async fn controller_should_delete_pod_isolated_before_restart() {
+    within_test_namespace(|context| async move {
+        install_test_host_service(&context).await;
+        apply_yaml!(
+            &context,
+            Pod,
+            r#"
+metadata:
+  name: some-pod
+  labels:
+    app: test
+spec:
+  containers:
+  - name: app
+    image: public.ecr.aws/docker/library/busybox
+    command: ["sleep", "9999"]"#
+        );
+        kubectl!(&context, ["wait", "pod/some-pod", "--for=condition=Ready"]);
+
+        // Isolated by the previous instance, which is gone before it deletes the pod.
+        patch_drain_until(&context, "some-pod", TimeDelta::seconds(5), None).await;
+
+        let restarted = LoadBalancingConfig::new(Uuid::new_v4());
+        pod_graceful_drain::start_controller(
+            &context.api_resolver,
+            &Config::default(),
+            &ServiceRegistry::default(),
+            &restarted,
+            &Clock::default(),
+            &context.shutdown,
+        )
+        .unwrap();
+
+        // The original controller is given a chance first, before the others take over.
+        assert!(
+            eventually!(
+                timeout = 30,
+                pod_has_been_deleted(&context, "some-pod").await
+            ),
+            "pod should've been deleted"
+        );
+    })
+    .await;
+}
+
+#[tokio::test]
+async fn controller_should_delete_expired_pod_immediately_after_restart() {
+    within_test_namespace(|context| async move {
+        install_test_host_service(&context).await;
+        apply_yaml!(
+            &context,
+            Pod,
+            r#"
+metadata:
+  name: some-pod
+  labels:
+    app: test
+spec:
+  containers:
+  - name: app
+    image: public.ecr.aws/docker/library/busybox
+    command: ["sleep", "9999"]"#
+        );
+        kubectl!(&context, ["wait", "pod/some-pod", "--for=condition=Ready"]);
+
+        // Expired long ago while the controller was down.
+        patch_drain_until(&context, "some-pod", TimeDelta::seconds(-60), None).await;
+
+        let restarted = LoadBalancingConfig::new(Uuid::new_v4());
+        pod_graceful_drain::start_controller(
+            &context.api_resolver,
+            &Config::default(),
+            &ServiceRegistry::default(),
+            &restarted,
+            &Clock::default(),
+            &context.shutdown,
+        )
+        .unwrap();
+
+        assert!(
+            eventually!(
+                timeout = 5,
+                pod_has_been_deleted(&context, "some-pod").await
+            ),
+            "pod should've been deleted without waiting for the original controller"
+        );
+    })
+    .await;
+}
+
 async fn patch_drain_until(
     context: &TestContext,
     name: &str,
@@ -173,10 +316,16 @@ async fn patch_drain_until(
     let pod: Pod = context.api_resolver.all().get(name).await.unwrap();
     patch_pod_isolate(
         &context.api_resolver,
+        &Config::default(),
         &pod,
+        now,
         drain_until,
-        delete_options,
         &context.loadbalancing,
+        IsolateOptions {
+            eviction_delete_options: delete_options,
+            cut_owner_references: true,
+            ..IsolateOptions::default()
+        },
     )
     .await
     .unwrap();
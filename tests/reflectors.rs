@@ -16,6 +16,7 @@ fn start_test_reflector(context: &TestContext) -> Stores {
     let config = Config {
         delete_after: Duration::from_secs(10),
         experimental_general_ingress: true,
+        ..Config::default()
     };
 
     start_reflectors(
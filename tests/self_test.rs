@@ -0,0 +1,36 @@
+use k8s_openapi::api::core::v1::Pod;
+use kube::api::ListParams;
+
+use pod_graceful_drain::{run_self_test, Config};
+
+use crate::testutils::context::within_test_namespace;
+
+mod testutils;
+
+#[tokio::test]
+async fn self_test_should_pass_and_clean_up() {
+    within_test_namespace(|context| async move {
+        run_self_test(
+            &context.api_resolver,
+            &Config::default(),
+            &context.loadbalancing,
+            &context.namespace,
+        )
+        .await
+        .unwrap();
+
+        let pods = context
+            .api_resolver
+            .all::<Pod>()
+            .list(&ListParams::default())
+            .await
+            .unwrap();
+        assert!(
+            pods.items
+                .iter()
+                .all(|pod| pod.metadata.deletion_timestamp.is_some()),
+            "canary pod should be deleted"
+        );
+    })
+    .await;
+}
@@ -1,7 +1,8 @@
-use std::io::Cursor;
+use std::io::{Cursor, Write};
 use std::sync::Arc;
 use std::time::{Duration, Instant};
 
+use axum::http::{header, Request, StatusCode};
 use base64::Engine;
 use eyre::{ContextCompat, Result};
 use k8s_openapi::api::admissionregistration::v1::{
@@ -11,12 +12,12 @@ use k8s_openapi::api::apps::v1::Deployment;
 use k8s_openapi::api::core::v1::{Pod, Service};
 use k8s_openapi::api::discovery::v1::EndpointSlice;
 use k8s_openapi::api::networking::v1::Ingress;
-use kube::api::{ListParams, ObjectList};
+use kube::api::{DeleteParams, ListParams, ObjectList};
 use rcgen::generate_simple_self_signed;
 use rustls::pki_types::{CertificateDer, PrivateKeyDer};
 use uuid::Uuid;
 
-use pod_graceful_drain::{Config, LoadBalancingConfig, ServiceRegistry, WebhookConfig};
+use pod_graceful_drain::{Clock, Config, LoadBalancingConfig, ServiceRegistry, WebhookConfig};
 
 use crate::testutils::context::{within_test_namespace, TestContext};
 use crate::testutils::event_tracker::EventTracker;
@@ -40,17 +41,23 @@ async fn generate_self_signed_cert(
     Ok((ca_bundle, cert, private_key))
 }
 
-async fn setup(context: &TestContext, config: Config) {
+async fn setup(context: &TestContext, config: Config) -> u16 {
     let namespace = &context.namespace;
     let service_domain = install_test_host_service(context).await;
     let (ca_bundle, cert, key_pair) = generate_self_signed_cert(service_domain).await.unwrap();
     let service_registry = ServiceRegistry::default();
     let loadbalancing = LoadBalancingConfig::new(Uuid::nil());
+    let validate_webhook_path = config.validate_webhook_path.clone();
+    let mutate_webhook_path = config.mutate_webhook_path.clone();
+    let enable_pod_webhook = config.enable_pod_webhook;
+    let enable_eviction_webhook = config.enable_eviction_webhook;
 
     pod_graceful_drain::start_controller(
         &context.api_resolver,
+        &config,
         &service_registry,
         &loadbalancing,
+        &Clock::default(),
         &context.shutdown,
     )
     .unwrap();
@@ -76,10 +83,12 @@ async fn setup(context: &TestContext, config: Config) {
     .unwrap()
     .port();
 
-    apply_yaml!(
-        context,
-        ValidatingWebhookConfiguration,
-        r#"
+    // The disabled webhooks aren't registered, like the chart does.
+    if enable_pod_webhook {
+        apply_yaml!(
+            context,
+            ValidatingWebhookConfiguration,
+            r#"
 metadata:
   name: {namespace}-webhook
 webhooks:
@@ -90,7 +99,7 @@ webhooks:
       service:
         namespace: {namespace}
         name: test-host
-        path: /webhook/validate
+        path: {validate_webhook_path}
         port: {port}
     rules:
       - apiGroups: [""]
@@ -103,12 +112,14 @@ webhooks:
     namespaceSelector:
       matchLabels:
         name: {namespace}"#,
-    );
+        );
+    }
 
-    apply_yaml!(
-        context,
-        MutatingWebhookConfiguration,
-        r#"
+    if enable_eviction_webhook {
+        apply_yaml!(
+            context,
+            MutatingWebhookConfiguration,
+            r#"
 metadata:
   name: {namespace}-webhook
 webhooks:
@@ -119,7 +130,7 @@ webhooks:
       service:
         namespace: {namespace}
         name: test-host
-        path: /webhook/mutate
+        path: {mutate_webhook_path}
         port: {port}
     rules:
       - apiGroups: [""]
@@ -131,7 +142,10 @@ webhooks:
     namespaceSelector:
       matchLabels:
         name: {namespace}"#,
-    );
+        );
+    }
+
+    port
 }
 
 async fn pod_is_alive(context: &TestContext, name: &str) -> bool {
@@ -180,6 +194,7 @@ async fn should_delay_deletion_by_kubectl_delete() {
         let config = Config {
             delete_after: DELETE_AFTER,
             experimental_general_ingress: true,
+            ..Config::default()
         };
         setup(&context, config).await;
 
@@ -307,12 +322,215 @@ spec:
     .await;
 }
 
+#[tokio::test]
+async fn should_delay_deletion_by_delete_collection() {
+    within_test_namespace(|context| async move {
+        let config = Config {
+            delete_after: DELETE_AFTER,
+            experimental_general_ingress: true,
+            ..Config::default()
+        };
+        setup(&context, config).await;
+
+        apply_yaml!(
+            &context,
+            Pod,
+            r#"
+metadata:
+  name: some-pod
+  labels:
+    app: test
+spec:
+  containers:
+  - name: app
+    image: public.ecr.aws/docker/library/busybox
+    command: ["sleep", "9999"]"#
+        );
+
+        apply_yaml!(
+            &context,
+            Service,
+            r#"
+metadata:
+  name: some-service
+spec:
+  ports:
+  - name: http
+    port: 80
+  selector:
+    app: test"#
+        );
+
+        apply_yaml!(
+            &context,
+            Ingress,
+            r#"
+metadata:
+  name: some-ingress
+spec:
+  rules:
+  - http:
+      paths:
+      - backend:
+          service:
+            name: some-service
+            port:
+              name: http
+        pathType: Exact
+        path: /"#
+        );
+
+        kubectl!(&context, ["wait", "pod/some-pod", "--for=condition=Ready"]);
+
+        let context = Arc::new(context);
+        let mut event_tracker = EventTracker::new(&context, Duration::from_secs(5)).await;
+
+        let delete_collection = tokio::spawn({
+            let context = Arc::clone(&context);
+            async move {
+                let start = Instant::now();
+                context
+                    .api_resolver
+                    .all::<Pod>()
+                    .delete_collection(
+                        &DeleteParams::default(),
+                        &ListParams::default().labels("app=test"),
+                    )
+                    .await
+                    .unwrap();
+                let duration = Instant::now() - start;
+
+                assert!(
+                    duration > DELETE_DELAY_APPROX,
+                    "should be delayed approx. 10s"
+                );
+            }
+        });
+
+        assert!(event_tracker.issued_soon("DelayDeletion", "Drain").await);
+
+        delete_collection.await.unwrap();
+
+        assert!(
+            pod_is_deleted_within(&context, "some-pod", Duration::from_secs(20)).await,
+            "pod is eventually deleted"
+        );
+    })
+    .await;
+}
+
+#[tokio::test]
+async fn should_delete_isolated_pod_by_admin_api() {
+    within_test_namespace(|context| async move {
+        let mut token_file = tempfile::NamedTempFile::new().unwrap();
+        writeln!(token_file, "some-token").unwrap();
+        let config = Config {
+            delete_after: Duration::from_secs(60),
+            experimental_general_ingress: true,
+            admin_token_file: Some(token_file.path().to_path_buf()),
+            ..Config::default()
+        };
+        let port = setup(&context, config).await;
+
+        apply_yaml!(
+            &context,
+            Pod,
+            r#"
+metadata:
+  name: some-pod
+  labels:
+    app: test
+spec:
+  containers:
+  - name: app
+    image: public.ecr.aws/docker/library/busybox
+    command: ["sleep", "9999"]"#
+        );
+
+        apply_yaml!(
+            &context,
+            Service,
+            r#"
+metadata:
+  name: some-service
+spec:
+  ports:
+  - name: http
+    port: 80
+  selector:
+    app: test"#
+        );
+
+        apply_yaml!(
+            &context,
+            Ingress,
+            r#"
+metadata:
+  name: some-ingress
+spec:
+  rules:
+  - http:
+      paths:
+      - backend:
+          service:
+            name: some-service
+            port:
+              name: http
+        pathType: Exact
+        path: /"#
+        );
+
+        kubectl!(&context, ["wait", "pod/some-pod", "--for=condition=Ready"]);
+
+        let context = Arc::new(context);
+        let mut event_tracker = EventTracker::new(&context, Duration::from_secs(5)).await;
+
+        let delete = tokio::spawn({
+            let context = Arc::clone(&context);
+            async move {
+                kubectl!(&context, ["delete", "pod", "some-pod"]);
+            }
+        });
+        assert!(event_tracker.issued_soon("DelayDeletion", "Drain").await);
+
+        let admin_delete = |token: &'static str| {
+            let namespace = context.namespace.clone();
+            async move {
+                let mut config =
+                    kube::Config::new(format!("https://127.0.0.1:{port}").parse().unwrap());
+                config.accept_invalid_certs = true;
+                let client = kube::Client::try_from(config).unwrap();
+                let request = Request::post(format!("/delete?namespace={namespace}&name=some-pod"))
+                    .header(header::AUTHORIZATION, format!("Bearer {token}"))
+                    .body(kube::client::Body::empty())
+                    .unwrap();
+                client.send(request).await.unwrap().status()
+            }
+        };
+
+        assert_eq!(admin_delete("wrong-token").await, StatusCode::UNAUTHORIZED);
+        assert!(pod_is_alive(&context, "some-pod").await);
+
+        assert_eq!(admin_delete("some-token").await, StatusCode::OK);
+        assert!(
+            pod_is_deleted_within(&context, "some-pod", Duration::from_secs(10)).await,
+            "pod is deleted without waiting for the drain"
+        );
+        tokio::time::timeout(Duration::from_secs(5), delete)
+            .await
+            .expect("delayed deletion should be cancelled")
+            .unwrap();
+    })
+    .await;
+}
+
 #[tokio::test]
 async fn should_allow_deletion_when_pod_is_not_ready() {
     within_test_namespace(|context| async move {
         let config = Config {
             delete_after: DELETE_AFTER,
             experimental_general_ingress: true,
+            ..Config::default()
         };
         setup(&context, config).await;
 
@@ -381,6 +599,7 @@ async fn should_allow_deletion_when_pod_is_not_exposed() {
         let config = Config {
             delete_after: DELETE_AFTER,
             experimental_general_ingress: true,
+            ..Config::default()
         };
         setup(&context, config).await;
 
@@ -413,6 +632,38 @@ async fn should_allow_deletion_when_dry_run() {
         let config = Config {
             delete_after: DELETE_AFTER,
             experimental_general_ingress: true,
+            ..Config::default()
+        };
+        setup(&context, config).await;
+
+        kubectl!(
+            &context,
+            [
+                "run",
+                "some-pod",
+                "--image=public.ecr.aws/docker/library/busybox",
+                "--",
+                "sleep",
+                "9999"
+            ]
+        );
+
+        let mut event_tracker = EventTracker::new(&context, Duration::from_secs(1)).await;
+        kubectl!(&context, ["delete", "pod", "some-pod", "--dry-run=server"]);
+        assert!(event_tracker.issued_soon("Allow", "DryRun").await);
+    })
+    .await;
+}
+
+#[tokio::test]
+async fn should_serve_webhooks_at_configured_paths() {
+    within_test_namespace(|context| async move {
+        let config = Config {
+            delete_after: DELETE_AFTER,
+            experimental_general_ingress: true,
+            validate_webhook_path: String::from("/custom/validate"),
+            mutate_webhook_path: String::from("/custom/mutate"),
+            ..Config::default()
         };
         setup(&context, config).await;
 
@@ -435,12 +686,131 @@ async fn should_allow_deletion_when_dry_run() {
     .await;
 }
 
+#[tokio::test]
+async fn disabled_webhook_should_not_be_served() {
+    within_test_namespace(|context| async move {
+        let config = Config {
+            delete_after: DELETE_AFTER,
+            experimental_general_ingress: true,
+            enable_eviction_webhook: false,
+            ..Config::default()
+        };
+        let validate_webhook_path = config.validate_webhook_path.clone();
+        let mutate_webhook_path = config.mutate_webhook_path.clone();
+        let port = setup(&context, config).await;
+
+        let post = |path: String| async move {
+            let mut config =
+                kube::Config::new(format!("https://127.0.0.1:{port}").parse().unwrap());
+            config.accept_invalid_certs = true;
+            let client = kube::Client::try_from(config).unwrap();
+            let request = Request::post(path)
+                .header(header::CONTENT_TYPE, "application/json")
+                .body(kube::client::Body::from(b"{}".to_vec()))
+                .unwrap();
+            client.send(request).await.unwrap().status()
+        };
+
+        assert_eq!(post(mutate_webhook_path).await, StatusCode::NOT_FOUND);
+        assert_ne!(post(validate_webhook_path).await, StatusCode::NOT_FOUND);
+
+        let registered = context
+            .api_resolver
+            .all::<MutatingWebhookConfiguration>()
+            .get_opt(&format!("{}-webhook", context.namespace))
+            .await
+            .unwrap();
+        assert!(registered.is_none(), "disabled webhook isn't registered");
+    })
+    .await;
+}
+
+#[tokio::test]
+async fn should_allow_deletion_without_isolation_when_observe_only() {
+    within_test_namespace(|context| async move {
+        let config = Config {
+            delete_after: DELETE_AFTER,
+            experimental_general_ingress: true,
+            observe_only: true,
+            ..Config::default()
+        };
+        setup(&context, config).await;
+
+        apply_yaml!(
+            &context,
+            Pod,
+            r#"
+metadata:
+  name: some-pod
+  labels:
+    app: test
+spec:
+  containers:
+  - name: app
+    image: public.ecr.aws/docker/library/busybox
+    command: ["sleep", "9999"]"#
+        );
+
+        apply_yaml!(
+            &context,
+            Service,
+            r#"
+metadata:
+  name: some-service
+spec:
+  ports:
+  - name: http
+    port: 80
+  selector:
+    app: test"#
+        );
+
+        apply_yaml!(
+            &context,
+            Ingress,
+            r#"
+metadata:
+  name: some-ingress
+spec:
+  rules:
+  - http:
+      paths:
+      - backend:
+          service:
+            name: some-service
+            port:
+              name: http
+        pathType: Exact
+        path: /"#
+        );
+
+        kubectl!(&context, ["wait", "pod/some-pod", "--for=condition=Ready"]);
+
+        let mut event_tracker = EventTracker::new(&context, Duration::from_secs(1)).await;
+        kubectl!(&context, ["delete", "pod", "some-pod", "--wait=false"]);
+        assert!(
+            event_tracker
+                .issued_soon("AllowDeletion", "ObserveOnly")
+                .await
+        );
+
+        let pod: Pod = context.api_resolver.all().get("some-pod").await.unwrap();
+        let labels = pod.metadata.labels.unwrap_or_default();
+        assert!(
+            !labels.contains_key("pod-graceful-drain/draining"),
+            "pod shouldn't have been patched"
+        );
+    })
+    .await;
+}
+
 #[tokio::test]
 async fn should_delay_deletion_by_deployment_rollout() {
     within_test_namespace(|context| async move {
         let config = Config {
             delete_after: DELETE_AFTER,
             experimental_general_ingress: true,
+            ..Config::default()
         };
         setup(&context, config).await;
 
@@ -15,7 +15,7 @@ use rcgen::generate_simple_self_signed;
 use rustls::pki_types::{CertificateDer, PrivateKeyDer};
 use uuid::Uuid;
 
-use pod_graceful_drain::{Config, LoadBalancingConfig, ServiceRegistry, WebhookConfig};
+use pod_graceful_drain::{Clock, Config, LoadBalancingConfig, ServiceRegistry, WebhookConfig};
 
 use crate::testutils::context::{within_test_cluster, TestContext};
 use crate::testutils::event_tracker::EventTracker;
@@ -45,11 +45,15 @@ async fn setup(context: &TestContext, config: Config) {
     let (ca_bundle, cert, key_pair) = generate_self_signed_cert(service_domain).await.unwrap();
     let service_registry = ServiceRegistry::default();
     let loadbalancing = LoadBalancingConfig::new(Uuid::nil());
+    let validate_webhook_path = config.validate_webhook_path.clone();
+    let mutate_webhook_path = config.mutate_webhook_path.clone();
 
     pod_graceful_drain::start_controller(
         &context.api_resolver,
+        &config,
         &service_registry,
         &loadbalancing,
+        &Clock::default(),
         &context.shutdown,
     )
     .unwrap();
@@ -87,7 +91,7 @@ webhooks:
       service:
         namespace: {namespace}
         name: test-host
-        path: /webhook/validate
+        path: {validate_webhook_path}
         port: {port}
     rules:
       - apiGroups: [""]
@@ -116,7 +120,7 @@ webhooks:
       service:
         namespace: {namespace}
         name: test-host
-        path: /webhook/mutate
+        path: {mutate_webhook_path}
         port: {port}
     rules:
       - apiGroups: [""]
@@ -172,6 +176,7 @@ async fn should_intercept_eviction_by_kubectl_drain() {
         let config = Config {
             delete_after: Duration::from_secs(10),
             experimental_general_ingress: true,
+            ..Config::default()
         };
         setup(&context, config).await;
 
@@ -335,6 +340,7 @@ async fn should_intercept_deletion_by_kubectl_drain_disable_eviction() {
         let config = Config {
             delete_after: Duration::from_secs(30),
             experimental_general_ingress: true,
+            ..Config::default()
         };
         setup(&context, config).await;
 